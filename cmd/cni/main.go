@@ -0,0 +1,94 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	blended "github.com/inwinstack/blended/generated/clientset/versioned"
+	"github.com/inwinstack/ipam/pkg/cni"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func restConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return rest.InClusterConfig()
+}
+
+// newPlugin creates the plugin with the clients of the kubeconfig in the network configuration.
+func newPlugin(args *cni.Args, stdin []byte) (*cni.Plugin, error) {
+	if args.Command == cni.CommandVersion {
+		return cni.New(nil, nil), nil
+	}
+
+	conf, err := cni.ParseConfig(stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	k8scfg, err := restConfig(conf.IPAM.Kubeconfig)
+	if err != nil {
+		return nil, &cni.Error{CNIVersion: conf.CNIVersion, Code: cni.ErrInvalidConfig, Msg: "failed to build kubeconfig: " + err.Error()}
+	}
+
+	k8sclient, err := kubernetes.NewForConfig(k8scfg)
+	if err != nil {
+		return nil, &cni.Error{CNIVersion: conf.CNIVersion, Code: cni.ErrInvalidConfig, Msg: "failed to build Kubernetes client: " + err.Error()}
+	}
+
+	blendedclient, err := blended.NewForConfig(k8scfg)
+	if err != nil {
+		return nil, &cni.Error{CNIVersion: conf.CNIVersion, Code: cni.ErrInvalidConfig, Msg: "failed to build Blended client: " + err.Error()}
+	}
+	return cni.New(k8sclient, blendedclient), nil
+}
+
+func run() ([]byte, error) {
+	args, err := cni.ArgsFromEnv(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, &cni.Error{Code: cni.ErrDecodingFailure, Msg: "failed to read the network configuration: " + err.Error()}
+	}
+
+	plugin, err := newPlugin(args, stdin)
+	if err != nil {
+		return nil, err
+	}
+	return plugin.Exec(args, stdin)
+}
+
+// The plugin prints its result, or its error, on the standard output as the CNI
+// specification requires.
+func main() {
+	out, err := run()
+	if err != nil {
+		out, _ = json.Marshal(err)
+		os.Stdout.Write(out)
+		os.Exit(1)
+	}
+	os.Stdout.Write(out)
+}
@@ -23,13 +23,17 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	blended "github.com/inwinstack/blended/generated/clientset/versioned"
 	"github.com/inwinstack/ipam/pkg/config"
+	"github.com/inwinstack/ipam/pkg/metrics"
 	"github.com/inwinstack/ipam/pkg/operator"
 	"github.com/inwinstack/ipam/pkg/version"
 	flag "github.com/spf13/pflag"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -44,6 +48,21 @@ func parserFlags() {
 	flag.StringVarP(&kubeconfig, "kubeconfig", "", "", "Absolute path to the kubeconfig file.")
 	flag.IntVarP(&cfg.Threads, "threads", "", 2, "Number of worker threads used by the controller.")
 	flag.IntVarP(&cfg.SyncSec, "sync-seconds", "", 30, "Seconds for syncing and retrying objects.")
+	flag.DurationVarP(&cfg.GCPeriod, "gc-period", "", time.Minute, "Period for collecting the addresses of missing IPs, 0 disables it.")
+	flag.DurationVarP(&cfg.GCGrace, "gc-grace-period", "", 5*time.Minute, "Time an address must stay without IP before it's collected.")
+	flag.BoolVarP(&cfg.GCDryRun, "gc-dry-run", "", false, "Only report the addresses of missing IPs without collecting them.")
+	flag.StringVarP(&cfg.DefaultServicePool, "default-service-pool", "", "", "Pool of the LoadBalancer Services without a pool annotation, empty leaves them alone.")
+	flag.StringVarP(&cfg.MetricsAddr, "metrics-address", "", ":8080", "Address to serve the Prometheus metrics on, empty disables them.")
+	flag.StringVarP(&cfg.WebhookAddr, "webhook-address", "", "", "Address to serve the validating webhooks on, empty disables them.")
+	flag.StringVarP(&cfg.TLSCertFile, "tls-cert-file", "", "", "File containing the certificate of the webhook server.")
+	flag.StringVarP(&cfg.TLSKeyFile, "tls-private-key-file", "", "", "File containing the private key of the webhook server.")
+	flag.BoolVarP(&cfg.LeaderElect, "leader-elect", "", false, "Elect a leader before reconciling, so that multiple replicas can run.")
+	flag.StringVarP(&cfg.LeaderElectIdentity, "leader-elect-identity", "", "", "Identity of the replica in the election, the hostname by default.")
+	flag.StringVarP(&cfg.LockType, "leader-elect-resource-lock", "", "leases", "Type of the resource used for the leader lock, either leases or configmaps.")
+	flag.StringVarP(&cfg.LockNamespace, "leader-elect-namespace", "", "kube-system", "Namespace of the resource used for the leader lock.")
+	flag.DurationVarP(&cfg.LeaseDuration, "leader-elect-lease-duration", "", 15*time.Second, "Time the non-leader replicas wait before taking over an unrenewed leadership.")
+	flag.DurationVarP(&cfg.RenewDeadline, "leader-elect-renew-deadline", "", 10*time.Second, "Time the leader retries to renew its leadership before giving it up.")
+	flag.DurationVarP(&cfg.RetryPeriod, "leader-elect-retry-period", "", 2*time.Second, "Time the replicas wait between the attempts to acquire or renew the leadership.")
 	flag.BoolVarP(&ver, "version", "", false, "Display the version")
 	flag.CommandLine.AddGoFlagSet(goflag.CommandLine)
 	flag.Parse()
@@ -79,22 +98,43 @@ func main() {
 		glog.Fatalf("Error to build kubeconfig: %s", err.Error())
 	}
 
+	k8sclient, err := kubernetes.NewForConfig(k8scfg)
+	if err != nil {
+		glog.Fatalf("Error to build Kubernetes client: %s", err.Error())
+	}
+
 	blendedclient, err := blended.NewForConfig(k8scfg)
 	if err != nil {
 		glog.Fatalf("Error to build Blended client: %s", err.Error())
 	}
 
+	dynamicclient, err := dynamic.NewForConfig(k8scfg)
+	if err != nil {
+		glog.Fatalf("Error to build dynamic client: %s", err.Error())
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
-	op := operator.New(cfg, blendedclient)
+	if cfg.MetricsAddr != "" {
+		if err := metrics.Serve(ctx, cfg.MetricsAddr); err != nil {
+			glog.Fatalf("Error to serve the metrics: %s", err.Error())
+		}
+	}
+
+	op := operator.New(cfg, k8sclient, blendedclient, dynamicclient)
 	if err := op.Run(ctx); err != nil {
 		glog.Fatalf("Error to serve the operator instance: %s.", err)
 	}
 
-	<-signalChan
-	cancel()
-	op.Stop()
-	glog.Infof("Shutdown signal received, exiting...")
+	select {
+	case <-signalChan:
+		cancel()
+		op.Stop()
+		glog.Infof("Shutdown signal received, exiting...")
+	case <-op.Done():
+		cancel()
+		glog.Fatalf("Leadership lost, exiting...")
+	}
 }
@@ -6,6 +6,7 @@ require (
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/inwinstack/blended v0.7.0
 	github.com/mikioh/ipaddr v0.0.0-20190404000644-d465c8ab6721
+	github.com/prometheus/client_golang v0.9.2
 	github.com/spf13/pflag v1.0.3
 	github.com/stretchr/testify v1.3.0
 	github.com/thoas/go-funk v0.4.0
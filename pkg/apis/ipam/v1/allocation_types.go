@@ -0,0 +1,102 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// AllocationList is a list of Allocation.
+type AllocationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []Allocation `json:"items"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// Allocation represents a Kubernetes Allocation Custom Resource.
+// The Allocation claims an address of a pool for an IP, it's named after
+// the address so that creating it is the atomic claim. A cluster-scoped
+// object can't be owned by a namespaced one, so the owner is kept in spec.
+type Allocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+
+	Spec   AllocationSpec   `json:"spec"`
+	Status AllocationStatus `json:"status,omitempty"`
+}
+
+// IPReference refers to the IP that owns an allocation.
+type IPReference struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	UID       types.UID `json:"uid,omitempty"`
+}
+
+// AllocationSpec is the spec for an allocation resource.
+type AllocationSpec struct {
+	PoolName string      `json:"poolName"`
+	Address  string      `json:"address"`
+	IP       IPReference `json:"ip"`
+}
+
+type AllocationPhase string
+
+// These are the valid phases of an allocation.
+const (
+	AllocationNone      AllocationPhase = ""
+	AllocationActive    AllocationPhase = "Active"
+	AllocationReleasing AllocationPhase = "Releasing"
+)
+
+// AllocationStatus represents the current state of an allocation resource.
+type AllocationStatus struct {
+	Phase          AllocationPhase `json:"phase"`
+	LastUpdateTime metav1.Time     `json:"lastUpdateTime"`
+	ReleaseTime    metav1.Time     `json:"releaseTime,omitempty"`
+}
+
+// AllocationName returns the name of the allocation for the address. IPv4
+// addresses are used as is, IPv6 addresses are fully expanded with dashes
+// because colons aren't allowed in names.
+func AllocationName(address string) (string, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP %q", address)
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String(), nil
+	}
+
+	groups := make([]string, 0, net.IPv6len/2)
+	for i := 0; i < net.IPv6len; i += 2 {
+		groups = append(groups, fmt.Sprintf("%02x%02x", ip[i], ip[i+1]))
+	}
+	return strings.Join(groups, "-"), nil
+}
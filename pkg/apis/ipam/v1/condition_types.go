@@ -0,0 +1,66 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionType is the type of a condition of a pool or an IP.
+type ConditionType string
+
+// These are the conditions of a pool.
+const (
+	// PoolReady is true when the addresses of a pool can be allocated.
+	PoolReady ConditionType = "Ready"
+	// PoolExhausted is true when a pool has no address left to allocate.
+	PoolExhausted ConditionType = "Exhausted"
+	// PoolDegraded is true when a pool works, but some of its allocations need attention.
+	PoolDegraded ConditionType = "Degraded"
+	// PoolAddressesValid is true when the addresses and filtered IPs of a pool can be parsed.
+	PoolAddressesValid ConditionType = "AddressesValid"
+	// PoolLowCapacity is true when the utilisation of a pool crossed one of its thresholds.
+	PoolLowCapacity ConditionType = "LowCapacity"
+)
+
+// These are the conditions of an IP.
+const (
+	// IPAllocated is true when an IP got an address.
+	IPAllocated ConditionType = "Allocated"
+	// IPPoolAvailable is true when the pool of an IP can allocate addresses.
+	IPPoolAvailable ConditionType = "PoolAvailable"
+)
+
+// These are the reasons of the LowCapacity condition.
+const (
+	BelowThresholdReason    = "BelowThreshold"
+	WarningThresholdReason  = "WarningThreshold"
+	CriticalThresholdReason = "CriticalThreshold"
+)
+
+// Condition describes an aspect of the state of a pool or an IP. The Pool and IP
+// resources have no room for conditions, so they are kept in an annotation and
+// mirrored into the status of the objects.
+type Condition struct {
+	Type               ConditionType          `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	ObservedGeneration int64                  `json:"observedGeneration,omitempty"`
+}
@@ -0,0 +1,69 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PoolQuotaList is a list of PoolQuota.
+type PoolQuotaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []PoolQuota `json:"items"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PoolQuota represents a Kubernetes PoolQuota Custom Resource.
+// The PoolQuota limits how many addresses of a pool the IPs of a group of
+// namespaces can hold, either all together or each namespace on its own.
+type PoolQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+
+	Spec   PoolQuotaSpec   `json:"spec"`
+	Status PoolQuotaStatus `json:"status,omitempty"`
+}
+
+// PoolQuotaSpec is the spec for a pool quota resource.
+type PoolQuotaSpec struct {
+	PoolName string `json:"poolName"`
+	// Namespaces lists the namespaces that the quota applies to.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// NamespaceSelector selects the namespaces that the quota applies to, along with the listed ones.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Limit is how many addresses of the pool the namespaces can hold.
+	Limit int `json:"limit"`
+	// PerNamespace applies the limit to each namespace instead of all of them together.
+	PerNamespace bool `json:"perNamespace,omitempty"`
+}
+
+// PoolQuotaStatus represents the current state of a pool quota resource.
+type PoolQuotaStatus struct {
+	// Used is how many addresses of the pool the namespaces hold together.
+	Used int `json:"used"`
+	// Namespaces is how many addresses of the pool each namespace holds, if any.
+	Namespaces     map[string]int `json:"namespaces,omitempty"`
+	Reason         string         `json:"reason,omitempty"`
+	LastUpdateTime metav1.Time    `json:"lastUpdateTime"`
+}
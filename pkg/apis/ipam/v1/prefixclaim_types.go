@@ -0,0 +1,72 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PrefixClaimList is a list of PrefixClaim.
+type PrefixClaimList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []PrefixClaim `json:"items"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PrefixClaim represents a Kubernetes PrefixClaim Custom Resource.
+// The PrefixClaim carves an aligned prefix of the requested length out of
+// a pool, all the addresses of the prefix are taken from the pool at once
+// and they can be published as a child pool.
+type PrefixClaim struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+
+	Spec   PrefixClaimSpec   `json:"spec"`
+	Status PrefixClaimStatus `json:"status,omitempty"`
+}
+
+// PrefixClaimSpec is the spec for a prefix claim resource.
+type PrefixClaimSpec struct {
+	PoolName     string `json:"poolName"`
+	PrefixLength int    `json:"prefixLength"`
+	// ChildPoolName is the name of the pool that publishes the prefix, if any.
+	ChildPoolName string `json:"childPoolName,omitempty"`
+}
+
+type PrefixClaimPhase string
+
+// These are the valid phases of a prefix claim.
+const (
+	PrefixClaimNone    PrefixClaimPhase = ""
+	PrefixClaimPending PrefixClaimPhase = "Pending"
+	PrefixClaimActive  PrefixClaimPhase = "Active"
+	PrefixClaimFailed  PrefixClaimPhase = "Failed"
+)
+
+// PrefixClaimStatus represents the current state of a prefix claim resource.
+type PrefixClaimStatus struct {
+	Phase          PrefixClaimPhase `json:"phase"`
+	Reason         string           `json:"reason,omitempty"`
+	Prefix         string           `json:"prefix,omitempty"`
+	LastUpdateTime metav1.Time      `json:"lastUpdateTime"`
+}
@@ -0,0 +1,152 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+// AllocationResource is the resource of the allocation objects
+var AllocationResource = ipamv1.SchemeGroupVersion.WithResource("allocations")
+
+// AllocationInterface has methods to work with Allocation resources.
+type AllocationInterface interface {
+	Create(*ipamv1.Allocation) (*ipamv1.Allocation, error)
+	Update(*ipamv1.Allocation) (*ipamv1.Allocation, error)
+	Delete(name string, options *metav1.DeleteOptions) error
+	Get(name string, options metav1.GetOptions) (*ipamv1.Allocation, error)
+	List(opts metav1.ListOptions) (*ipamv1.AllocationList, error)
+	Watch(opts metav1.ListOptions) (watch.Interface, error)
+}
+
+// allocations implements AllocationInterface on top of the dynamic client
+type allocations struct {
+	client dynamic.ResourceInterface
+}
+
+// NewAllocations creates an allocation client from the dynamic client
+func NewAllocations(client dynamic.Interface) AllocationInterface {
+	return &allocations{client: client.Resource(AllocationResource)}
+}
+
+func toUnstructured(allocation *ipamv1.Allocation) (*unstructured.Unstructured, error) {
+	data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(allocation)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &unstructured.Unstructured{Object: data}
+	obj.SetGroupVersionKind(ipamv1.SchemeGroupVersion.WithKind("Allocation"))
+	return obj, nil
+}
+
+func fromUnstructured(obj *unstructured.Unstructured) (*ipamv1.Allocation, error) {
+	allocation := &ipamv1.Allocation{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, allocation); err != nil {
+		return nil, err
+	}
+	return allocation, nil
+}
+
+// Create takes the representation of an allocation and creates it.
+func (c *allocations) Create(allocation *ipamv1.Allocation) (*ipamv1.Allocation, error) {
+	obj, err := toUnstructured(allocation)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.client.Create(obj, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return fromUnstructured(result)
+}
+
+// Update takes the representation of an allocation and updates it.
+func (c *allocations) Update(allocation *ipamv1.Allocation) (*ipamv1.Allocation, error) {
+	obj, err := toUnstructured(allocation)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.client.Update(obj, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return fromUnstructured(result)
+}
+
+// Delete takes name of the allocation and deletes it.
+func (c *allocations) Delete(name string, options *metav1.DeleteOptions) error {
+	return c.client.Delete(name, options)
+}
+
+// Get takes name of the allocation and returns it.
+func (c *allocations) Get(name string, options metav1.GetOptions) (*ipamv1.Allocation, error) {
+	result, err := c.client.Get(name, options)
+	if err != nil {
+		return nil, err
+	}
+	return fromUnstructured(result)
+}
+
+// List takes label and field selectors, and returns the list of allocations that match those selectors.
+func (c *allocations) List(opts metav1.ListOptions) (*ipamv1.AllocationList, error) {
+	result, err := c.client.List(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &ipamv1.AllocationList{}
+	list.SetResourceVersion(result.GetResourceVersion())
+	list.SetContinue(result.GetContinue())
+	for i := range result.Items {
+		allocation, err := fromUnstructured(&result.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, *allocation)
+	}
+	return list, nil
+}
+
+// Watch returns a watch.Interface that watches the requested allocations.
+func (c *allocations) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := c.client.Watch(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return watch.Filter(w, func(in watch.Event) (watch.Event, bool) {
+		obj, ok := in.Object.(*unstructured.Unstructured)
+		if !ok {
+			return in, true
+		}
+
+		allocation, err := fromUnstructured(obj)
+		if err != nil {
+			return in, true
+		}
+		in.Object = allocation
+		return in, true
+	}), nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newAllocation(pool, address, namespace, name string) *ipamv1.Allocation {
+	allocationName, _ := ipamv1.AllocationName(address)
+	return &ipamv1.Allocation{
+		ObjectMeta: metav1.ObjectMeta{Name: allocationName},
+		Spec: ipamv1.AllocationSpec{
+			PoolName: pool,
+			Address:  address,
+			IP:       ipamv1.IPReference{Namespace: namespace, Name: name},
+		},
+		Status: ipamv1.AllocationStatus{Phase: ipamv1.AllocationActive},
+	}
+}
+
+func TestAllocations(t *testing.T) {
+	allocations := NewAllocations(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+
+	created, err := allocations.Create(newAllocation("test-pool", "172.22.132.1", "default", "test-ip"))
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.1", created.Name)
+	assert.Equal(t, "test-ip", created.Spec.IP.Name)
+
+	// The name of the allocation is the claim of the address
+	_, err = allocations.Create(newAllocation("test-pool", "172.22.132.1", "default", "other-ip"))
+	assert.True(t, errors.IsAlreadyExists(err))
+
+	created.Status.Phase = ipamv1.AllocationReleasing
+	created.Status.ReleaseTime = metav1.NewTime(time.Now().Truncate(time.Second))
+	_, err = allocations.Update(created)
+	assert.Nil(t, err)
+
+	got, err := allocations.Get(created.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, ipamv1.AllocationReleasing, got.Status.Phase)
+	assert.True(t, created.Status.ReleaseTime.Equal(&got.Status.ReleaseTime))
+
+	list, err := allocations.List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list.Items))
+
+	assert.Nil(t, allocations.Delete(created.Name, nil))
+	_, err = allocations.Get(created.Name, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func TestAllocationInformer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	allocations := NewAllocations(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+	informer := NewAllocationInformer(allocations, 0)
+	go informer.Informer().Run(ctx.Done())
+	assert.True(t, cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced))
+
+	_, err := allocations.Create(newAllocation("test-pool", "172.22.132.1", "default", "test-ip"))
+	assert.Nil(t, err)
+	_, err = allocations.Create(newAllocation("test-pool", "2001:db8::1", "default", "other-ip"))
+	assert.Nil(t, err)
+
+	lister := informer.Lister()
+	for start := time.Now(); time.Since(start) < 3*time.Second; {
+		if all, _ := lister.ByPool("test-pool"); len(all) == 2 {
+			break
+		}
+	}
+
+	all, err := lister.ByPool("test-pool")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(all))
+
+	owned, err := lister.ByIP("default", "other-ip")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(owned))
+	assert.Equal(t, "2001-0db8-0000-0000-0000-0000-0000-0001", owned[0].Name)
+
+	_, err = lister.Get("172.22.132.1")
+	assert.Nil(t, err)
+	_, err = lister.Get("172.22.132.2")
+	assert.True(t, errors.IsNotFound(err))
+}
@@ -0,0 +1,84 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"strings"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	"github.com/inwinstack/ipam/pkg/constants"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// The resources of the pool and IP objects
+var (
+	PoolResource = blendedv1.SchemeGroupVersion.WithResource("pools")
+	IPResource   = blendedv1.SchemeGroupVersion.WithResource("ips")
+)
+
+// ConditionsInterface mirrors the conditions that are kept in the annotations of the pools
+// and IPs into their status, where tools like `kubectl wait` look for them, along with the
+// IPs that block the deletion of a pool and the addresses of an IP. The typed clients don't know these fields and drop
+// them, so they are mirrored again after each update.
+type ConditionsInterface interface {
+	Mirror(resource schema.GroupVersionResource, meta metav1.ObjectMeta) error
+}
+
+// conditions implements ConditionsInterface on top of the dynamic client
+type conditions struct {
+	client dynamic.Interface
+}
+
+// NewConditions creates a conditions client from the dynamic client
+func NewConditions(client dynamic.Interface) ConditionsInterface {
+	return &conditions{client: client}
+}
+
+func (c *conditions) Mirror(resource schema.GroupVersionResource, meta metav1.ObjectMeta) error {
+	status := map[string]interface{}{}
+	if value, ok := meta.Annotations[constants.ConditionsKey]; ok {
+		status["conditions"] = json.RawMessage(value)
+	}
+
+	if value, ok := meta.Annotations[constants.BlockingIPsKey]; ok && value != "" {
+		status["blockingIPs"] = strings.Split(value, ",")
+	}
+
+	if value, ok := meta.Annotations[constants.IPAddressesKey]; ok && value != "" {
+		status["addresses"] = strings.Split(value, ",")
+	}
+
+	if len(status) == 0 {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.Resource(resource).Namespace(meta.Namespace).Patch(meta.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"testing"
+
+	"github.com/inwinstack/ipam/pkg/constants"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestMirrorConditions(t *testing.T) {
+	ip := &unstructured.Unstructured{}
+	ip.SetGroupVersionKind(IPResource.GroupVersion().WithKind("IP"))
+	ip.SetNamespace("default")
+	ip.SetName("test-ip")
+	assert.Nil(t, unstructured.SetNestedField(ip.Object, "Active", "status", "phase"))
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), ip)
+	conditions := NewConditions(dynamicClient)
+
+	// Nothing is mirrored without conditions, and the missing objects are ignored
+	meta := metav1.ObjectMeta{Namespace: "default", Name: "test-ip"}
+	assert.Nil(t, conditions.Mirror(IPResource, meta))
+	meta.Annotations = map[string]string{constants.ConditionsKey: `[{"type":"Allocated","status":"True"}]`}
+	assert.Nil(t, conditions.Mirror(IPResource, metav1.ObjectMeta{Namespace: "default", Name: "test-missing", Annotations: meta.Annotations}))
+
+	assert.Nil(t, conditions.Mirror(IPResource, meta))
+	got, err := dynamicClient.Resource(IPResource).Namespace("default").Get("test-ip", metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	phase, _, _ := unstructured.NestedString(got.Object, "status", "phase")
+	assert.Equal(t, "Active", phase)
+	mirrored, _, _ := unstructured.NestedSlice(got.Object, "status", "conditions")
+	assert.Equal(t, []interface{}{map[string]interface{}{"type": "Allocated", "status": "True"}}, mirrored)
+
+	meta.Annotations[constants.BlockingIPsKey] = "default/test-1,default/test-2"
+	assert.Nil(t, conditions.Mirror(IPResource, meta))
+	got, err = dynamicClient.Resource(IPResource).Namespace("default").Get("test-ip", metav1.GetOptions{})
+	assert.Nil(t, err)
+	blocking, _, _ := unstructured.NestedStringSlice(got.Object, "status", "blockingIPs")
+	assert.Equal(t, []string{"default/test-1", "default/test-2"}, blocking)
+
+	meta.Annotations[constants.IPAddressesKey] = "172.22.132.1,172.22.132.2"
+	assert.Nil(t, conditions.Mirror(IPResource, meta))
+	got, err = dynamicClient.Resource(IPResource).Namespace("default").Get("test-ip", metav1.GetOptions{})
+	assert.Nil(t, err)
+	addresses, _, _ := unstructured.NestedStringSlice(got.Object, "status", "addresses")
+	assert.Equal(t, []string{"172.22.132.1", "172.22.132.2"}, addresses)
+
+	meta.Annotations[constants.ConditionsKey] = "{"
+	assert.NotNil(t, conditions.Mirror(IPResource, meta))
+}
@@ -0,0 +1,331 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"time"
+
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// PoolIndex indexes the allocations by the name of their pool
+	PoolIndex = "pool"
+	// IPIndex indexes the allocations by the namespace/name of their IP
+	IPIndex = "ip"
+)
+
+// AllocationInformer provides access to a shared informer and lister for allocations.
+type AllocationInformer interface {
+	Informer() cache.SharedIndexInformer
+	Lister() AllocationLister
+}
+
+type allocationInformer struct {
+	informer cache.SharedIndexInformer
+}
+
+// IPKey returns the index key of the IP that owns the allocation.
+func IPKey(namespace, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
+
+func poolIndexFunc(obj interface{}) ([]string, error) {
+	allocation, ok := obj.(*ipamv1.Allocation)
+	if !ok {
+		return nil, fmt.Errorf("expected an allocation but got %T", obj)
+	}
+	return []string{allocation.Spec.PoolName}, nil
+}
+
+func ipIndexFunc(obj interface{}) ([]string, error) {
+	allocation, ok := obj.(*ipamv1.Allocation)
+	if !ok {
+		return nil, fmt.Errorf("expected an allocation but got %T", obj)
+	}
+
+	if allocation.Spec.IP.Name == "" {
+		return []string{}, nil
+	}
+	return []string{IPKey(allocation.Spec.IP.Namespace, allocation.Spec.IP.Name)}, nil
+}
+
+// NewAllocationInformer constructs a new informer for the allocations.
+func NewAllocationInformer(client AllocationInterface, resyncPeriod time.Duration) AllocationInformer {
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.Watch(options)
+			},
+		},
+		&ipamv1.Allocation{},
+		resyncPeriod,
+		cache.Indexers{PoolIndex: poolIndexFunc, IPIndex: ipIndexFunc},
+	)
+	return &allocationInformer{informer: informer}
+}
+
+func (f *allocationInformer) Informer() cache.SharedIndexInformer {
+	return f.informer
+}
+
+func (f *allocationInformer) Lister() AllocationLister {
+	return &allocationLister{indexer: f.informer.GetIndexer()}
+}
+
+// AllocationLister helps list allocations.
+type AllocationLister interface {
+	// List lists all allocations in the indexer.
+	List(selector labels.Selector) ([]*ipamv1.Allocation, error)
+	// Get retrieves the allocation from the index for a given name.
+	Get(name string) (*ipamv1.Allocation, error)
+	// ByPool lists the allocations of the pool.
+	ByPool(pool string) ([]*ipamv1.Allocation, error)
+	// ByIP lists the allocations owned by the IP.
+	ByIP(namespace, name string) ([]*ipamv1.Allocation, error)
+}
+
+type allocationLister struct {
+	indexer cache.Indexer
+}
+
+func (s *allocationLister) List(selector labels.Selector) (ret []*ipamv1.Allocation, err error) {
+	err = cache.ListAll(s.indexer, selector, func(m interface{}) {
+		ret = append(ret, m.(*ipamv1.Allocation))
+	})
+	return ret, err
+}
+
+func (s *allocationLister) Get(name string) (*ipamv1.Allocation, error) {
+	obj, exists, err := s.indexer.GetByKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(ipamv1.Resource("allocation"), name)
+	}
+	return obj.(*ipamv1.Allocation), nil
+}
+
+func (s *allocationLister) byIndex(index, value string) ([]*ipamv1.Allocation, error) {
+	objs, err := s.indexer.ByIndex(index, value)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*ipamv1.Allocation, 0, len(objs))
+	for _, obj := range objs {
+		ret = append(ret, obj.(*ipamv1.Allocation))
+	}
+	return ret, nil
+}
+
+func (s *allocationLister) ByPool(pool string) ([]*ipamv1.Allocation, error) {
+	return s.byIndex(PoolIndex, pool)
+}
+
+func (s *allocationLister) ByIP(namespace, name string) ([]*ipamv1.Allocation, error) {
+	return s.byIndex(IPIndex, IPKey(namespace, name))
+}
+
+// PrefixClaimInformer provides access to a shared informer and lister for prefix claims.
+type PrefixClaimInformer interface {
+	Informer() cache.SharedIndexInformer
+	Lister() PrefixClaimLister
+}
+
+type prefixClaimInformer struct {
+	informer cache.SharedIndexInformer
+}
+
+func prefixClaimPoolIndexFunc(obj interface{}) ([]string, error) {
+	claim, ok := obj.(*ipamv1.PrefixClaim)
+	if !ok {
+		return nil, fmt.Errorf("expected a prefix claim but got %T", obj)
+	}
+	return []string{claim.Spec.PoolName}, nil
+}
+
+// NewPrefixClaimInformer constructs a new informer for the prefix claims of all namespaces.
+func NewPrefixClaimInformer(client PrefixClaimsGetter, resyncPeriod time.Duration) PrefixClaimInformer {
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.PrefixClaims(metav1.NamespaceAll).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.PrefixClaims(metav1.NamespaceAll).Watch(options)
+			},
+		},
+		&ipamv1.PrefixClaim{},
+		resyncPeriod,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc, PoolIndex: prefixClaimPoolIndexFunc},
+	)
+	return &prefixClaimInformer{informer: informer}
+}
+
+func (f *prefixClaimInformer) Informer() cache.SharedIndexInformer {
+	return f.informer
+}
+
+func (f *prefixClaimInformer) Lister() PrefixClaimLister {
+	return &prefixClaimLister{indexer: f.informer.GetIndexer()}
+}
+
+// PrefixClaimLister helps list prefix claims.
+type PrefixClaimLister interface {
+	// List lists all prefix claims in the indexer.
+	List(selector labels.Selector) ([]*ipamv1.PrefixClaim, error)
+	// Get retrieves the prefix claim from the index for a given namespace and name.
+	Get(namespace, name string) (*ipamv1.PrefixClaim, error)
+	// ByPool lists the prefix claims of the pool.
+	ByPool(pool string) ([]*ipamv1.PrefixClaim, error)
+}
+
+type prefixClaimLister struct {
+	indexer cache.Indexer
+}
+
+func (s *prefixClaimLister) List(selector labels.Selector) (ret []*ipamv1.PrefixClaim, err error) {
+	err = cache.ListAll(s.indexer, selector, func(m interface{}) {
+		ret = append(ret, m.(*ipamv1.PrefixClaim))
+	})
+	return ret, err
+}
+
+func (s *prefixClaimLister) Get(namespace, name string) (*ipamv1.PrefixClaim, error) {
+	obj, exists, err := s.indexer.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(ipamv1.Resource("prefixclaim"), name)
+	}
+	return obj.(*ipamv1.PrefixClaim), nil
+}
+
+func (s *prefixClaimLister) ByPool(pool string) ([]*ipamv1.PrefixClaim, error) {
+	objs, err := s.indexer.ByIndex(PoolIndex, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*ipamv1.PrefixClaim, 0, len(objs))
+	for _, obj := range objs {
+		ret = append(ret, obj.(*ipamv1.PrefixClaim))
+	}
+	return ret, nil
+}
+
+// PoolQuotaInformer provides access to a shared informer and lister for pool quotas.
+type PoolQuotaInformer interface {
+	Informer() cache.SharedIndexInformer
+	Lister() PoolQuotaLister
+}
+
+type poolQuotaInformer struct {
+	informer cache.SharedIndexInformer
+}
+
+func poolQuotaPoolIndexFunc(obj interface{}) ([]string, error) {
+	quota, ok := obj.(*ipamv1.PoolQuota)
+	if !ok {
+		return nil, fmt.Errorf("expected a pool quota but got %T", obj)
+	}
+	return []string{quota.Spec.PoolName}, nil
+}
+
+// NewPoolQuotaInformer constructs a new informer for the pool quotas.
+func NewPoolQuotaInformer(client PoolQuotaInterface, resyncPeriod time.Duration) PoolQuotaInformer {
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.Watch(options)
+			},
+		},
+		&ipamv1.PoolQuota{},
+		resyncPeriod,
+		cache.Indexers{PoolIndex: poolQuotaPoolIndexFunc},
+	)
+	return &poolQuotaInformer{informer: informer}
+}
+
+func (f *poolQuotaInformer) Informer() cache.SharedIndexInformer {
+	return f.informer
+}
+
+func (f *poolQuotaInformer) Lister() PoolQuotaLister {
+	return &poolQuotaLister{indexer: f.informer.GetIndexer()}
+}
+
+// PoolQuotaLister helps list pool quotas.
+type PoolQuotaLister interface {
+	// List lists all pool quotas in the indexer.
+	List(selector labels.Selector) ([]*ipamv1.PoolQuota, error)
+	// Get retrieves the pool quota from the index for a given name.
+	Get(name string) (*ipamv1.PoolQuota, error)
+	// ByPool lists the quotas of the pool.
+	ByPool(pool string) ([]*ipamv1.PoolQuota, error)
+}
+
+type poolQuotaLister struct {
+	indexer cache.Indexer
+}
+
+func (s *poolQuotaLister) List(selector labels.Selector) (ret []*ipamv1.PoolQuota, err error) {
+	err = cache.ListAll(s.indexer, selector, func(m interface{}) {
+		ret = append(ret, m.(*ipamv1.PoolQuota))
+	})
+	return ret, err
+}
+
+func (s *poolQuotaLister) Get(name string) (*ipamv1.PoolQuota, error) {
+	obj, exists, err := s.indexer.GetByKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(ipamv1.Resource("poolquota"), name)
+	}
+	return obj.(*ipamv1.PoolQuota), nil
+}
+
+func (s *poolQuotaLister) ByPool(pool string) ([]*ipamv1.PoolQuota, error) {
+	objs, err := s.indexer.ByIndex(PoolIndex, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*ipamv1.PoolQuota, 0, len(objs))
+	for _, obj := range objs {
+		ret = append(ret, obj.(*ipamv1.PoolQuota))
+	}
+	return ret, nil
+}
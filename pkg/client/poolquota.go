@@ -0,0 +1,152 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+// PoolQuotaResource is the resource of the pool quota objects
+var PoolQuotaResource = ipamv1.SchemeGroupVersion.WithResource("poolquotas")
+
+// PoolQuotaInterface has methods to work with PoolQuota resources.
+type PoolQuotaInterface interface {
+	Create(*ipamv1.PoolQuota) (*ipamv1.PoolQuota, error)
+	Update(*ipamv1.PoolQuota) (*ipamv1.PoolQuota, error)
+	Delete(name string, options *metav1.DeleteOptions) error
+	Get(name string, options metav1.GetOptions) (*ipamv1.PoolQuota, error)
+	List(opts metav1.ListOptions) (*ipamv1.PoolQuotaList, error)
+	Watch(opts metav1.ListOptions) (watch.Interface, error)
+}
+
+// poolQuotas implements PoolQuotaInterface on top of the dynamic client
+type poolQuotas struct {
+	client dynamic.ResourceInterface
+}
+
+// NewPoolQuotas creates a pool quota client from the dynamic client
+func NewPoolQuotas(client dynamic.Interface) PoolQuotaInterface {
+	return &poolQuotas{client: client.Resource(PoolQuotaResource)}
+}
+
+func poolQuotaToUnstructured(quota *ipamv1.PoolQuota) (*unstructured.Unstructured, error) {
+	data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(quota)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &unstructured.Unstructured{Object: data}
+	obj.SetGroupVersionKind(ipamv1.SchemeGroupVersion.WithKind("PoolQuota"))
+	return obj, nil
+}
+
+func poolQuotaFromUnstructured(obj *unstructured.Unstructured) (*ipamv1.PoolQuota, error) {
+	quota := &ipamv1.PoolQuota{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, quota); err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+// Create takes the representation of a pool quota and creates it.
+func (c *poolQuotas) Create(quota *ipamv1.PoolQuota) (*ipamv1.PoolQuota, error) {
+	obj, err := poolQuotaToUnstructured(quota)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.client.Create(obj, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return poolQuotaFromUnstructured(result)
+}
+
+// Update takes the representation of a pool quota and updates it.
+func (c *poolQuotas) Update(quota *ipamv1.PoolQuota) (*ipamv1.PoolQuota, error) {
+	obj, err := poolQuotaToUnstructured(quota)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.client.Update(obj, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return poolQuotaFromUnstructured(result)
+}
+
+// Delete takes name of the pool quota and deletes it.
+func (c *poolQuotas) Delete(name string, options *metav1.DeleteOptions) error {
+	return c.client.Delete(name, options)
+}
+
+// Get takes name of the pool quota and returns it.
+func (c *poolQuotas) Get(name string, options metav1.GetOptions) (*ipamv1.PoolQuota, error) {
+	result, err := c.client.Get(name, options)
+	if err != nil {
+		return nil, err
+	}
+	return poolQuotaFromUnstructured(result)
+}
+
+// List takes label and field selectors, and returns the list of pool quotas that match those selectors.
+func (c *poolQuotas) List(opts metav1.ListOptions) (*ipamv1.PoolQuotaList, error) {
+	result, err := c.client.List(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &ipamv1.PoolQuotaList{}
+	list.SetResourceVersion(result.GetResourceVersion())
+	list.SetContinue(result.GetContinue())
+	for i := range result.Items {
+		quota, err := poolQuotaFromUnstructured(&result.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, *quota)
+	}
+	return list, nil
+}
+
+// Watch returns a watch.Interface that watches the requested pool quotas.
+func (c *poolQuotas) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := c.client.Watch(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return watch.Filter(w, func(in watch.Event) (watch.Event, bool) {
+		obj, ok := in.Object.(*unstructured.Unstructured)
+		if !ok {
+			return in, true
+		}
+
+		quota, err := poolQuotaFromUnstructured(obj)
+		if err != nil {
+			return in, true
+		}
+		in.Object = quota
+		return in, true
+	}), nil
+}
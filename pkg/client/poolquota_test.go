@@ -0,0 +1,83 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestPoolQuotas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	quotas := NewPoolQuotas(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+	informer := NewPoolQuotaInformer(quotas, 0)
+	go informer.Informer().Run(ctx.Done())
+	assert.True(t, cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced))
+
+	created, err := quotas.Create(&ipamv1.PoolQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-quota"},
+		Spec: ipamv1.PoolQuotaSpec{
+			PoolName:          "test-pool",
+			Namespaces:        []string{"default"},
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "a"}},
+			Limit:             10,
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "a", created.Spec.NamespaceSelector.MatchLabels["tenant"])
+
+	created.Status.Used = 3
+	created.Status.Namespaces = map[string]int{"default": 1, "tenant-a": 2}
+	_, err = quotas.Update(created)
+	assert.Nil(t, err)
+
+	got, err := quotas.Get("test-quota", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, got.Status.Used)
+	assert.Equal(t, map[string]int{"default": 1, "tenant-a": 2}, got.Status.Namespaces)
+
+	list, err := quotas.List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list.Items))
+
+	lister := informer.Lister()
+	for start := time.Now(); time.Since(start) < 3*time.Second; {
+		if quota, err := lister.Get("test-quota"); err == nil && quota.Status.Used == 3 {
+			break
+		}
+	}
+
+	all, err := lister.ByPool("test-pool")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(all))
+	assert.Equal(t, 3, all[0].Status.Used)
+
+	assert.Nil(t, quotas.Delete("test-quota", nil))
+	_, err = quotas.Get("test-quota", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
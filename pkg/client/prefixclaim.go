@@ -0,0 +1,165 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+// PrefixClaimResource is the resource of the prefix claim objects
+var PrefixClaimResource = ipamv1.SchemeGroupVersion.WithResource("prefixclaims")
+
+// PrefixClaimsGetter has a method to return a PrefixClaimInterface.
+type PrefixClaimsGetter interface {
+	PrefixClaims(namespace string) PrefixClaimInterface
+}
+
+// PrefixClaimInterface has methods to work with PrefixClaim resources.
+type PrefixClaimInterface interface {
+	Create(*ipamv1.PrefixClaim) (*ipamv1.PrefixClaim, error)
+	Update(*ipamv1.PrefixClaim) (*ipamv1.PrefixClaim, error)
+	Delete(name string, options *metav1.DeleteOptions) error
+	Get(name string, options metav1.GetOptions) (*ipamv1.PrefixClaim, error)
+	List(opts metav1.ListOptions) (*ipamv1.PrefixClaimList, error)
+	Watch(opts metav1.ListOptions) (watch.Interface, error)
+}
+
+type prefixClaimsGetter struct {
+	client dynamic.Interface
+}
+
+// NewPrefixClaims creates a prefix claim client from the dynamic client
+func NewPrefixClaims(client dynamic.Interface) PrefixClaimsGetter {
+	return &prefixClaimsGetter{client: client}
+}
+
+func (g *prefixClaimsGetter) PrefixClaims(namespace string) PrefixClaimInterface {
+	return &prefixClaims{client: g.client.Resource(PrefixClaimResource).Namespace(namespace)}
+}
+
+// prefixClaims implements PrefixClaimInterface on top of the dynamic client
+type prefixClaims struct {
+	client dynamic.ResourceInterface
+}
+
+func prefixClaimToUnstructured(claim *ipamv1.PrefixClaim) (*unstructured.Unstructured, error) {
+	data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(claim)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &unstructured.Unstructured{Object: data}
+	obj.SetGroupVersionKind(ipamv1.SchemeGroupVersion.WithKind("PrefixClaim"))
+	return obj, nil
+}
+
+func prefixClaimFromUnstructured(obj *unstructured.Unstructured) (*ipamv1.PrefixClaim, error) {
+	claim := &ipamv1.PrefixClaim{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, claim); err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+// Create takes the representation of a prefix claim and creates it.
+func (c *prefixClaims) Create(claim *ipamv1.PrefixClaim) (*ipamv1.PrefixClaim, error) {
+	obj, err := prefixClaimToUnstructured(claim)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.client.Create(obj, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return prefixClaimFromUnstructured(result)
+}
+
+// Update takes the representation of a prefix claim and updates it.
+func (c *prefixClaims) Update(claim *ipamv1.PrefixClaim) (*ipamv1.PrefixClaim, error) {
+	obj, err := prefixClaimToUnstructured(claim)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.client.Update(obj, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return prefixClaimFromUnstructured(result)
+}
+
+// Delete takes name of the prefix claim and deletes it.
+func (c *prefixClaims) Delete(name string, options *metav1.DeleteOptions) error {
+	return c.client.Delete(name, options)
+}
+
+// Get takes name of the prefix claim and returns it.
+func (c *prefixClaims) Get(name string, options metav1.GetOptions) (*ipamv1.PrefixClaim, error) {
+	result, err := c.client.Get(name, options)
+	if err != nil {
+		return nil, err
+	}
+	return prefixClaimFromUnstructured(result)
+}
+
+// List takes label and field selectors, and returns the list of prefix claims that match those selectors.
+func (c *prefixClaims) List(opts metav1.ListOptions) (*ipamv1.PrefixClaimList, error) {
+	result, err := c.client.List(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &ipamv1.PrefixClaimList{}
+	list.SetResourceVersion(result.GetResourceVersion())
+	list.SetContinue(result.GetContinue())
+	for i := range result.Items {
+		claim, err := prefixClaimFromUnstructured(&result.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, *claim)
+	}
+	return list, nil
+}
+
+// Watch returns a watch.Interface that watches the requested prefix claims.
+func (c *prefixClaims) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := c.client.Watch(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return watch.Filter(w, func(in watch.Event) (watch.Event, bool) {
+		obj, ok := in.Object.(*unstructured.Unstructured)
+		if !ok {
+			return in, true
+		}
+
+		claim, err := prefixClaimFromUnstructured(obj)
+		if err != nil {
+			return in, true
+		}
+		in.Object = claim
+		return in, true
+	}), nil
+}
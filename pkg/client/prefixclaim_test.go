@@ -0,0 +1,86 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newPrefixClaim(namespace, name, pool string, length int) *ipamv1.PrefixClaim {
+	return &ipamv1.PrefixClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       ipamv1.PrefixClaimSpec{PoolName: pool, PrefixLength: length},
+	}
+}
+
+func TestPrefixClaims(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	claims := NewPrefixClaims(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+	informer := NewPrefixClaimInformer(claims, 0)
+	go informer.Informer().Run(ctx.Done())
+	assert.True(t, cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced))
+
+	created, err := claims.PrefixClaims("default").Create(newPrefixClaim("default", "test-claim", "test-pool", 28))
+	assert.Nil(t, err)
+	_, err = claims.PrefixClaims("other").Create(newPrefixClaim("other", "test-claim", "test-pool", 29))
+	assert.Nil(t, err)
+
+	created.Status.Phase = ipamv1.PrefixClaimActive
+	created.Status.Prefix = "172.22.132.0/28"
+	_, err = claims.PrefixClaims("default").Update(created)
+	assert.Nil(t, err)
+
+	got, err := claims.PrefixClaims("default").Get("test-claim", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.0/28", got.Status.Prefix)
+
+	list, err := claims.PrefixClaims("other").List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list.Items))
+	assert.Equal(t, 29, list.Items[0].Spec.PrefixLength)
+
+	lister := informer.Lister()
+	for start := time.Now(); time.Since(start) < 3*time.Second; {
+		if claim, err := lister.Get("default", "test-claim"); err == nil && claim.Status.Prefix != "" {
+			break
+		}
+	}
+
+	all, err := lister.ByPool("test-pool")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(all))
+
+	claim, err := lister.Get("default", "test-claim")
+	assert.Nil(t, err)
+	assert.Equal(t, ipamv1.PrefixClaimActive, claim.Status.Phase)
+
+	assert.Nil(t, claims.PrefixClaims("other").Delete("test-claim", nil))
+	_, err = claims.PrefixClaims("other").Get("test-claim", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
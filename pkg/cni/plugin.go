@@ -0,0 +1,309 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blended "github.com/inwinstack/blended/generated/clientset/versioned"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/util"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultTimeout  = 30 * time.Second
+	defaultInterval = 500 * time.Millisecond
+	maxNameLength   = 253
+	hashLength      = 16
+)
+
+// Plugin represents the CNI IPAM plugin, which creates an IP for each container and waits
+// for the ip controller to allocate its address. The pods that select a pool themselves get
+// the IP of the pod controller instead, so that they keep their address.
+type Plugin struct {
+	k8sclient  kubernetes.Interface
+	blendedset blended.Interface
+	interval   time.Duration
+}
+
+// New creates an instance of the CNI plugin
+func New(k8sclient kubernetes.Interface, blendedset blended.Interface) *Plugin {
+	return &Plugin{
+		k8sclient:  k8sclient,
+		blendedset: blendedset,
+		interval:   defaultInterval,
+	}
+}
+
+// Exec executes the command of the arguments for the network configuration, and returns
+// what the plugin prints. The errors are always a *Error.
+func (p *Plugin) Exec(args *Args, stdin []byte) ([]byte, error) {
+	if args.Command == CommandVersion {
+		return json.Marshal(&VersionResult{
+			CNIVersion:        SupportedVersions[len(SupportedVersions)-1],
+			SupportedVersions: SupportedVersions,
+		})
+	}
+
+	conf, err := ParseConfig(stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	switch args.Command {
+	case CommandAdd:
+		var result *Result
+		if result, err = p.add(args, conf); err == nil {
+			out, err = json.Marshal(result)
+		}
+	case CommandDel:
+		err = p.del(args, conf)
+	case CommandCheck:
+		err = p.check(args, conf)
+	default:
+		err = newError(ErrInvalidEnvironment, "unknown CNI_COMMAND %q", args.Command)
+	}
+
+	if err != nil {
+		e, ok := err.(*Error)
+		if !ok {
+			e = newError(ErrTryAgainLater, err.Error())
+		}
+		e.CNIVersion = conf.CNIVersion
+		return nil, e
+	}
+	return out, nil
+}
+
+// ipName returns the name of the IP the plugin creates for the container. The characters that
+// can't be in a name become dashes, and the IDs that had to change or be truncated get a hash
+// of the ID, so that they still get their own IP.
+func ipName(containerID string) string {
+	id := strings.ToLower(containerID)
+	name := "cni-" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, id)
+	if name == "cni-"+id && len(name) <= maxNameLength && !strings.HasSuffix(name, "-") {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(containerID))
+	suffix := "-" + hex.EncodeToString(sum[:])[:hashLength]
+	if len(name) > maxNameLength-len(suffix) {
+		name = name[:maxNameLength-len(suffix)]
+	}
+	return strings.TrimRight(name, "-") + suffix
+}
+
+// target returns the IP of the container, and whether the plugin owns it. The IP of a pod
+// with a pool annotation belongs to the pod controller.
+func (p *Plugin) target(args *Args, conf *NetConf) (*blendedv1.IP, bool, error) {
+	if args.PodName != "" && p.k8sclient != nil {
+		pod, err := p.k8sclient.CoreV1().Pods(args.PodNamespace).Get(args.PodName, metav1.GetOptions{})
+		switch {
+		case err == nil && pod.Annotations[ipamconstants.PoolKey] != "":
+			return &blendedv1.IP{
+				ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+				Spec:       blendedv1.IPSpec{PoolName: pod.Annotations[ipamconstants.PoolKey]},
+			}, false, nil
+		case err != nil && !errors.IsNotFound(err):
+			return nil, false, err
+		}
+	}
+
+	namespace := args.PodNamespace
+	if namespace == "" {
+		namespace = conf.IPAM.Namespace
+	}
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	return &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        ipName(args.ContainerID),
+			Namespace:   namespace,
+			Annotations: map[string]string{ipamconstants.ContainerIDKey: args.ContainerID},
+		},
+		Spec: blendedv1.IPSpec{PoolName: conf.IPAM.Pool},
+	}, true, nil
+}
+
+func (p *Plugin) add(args *Args, conf *NetConf) (*Result, error) {
+	target, owned, err := p.target(args, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if owned {
+		if target.Spec.PoolName == "" {
+			return nil, newError(ErrInvalidConfig, "the ipam section of the network configuration has no pool")
+		}
+
+		_, err := p.blendedset.InwinstackV1().IPs(target.Namespace).Create(target)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return nil, err
+		}
+	}
+
+	timeout := defaultTimeout
+	if conf.IPAM.TimeoutSeconds > 0 {
+		timeout = time.Duration(conf.IPAM.TimeoutSeconds) * time.Second
+	}
+
+	var ip *blendedv1.IP
+	err = wait.PollImmediate(p.interval, timeout, func() (bool, error) {
+		ip, err = p.blendedset.InwinstackV1().IPs(target.Namespace).Get(target.Name, metav1.GetOptions{})
+		// The pod controller may not have created the IP of the pod yet
+		if errors.IsNotFound(err) && !owned {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		// The runtime doesn't have to wait for the IP that can't get an address
+		if ip.Status.Phase == blendedv1.IPFailed {
+			return false, newError(ErrAllocation, "the IP \"%s/%s\" failed to get an address: %s", ip.Namespace, ip.Name, ip.Status.Reason)
+		}
+		return ip.Status.Phase == blendedv1.IPActive && ip.Status.Address != "", nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return nil, newError(ErrTryAgainLater, "timed out waiting for an address of the IP \"%s/%s\"", target.Namespace, target.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := p.blendedset.InwinstackV1().Pools().Get(util.IPPool(ip), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return newResult(conf.CNIVersion, pool, ip.Status.Address)
+}
+
+// newResult returns the result for the address of the pool, along with the gateway and
+// routes of its address family.
+func newResult(version string, pool *blendedv1.Pool, address string) (*Result, error) {
+	network, err := util.AddressNetwork(pool, address)
+	if err != nil {
+		return nil, newError(ErrAllocation, err.Error())
+	}
+
+	gateways, err := util.Gateways(pool)
+	if err != nil {
+		return nil, newError(ErrInvalidConfig, "the \"%s\" pool has an %s", pool.Name, err.Error())
+	}
+
+	routes, err := util.Routes(pool)
+	if err != nil {
+		return nil, newError(ErrInvalidConfig, "the \"%s\" pool has an %s", pool.Name, err.Error())
+	}
+
+	v4 := network.IP.To4() != nil
+	config := &IPConfig{Version: "6", Address: network.String()}
+	if v4 {
+		config.Version = "4"
+	}
+
+	var gateway net.IP
+	for _, gw := range gateways {
+		if (gw.To4() != nil) == v4 {
+			gateway = gw
+			config.Gateway = gw.String()
+		}
+	}
+
+	result := &Result{CNIVersion: version, IPs: []*IPConfig{config}}
+	for _, dst := range routes {
+		if (dst.IP.To4() != nil) != v4 {
+			continue
+		}
+
+		route := &Route{Dst: dst.String()}
+		if gateway != nil {
+			route.GW = gateway.String()
+		}
+		result.Routes = append(result.Routes, route)
+	}
+	return result, nil
+}
+
+func (p *Plugin) del(args *Args, conf *NetConf) error {
+	target, owned, err := p.target(args, conf)
+	if err != nil || !owned {
+		return err
+	}
+
+	err = p.blendedset.InwinstackV1().IPs(target.Namespace).Delete(target.Name, nil)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *Plugin) check(args *Args, conf *NetConf) error {
+	if conf.CNIVersion != SupportedVersions[len(SupportedVersions)-1] {
+		return newError(ErrIncompatibleVersion, "CHECK isn't supported by CNI version %q", conf.CNIVersion)
+	}
+
+	prev := &Result{}
+	if len(conf.PrevResult) == 0 {
+		return newError(ErrInvalidConfig, "the network configuration has no prevResult")
+	}
+	if err := json.Unmarshal(conf.PrevResult, prev); err != nil {
+		return newError(ErrDecodingFailure, "failed to parse the prevResult: %s", err.Error())
+	}
+
+	target, _, err := p.target(args, conf)
+	if err != nil {
+		return err
+	}
+
+	ip, err := p.blendedset.InwinstackV1().IPs(target.Namespace).Get(target.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return newError(ErrCheckFailed, "the IP \"%s/%s\" doesn't exist", target.Namespace, target.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	if ip.Status.Phase != blendedv1.IPActive || ip.Status.Address == "" {
+		return newError(ErrCheckFailed, "the IP \"%s/%s\" has no address", ip.Namespace, ip.Name)
+	}
+
+	for _, config := range prev.IPs {
+		if addr, _, err := net.ParseCIDR(config.Address); err == nil && addr.Equal(net.ParseIP(ip.Status.Address)) {
+			return nil
+		}
+	}
+	return newError(ErrCheckFailed, "the container doesn't have the address %s of the IP \"%s/%s\"", ip.Status.Address, ip.Namespace, ip.Name)
+}
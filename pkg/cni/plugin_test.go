@@ -0,0 +1,268 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func readPayload(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	assert.Nil(t, err)
+	return data
+}
+
+func newPlugin() (*Plugin, *k8sfake.Clientset, *blendedfake.Clientset) {
+	k8sclient := k8sfake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        "web-0",
+			Namespace:   "default",
+			Annotations: map[string]string{ipamconstants.PoolKey: "test-pool"},
+		}},
+	)
+	blendedset := blendedfake.NewSimpleClientset(&blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-pool",
+			Annotations: map[string]string{
+				ipamconstants.GatewayKey: "172.22.132.1",
+				ipamconstants.RoutesKey:  "0.0.0.0/0,2001:db8::/64",
+			},
+		},
+		Spec: blendedv1.PoolSpec{Addresses: []string{"172.22.132.0/24"}},
+	})
+
+	plugin := New(k8sclient, blendedset)
+	plugin.interval = 10 * time.Millisecond
+	return plugin, k8sclient, blendedset
+}
+
+// allocate gives addresses to the IPs in the place of the ip controller.
+func allocate(ctx context.Context, blendedset *blendedfake.Clientset) {
+	next := 10
+	for ctx.Err() == nil {
+		ips, _ := blendedset.InwinstackV1().IPs(metav1.NamespaceAll).List(metav1.ListOptions{})
+		for i := range ips.Items {
+			ip := &ips.Items[i]
+			if ip.Status.Phase == blendedv1.IPActive {
+				continue
+			}
+
+			ip.Status.Phase = blendedv1.IPActive
+			ip.Status.Address = fmt.Sprintf("172.22.132.%d", next)
+			if _, err := blendedset.InwinstackV1().IPs(ip.Namespace).Update(ip); err == nil {
+				next++
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestArgsFromEnv(t *testing.T) {
+	env := map[string]string{
+		"CNI_COMMAND":     "ADD",
+		"CNI_CONTAINERID": "test-container",
+		"CNI_NETNS":       "/var/run/netns/test",
+		"CNI_IFNAME":      "eth0",
+		"CNI_ARGS":        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=test-pod",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	args, err := ArgsFromEnv(getenv)
+	assert.Nil(t, err)
+	assert.Equal(t, &Args{
+		Command:      CommandAdd,
+		ContainerID:  "test-container",
+		Netns:        "/var/run/netns/test",
+		IfName:       "eth0",
+		PodNamespace: "default",
+		PodName:      "test-pod",
+	}, args)
+
+	delete(env, "CNI_CONTAINERID")
+	_, err = ArgsFromEnv(getenv)
+	assert.NotNil(t, err)
+
+	env["CNI_COMMAND"] = CommandVersion
+	_, err = ArgsFromEnv(getenv)
+	assert.Nil(t, err)
+}
+
+func TestIPName(t *testing.T) {
+	assert.Equal(t, "cni-abc123", ipName("ABC123"))
+
+	long := strings.Repeat("a", 300)
+	ids := []string{"pod_sandbox.1", "pod.sandbox_1", "sandbox-", long, long + "b"}
+	names := map[string]bool{}
+	for _, id := range ids {
+		name := ipName(id)
+		assert.Empty(t, validation.IsDNS1123Subdomain(name), name)
+		assert.False(t, strings.Contains(name, "."), name)
+		assert.Equal(t, name, ipName(id))
+		names[name] = true
+	}
+	assert.Equal(t, len(ids), len(names))
+}
+
+func TestPlugin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	plugin, _, blendedset := newPlugin()
+	go allocate(ctx, blendedset)
+
+	args := &Args{
+		Command:      CommandAdd,
+		ContainerID:  "ABC123",
+		IfName:       "eth0",
+		PodNamespace: "default",
+		PodName:      "test-pod",
+	}
+	out, err := plugin.Exec(args, readPayload(t, "add.json"))
+	assert.Nil(t, err)
+
+	result := &Result{}
+	assert.Nil(t, json.Unmarshal(out, result))
+	assert.Equal(t, &Result{
+		CNIVersion: "0.4.0",
+		IPs:        []*IPConfig{{Version: "4", Address: "172.22.132.10/24", Gateway: "172.22.132.1"}},
+		Routes:     []*Route{{Dst: "0.0.0.0/0", GW: "172.22.132.1"}},
+	}, result)
+
+	ip, err := blendedset.InwinstackV1().IPs("default").Get("cni-abc123", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "test-pool", ip.Spec.PoolName)
+	assert.Equal(t, "ABC123", ip.Annotations[ipamconstants.ContainerIDKey])
+
+	// ADD is idempotent
+	again, err := plugin.Exec(args, readPayload(t, "add.json"))
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(out), string(again))
+
+	args.Command = CommandCheck
+	_, err = plugin.Exec(args, readPayload(t, "check.json"))
+	assert.Nil(t, err)
+
+	args.Command = CommandDel
+	_, err = plugin.Exec(args, readPayload(t, "add.json"))
+	assert.Nil(t, err)
+	_, err = blendedset.InwinstackV1().IPs("default").Get("cni-abc123", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	// DEL is idempotent, and CHECK fails without the IP
+	_, err = plugin.Exec(args, readPayload(t, "add.json"))
+	assert.Nil(t, err)
+
+	args.Command = CommandCheck
+	_, err = plugin.Exec(args, readPayload(t, "check.json"))
+	assert.Equal(t, ErrCheckFailed, err.(*Error).Code)
+}
+
+func TestPluginStaticPod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	plugin, _, blendedset := newPlugin()
+	args := &Args{Command: CommandAdd, ContainerID: "abc123", PodNamespace: "default", PodName: "web-0"}
+
+	// The plugin waits for the pod controller to create the IP of the pod
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ip := &blendedv1.IP{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"},
+			Spec:       blendedv1.IPSpec{PoolName: "test-pool"},
+		}
+		_, err := blendedset.InwinstackV1().IPs("default").Create(ip)
+		assert.Nil(t, err)
+		allocate(ctx, blendedset)
+	}()
+
+	out, err := plugin.Exec(args, readPayload(t, "add.json"))
+	assert.Nil(t, err)
+	result := &Result{}
+	assert.Nil(t, json.Unmarshal(out, result))
+	assert.Equal(t, "172.22.132.10/24", result.IPs[0].Address)
+
+	_, err = blendedset.InwinstackV1().IPs("default").Get("cni-abc123", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	// The IP of the pod outlives its containers
+	args.Command = CommandDel
+	_, err = plugin.Exec(args, readPayload(t, "add.json"))
+	assert.Nil(t, err)
+	_, err = blendedset.InwinstackV1().IPs("default").Get("web-0", metav1.GetOptions{})
+	assert.Nil(t, err)
+}
+
+func TestPluginErrors(t *testing.T) {
+	plugin, _, blendedset := newPlugin()
+	args := &Args{Command: CommandVersion}
+
+	out, err := plugin.Exec(args, nil)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"cniVersion":"0.4.0","supportedVersions":["0.3.0","0.3.1","0.4.0"]}`, string(out))
+
+	args = &Args{Command: CommandAdd, ContainerID: "abc123"}
+	_, err = plugin.Exec(args, []byte("{"))
+	assert.Equal(t, ErrDecodingFailure, err.(*Error).Code)
+
+	_, err = plugin.Exec(args, []byte(`{"cniVersion":"1.0.0"}`))
+	assert.Equal(t, ErrIncompatibleVersion, err.(*Error).Code)
+
+	_, err = plugin.Exec(args, readPayload(t, "no-pool-v030.json"))
+	assert.Equal(t, ErrInvalidConfig, err.(*Error).Code)
+	assert.Equal(t, "0.3.0", err.(*Error).CNIVersion)
+
+	args.Command = CommandCheck
+	_, err = plugin.Exec(args, readPayload(t, "no-pool-v030.json"))
+	assert.Equal(t, ErrIncompatibleVersion, err.(*Error).Code)
+
+	// Nothing allocates the address of the IP
+	args.Command = CommandAdd
+	_, err = plugin.Exec(args, readPayload(t, "add.json"))
+	assert.Equal(t, ErrTryAgainLater, err.(*Error).Code)
+
+	ip, err := blendedset.InwinstackV1().IPs("default").Get("cni-abc123", metav1.GetOptions{})
+	assert.Nil(t, err)
+	ip.Status.Phase = blendedv1.IPFailed
+	ip.Status.Reason = "The pool is exhausted"
+	_, err = blendedset.InwinstackV1().IPs("default").Update(ip)
+	assert.Nil(t, err)
+
+	// The failed IP doesn't wait for the timeout
+	start := time.Now()
+	_, err = plugin.Exec(args, readPayload(t, "add.json"))
+	assert.Equal(t, ErrAllocation, err.(*Error).Code)
+	assert.Contains(t, err.Error(), "The pool is exhausted")
+	assert.True(t, time.Since(start) < time.Second)
+}
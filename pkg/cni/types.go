@@ -0,0 +1,189 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Commands of the CNI protocol.
+const (
+	CommandAdd     = "ADD"
+	CommandDel     = "DEL"
+	CommandCheck   = "CHECK"
+	CommandVersion = "VERSION"
+)
+
+// Codes of the CNI errors.
+const (
+	ErrIncompatibleVersion uint = 1
+	ErrInvalidEnvironment  uint = 4
+	ErrDecodingFailure     uint = 6
+	ErrInvalidConfig       uint = 7
+	ErrTryAgainLater       uint = 11
+	// ErrAllocation is returned when the IP didn't get an address.
+	ErrAllocation uint = 100
+	// ErrCheckFailed is returned when the address of the container isn't the allocated one.
+	ErrCheckFailed uint = 101
+)
+
+// SupportedVersions are the versions of the CNI specification the plugin supports.
+var SupportedVersions = []string{"0.3.0", "0.3.1", "0.4.0"}
+
+// Error represents the error a CNI plugin prints on failure.
+type Error struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+	Code       uint   `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func newError(code uint, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+// IPAMConfig represents the ipam section of the network configuration.
+type IPAMConfig struct {
+	Type string `json:"type"`
+	// Pool is the pool of the containers whose pod doesn't select one.
+	Pool string `json:"pool"`
+	// Namespace holds the IPs of the containers that aren't in a pod.
+	Namespace string `json:"namespace,omitempty"`
+	// Kubeconfig is the path to the kubeconfig file of the plugin.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// TimeoutSeconds bounds the wait for an address, 30 seconds by default.
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+// NetConf represents the network configuration that the runtime passes to the plugin.
+type NetConf struct {
+	CNIVersion string          `json:"cniVersion"`
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	IPAM       IPAMConfig      `json:"ipam"`
+	PrevResult json.RawMessage `json:"prevResult,omitempty"`
+}
+
+// ParseConfig parses the network configuration and checks its version.
+func ParseConfig(stdin []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(stdin, conf); err != nil {
+		return nil, newError(ErrDecodingFailure, "failed to parse the network configuration: %s", err.Error())
+	}
+
+	if conf.CNIVersion == "" {
+		conf.CNIVersion = "0.3.0"
+	}
+	if !isSupported(conf.CNIVersion) {
+		return nil, newError(ErrIncompatibleVersion, "unsupported CNI version %q", conf.CNIVersion)
+	}
+	return conf, nil
+}
+
+func isSupported(version string) bool {
+	for _, supported := range SupportedVersions {
+		if supported == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Args represents the arguments that the runtime passes to the plugin in the environment.
+type Args struct {
+	Command     string
+	ContainerID string
+	Netns       string
+	IfName      string
+	// PodNamespace and PodName are set by Kubernetes in CNI_ARGS.
+	PodNamespace string
+	PodName      string
+}
+
+// ArgsFromEnv reads the arguments from the environment variables.
+func ArgsFromEnv(getenv func(string) string) (*Args, error) {
+	args := &Args{
+		Command:     getenv("CNI_COMMAND"),
+		ContainerID: getenv("CNI_CONTAINERID"),
+		Netns:       getenv("CNI_NETNS"),
+		IfName:      getenv("CNI_IFNAME"),
+	}
+
+	if args.Command == "" {
+		return nil, newError(ErrInvalidEnvironment, "CNI_COMMAND is required")
+	}
+	if args.Command != CommandVersion && args.ContainerID == "" {
+		return nil, newError(ErrInvalidEnvironment, "CNI_CONTAINERID is required")
+	}
+
+	for _, pair := range strings.Split(getenv("CNI_ARGS"), ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "K8S_POD_NAMESPACE":
+			args.PodNamespace = kv[1]
+		case "K8S_POD_NAME":
+			args.PodName = kv[1]
+		}
+	}
+	return args, nil
+}
+
+// IPConfig represents an address of the result.
+type IPConfig struct {
+	Version   string `json:"version"`
+	Interface *int   `json:"interface,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+}
+
+// Route represents a route of the result.
+type Route struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+// DNS represents the DNS settings of the result, which the plugin leaves empty.
+type DNS struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Domain      string   `json:"domain,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// Result represents the result of the ADD command.
+type Result struct {
+	CNIVersion string      `json:"cniVersion,omitempty"`
+	IPs        []*IPConfig `json:"ips,omitempty"`
+	Routes     []*Route    `json:"routes,omitempty"`
+	DNS        DNS         `json:"dns,omitempty"`
+}
+
+// VersionResult represents the result of the VERSION command.
+type VersionResult struct {
+	CNIVersion        string   `json:"cniVersion"`
+	SupportedVersions []string `json:"supportedVersions"`
+}
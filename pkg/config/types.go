@@ -16,8 +16,28 @@ limitations under the License.
 
 package config
 
+import "time"
+
 // Config contains the operator config
 type Config struct {
-	Threads int
-	SyncSec int
+	Threads  int
+	SyncSec  int
+	GCPeriod time.Duration
+	GCGrace  time.Duration
+	GCDryRun bool
+
+	DefaultServicePool string
+
+	MetricsAddr string
+	WebhookAddr string
+	TLSCertFile string
+	TLSKeyFile  string
+
+	LeaderElect         bool
+	LeaderElectIdentity string
+	LockType            string
+	LockNamespace       string
+	LeaseDuration       time.Duration
+	RenewDeadline       time.Duration
+	RetryPeriod         time.Duration
 }
@@ -0,0 +1,213 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package constants
+
+// Annotations that extend the Pool and IP resources.
+const (
+	// RequestedIPKey pins the address an IP wants to get from its pool.
+	RequestedIPKey = "inwinstack.com/requested-ip"
+	// AllocationStrategyKey selects how a pool picks the next free address.
+	AllocationStrategyKey = "inwinstack.com/allocation-strategy"
+	// LastAllocatedIPKey records the address a pool allocated last.
+	LastAllocatedIPKey = "inwinstack.com/last-allocated-ip"
+	// ReleasedIPsKey records the addresses a pool released, from the least recently released.
+	ReleasedIPsKey = "inwinstack.com/released-ips"
+	// ReleaseHoldTimeKey is how long a pool holds a released address before it can be allocated again.
+	ReleaseHoldTimeKey = "inwinstack.com/release-hold-time"
+	// UtilizationWarningKey is the percentage of used addresses over which a pool warns about its capacity.
+	UtilizationWarningKey = "inwinstack.com/utilization-warning-threshold"
+	// UtilizationCriticalKey is the percentage of used addresses over which a pool's capacity is critical.
+	UtilizationCriticalKey = "inwinstack.com/utilization-critical-threshold"
+	// ConditionsKey records the conditions of a pool or an IP.
+	ConditionsKey = "inwinstack.com/conditions"
+	// AddressCountKey is how many addresses an IP gets from its pool, one by default.
+	AddressCountKey = "inwinstack.com/address-count"
+	// ContiguousKey makes the addresses of an IP a block of consecutive addresses.
+	ContiguousKey = "inwinstack.com/contiguous"
+	// IPAddressesKey records the addresses allocated to an IP, starting with its status address.
+	IPAddressesKey = "inwinstack.com/addresses"
+	// ShrinkPolicyKey selects what a pool does with the allocations its addresses no longer cover.
+	ShrinkPolicyKey = "inwinstack.com/shrink-policy"
+	// StrandedIPsKey records the allocated addresses that are no longer in a pool.
+	StrandedIPsKey = "inwinstack.com/stranded-ips"
+	// DrainPolicyKey selects what a deleted pool does with the IPs that still have its addresses.
+	DrainPolicyKey = "inwinstack.com/drain-policy"
+	// BlockingIPsKey records the IPs and child pools that keep a deleted pool from going away.
+	BlockingIPsKey = "inwinstack.com/blocking-ips"
+	// NamespaceIPsKey records the addresses assigned to a namespace, by the name of their pool.
+	NamespaceIPsKey = "inwinstack.com/allocated-ips"
+	// PoolKey selects the pool of the address of a LoadBalancer Service or a pod.
+	PoolKey = "inwinstack.com/pool"
+	// GatewayKey lists the gateways that the CNI plugin configures for the addresses of a pool,
+	// at most one of each address family.
+	GatewayKey = "inwinstack.com/gateway"
+	// RoutesKey lists the destinations that the CNI plugin routes through the gateways of a pool.
+	RoutesKey = "inwinstack.com/routes"
+	// ContainerIDKey records the container that the CNI plugin created an IP for.
+	ContainerIDKey = "inwinstack.com/container-id"
+	// AddressKey records the address of a pod, which the CNI plugin configures.
+	AddressKey = "inwinstack.com/address"
+	// DelegatedPrefixesKey records the prefixes a pool delegated, by the namespace/name of their prefix claims,
+	// and the addresses of its child pools, by their name.
+	DelegatedPrefixesKey = "inwinstack.com/delegated-prefixes"
+	// PrefixClaimKey records the namespace/name of the prefix claim that a child pool publishes the prefix of.
+	PrefixClaimKey = "inwinstack.com/prefix-claim"
+	// ParentPoolKey is the name of the pool that a child pool draws its addresses from.
+	ParentPoolKey = "inwinstack.com/parent-pool"
+	// FallbackPoolsKey lists the pools that an IP tries in order when its pool can't give it addresses.
+	FallbackPoolsKey = "inwinstack.com/fallback-pools"
+	// PoolSelectorKey is the label selector of the pools that an IP tries after its fallback pools.
+	PoolSelectorKey = "inwinstack.com/pool-selector"
+	// PoolSelectionKey selects how an IP orders the pools it can get its addresses from.
+	PoolSelectionKey = "inwinstack.com/pool-selection"
+	// AllocatedPoolKey records the pool that an IP got its addresses from.
+	AllocatedPoolKey = "inwinstack.com/allocated-pool"
+	// SpecHashKey records the hash of the spec that the status of a pool was made from.
+	SpecHashKey = "inwinstack.com/spec-hash"
+)
+
+// Orders of the pools that an IP can get its addresses from.
+const (
+	// PoolSelectionOrdered tries its pool, then its fallback pools, then the selected pools by name.
+	PoolSelectionOrdered = "ordered"
+	// PoolSelectionMostFree tries the pools with the most allocatable addresses first.
+	PoolSelectionMostFree = "most-free"
+)
+
+// Policies for the allocations that a pool no longer covers after its addresses are edited.
+const (
+	// ShrinkPolicyBlock rejects the edits that strand allocations. The webhook denies them, and
+	// the pool fails until they are reverted if the webhook is disabled.
+	ShrinkPolicyBlock = "block"
+	// ShrinkPolicyKeep keeps the stranded allocations until their IPs release them.
+	ShrinkPolicyKeep = "keep"
+	// ShrinkPolicyRelease releases the stranded allocations and fails the IPs that own them.
+	ShrinkPolicyRelease = "release"
+)
+
+// Policies for the IPs that still have addresses of a deleted pool.
+const (
+	// DrainPolicyWait keeps the pool until the IPs release their addresses.
+	DrainPolicyWait = "wait"
+	// DrainPolicyCascade deletes the IPs along with the pool.
+	DrainPolicyCascade = "cascade"
+	// DrainPolicyOrphan deletes the pool right away, and leaves the IPs with their addresses.
+	DrainPolicyOrphan = "orphan"
+)
+
+// Labels of the Allocation resources.
+const (
+	// PoolLabelKey is the name of the pool an allocation belongs to.
+	PoolLabelKey = "inwinstack.com/pool"
+	// MigratedLabelKey marks the allocations that were migrated without an IP. The garbage
+	// collector never reclaims them, since their addresses may still be in use.
+	MigratedLabelKey = "inwinstack.com/migrated"
+)
+
+// Labels of the IP resources.
+const (
+	// NamespacePoolLabelKey is the name of the pool that assigned the IP to its namespace.
+	NamespacePoolLabelKey = "inwinstack.com/namespace-pool"
+	// ServiceLabelKey is the name of the LoadBalancer Service that owns the IP.
+	ServiceLabelKey = "inwinstack.com/service"
+	// PodLabelKey is the name of the pod that the IP gives an address to.
+	PodLabelKey = "inwinstack.com/pod"
+	// StatefulSetLabelKey is the name of the StatefulSet that keeps the IP for the pod of an ordinal.
+	StatefulSetLabelKey = "inwinstack.com/statefulset"
+)
+
+// Reasons of the events about the addresses.
+const (
+	// OrphanDetectedReason is recorded when an address outlives its IP.
+	OrphanDetectedReason = "OrphanDetected"
+	// OrphanReclaimedReason is recorded when the address of a missing IP is reclaimed.
+	OrphanReclaimedReason = "OrphanReclaimed"
+)
+
+// Reasons of the events about the pools and IPs, which are also mirrored into their status.
+const (
+	// AllocatedReason is recorded when an IP gets an address.
+	AllocatedReason = "Allocated"
+	// ReleasedReason is recorded when an IP releases its address.
+	ReleasedReason = "Released"
+	// PoolReadyReason is recorded when a pool becomes active.
+	PoolReadyReason = "PoolReady"
+	// PoolExhaustedReason is recorded when a pool has no address left to allocate.
+	PoolExhaustedReason = "PoolExhausted"
+	// PoolTerminatingReason is recorded when a pool is deleted, or an IP refers to a deleted pool.
+	PoolTerminatingReason = "PoolTerminating"
+	// InvalidAddressesReason is recorded when the addresses of a pool can't be parsed.
+	InvalidAddressesReason = "InvalidAddresses"
+	// InvalidSpecReason is recorded when the other settings of a pool are invalid.
+	InvalidSpecReason = "InvalidSpec"
+	// RequestedIPUnavailableReason is recorded when the requested IP of an IP can't be allocated.
+	RequestedIPUnavailableReason = "RequestedIPUnavailable"
+	// UpdateConflictReason is recorded when a pool or IP changed while it was being updated.
+	UpdateConflictReason = "UpdateConflict"
+	// UtilizationNormalReason is recorded when the utilisation of a pool drops below its thresholds.
+	UtilizationNormalReason = "UtilizationNormal"
+	// UtilizationWarningReason is recorded when the utilisation of a pool crosses its warning threshold.
+	UtilizationWarningReason = "UtilizationWarning"
+	// UtilizationCriticalReason is recorded when the utilisation of a pool crosses its critical threshold.
+	UtilizationCriticalReason = "UtilizationCritical"
+	// AddressesStrandedReason is recorded when a pool no longer covers some of its allocated addresses.
+	AddressesStrandedReason = "AddressesStranded"
+	// StrandedReleasedReason is recorded when a pool releases an address it no longer covers.
+	StrandedReleasedReason = "StrandedReleased"
+	// ShrinkBlockedReason is recorded when an edit of a pool with the block policy strands allocations.
+	ShrinkBlockedReason = "ShrinkBlocked"
+	// DrainDeletedReason is recorded when a deleted pool deletes one of its IPs.
+	DrainDeletedReason = "DrainDeleted"
+	// DrainOrphanedReason is recorded when a deleted pool leaves its IPs behind.
+	DrainOrphanedReason = "DrainOrphaned"
+	// NamespaceAssignedReason is recorded when a pool assigns an IP to a namespace.
+	NamespaceAssignedReason = "NamespaceAssigned"
+	// LoadBalancerAssignedReason is recorded when a LoadBalancer Service gets the address of its IP.
+	LoadBalancerAssignedReason = "LoadBalancerAssigned"
+	// PodAddressAssignedReason is recorded when a pod gets the address of its IP.
+	PodAddressAssignedReason = "PodAddressAssigned"
+	// IPConflictReason is recorded when an IP that the operator didn't create is in the way.
+	IPConflictReason = "IPConflict"
+	// PrefixDelegatedReason is recorded when a prefix claim gets a prefix of its pool.
+	PrefixDelegatedReason = "PrefixDelegated"
+	// PrefixReleasedReason is recorded when a prefix claim gives its prefix back to its pool.
+	PrefixReleasedReason = "PrefixReleased"
+	// PoolConflictReason is recorded when a pool that the operator didn't create is in the way.
+	PoolConflictReason = "PoolConflict"
+	// PoolChangedReason is recorded when the pool of an IP changes after the IP got its addresses.
+	PoolChangedReason = "PoolChanged"
+	// QuotaExceededReason is recorded when an IP would take more addresses of a pool than a quota of its namespace allows.
+	QuotaExceededReason = "QuotaExceeded"
+)
+
+// Reasons of the conditions of the pools and IPs, besides the reasons of the events.
+const (
+	// AddressesParsedReason is set when the addresses of a pool are valid.
+	AddressesParsedReason = "AddressesParsed"
+	// AddressesAvailableReason is set when a pool has addresses left to allocate.
+	AddressesAvailableReason = "AddressesAvailable"
+	// AsExpectedReason is set when a pool isn't degraded.
+	AsExpectedReason = "AsExpected"
+	// PendingReason is set when an IP waits for an address.
+	PendingReason = "Pending"
+	// PoolActiveReason is set when the pool of an IP can allocate addresses.
+	PoolActiveReason = "PoolActive"
+	// PoolNotReadyReason is set when the pool of an IP isn't active yet, or failed.
+	PoolNotReadyReason = "PoolNotReady"
+	// PoolNotFoundReason is set when the pool of an IP doesn't exist.
+	PoolNotFoundReason = "PoolNotFound"
+)
@@ -0,0 +1,781 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipaddr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"sort"
+)
+
+// uint128 is an IPv6 address, IPv4 addresses are stored in their IPv4-mapped form.
+type uint128 struct {
+	hi uint64
+	lo uint64
+}
+
+var maxUint128 = uint128{^uint64(0), ^uint64(0)}
+
+func uint128FromIP(ip net.IP) uint128 {
+	b := ip.To16()
+	return uint128{binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])}
+}
+
+func (u uint128) IP() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], u.hi)
+	binary.BigEndian.PutUint64(ip[8:], u.lo)
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+func (u uint128) cmp(v uint128) int {
+	switch {
+	case u.hi < v.hi:
+		return -1
+	case u.hi > v.hi:
+		return 1
+	case u.lo < v.lo:
+		return -1
+	case u.lo > v.lo:
+		return 1
+	}
+	return 0
+}
+
+func (u uint128) add(n uint64) uint128 {
+	lo := u.lo + n
+	hi := u.hi
+	if lo < u.lo {
+		hi++
+	}
+	return uint128{hi, lo}
+}
+
+func (u uint128) sub(n uint64) uint128 {
+	lo := u.lo - n
+	hi := u.hi
+	if lo > u.lo {
+		hi--
+	}
+	return uint128{hi, lo}
+}
+
+func (u uint128) big() *big.Int {
+	v := new(big.Int).SetUint64(u.hi)
+	v.Lsh(v, 64)
+	return v.Or(v, new(big.Int).SetUint64(u.lo))
+}
+
+func uint128FromBig(v *big.Int) uint128 {
+	lo := new(big.Int).And(v, new(big.Int).SetUint64(^uint64(0)))
+	hi := new(big.Int).Rsh(v, 64)
+	return uint128{hi.Uint64(), lo.Uint64()}
+}
+
+func (u uint128) isIPv4() bool {
+	return u.hi == 0 && u.lo>>32 == 0xffff
+}
+
+// span is an inclusive range of addresses.
+type span struct {
+	first uint128
+	last  uint128
+}
+
+func (s span) size() *big.Int {
+	size := new(big.Int).Sub(s.last.big(), s.first.big())
+	return size.Add(size, big.NewInt(1))
+}
+
+// intersect returns the addresses that are in both spans.
+func (s span) intersect(o span) (span, bool) {
+	n := s
+	if o.first.cmp(n.first) > 0 {
+		n.first = o.first
+	}
+	if o.last.cmp(n.last) < 0 {
+		n.last = o.last
+	}
+	return n, n.first.cmp(n.last) <= 0
+}
+
+// lowMask returns the value with the low n bits set.
+func lowMask(n uint) uint128 {
+	switch {
+	case n >= 128:
+		return maxUint128
+	case n >= 64:
+		return uint128{1<<(n-64) - 1, ^uint64(0)}
+	}
+	return uint128{0, 1<<n - 1}
+}
+
+// spanSet is a sorted list of disjoint and non-adjacent spans.
+type spanSet []span
+
+// search returns the index of the first span that ends at or after x.
+func (s spanSet) search(x uint128) int {
+	return sort.Search(len(s), func(i int) bool { return s[i].last.cmp(x) >= 0 })
+}
+
+func (s spanSet) contains(x uint128) bool {
+	i := s.search(x)
+	return i < len(s) && s[i].first.cmp(x) <= 0
+}
+
+// insert adds the span and merges it with its overlapping and adjacent spans.
+func (s *spanSet) insert(n span) {
+	set := *s
+	start := n.first
+	if start != (uint128{}) {
+		start = start.sub(1)
+	}
+	i := set.search(start)
+
+	j := i
+	for j < len(set) {
+		if n.last != maxUint128 && set[j].first.cmp(n.last.add(1)) > 0 {
+			break
+		}
+		if set[j].first.cmp(n.first) < 0 {
+			n.first = set[j].first
+		}
+		if set[j].last.cmp(n.last) > 0 {
+			n.last = set[j].last
+		}
+		j++
+	}
+
+	if i == j {
+		set = append(set, span{})
+		copy(set[i+1:], set[i:])
+		set[i] = n
+	} else {
+		set[i] = n
+		set = append(set[:i+1], set[j:]...)
+	}
+	*s = set
+}
+
+// remove takes the address out of the set.
+func (s *spanSet) remove(x uint128) {
+	set := *s
+	i := set.search(x)
+	if i == len(set) || set[i].first.cmp(x) > 0 {
+		return
+	}
+
+	n := set[i]
+	switch {
+	case n.first == x && n.last == x:
+		set = append(set[:i], set[i+1:]...)
+	case n.first == x:
+		set[i].first = x.add(1)
+	case n.last == x:
+		set[i].last = x.sub(1)
+	default:
+		set[i].last = x.sub(1)
+		set = append(set, span{})
+		copy(set[i+2:], set[i+1:])
+		set[i+1] = span{x.add(1), n.last}
+	}
+	*s = set
+}
+
+// Allocator tracks the free addresses of a pool without materializing them.
+// The pool is kept as the parsed address spans plus a set of used spans, the
+// used spans also absorb the buggy and gateway addresses next to them so that
+// a contiguous run of allocations stays a single span.
+type Allocator struct {
+	parser   *Parser
+	spans    []span
+	used     spanSet
+	capacity *big.Int
+	excluded *big.Int
+	inUse    *big.Int
+	held     *big.Int
+	// delegated holds the prefixes that were handed over to other pools
+	delegated spanSet
+	// allocated holds the addresses marked as allocated one by one, which can be released
+	allocated spanSet
+}
+
+// NewAllocator creates an allocator for the addresses of the parser.
+func NewAllocator(p *Parser) (*Allocator, error) {
+	nets, err := p.getAllIPNets()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Allocator{
+		parser:   p,
+		capacity: new(big.Int),
+		excluded: new(big.Int),
+		inUse:    new(big.Int),
+		held:     new(big.Int),
+	}
+
+	// The spans keep the order of the addresses, but the addresses of overlapping entries
+	// are only counted once
+	var merged spanSet
+	for _, n := range nets {
+		first := uint128FromIP(n.IP.Mask(n.Mask))
+		last := uint128FromIP(lastIP(n))
+		a.spans = append(a.spans, span{first, last})
+		merged.insert(span{first, last})
+	}
+
+	for _, s := range merged {
+		a.capacity.Add(a.capacity, a.countUsable(s))
+	}
+	return a, nil
+}
+
+func lastIP(n *net.IPNet) net.IP {
+	ip := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		ip[i] = n.IP[i] | ^n.Mask[len(n.Mask)-len(n.IP)+i]
+	}
+	return ip
+}
+
+// hostRanges returns the host ranges of the avoided addresses of the address family.
+func (a *Allocator) hostRanges(v4 bool) []hostRange {
+	var ranges []hostRange
+	if v4 {
+		if a.parser.AvoidBuggy {
+			ranges = append(ranges, ipv4BuggyHosts...)
+		}
+		if a.parser.AvoidGateway {
+			ranges = append(ranges, ipv4GatewayHosts...)
+		}
+	} else {
+		if a.parser.AvoidBuggy {
+			ranges = append(ranges, ipv6BuggyHosts...)
+		}
+		if a.parser.AvoidGateway {
+			ranges = append(ranges, ipv6GatewayHosts...)
+		}
+	}
+	return ranges
+}
+
+// avoided returns the run of avoided addresses that holds x.
+func (a *Allocator) avoided(x uint128) (span, bool) {
+	host := x.lo
+	if x.isIPv4() {
+		host = x.lo & 0xff
+	}
+
+	for _, r := range a.hostRanges(x.isIPv4()) {
+		if host >= r.first && host <= r.last {
+			return span{x.sub(host - r.first), x.add(r.last - host)}, true
+		}
+	}
+	return span{}, false
+}
+
+// spanOf returns the pool span that holds x.
+func (a *Allocator) spanOf(x uint128) (span, bool) {
+	for _, s := range a.spans {
+		if s.first.cmp(x) <= 0 && s.last.cmp(x) >= 0 {
+			return s, true
+		}
+	}
+	return span{}, false
+}
+
+func (a *Allocator) usable(x uint128) bool {
+	if _, ok := a.spanOf(x); !ok {
+		return false
+	}
+	_, ok := a.avoided(x)
+	return !ok
+}
+
+// mark adds x to the used spans, along with the avoided addresses around it.
+func (a *Allocator) mark(x uint128) {
+	pool, _ := a.spanOf(x)
+	n := span{x, x}
+	for n.first != pool.first {
+		run, ok := a.avoided(n.first.sub(1))
+		if !ok {
+			break
+		}
+		n.first = run.first
+		if n.first.cmp(pool.first) < 0 {
+			n.first = pool.first
+		}
+	}
+	for n.last != pool.last {
+		run, ok := a.avoided(n.last.add(1))
+		if !ok {
+			break
+		}
+		n.last = run.last
+		if n.last.cmp(pool.last) > 0 {
+			n.last = pool.last
+		}
+	}
+	a.used.insert(n)
+}
+
+func parseAll(addrs []string) ([]uint128, error) {
+	values := make([]uint128, 0, len(addrs))
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q", addr)
+		}
+		values = append(values, uint128FromIP(ip))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].cmp(values[j]) < 0 })
+	return values, nil
+}
+
+// take marks the addresses as unavailable and counts them. The allocated addresses are also
+// recorded, so that they can be released one by one.
+func (a *Allocator) take(addrs []string, counter *big.Int, allocated bool) error {
+	values, err := parseAll(addrs)
+	if err != nil {
+		return err
+	}
+
+	for _, x := range values {
+		if !a.usable(x) || a.used.contains(x) {
+			continue
+		}
+		a.mark(x)
+		counter.Add(counter, big.NewInt(1))
+		if allocated {
+			a.allocated.insert(span{x, x})
+		}
+	}
+	return nil
+}
+
+// Exclude removes the addresses from the capacity of the pool, addresses
+// that aren't usable addresses of the pool are ignored.
+func (a *Allocator) Exclude(addrs ...string) error {
+	return a.take(addrs, a.excluded, false)
+}
+
+// Use marks the addresses as allocated, addresses that aren't usable
+// addresses of the pool are ignored.
+func (a *Allocator) Use(addrs ...string) error {
+	return a.take(addrs, a.inUse, true)
+}
+
+// Hold marks the addresses as unavailable without allocating them, addresses
+// that aren't usable addresses of the pool are ignored.
+func (a *Allocator) Hold(addrs ...string) error {
+	return a.take(addrs, a.held, false)
+}
+
+// Release marks the allocated address as free. Only the addresses marked as allocated one
+// by one can be released, not the excluded, held or delegated ones.
+func (a *Allocator) Release(addr string) error {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("invalid IP %q", addr)
+	}
+
+	x := uint128FromIP(ip)
+	if !a.allocated.contains(x) {
+		return fmt.Errorf("IP %q isn't allocated", addr)
+	}
+	a.allocated.remove(x)
+	a.used.remove(x)
+	a.inUse.Sub(a.inUse, big.NewInt(1))
+	return nil
+}
+
+// Contains reports whether the address is a usable address of the pool.
+func (a *Allocator) Contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	return a.usable(uint128FromIP(ip))
+}
+
+// IsFree reports whether the address is a usable address of the pool that
+// is neither allocated nor excluded.
+func (a *Allocator) IsFree(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	x := uint128FromIP(ip)
+	return a.usable(x) && !a.used.contains(x)
+}
+
+// nextFrom returns the first free address at or after x within the pool span.
+func (a *Allocator) nextFrom(x uint128, pool span) (uint128, bool) {
+	for x.cmp(pool.last) <= 0 {
+		if i := a.used.search(x); i < len(a.used) && a.used[i].first.cmp(x) <= 0 {
+			if a.used[i].last.cmp(pool.last) >= 0 {
+				return uint128{}, false
+			}
+			x = a.used[i].last.add(1)
+			continue
+		}
+
+		if run, ok := a.avoided(x); ok {
+			if run.last.cmp(pool.last) >= 0 {
+				return uint128{}, false
+			}
+			x = run.last.add(1)
+			continue
+		}
+		return x, true
+	}
+	return uint128{}, false
+}
+
+func (a *Allocator) exhausted() error {
+	return fmt.Errorf("No available IP in %+v", a.parser.Addresses)
+}
+
+// nextWrapping returns the first free address at or after x, it walks the pool
+// spans from the i-th span and wraps around to the beginning of the pool.
+func (a *Allocator) nextWrapping(i int, x uint128) (net.IP, error) {
+	if next, ok := a.nextFrom(x, a.spans[i]); ok {
+		return next.IP(), nil
+	}
+
+	for j := 1; j <= len(a.spans); j++ {
+		s := a.spans[(i+j)%len(a.spans)]
+		if next, ok := a.nextFrom(s.first, s); ok {
+			return next.IP(), nil
+		}
+	}
+	return nil, a.exhausted()
+}
+
+// Next returns the first free address in the order of the pool addresses.
+func (a *Allocator) Next() (net.IP, error) {
+	for _, s := range a.spans {
+		if x, ok := a.nextFrom(s.first, s); ok {
+			return x.IP(), nil
+		}
+	}
+	return nil, a.exhausted()
+}
+
+// NextAfter returns the first free address after the given one, wrapping around
+// to the beginning of the pool. It falls back to Next if the address isn't in the pool.
+func (a *Allocator) NextAfter(addr string) (net.IP, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return a.Next()
+	}
+
+	x := uint128FromIP(ip)
+	for i, s := range a.spans {
+		if s.first.cmp(x) <= 0 && s.last.cmp(x) >= 0 {
+			if x == s.last {
+				return a.nextWrapping((i+1)%len(a.spans), a.spans[(i+1)%len(a.spans)].first)
+			}
+			return a.nextWrapping(i, x.add(1))
+		}
+	}
+	return a.Next()
+}
+
+// NextRandom returns the first free address at or after a random address of the pool.
+func (a *Allocator) NextRandom(rnd *rand.Rand) (net.IP, error) {
+	if len(a.spans) == 0 {
+		return nil, a.exhausted()
+	}
+
+	sizes := make([]*big.Int, len(a.spans))
+	total := new(big.Int)
+	for i, s := range a.spans {
+		sizes[i] = new(big.Int).Sub(s.last.big(), s.first.big())
+		sizes[i].Add(sizes[i], big.NewInt(1))
+		total.Add(total, sizes[i])
+	}
+
+	offset := new(big.Int).Rand(rnd, total)
+	for i, s := range a.spans {
+		if offset.Cmp(sizes[i]) < 0 {
+			return a.nextWrapping(i, uint128FromBig(offset.Add(offset, s.first.big())))
+		}
+		offset.Sub(offset, sizes[i])
+	}
+	return a.Next()
+}
+
+// isFree reports whether x is a usable address that is neither allocated nor excluded.
+func (a *Allocator) isFree(x uint128) bool {
+	return a.usable(x) && !a.used.contains(x)
+}
+
+// NextBlock returns the first n consecutive free addresses in the order of the pool addresses.
+func (a *Allocator) NextBlock(n int) ([]net.IP, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid block size %d", n)
+	}
+
+	for _, s := range a.spans {
+		first, ok := a.nextFrom(s.first, s)
+		for ok {
+			last, size := first, 1
+			// The parsed spans of an address range are adjacent, so the block can go on in the next one
+			for size < n && last != maxUint128 && a.isFree(last.add(1)) {
+				last = last.add(1)
+				size++
+			}
+
+			if size == n {
+				block := make([]net.IP, 0, n)
+				for x := first; ; x = x.add(1) {
+					block = append(block, x.IP())
+					if x == last {
+						break
+					}
+				}
+				return block, nil
+			}
+
+			if last.cmp(s.last) >= 0 {
+				break
+			}
+			first, ok = a.nextFrom(last.add(1), s)
+		}
+	}
+	return nil, fmt.Errorf("No %d contiguous available IPs in %+v", n, a.parser.Addresses)
+}
+
+// AllocateBlock marks the first n consecutive free addresses as allocated and returns them.
+func (a *Allocator) AllocateBlock(n int) ([]string, error) {
+	block, err := a.NextBlock(n)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, n)
+	for _, ip := range block {
+		addrs = append(addrs, ip.String())
+	}
+	if err := a.Use(addrs...); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// countUsable returns the number of addresses of the span that aren't avoided.
+func (a *Allocator) countUsable(s span) *big.Int {
+	modulus := ipv6HostModulus
+	if s.first.isIPv4() {
+		modulus = ipv4HostModulus
+	}
+
+	first, last := s.first.big(), s.last.big()
+	count := s.size()
+	for _, h := range a.hostRanges(s.first.isIPv4()) {
+		count.Sub(count, countHosts(first, last, modulus, h))
+	}
+	return count
+}
+
+// countUsed returns the number of usable addresses of the span that are already taken.
+func (a *Allocator) countUsed(s span) *big.Int {
+	count := new(big.Int)
+	for i := a.used.search(s.first); i < len(a.used) && a.used[i].first.cmp(s.last) <= 0; i++ {
+		if n, ok := a.used[i].intersect(s); ok {
+			count.Add(count, a.countUsable(n))
+		}
+	}
+	return count
+}
+
+// parseSpans returns the spans of a prefix or an address range.
+func (a *Allocator) parseSpans(address string) ([]span, error) {
+	nets, err := a.parser.getIPNets(address)
+	if err != nil {
+		return nil, err
+	}
+
+	spans := make([]span, 0, len(nets))
+	for _, n := range nets {
+		spans = append(spans, span{uint128FromIP(n.IP.Mask(n.Mask)), uint128FromIP(lastIP(n))})
+	}
+	return spans, nil
+}
+
+// Delegate marks the prefixes or address ranges as allocated, they are handed over to other
+// pools as a whole. The delegated addresses that aren't in the pool are ignored.
+func (a *Allocator) Delegate(addresses ...string) error {
+	for _, address := range addresses {
+		spans, err := a.parseSpans(address)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range spans {
+			for _, s := range a.spans {
+				n, ok := s.intersect(p)
+				if !ok {
+					continue
+				}
+
+				taken := a.countUsable(n)
+				taken.Sub(taken, a.countUsed(n))
+				a.inUse.Add(a.inUse, taken)
+				a.used.insert(n)
+				a.delegated.insert(n)
+			}
+		}
+	}
+	return nil
+}
+
+// IsDelegated reports whether the address is in one of the delegated prefixes.
+func (a *Allocator) IsDelegated(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	return a.delegated.contains(uint128FromIP(ip))
+}
+
+// isFreeSpan reports whether all the addresses of the span are in the pool, and none
+// of its usable addresses is taken.
+func (a *Allocator) isFreeSpan(p span) bool {
+	covered := new(big.Int)
+	for _, s := range a.spans {
+		if n, ok := s.intersect(p); ok {
+			covered.Add(covered, n.size())
+		}
+	}
+
+	if covered.Cmp(p.size()) < 0 {
+		return false
+	}
+
+	if i := a.delegated.search(p.first); i < len(a.delegated) && a.delegated[i].first.cmp(p.last) <= 0 {
+		return false
+	}
+	return a.countUsed(p).Sign() == 0
+}
+
+// IsFreePrefix reports whether the prefix or address range can be delegated by the pool.
+func (a *Allocator) IsFreePrefix(address string) bool {
+	spans, err := a.parseSpans(address)
+	if err != nil {
+		return false
+	}
+
+	for _, p := range spans {
+		if !a.isFreeSpan(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// NextPrefix returns the first free prefix of the length in the order of the pool addresses.
+// The prefix is aligned on its size, and it may go on in the next span of an address range.
+func (a *Allocator) NextPrefix(length int) (*net.IPNet, error) {
+	for _, s := range a.spans {
+		bits := net.IPv6len * 8
+		if s.first.isIPv4() {
+			bits = net.IPv4len * 8
+		}
+		if length < 1 || length > bits {
+			continue
+		}
+
+		m := lowMask(uint(bits - length))
+		first := uint128{s.first.hi &^ m.hi, s.first.lo &^ m.lo}
+		for {
+			last := uint128{first.hi | m.hi, first.lo | m.lo}
+			// The prefixes of avoided addresses only aren't worth delegating
+			if p := (span{first, last}); first.cmp(s.first) >= 0 && a.countUsable(p).Sign() > 0 && a.isFreeSpan(p) {
+				return &net.IPNet{IP: first.IP(), Mask: net.CIDRMask(length, bits)}, nil
+			}
+
+			// Skip the prefixes that the taken addresses overlap
+			for i := a.used.search(first); i < len(a.used) && a.used[i].first.cmp(last) <= 0; i++ {
+				if a.used[i].last.cmp(last) > 0 {
+					last = uint128{a.used[i].last.hi | m.hi, a.used[i].last.lo | m.lo}
+				}
+			}
+
+			if last.cmp(s.last) >= 0 || last == maxUint128 {
+				break
+			}
+			first = last.add(1)
+		}
+	}
+	return nil, fmt.Errorf("No available /%d prefix in %+v", length, a.parser.Addresses)
+}
+
+// Clone returns a copy of the allocator that can be changed independently.
+func (a *Allocator) Clone() *Allocator {
+	clone := *a
+	clone.used = append(spanSet{}, a.used...)
+	clone.delegated = append(spanSet{}, a.delegated...)
+	clone.allocated = append(spanSet{}, a.allocated...)
+	clone.excluded = new(big.Int).Set(a.excluded)
+	clone.inUse = new(big.Int).Set(a.inUse)
+	clone.held = new(big.Int).Set(a.held)
+	return &clone
+}
+
+// Allocate marks the first free address as allocated and returns it.
+func (a *Allocator) Allocate() (string, error) {
+	return a.AllocateWith(&Sequential{})
+}
+
+// AllocateWith marks the address picked by the strategy as allocated and returns it.
+func (a *Allocator) AllocateWith(strategy Strategy) (string, error) {
+	ip, err := strategy.Next(a)
+	if err != nil {
+		return "", err
+	}
+
+	addr := ip.String()
+	if err := a.Use(addr); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+// Capacity returns the number of usable addresses that aren't excluded.
+func (a *Allocator) Capacity() *big.Int {
+	return new(big.Int).Sub(a.capacity, a.excluded)
+}
+
+// Held returns the number of usable addresses that are held.
+func (a *Allocator) Held() *big.Int {
+	return new(big.Int).Set(a.held)
+}
+
+// Free returns the number of usable addresses that are neither allocated, held nor excluded.
+func (a *Allocator) Free() *big.Int {
+	free := new(big.Int).Sub(a.Capacity(), a.inUse)
+	return free.Sub(free, a.held)
+}
@@ -0,0 +1,320 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipaddr
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocator(t *testing.T) {
+	tests := []struct {
+		Parser  *Parser
+		Exclude []string
+		Use     []string
+		IPs     []string
+	}{
+		{
+			Parser: NewParser([]string{"172.22.132.0-172.22.132.5"}, true, true),
+			IPs:    []string{"172.22.132.2", "172.22.132.3", "172.22.132.4", "172.22.132.5"},
+		},
+		{
+			Parser:  NewParser([]string{"172.22.132.250-172.22.133.5"}, true, true),
+			Exclude: []string{"172.22.132.252", "172.22.133.3", "172.22.132.254"},
+			Use:     []string{"172.22.132.250"},
+			IPs:     []string{"172.22.132.251", "172.22.132.253", "172.22.133.2", "172.22.133.4", "172.22.133.5"},
+		},
+		{
+			Parser: NewParser([]string{"172.22.132.10/31", "172.22.132.4/31"}, false, false),
+			Use:    []string{"172.22.132.11"},
+			IPs:    []string{"172.22.132.10", "172.22.132.4", "172.22.132.5"},
+		},
+		{
+			Parser: NewParser([]string{"2001:db8::200:5eff:fdff:fffe-2001:db8::200:5eff:ff00:1"}, true, true),
+			Use:    []string{"2001:db8::200:5eff:fdff:ffff"},
+			IPs:    []string{"2001:db8::200:5eff:fdff:fffe", "2001:db8::200:5eff:ff00:0", "2001:db8::200:5eff:ff00:1"},
+		},
+	}
+
+	for _, test := range tests {
+		a, err := NewAllocator(test.Parser)
+		assert.Nil(t, err)
+		assert.Nil(t, a.Exclude(test.Exclude...))
+		assert.Nil(t, a.Use(test.Use...))
+		assert.Equal(t, int64(len(test.IPs)), a.Free().Int64())
+
+		var ips []string
+		for {
+			ip, err := a.Allocate()
+			if err != nil {
+				break
+			}
+			ips = append(ips, ip)
+		}
+		assert.Equal(t, test.IPs, ips)
+		assert.Equal(t, int64(0), a.Free().Int64())
+	}
+}
+
+func TestAllocatorOverlap(t *testing.T) {
+	a, err := NewAllocator(NewParser([]string{"172.22.132.0/24", "172.22.132.0/25", "172.22.132.200-172.22.133.5"}, true, true))
+	assert.Nil(t, err)
+
+	// The addresses of the overlapping entries are only counted once
+	expected, err := NewParser([]string{"172.22.132.0/24", "172.22.133.0-172.22.133.5"}, true, true).Capacity()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, expected.Cmp(a.Capacity()))
+	assert.Equal(t, 0, expected.Cmp(a.Free()))
+
+	ips := map[string]bool{}
+	for {
+		ip, err := a.Allocate()
+		if err != nil {
+			break
+		}
+		assert.False(t, ips[ip])
+		ips[ip] = true
+	}
+	assert.Equal(t, expected.Int64(), int64(len(ips)))
+	assert.Equal(t, int64(0), a.Free().Int64())
+}
+
+func TestAllocatorRelease(t *testing.T) {
+	a, err := NewAllocator(NewParser([]string{"172.22.132.0/24"}, true, true))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(252), a.Capacity().Int64())
+
+	for i := 0; i < 10; i++ {
+		_, err := a.Allocate()
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, len(a.used))
+	assert.Equal(t, int64(242), a.Free().Int64())
+
+	assert.Nil(t, a.Release("172.22.132.5"))
+	assert.NotNil(t, a.Release("172.22.132.5"))
+	assert.NotNil(t, a.Release("172.22.132"))
+	assert.Equal(t, 2, len(a.used))
+	assert.Equal(t, int64(243), a.Free().Int64())
+	assert.True(t, a.IsFree("172.22.132.5"))
+	assert.False(t, a.IsFree("172.22.132.6"))
+	assert.False(t, a.IsFree("172.22.132.1"))
+	assert.True(t, a.Contains("172.22.132.6"))
+	assert.False(t, a.Contains("172.22.133.6"))
+
+	ip, err := a.Allocate()
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.5", ip)
+	assert.Equal(t, 1, len(a.used))
+}
+
+func TestAllocatorReleaseUnallocated(t *testing.T) {
+	a, err := NewAllocator(NewParser([]string{"172.22.132.0/24"}, true, true))
+	assert.Nil(t, err)
+	assert.Nil(t, a.Exclude("172.22.132.100"))
+	assert.Nil(t, a.Hold("172.22.132.101"))
+	_, err = a.Allocate()
+	assert.Nil(t, err)
+
+	// The avoided, excluded, held and free addresses aren't allocated
+	for _, addr := range []string{"172.22.132.1", "172.22.132.100", "172.22.132.101", "172.22.132.50"} {
+		assert.NotNil(t, a.Release(addr), addr)
+	}
+	assert.Equal(t, int64(251), a.Capacity().Int64())
+	assert.Equal(t, int64(249), a.Free().Int64())
+
+	assert.Nil(t, a.Release("172.22.132.2"))
+	assert.Equal(t, int64(250), a.Free().Int64())
+}
+
+func TestAllocatorHold(t *testing.T) {
+	a, err := NewAllocator(NewParser([]string{"172.22.132.0-172.22.132.5"}, true, false))
+	assert.Nil(t, err)
+	assert.Nil(t, a.Use("172.22.132.1"))
+	assert.Nil(t, a.Hold("172.22.132.1", "172.22.132.2", "172.22.132.3"))
+	assert.Equal(t, int64(2), a.Held().Int64())
+	assert.Equal(t, int64(2), a.Free().Int64())
+	assert.False(t, a.IsFree("172.22.132.2"))
+
+	ip, err := a.Allocate()
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.4", ip)
+}
+
+func TestAllocatorBlock(t *testing.T) {
+	a, err := NewAllocator(NewParser([]string{"172.22.132.0-172.22.132.9", "172.22.133.0/30"}, false, false))
+	assert.Nil(t, err)
+	assert.Nil(t, a.Use("172.22.132.2", "172.22.132.6"))
+
+	block, err := a.AllocateBlock(3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"172.22.132.3", "172.22.132.4", "172.22.132.5"}, block)
+	assert.Equal(t, int64(9), a.Free().Int64())
+
+	// The block doesn't span the pool addresses
+	block, err = a.AllocateBlock(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"172.22.133.0", "172.22.133.1", "172.22.133.2", "172.22.133.3"}, block)
+
+	_, err = a.NextBlock(4)
+	assert.NotNil(t, err)
+	_, err = a.NextBlock(0)
+	assert.NotNil(t, err)
+
+	block, err = a.AllocateBlock(1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"172.22.132.0"}, block)
+
+	// The avoided addresses break the blocks
+	a, err = NewAllocator(NewParser([]string{"172.22.132.250-172.22.133.5"}, true, true))
+	assert.Nil(t, err)
+	block, err = a.AllocateBlock(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"172.22.132.250", "172.22.132.251", "172.22.132.252", "172.22.132.253"}, block)
+	block, err = a.AllocateBlock(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"172.22.133.2", "172.22.133.3", "172.22.133.4", "172.22.133.5"}, block)
+}
+
+func TestAllocatorPrefix(t *testing.T) {
+	a, err := NewAllocator(NewParser([]string{"172.22.132.0/24"}, false, false))
+	assert.Nil(t, err)
+	assert.Nil(t, a.Use("172.22.132.3"))
+
+	prefix, err := a.NextPrefix(28)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.16/28", prefix.String())
+
+	assert.Nil(t, a.Delegate(prefix.String()))
+	assert.Equal(t, int64(239), a.Free().Int64())
+	assert.False(t, a.IsFree("172.22.132.17"))
+	assert.True(t, a.IsDelegated("172.22.132.17"))
+	assert.False(t, a.IsDelegated("172.22.132.3"))
+	assert.False(t, a.IsFreePrefix("172.22.132.16/28"))
+	assert.False(t, a.IsFreePrefix("172.22.132.0/28"))
+	assert.True(t, a.IsFreePrefix("172.22.132.48/28"))
+
+	// The addresses of a delegated prefix aren't allocated or released one by one
+	assert.Nil(t, a.Use("172.22.132.18"))
+	assert.NotNil(t, a.Release("172.22.132.17"))
+	assert.Equal(t, int64(239), a.Free().Int64())
+
+	prefix, err = a.NextPrefix(28)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.32/28", prefix.String())
+	prefix, err = a.NextPrefix(25)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.128/25", prefix.String())
+
+	_, err = a.NextPrefix(24)
+	assert.NotNil(t, err)
+	_, err = a.NextPrefix(23)
+	assert.NotNil(t, err)
+	assert.NotNil(t, a.Delegate("172.22.132.0"))
+
+	// The prefix may span the pool addresses of a range, but it only counts the usable addresses
+	a, err = NewAllocator(NewParser([]string{"172.22.132.0-172.22.133.255"}, true, false))
+	assert.Nil(t, err)
+	prefix, err = a.NextPrefix(32)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.1/32", prefix.String())
+	prefix, err = a.NextPrefix(23)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.0/23", prefix.String())
+	assert.Nil(t, a.Delegate("172.22.132.0/31", "172.22.133.0/24"))
+	assert.Equal(t, int64(253), a.Free().Int64())
+
+	// The address ranges are delegated like prefixes
+	assert.True(t, a.IsFreePrefix("172.22.132.10-172.22.132.20"))
+	assert.False(t, a.IsFreePrefix("172.22.132.250-172.22.133.1"))
+	assert.Nil(t, a.Delegate("172.22.132.10-172.22.132.20"))
+	assert.Equal(t, int64(242), a.Free().Int64())
+	assert.False(t, a.IsFreePrefix("172.22.132.16/30"))
+
+	// The prefixes that the taken addresses overlap are skipped at once
+	a, err = NewAllocator(NewParser([]string{"2001:db8::/64"}, true, true))
+	assert.Nil(t, err)
+	assert.Nil(t, a.Delegate("2001:db8::/72"))
+	prefix, err = a.NextPrefix(120)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8:0:0:100::/120", prefix.String())
+}
+
+func TestAllocatorLargePool(t *testing.T) {
+	a, err := NewAllocator(NewParser([]string{"2001:db8::/48"}, true, true))
+	assert.Nil(t, err)
+
+	expected, _ := new(big.Int).SetString("1208925819614629174706176", 10)
+	expected.Sub(expected, new(big.Int).Mul(big.NewInt(65536), big.NewInt(16777346)))
+	assert.Equal(t, 0, expected.Cmp(a.Capacity()))
+
+	assert.Nil(t, a.Use("2001:db8::2", "2001:db8::3"))
+	ip, err := a.Allocate()
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::4", ip)
+	assert.Equal(t, 0, new(big.Int).Sub(expected, big.NewInt(3)).Cmp(a.Free()))
+}
+
+func firstIPs(cidr string, n int) []string {
+	ip, _, _ := net.ParseCIDR(cidr)
+	ip = ip.To4()
+	var ips []string
+	for i := 0; i < n; i++ {
+		inc(ip)
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
+
+func BenchmarkNextIP(b *testing.B) {
+	for _, cidr := range []string{"10.0.0.0/24", "10.0.0.0/16", "10.0.0.0/8"} {
+		parser := NewParser([]string{cidr}, true, true)
+		allocated := firstIPs(cidr, 4)
+		filters := []string{"10.0.0.100"}
+
+		b.Run(fmt.Sprintf("FilterIPs/%s", cidr), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ips, err := parser.FilterIPs(allocated, filters)
+				if err != nil || len(ips) == 0 {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("Allocator/%s", cidr), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				a, err := NewAllocator(parser)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := a.Exclude(filters...); err != nil {
+					b.Fatal(err)
+				}
+				if err := a.Use(allocated...); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := a.Allocate(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
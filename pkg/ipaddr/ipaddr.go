@@ -17,7 +17,9 @@ limitations under the License.
 package ipaddr
 
 import (
+	"bytes"
 	"fmt"
+	"math/big"
 	"net"
 	"strings"
 
@@ -26,6 +28,36 @@ import (
 	"github.com/mikioh/ipaddr"
 )
 
+// maxEnumerateIPs limits how many addresses IPs() will materialize,
+// it's large enough for an IPv4 /8.
+const maxEnumerateIPs = 1 << 24
+
+// hostRange is an inclusive range of host values, for IPv4 it matches the
+// last octet and for IPv6 it matches the 64-bit interface ID.
+type hostRange struct {
+	first uint64
+	last  uint64
+}
+
+var (
+	// The network and broadcast addresses of a /24.
+	ipv4BuggyHosts = []hostRange{{0, 0}, {255, 255}}
+	// The addresses usually taken by routers.
+	ipv4GatewayHosts = []hostRange{{1, 1}, {254, 254}}
+	// The subnet-router anycast address (RFC 4291) and the reserved
+	// interface IDs (RFC 5453).
+	ipv6BuggyHosts = []hostRange{
+		{0, 0},
+		{0x02005efffe000000, 0x02005efffeffffff},
+		{0xfdffffffffffff80, 0xfdffffffffffffff},
+	}
+	// The ::1 interface ID usually taken by routers.
+	ipv6GatewayHosts = []hostRange{{1, 1}}
+
+	ipv4HostModulus = big.NewInt(1 << 8)
+	ipv6HostModulus = new(big.Int).Lsh(big.NewInt(1), 64)
+)
+
 type Parser struct {
 	Addresses    []string
 	AvoidBuggy   bool
@@ -64,39 +96,170 @@ func (p *Parser) getIPNets(cidr string) ([]*net.IPNet, error) {
 		return nil, fmt.Errorf("invalid IP range %q: invalid end IP %q", cidr, fs[1])
 	}
 
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return nil, fmt.Errorf("invalid IP range %q: mixed address families", cidr)
+	}
+
+	if bytes.Compare(start.To16(), end.To16()) > 0 {
+		return nil, fmt.Errorf("invalid IP range %q: the start IP is after the end IP", cidr)
+	}
+
 	var ret []*net.IPNet
 	for _, pfx := range ipaddr.Summarize(start, end) {
 		n := &net.IPNet{
 			IP:   pfx.IP,
 			Mask: pfx.Mask,
 		}
+		if v4 := n.IP.To4(); v4 != nil {
+			n.IP = v4
+		}
 		ret = append(ret, n)
 	}
 	return ret, nil
 }
 
-func (p *Parser) isGatewayIP(v string) bool {
-	gatewayIPs := []string{"1", "254"}
-	fs := strings.SplitN(v, ".", 4)
-	for _, ip := range gatewayIPs {
-		if fs[3] == ip {
-			return true
+func (p *Parser) getAllIPNets() ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+	for _, address := range p.Addresses {
+		nets, err := p.getIPNets(address)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid parse CIDR from %+v address", address)
 		}
+		ret = append(ret, nets...)
 	}
-	return false
+	return ret, nil
+}
+
+// Validate checks that every address is a valid CIDR or IP range.
+func (p *Parser) Validate() error {
+	for _, address := range p.Addresses {
+		if _, err := p.getIPNets(address); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (p *Parser) isBuggyIP(v string) bool {
-	buggyIPs := []string{"0", "255"}
-	fs := strings.SplitN(v, ".", 4)
-	for _, ip := range buggyIPs {
-		if fs[3] == ip {
+// InRanges checks if the address is within the addresses, whether it's avoided or not.
+func (p *Parser) InRanges(addr string) (bool, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false, fmt.Errorf("invalid IP %q", addr)
+	}
+
+	nets, err := p.getAllIPNets()
+	if err != nil {
+		return false, err
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Overlaps returns the first address that shares IPs with the addresses of the other parser.
+func (p *Parser) Overlaps(other *Parser) (string, bool, error) {
+	otherNets, err := other.getAllIPNets()
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, address := range p.Addresses {
+		nets, err := p.getIPNets(address)
+		if err != nil {
+			return "", false, err
+		}
+
+		for _, n := range nets {
+			for _, o := range otherNets {
+				if n.Contains(o.IP) || o.Contains(n.IP) {
+					return address, true, nil
+				}
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// Outside returns the first address that isn't entirely within the addresses of the other parser.
+func (p *Parser) Outside(other *Parser) (string, bool, error) {
+	otherNets, err := other.getAllIPNets()
+	if err != nil {
+		return "", false, err
+	}
+
+	// The adjacent addresses of the other parser are merged, so that they cover a range together
+	var covered spanSet
+	for _, o := range otherNets {
+		covered.insert(span{uint128FromIP(o.IP.Mask(o.Mask)), uint128FromIP(lastIP(o))})
+	}
+
+	for _, address := range p.Addresses {
+		nets, err := p.getIPNets(address)
+		if err != nil {
+			return "", false, err
+		}
+
+		for _, n := range nets {
+			first, last := uint128FromIP(n.IP.Mask(n.Mask)), uint128FromIP(lastIP(n))
+			i := covered.search(first)
+			if i == len(covered) || covered[i].first.cmp(first) > 0 || covered[i].last.cmp(last) < 0 {
+				return address, true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// hostID returns the last octet of an IPv4 address or the interface ID
+// of an IPv6 address, and whether the address is IPv4.
+func hostID(ip net.IP) (uint64, bool) {
+	if v4 := ip.To4(); v4 != nil {
+		return uint64(v4[3]), true
+	}
+
+	var id uint64
+	for _, b := range ip.To16()[8:] {
+		id = id<<8 | uint64(b)
+	}
+	return id, false
+}
+
+func inHostRanges(host uint64, ranges []hostRange) bool {
+	for _, r := range ranges {
+		if host >= r.first && host <= r.last {
 			return true
 		}
 	}
 	return false
 }
 
+func (p *Parser) isGatewayIP(ip net.IP) bool {
+	host, v4 := hostID(ip)
+	if v4 {
+		return inHostRanges(host, ipv4GatewayHosts)
+	}
+	return inHostRanges(host, ipv6GatewayHosts)
+}
+
+func (p *Parser) isBuggyIP(ip net.IP) bool {
+	host, v4 := hostID(ip)
+	if v4 {
+		return inHostRanges(host, ipv4BuggyHosts)
+	}
+	return inHostRanges(host, ipv6BuggyHosts)
+}
+
+func (p *Parser) isAvoided(ip net.IP) bool {
+	if p.AvoidBuggy && p.isBuggyIP(ip) {
+		return true
+	}
+	return p.AvoidGateway && p.isGatewayIP(ip)
+}
+
 func inc(ip net.IP) {
 	for j := len(ip) - 1; j >= 0; j-- {
 		ip[j]++
@@ -106,32 +269,47 @@ func inc(ip net.IP) {
 	}
 }
 
-func (p *Parser) getIPs(ipnet *net.IPNet) []string {
-	var ips []string
+// walk calls fn for every usable address of the given network until fn returns false.
+func (p *Parser) walk(ipnet *net.IPNet, fn func(ip net.IP) bool) bool {
 	for ip := ipnet.IP.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-		if p.AvoidBuggy && p.isBuggyIP(ip.String()) {
+		if p.isAvoided(ip) {
 			continue
 		}
-
-		if p.AvoidGateway && p.isGatewayIP(ip.String()) {
-			continue
+		if !fn(ip) {
+			return false
 		}
-		ips = append(ips, ip.String())
 	}
+	return true
+}
+
+func (p *Parser) getIPs(ipnet *net.IPNet) []string {
+	var ips []string
+	p.walk(ipnet, func(ip net.IP) bool {
+		ips = append(ips, ip.String())
+		return true
+	})
 	return ips
 }
 
+// IPs returns all usable addresses of the pool. It refuses to enumerate
+// pools larger than an IPv4 /8, use NextIP and Capacity for those instead.
 func (p *Parser) IPs() ([]string, error) {
-	var ips []string
-	for _, address := range p.Addresses {
-		nets, err := p.getIPNets(address)
-		if err != nil {
-			return nil, fmt.Errorf("Invalid parse CIDR from %+v address", address)
-		}
+	nets, err := p.getAllIPNets()
+	if err != nil {
+		return nil, err
+	}
 
-		for _, net := range nets {
-			ips = append([]string{}, append(ips, p.getIPs(net)...)...)
-		}
+	total := new(big.Int)
+	for _, n := range nets {
+		total.Add(total, netSize(n))
+	}
+	if total.Cmp(big.NewInt(maxEnumerateIPs)) > 0 {
+		return nil, fmt.Errorf("Too many addresses to enumerate: %s", total.String())
+	}
+
+	var ips []string
+	for _, net := range nets {
+		ips = append([]string{}, append(ips, p.getIPs(net)...)...)
 	}
 	return ips, nil
 }
@@ -145,9 +323,125 @@ func (p *Parser) FilterIPs(filters ...[]string) ([]string, error) {
 	for _, f := range filters {
 		if len(f) > 0 {
 			for _, addr := range f {
+				addr = normalizeIP(addr)
 				ips = funk.FilterString(ips, func(v string) bool { return v != addr })
 			}
 		}
 	}
 	return ips, nil
 }
+
+// NextIP returns the first usable address that isn't in any of the filters.
+func (p *Parser) NextIP(filters ...[]string) (string, error) {
+	a, err := NewAllocator(p)
+	if err != nil {
+		return "", err
+	}
+
+	for _, f := range filters {
+		if err := a.Use(f...); err != nil {
+			return "", err
+		}
+	}
+
+	ip, err := a.Next()
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// Contains reports whether the address is a usable address of the pool.
+func (p *Parser) Contains(addr string) (bool, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false, fmt.Errorf("invalid IP %q", addr)
+	}
+
+	nets, err := p.getAllIPNets()
+	if err != nil {
+		return false, err
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return !p.isAvoided(ip), nil
+		}
+	}
+	return false, nil
+}
+
+// Capacity returns the number of usable addresses that aren't in any of the filters.
+func (p *Parser) Capacity(filters ...[]string) (*big.Int, error) {
+	a, err := NewAllocator(p)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range filters {
+		if err := a.Exclude(f...); err != nil {
+			return nil, err
+		}
+	}
+	return a.Capacity(), nil
+}
+
+// countHosts returns how many values in [first, last] have a remainder
+// of the modulus that falls into the host range.
+func countHosts(first, last, modulus *big.Int, h hostRange) *big.Int {
+	upTo := func(n *big.Int) *big.Int {
+		if n.Sign() < 0 {
+			return new(big.Int)
+		}
+		lo := new(big.Int).SetUint64(h.first)
+		hi := new(big.Int).SetUint64(h.last)
+		width := new(big.Int).Sub(hi, lo)
+		width.Add(width, big.NewInt(1))
+
+		q, r := new(big.Int).DivMod(n, modulus, new(big.Int))
+		count := new(big.Int).Mul(q, width)
+		if r.Cmp(lo) >= 0 {
+			partial := new(big.Int).Sub(r, lo)
+			partial.Add(partial, big.NewInt(1))
+			if partial.Cmp(width) > 0 {
+				partial = width
+			}
+			count.Add(count, partial)
+		}
+		return count
+	}
+
+	before := new(big.Int).Sub(first, big.NewInt(1))
+	return new(big.Int).Sub(upTo(last), upTo(before))
+}
+
+func netSize(n *net.IPNet) *big.Int {
+	ones, bits := n.Mask.Size()
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		return new(big.Int).SetBytes(v4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+func normalizeIP(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// ClampInt converts the value to an int, saturating at the largest int.
+func ClampInt(v *big.Int) int {
+	max := big.NewInt(int64(^uint(0) >> 1))
+	if v.Cmp(max) > 0 {
+		return int(max.Int64())
+	}
+	if v.Sign() < 0 {
+		return 0
+	}
+	return int(v.Int64())
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package ipaddr
 
 import (
+	"math/big"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -43,6 +44,18 @@ func TestIPs(t *testing.T) {
 			Parser: NewParser([]string{"172.22.132.0/30"}, false, false),
 			IPs:    []string{"172.22.132.0", "172.22.132.1", "172.22.132.2", "172.22.132.3"},
 		},
+		{
+			Parser: NewParser([]string{"2001:db8::/126"}, true, true),
+			IPs:    []string{"2001:db8::2", "2001:db8::3"},
+		},
+		{
+			Parser: NewParser([]string{"2001:db8::/126"}, false, false),
+			IPs:    []string{"2001:db8::", "2001:db8::1", "2001:db8::2", "2001:db8::3"},
+		},
+		{
+			Parser: NewParser([]string{"2001:db8::fdff:ffff:ffff:ff7e-2001:db8::fdff:ffff:ffff:ff81"}, true, false),
+			IPs:    []string{"2001:db8::fdff:ffff:ffff:ff7e", "2001:db8::fdff:ffff:ffff:ff7f"},
+		},
 	}
 
 	for _, test := range tests {
@@ -76,3 +89,186 @@ func TestFilterIPs(t *testing.T) {
 		assert.Equal(t, test.IPs, ips)
 	}
 }
+
+func TestIPsTooLarge(t *testing.T) {
+	_, err := NewParser([]string{"2001:db8::/64"}, true, true).IPs()
+	assert.NotNil(t, err)
+}
+
+func TestInvalidAddresses(t *testing.T) {
+	for _, addrs := range [][]string{
+		{"172.22.132.0/33"},
+		{"172.22.132.0-172.22.132.267"},
+		{"172.22.132.0-2001:db8::1"},
+		{"172.22.132.10-172.22.132.1"},
+	} {
+		_, err := NewParser(addrs, true, true).Capacity()
+		assert.NotNil(t, err)
+		assert.NotNil(t, NewParser(addrs, true, true).Validate())
+	}
+	assert.Nil(t, NewParser([]string{"172.22.132.1-172.22.132.1", "2001:db8::/64"}, true, true).Validate())
+}
+
+func TestNextIP(t *testing.T) {
+	tests := []struct {
+		Parser  *Parser
+		Filters [][]string
+		IP      string
+	}{
+		{
+			Parser:  NewParser([]string{"172.22.132.0-172.22.132.5"}, true, true),
+			Filters: [][]string{{"172.22.132.2"}, {"172.22.132.3"}},
+			IP:      "172.22.132.4",
+		},
+		{
+			Parser:  NewParser([]string{"2001:db8::/64"}, true, true),
+			Filters: [][]string{{"2001:db8::2"}, {"2001:db8:0:0::0003"}},
+			IP:      "2001:db8::4",
+		},
+	}
+
+	for _, test := range tests {
+		ip, err := test.Parser.NextIP(test.Filters...)
+		assert.Nil(t, err)
+		assert.Equal(t, test.IP, ip)
+	}
+
+	_, err := NewParser([]string{"172.22.132.0/30"}, true, true).NextIP([]string{"172.22.132.2", "172.22.132.3"})
+	assert.NotNil(t, err)
+}
+
+func TestContains(t *testing.T) {
+	parser := NewParser([]string{"172.22.132.0/24", "2001:db8::/64"}, true, true)
+	tests := []struct {
+		IP       string
+		Expected bool
+	}{
+		{IP: "172.22.132.10", Expected: true},
+		{IP: "172.22.132.254", Expected: false},
+		{IP: "172.22.133.10", Expected: false},
+		{IP: "2001:db8::10", Expected: true},
+		{IP: "2001:db8::", Expected: false},
+		{IP: "2001:db8::1", Expected: false},
+		{IP: "2001:db8::fdff:ffff:ffff:ff80", Expected: false},
+		{IP: "2001:db9::10", Expected: false},
+	}
+
+	for _, test := range tests {
+		ok, err := parser.Contains(test.IP)
+		assert.Nil(t, err)
+		assert.Equal(t, test.Expected, ok, test.IP)
+	}
+
+	_, err := parser.Contains("172.22.132")
+	assert.NotNil(t, err)
+}
+
+func TestInRanges(t *testing.T) {
+	parser := NewParser([]string{"172.22.132.0/24", "2001:db8::/64"}, true, true)
+	for ip, expected := range map[string]bool{
+		"172.22.132.255": true,
+		"172.22.133.10":  false,
+		"2001:db8::1":    true,
+		"2001:db9::10":   false,
+	} {
+		ok, err := parser.InRanges(ip)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, ok, ip)
+	}
+
+	_, err := parser.InRanges("172.22.132")
+	assert.NotNil(t, err)
+}
+
+func TestOverlaps(t *testing.T) {
+	parser := NewParser([]string{"172.22.132.0/24", "172.22.140.10-172.22.140.20"}, false, false)
+	tests := []struct {
+		Addresses []string
+		Address   string
+		Overlap   bool
+	}{
+		{Addresses: []string{"172.22.133.0/24", "2001:db8::/64"}},
+		{Addresses: []string{"172.22.132.128/25"}, Address: "172.22.132.0/24", Overlap: true},
+		{Addresses: []string{"172.22.128.0/20"}, Address: "172.22.132.0/24", Overlap: true},
+		{Addresses: []string{"172.22.140.20-172.22.140.30"}, Address: "172.22.140.10-172.22.140.20", Overlap: true},
+		{Addresses: []string{"172.22.140.21-172.22.140.30"}},
+	}
+
+	for _, test := range tests {
+		address, overlap, err := parser.Overlaps(NewParser(test.Addresses, false, false))
+		assert.Nil(t, err)
+		assert.Equal(t, test.Overlap, overlap, test.Addresses)
+		assert.Equal(t, test.Address, address, test.Addresses)
+	}
+
+	_, _, err := parser.Overlaps(NewParser([]string{"172.22.132.0/33"}, false, false))
+	assert.NotNil(t, err)
+}
+
+func TestOutside(t *testing.T) {
+	parser := NewParser([]string{"172.22.132.0/24", "172.22.133.0-172.22.133.9", "2001:db8::/64"}, false, false)
+	tests := []struct {
+		Addresses []string
+		Address   string
+		Outside   bool
+	}{
+		{Addresses: []string{"172.22.132.16/28", "172.22.132.250-172.22.133.9", "2001:db8::/120"}},
+		{Addresses: []string{"172.22.132.0/23"}, Address: "172.22.132.0/23", Outside: true},
+		{Addresses: []string{"172.22.132.16/28", "172.22.133.5-172.22.133.10"}, Address: "172.22.133.5-172.22.133.10", Outside: true},
+		{Addresses: []string{"2001:db8:1::/120"}, Address: "2001:db8:1::/120", Outside: true},
+	}
+
+	for _, test := range tests {
+		address, outside, err := NewParser(test.Addresses, false, false).Outside(parser)
+		assert.Nil(t, err)
+		assert.Equal(t, test.Outside, outside, test.Addresses)
+		assert.Equal(t, test.Address, address, test.Addresses)
+	}
+
+	_, _, err := NewParser([]string{"172.22.132.0/33"}, false, false).Outside(parser)
+	assert.NotNil(t, err)
+}
+
+func TestCapacity(t *testing.T) {
+	v6, _ := new(big.Int).SetString("18446744073692774270", 10)
+	tests := []struct {
+		Parser   *Parser
+		Filters  []string
+		Capacity *big.Int
+	}{
+		{
+			Parser:   NewParser([]string{"172.22.132.0-172.22.132.5"}, true, false),
+			Capacity: big.NewInt(5),
+		},
+		{
+			Parser:   NewParser([]string{"172.22.132.0-172.22.132.5"}, true, true),
+			Filters:  []string{"172.22.132.1", "172.22.132.4"},
+			Capacity: big.NewInt(3),
+		},
+		{
+			Parser:   NewParser([]string{"172.22.0.0/16"}, true, true),
+			Capacity: big.NewInt(64512),
+		},
+		{
+			Parser:   NewParser([]string{"2001:db8::/120"}, true, true),
+			Filters:  []string{"2001:db8::10"},
+			Capacity: big.NewInt(253),
+		},
+		{
+			Parser:   NewParser([]string{"2001:db8::/64"}, true, true),
+			Capacity: v6,
+		},
+	}
+
+	for _, test := range tests {
+		capacity, err := test.Parser.Capacity(test.Filters)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, test.Capacity.Cmp(capacity), capacity.String())
+	}
+}
+
+func TestClampInt(t *testing.T) {
+	assert.Equal(t, 10, ClampInt(big.NewInt(10)))
+	assert.Equal(t, 0, ClampInt(big.NewInt(-1)))
+	assert.Equal(t, int(^uint(0)>>1), ClampInt(new(big.Int).Lsh(big.NewInt(1), 64)))
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipaddr
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// The names of the allocation strategies.
+const (
+	SequentialStrategy            = "sequential"
+	RandomStrategy                = "random"
+	RoundRobinStrategy            = "round-robin"
+	LeastRecentlyReleasedStrategy = "least-recently-released"
+)
+
+// Strategy picks the next free address of an allocator.
+type Strategy interface {
+	Next(a *Allocator) (net.IP, error)
+}
+
+// History is the allocation activity of a pool that the strategies are based on.
+type History struct {
+	// LastAllocated is the address that was allocated last.
+	LastAllocated string
+	// Released are the released addresses, ordered from the least recently released.
+	Released []string
+}
+
+// NewStrategy creates the strategy of the given name, an empty name means sequential.
+func NewStrategy(name string, history History) (Strategy, error) {
+	switch name {
+	case "", SequentialStrategy:
+		return &Sequential{}, nil
+	case RandomStrategy:
+		return &Random{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	case RoundRobinStrategy:
+		return &RoundRobin{Last: history.LastAllocated}, nil
+	case LeastRecentlyReleasedStrategy:
+		return &LeastRecentlyReleased{Released: history.Released}, nil
+	}
+	return nil, fmt.Errorf("unknown allocation strategy %q", name)
+}
+
+// Sequential picks the first free address in the order of the pool addresses.
+type Sequential struct{}
+
+func (s *Sequential) Next(a *Allocator) (net.IP, error) {
+	return a.Next()
+}
+
+// Random picks a free address at random.
+type Random struct {
+	Rand *rand.Rand
+}
+
+func (s *Random) Next(a *Allocator) (net.IP, error) {
+	return a.NextRandom(s.Rand)
+}
+
+// RoundRobin picks the first free address after the last allocated one, so
+// released addresses aren't reused until the pool wraps around.
+type RoundRobin struct {
+	Last string
+}
+
+func (s *RoundRobin) Next(a *Allocator) (net.IP, error) {
+	return a.NextAfter(s.Last)
+}
+
+// LeastRecentlyReleased picks a free address that has never been released, or
+// else the free address that was released the longest time ago.
+type LeastRecentlyReleased struct {
+	Released []string
+}
+
+func (s *LeastRecentlyReleased) Next(a *Allocator) (net.IP, error) {
+	fresh := a.Clone()
+	if err := fresh.Use(s.Released...); err != nil {
+		return nil, err
+	}
+
+	if ip, err := fresh.Next(); err == nil {
+		return ip, nil
+	}
+
+	for _, addr := range s.Released {
+		if a.IsFree(addr) {
+			return net.ParseIP(addr), nil
+		}
+	}
+	return nil, a.exhausted()
+}
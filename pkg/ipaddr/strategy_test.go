@@ -0,0 +1,133 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipaddr
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStrategy(t *testing.T) {
+	history := History{LastAllocated: "172.22.132.3", Released: []string{"172.22.132.2"}}
+	for _, name := range []string{"", SequentialStrategy, RandomStrategy, RoundRobinStrategy, LeastRecentlyReleasedStrategy} {
+		s, err := NewStrategy(name, history)
+		assert.Nil(t, err)
+		assert.NotNil(t, s)
+	}
+
+	_, err := NewStrategy("unknown", history)
+	assert.NotNil(t, err)
+}
+
+func TestStrategies(t *testing.T) {
+	tests := []struct {
+		Strategy Strategy
+		Use      []string
+		IPs      []string
+	}{
+		{
+			Strategy: &Sequential{},
+			Use:      []string{"172.22.132.3"},
+			IPs:      []string{"172.22.132.1", "172.22.132.2", "172.22.132.4", "172.22.132.5"},
+		},
+		{
+			Strategy: &RoundRobin{Last: "172.22.132.3"},
+			Use:      []string{"172.22.132.3"},
+			IPs:      []string{"172.22.132.4"},
+		},
+		{
+			Strategy: &RoundRobin{Last: "172.22.132.5"},
+			Use:      []string{"172.22.132.1"},
+			IPs:      []string{"172.22.132.2"},
+		},
+		{
+			Strategy: &RoundRobin{Last: "172.22.133.5"},
+			IPs:      []string{"172.22.132.1"},
+		},
+		{
+			Strategy: &LeastRecentlyReleased{Released: []string{"172.22.132.4", "172.22.132.1", "172.22.132.2"}},
+			Use:      []string{"172.22.132.3"},
+			IPs:      []string{"172.22.132.5"},
+		},
+		{
+			Strategy: &LeastRecentlyReleased{Released: []string{"172.22.132.4", "172.22.132.1", "172.22.132.2"}},
+			Use:      []string{"172.22.132.3", "172.22.132.4", "172.22.132.5"},
+			IPs:      []string{"172.22.132.1"},
+		},
+	}
+
+	for _, test := range tests {
+		a, err := NewAllocator(NewParser([]string{"172.22.132.0-172.22.132.5"}, true, false))
+		assert.Nil(t, err)
+		assert.Nil(t, a.Use(test.Use...))
+
+		for _, expected := range test.IPs {
+			ip, err := a.AllocateWith(test.Strategy)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, ip)
+		}
+	}
+}
+
+func TestRoundRobinWraps(t *testing.T) {
+	a, err := NewAllocator(NewParser([]string{"172.22.132.1-172.22.132.3", "172.22.133.1-172.22.133.2"}, false, false))
+	assert.Nil(t, err)
+
+	s := &RoundRobin{}
+	var ips []string
+	for i := 0; i < 5; i++ {
+		ip, err := a.AllocateWith(s)
+		assert.Nil(t, err)
+		ips = append(ips, ip)
+		s.Last = ip
+	}
+	assert.Equal(t, []string{"172.22.132.1", "172.22.132.2", "172.22.132.3", "172.22.133.1", "172.22.133.2"}, ips)
+
+	assert.Nil(t, a.Release("172.22.132.2"))
+	ip, err := a.AllocateWith(s)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.2", ip)
+
+	_, err = a.AllocateWith(s)
+	assert.NotNil(t, err)
+}
+
+func TestRandom(t *testing.T) {
+	a, err := NewAllocator(NewParser([]string{"172.22.132.0/28", "2001:db8::/64"}, true, true))
+	assert.Nil(t, err)
+
+	s := &Random{Rand: rand.New(rand.NewSource(1))}
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		ip, err := a.AllocateWith(s)
+		assert.Nil(t, err)
+		assert.False(t, seen[ip], ip)
+		assert.True(t, a.Contains(ip), ip)
+		seen[ip] = true
+	}
+
+	small, err := NewAllocator(NewParser([]string{"172.22.132.0/29"}, true, true))
+	assert.Nil(t, err)
+	for i := 0; i < 6; i++ {
+		_, err := small.AllocateWith(s)
+		assert.Nil(t, err)
+	}
+	_, err = small.AllocateWith(s)
+	assert.NotNil(t, err)
+}
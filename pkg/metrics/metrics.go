@@ -0,0 +1,198 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "ipam"
+
+	// Path is where the metrics are served
+	Path = "/metrics"
+)
+
+// Reasons of the failed allocations
+const (
+	ReasonExhausted       = "exhausted"
+	ReasonPoolTerminating = "pool_terminating"
+	ReasonParseError      = "parse_error"
+	ReasonRequestedIP     = "requested_ip"
+	ReasonQuotaExceeded   = "quota_exceeded"
+)
+
+var (
+	poolCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "pool",
+		Name:      "capacity",
+		Help:      "Number of usable addresses of the pool.",
+	}, []string{"pool"})
+	poolAllocated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "pool",
+		Name:      "allocated",
+		Help:      "Number of addresses of the pool that are allocated to IPs.",
+	}, []string{"pool"})
+	poolAllocatable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "pool",
+		Name:      "allocatable",
+		Help:      "Number of addresses of the pool that can be allocated.",
+	}, []string{"pool"})
+	poolHeld = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "pool",
+		Name:      "held",
+		Help:      "Number of released addresses of the pool that are still held.",
+	}, []string{"pool"})
+	poolUtilization = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "pool",
+		Name:      "utilization_ratio",
+		Help:      "Ratio of the usable addresses of the pool that can't be allocated.",
+	}, []string{"pool"})
+	poolUtilizationLevel = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "pool",
+		Name:      "utilization_level",
+		Help:      "Utilization thresholds crossed by the pool, 0 below them, 1 over the warning one and 2 over the critical one.",
+	}, []string{"pool"})
+
+	allocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "allocations_total",
+		Help:      "Number of addresses allocated to IPs.",
+	}, []string{"pool"})
+	deallocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deallocations_total",
+		Help:      "Number of addresses released by IPs.",
+	}, []string{"pool"})
+	allocationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "allocation_failures_total",
+		Help:      "Number of IPs that failed to get an address, by reason.",
+	}, []string{"pool", "reason"})
+	allocationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "allocation_duration_seconds",
+		Help:      "Time taken to allocate the addresses of an IP.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"pool"})
+	deallocationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "deallocation_duration_seconds",
+		Help:      "Time taken to release the addresses of an IP.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"pool"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		poolCapacity,
+		poolAllocated,
+		poolAllocatable,
+		poolHeld,
+		poolUtilization,
+		poolUtilizationLevel,
+		allocations,
+		deallocations,
+		allocationFailures,
+		allocationDuration,
+		deallocationDuration,
+	)
+	registerWorkqueueMetrics()
+}
+
+// SetPoolUsage records how the addresses of a pool are used
+func SetPoolUsage(pool string, capacity, allocated, allocatable, held int) {
+	poolCapacity.WithLabelValues(pool).Set(float64(capacity))
+	poolAllocated.WithLabelValues(pool).Set(float64(allocated))
+	poolAllocatable.WithLabelValues(pool).Set(float64(allocatable))
+	poolHeld.WithLabelValues(pool).Set(float64(held))
+}
+
+// DeletePool forgets the usage of a pool that is gone or whose usage is unknown
+func DeletePool(pool string) {
+	poolCapacity.DeleteLabelValues(pool)
+	poolAllocated.DeleteLabelValues(pool)
+	poolAllocatable.DeleteLabelValues(pool)
+	poolHeld.DeleteLabelValues(pool)
+	poolUtilization.DeleteLabelValues(pool)
+	poolUtilizationLevel.DeleteLabelValues(pool)
+}
+
+// SetPoolUtilization records the utilisation of a pool and the thresholds it crossed
+func SetPoolUtilization(pool string, ratio float64, level int) {
+	poolUtilization.WithLabelValues(pool).Set(ratio)
+	poolUtilizationLevel.WithLabelValues(pool).Set(float64(level))
+}
+
+// ObserveAllocation records an allocation of the count of addresses that started at the given time
+func ObserveAllocation(pool string, count int, start time.Time) {
+	allocations.WithLabelValues(pool).Add(float64(count))
+	allocationDuration.WithLabelValues(pool).Observe(time.Since(start).Seconds())
+}
+
+// ObserveDeallocation records a deallocation of the count of addresses that started at the given time
+func ObserveDeallocation(pool string, count int, start time.Time) {
+	deallocations.WithLabelValues(pool).Add(float64(count))
+	deallocationDuration.WithLabelValues(pool).Observe(time.Since(start).Seconds())
+}
+
+// AllocationFailed records an IP that failed to get an address of the pool
+func AllocationFailed(pool, reason string) {
+	allocationFailures.WithLabelValues(pool, reason).Inc()
+}
+
+// Handler returns the handler that serves the metrics
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(Path, promhttp.Handler())
+	return mux
+}
+
+// Serve serves the metrics until the context is done
+func Serve(ctx context.Context, addr string) error {
+	glog.Infof("Starting the metrics server on %s", addr)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: Handler()}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			glog.Errorf("Metrics server got an error: %+v.", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		glog.Info("Stopping the metrics server")
+		server.Close()
+	}()
+	return nil
+}
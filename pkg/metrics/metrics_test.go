@@ -0,0 +1,111 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func scrape(t *testing.T) string {
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + Path)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(body)
+}
+
+func TestPoolUsage(t *testing.T) {
+	SetPoolUsage("test-usage", 254, 10, 240, 4)
+	body := scrape(t)
+	assert.Contains(t, body, `ipam_pool_capacity{pool="test-usage"} 254`)
+	assert.Contains(t, body, `ipam_pool_allocated{pool="test-usage"} 10`)
+	assert.Contains(t, body, `ipam_pool_allocatable{pool="test-usage"} 240`)
+	assert.Contains(t, body, `ipam_pool_held{pool="test-usage"} 4`)
+
+	SetPoolUtilization("test-usage", 0.5, 1)
+	body = scrape(t)
+	assert.Contains(t, body, `ipam_pool_utilization_ratio{pool="test-usage"} 0.5`)
+	assert.Contains(t, body, `ipam_pool_utilization_level{pool="test-usage"} 1`)
+
+	DeletePool("test-usage")
+	assert.NotContains(t, scrape(t), `pool="test-usage"`)
+}
+
+func TestAllocations(t *testing.T) {
+	for _, vec := range []interface{ Reset() }{allocations, deallocations, allocationFailures, allocationDuration, deallocationDuration} {
+		vec.Reset()
+	}
+
+	start := time.Now()
+	ObserveAllocation("test-allocations", 1, start)
+	ObserveAllocation("test-allocations", 3, start)
+	ObserveDeallocation("test-allocations", 2, start)
+	AllocationFailed("test-allocations", ReasonExhausted)
+
+	body := scrape(t)
+	assert.Contains(t, body, `ipam_allocations_total{pool="test-allocations"} 4`)
+	assert.Contains(t, body, `ipam_deallocations_total{pool="test-allocations"} 2`)
+	assert.Contains(t, body, `ipam_allocation_failures_total{pool="test-allocations",reason="exhausted"} 1`)
+	assert.Contains(t, body, `ipam_allocation_duration_seconds_count{pool="test-allocations"} 2`)
+	assert.Contains(t, body, `ipam_deallocation_duration_seconds_count{pool="test-allocations"} 1`)
+}
+
+func TestWorkqueue(t *testing.T) {
+	workqueueDepth.Reset()
+	workqueueAdds.Reset()
+	workqueueRetries.Reset()
+	workqueueWorkDuration.Reset()
+
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "test-queue")
+	defer queue.ShutDown()
+
+	queue.Add("a")
+	queue.Add("b")
+	item, _ := queue.Get()
+	queue.Done(item)
+
+	// The retried items are only counted once they are added back after a delay
+	retries := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "test-retries")
+	defer retries.ShutDown()
+	retries.AddRateLimited("a")
+
+	body := scrape(t)
+	assert.Contains(t, body, `ipam_workqueue_depth{name="test-queue"} 1`)
+	assert.Contains(t, body, `ipam_workqueue_adds_total{name="test-queue"} 2`)
+	assert.Contains(t, body, `ipam_workqueue_retries_total{name="test-retries"} 1`)
+	assert.Contains(t, body, `ipam_workqueue_work_duration_seconds_count{name="test-queue"} 1`)
+}
+
+func TestServe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, Serve(ctx, "127.0.0.1:0"))
+	assert.NotNil(t, Serve(ctx, "127.0.0.1:-1"))
+}
@@ -0,0 +1,223 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blended "github.com/inwinstack/blended/generated/clientset/versioned"
+	informerv1 "github.com/inwinstack/blended/generated/informers/externalversions/inwinstack/v1"
+	listerv1 "github.com/inwinstack/blended/generated/listers/inwinstack/v1"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	"github.com/inwinstack/ipam/pkg/config"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// orphan is an allocation whose IP went missing
+type orphan struct {
+	ip       ipamv1.IPReference
+	since    time.Time
+	reported bool
+}
+
+// Collector represents the garbage collector of the allocations whose IP no longer exists
+type Collector struct {
+	blendedset       blended.Interface
+	allocations      client.AllocationInterface
+	ipLister         listerv1.IPLister
+	poolLister       listerv1.PoolLister
+	allocationLister client.AllocationLister
+	synced           []cache.InformerSynced
+	recorder         record.EventRecorder
+	cfg              *config.Config
+	orphans          map[string]*orphan
+}
+
+// NewCollector creates an instance of the garbage collector
+func NewCollector(
+	blendedset blended.Interface,
+	allocations client.AllocationInterface,
+	ipInformer informerv1.IPInformer,
+	poolInformer informerv1.PoolInformer,
+	allocationInformer client.AllocationInformer,
+	recorder record.EventRecorder,
+	cfg *config.Config) *Collector {
+	return &Collector{
+		blendedset:       blendedset,
+		allocations:      allocations,
+		ipLister:         ipInformer.Lister(),
+		poolLister:       poolInformer.Lister(),
+		allocationLister: allocationInformer.Lister(),
+		synced: []cache.InformerSynced{
+			ipInformer.Informer().HasSynced,
+			poolInformer.Informer().HasSynced,
+			allocationInformer.Informer().HasSynced,
+		},
+		recorder: recorder,
+		cfg:      cfg,
+		orphans:  map[string]*orphan{},
+	}
+}
+
+// Run serves the garbage collector
+func (c *Collector) Run(ctx context.Context) error {
+	glog.Info("Starting the garbage collector")
+	glog.Info("Waiting for the garbage collector caches to sync")
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.synced...); !ok {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+
+	go wait.Until(c.collect, c.cfg.GCPeriod, ctx.Done())
+	return nil
+}
+
+// Stop stops the garbage collector
+func (c *Collector) Stop() {
+	glog.Info("Stopping the garbage collector")
+}
+
+func (c *Collector) collect() {
+	defer utilruntime.HandleCrash()
+	allocations, err := c.allocationLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	now := time.Now()
+	orphans := map[string]*orphan{}
+	for _, allocation := range allocations {
+		if allocation.Status.Phase != ipamv1.AllocationActive || !c.isOrphaned(allocation) {
+			continue
+		}
+
+		// The grace period starts over when the allocation changes hands
+		o, ok := c.orphans[allocation.Name]
+		if !ok || o.ip != allocation.Spec.IP {
+			o = &orphan{ip: allocation.Spec.IP, since: now}
+		}
+		orphans[allocation.Name] = o
+
+		if now.Sub(o.since) < c.cfg.GCGrace {
+			continue
+		}
+
+		reclaimed, err := c.reclaim(allocation, o)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("GC error reclaiming '%s': %s", allocation.Spec.Address, err.Error()))
+			continue
+		}
+
+		if reclaimed {
+			delete(orphans, allocation.Name)
+		}
+	}
+	c.orphans = orphans
+}
+
+// isOrphaned checks if the IP of the allocation is missing from the cache. The allocations
+// migrated without an IP are never orphaned.
+func (c *Collector) isOrphaned(allocation *ipamv1.Allocation) bool {
+	ref := allocation.Spec.IP
+	if ref.Name == "" {
+		return allocation.Labels[ipamconstants.MigratedLabelKey] != "true"
+	}
+
+	ip, err := c.ipLister.IPs(ref.Namespace).Get(ref.Name)
+	if err != nil {
+		return errors.IsNotFound(err)
+	}
+	return isReplaced(ip, ref)
+}
+
+// isReplaced checks if the IP was recreated after it claimed the address.
+func isReplaced(ip *blendedv1.IP, ref ipamv1.IPReference) bool {
+	return ref.UID != "" && ip.UID != "" && ip.UID != ref.UID
+}
+
+func owner(ref ipamv1.IPReference) string {
+	if ref.Name == "" {
+		return "no IP"
+	}
+	return fmt.Sprintf("the missing IP \"%s/%s\"", ref.Namespace, ref.Name)
+}
+
+// reclaim releases the address of the missing IP, it returns false if the IP turned out to exist.
+func (c *Collector) reclaim(allocation *ipamv1.Allocation, o *orphan) (bool, error) {
+	ref := allocation.Spec.IP
+	if ref.Name != "" {
+		// The cache may lag behind, so the IP must be gone from the API server as well
+		ip, err := c.blendedset.InwinstackV1().IPs(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+		if err == nil && !isReplaced(ip, ref) {
+			return false, nil
+		}
+
+		if err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+
+	pool, err := c.poolLister.Get(allocation.Spec.PoolName)
+	if err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	if c.cfg.GCDryRun {
+		if !o.reported {
+			glog.Infof("GC dry run: address %s of the \"%s\" pool is held by %s.", allocation.Spec.Address, allocation.Spec.PoolName, owner(ref))
+			c.event(pool, corev1.EventTypeWarning, ipamconstants.OrphanDetectedReason,
+				"Address %s is held by %s, and would be reclaimed", allocation.Spec.Address, owner(ref))
+			o.reported = true
+		}
+		return false, nil
+	}
+
+	var hold time.Duration
+	if pool != nil {
+		hold, _ = util.ReleaseHoldTime(pool)
+	}
+
+	if err := util.ReleaseAllocation(c.allocations, allocation, hold); err != nil {
+		return false, err
+	}
+
+	glog.Infof("GC reclaimed address %s of the \"%s\" pool held by %s.", allocation.Spec.Address, allocation.Spec.PoolName, owner(ref))
+	c.event(pool, corev1.EventTypeNormal, ipamconstants.OrphanReclaimedReason,
+		"Reclaimed address %s held by %s", allocation.Spec.Address, owner(ref))
+	return true, nil
+}
+
+func (c *Collector) event(pool *blendedv1.Pool, eventtype, reason, messageFmt string, args ...interface{}) {
+	if pool == nil || c.recorder == nil {
+		return
+	}
+	c.recorder.Eventf(pool, eventtype, reason, messageFmt, args...)
+}
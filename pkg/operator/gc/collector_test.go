@@ -0,0 +1,189 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
+	blendedinformers "github.com/inwinstack/blended/generated/informers/externalversions"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	"github.com/inwinstack/ipam/pkg/config"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const timeout = 3 * time.Second
+
+func newCollector(ctx context.Context, t *testing.T, cfg *config.Config) (*Collector, *blendedfake.Clientset, client.AllocationInterface, *record.FakeRecorder) {
+	blendedset := blendedfake.NewSimpleClientset()
+	allocations := client.NewAllocations(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+	informer := blendedinformers.NewSharedInformerFactory(blendedset, 0)
+	allocationInformer := client.NewAllocationInformer(allocations, 0)
+	recorder := record.NewFakeRecorder(10)
+
+	collector := NewCollector(
+		blendedset,
+		allocations,
+		informer.Inwinstack().V1().IPs(),
+		informer.Inwinstack().V1().Pools(),
+		allocationInformer,
+		recorder,
+		cfg)
+	go informer.Start(ctx.Done())
+	go allocationInformer.Informer().Run(ctx.Done())
+	// The tests collect by themselves, so the periodic collection isn't started
+	assert.True(t, cache.WaitForCacheSync(ctx.Done(), collector.synced...))
+	return collector, blendedset, allocations, recorder
+}
+
+// setup creates a pool with an address of an existing IP and an address of a missing IP,
+// and waits for the caches to see them.
+func setup(t *testing.T, collector *Collector, blendedset *blendedfake.Clientset, allocations client.AllocationInterface) {
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-gc"},
+		Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.132.0/24"}},
+	}
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	ip := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: "default"},
+		Spec:       blendedv1.IPSpec{PoolName: pool.Name},
+		Status:     blendedv1.IPStatus{Phase: blendedv1.IPActive, Address: "172.22.132.1"},
+	}
+	_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+	assert.Nil(t, err)
+
+	missing := &blendedv1.IP{ObjectMeta: metav1.ObjectMeta{Name: "test-missing", Namespace: "default"}}
+	for address, owner := range map[string]*blendedv1.IP{"172.22.132.1": ip, "172.22.132.2": missing} {
+		allocation, err := util.NewAllocation(pool.Name, address, owner)
+		assert.Nil(t, err)
+		_, err = allocations.Create(allocation)
+		assert.Nil(t, err)
+	}
+
+	for start := time.Now(); time.Since(start) < timeout; {
+		cached, _ := collector.allocationLister.List(labels.Everything())
+		_, err := collector.poolLister.Get(pool.Name)
+		_, ierr := collector.ipLister.IPs(ip.Namespace).Get(ip.Name)
+		if len(cached) == 2 && err == nil && ierr == nil {
+			break
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Config{GCPeriod: time.Hour, GCGrace: time.Hour}
+	collector, blendedset, allocations, recorder := newCollector(ctx, t, cfg)
+	setup(t, collector, blendedset, allocations)
+
+	// The address is kept during the grace period
+	collector.collect()
+	assert.Equal(t, 1, len(collector.orphans))
+	_, err := allocations.Get("172.22.132.2", metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	// The address is reclaimed once the grace period is over
+	collector.orphans["172.22.132.2"].since = time.Now().Add(-cfg.GCGrace)
+	collector.collect()
+	assert.Equal(t, 0, len(collector.orphans))
+
+	_, err = allocations.Get("172.22.132.2", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	_, err = allocations.Get("172.22.132.1", metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	event := <-recorder.Events
+	assert.True(t, strings.HasPrefix(event, "Normal "+ipamconstants.OrphanReclaimedReason))
+	assert.Contains(t, event, "default/test-missing")
+}
+
+func TestCollectHold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Config{GCPeriod: time.Hour}
+	collector, blendedset, allocations, _ := newCollector(ctx, t, cfg)
+
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-gc",
+			Annotations: map[string]string{ipamconstants.ReleaseHoldTimeKey: "1h"},
+		},
+	}
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	// The leaked address has no IP at all
+	allocation, err := util.NewAllocation(pool.Name, "172.22.132.2", nil)
+	assert.Nil(t, err)
+	_, err = allocations.Create(allocation)
+	assert.Nil(t, err)
+
+	for start := time.Now(); time.Since(start) < timeout; {
+		cached, _ := collector.allocationLister.List(labels.Everything())
+		_, err := collector.poolLister.Get(pool.Name)
+		if len(cached) == 1 && err == nil {
+			break
+		}
+	}
+
+	collector.collect()
+	held, err := allocations.Get(allocation.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, ipamv1.AllocationReleasing, held.Status.Phase)
+	assert.True(t, util.IsHeld(held, time.Now()))
+}
+
+func TestCollectDryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Config{GCPeriod: time.Hour, GCDryRun: true}
+	collector, blendedset, allocations, recorder := newCollector(ctx, t, cfg)
+	setup(t, collector, blendedset, allocations)
+
+	// The address is only reported once
+	collector.collect()
+	collector.collect()
+	assert.Equal(t, 1, len(collector.orphans))
+	assert.Equal(t, 1, len(recorder.Events))
+
+	event := <-recorder.Events
+	assert.True(t, strings.HasPrefix(event, "Warning "+ipamconstants.OrphanDetectedReason))
+
+	list, err := allocations.List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(list.Items))
+}
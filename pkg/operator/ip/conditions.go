@@ -0,0 +1,94 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ip
+
+import (
+	"fmt"
+	"strings"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// allocatedCondition returns the Allocated condition of the IP, which waits for an address
+// until it gets one.
+func allocatedCondition(ip *blendedv1.IP) ipamv1.Condition {
+	if ip.Status.Address == "" {
+		return ipamv1.Condition{
+			Type:    ipamv1.IPAllocated,
+			Status:  corev1.ConditionFalse,
+			Reason:  ipamconstants.PendingReason,
+			Message: fmt.Sprintf("Waiting for an address of the \"%s\" pool", util.IPPool(ip)),
+		}
+	}
+
+	return ipamv1.Condition{
+		Type:    ipamv1.IPAllocated,
+		Status:  corev1.ConditionTrue,
+		Reason:  ipamconstants.AllocatedReason,
+		Message: fmt.Sprintf("Allocated %s of the \"%s\" pool", describeAddresses(util.IPAddresses(ip)), util.IPPool(ip)),
+	}
+}
+
+// describeAddresses describes the addresses of an IP for the events and conditions.
+func describeAddresses(addresses []string) string {
+	if len(addresses) == 1 {
+		return "address " + addresses[0]
+	}
+	return "addresses " + strings.Join(addresses, ", ")
+}
+
+// poolAvailableCondition returns the PoolAvailable condition for the pool of an IP, the
+// pool is nil when it doesn't exist.
+func poolAvailableCondition(name string, pool *blendedv1.Pool) ipamv1.Condition {
+	condition := ipamv1.Condition{Type: ipamv1.IPPoolAvailable, Status: corev1.ConditionFalse}
+	switch {
+	case pool == nil:
+		condition.Reason = ipamconstants.PoolNotFoundReason
+		condition.Message = fmt.Sprintf("The \"%s\" pool doesn't exist", name)
+	case pool.Status.Phase == blendedv1.PoolActive:
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = ipamconstants.PoolActiveReason
+		condition.Message = fmt.Sprintf("The \"%s\" pool is active", name)
+	case pool.Status.Phase == blendedv1.PoolTerminating:
+		condition.Reason = ipamconstants.PoolTerminatingReason
+		condition.Message = fmt.Sprintf("The \"%s\" pool has been terminated", name)
+	default:
+		condition.Reason = ipamconstants.PoolNotReadyReason
+		condition.Message = fmt.Sprintf("The \"%s\" pool isn't ready", name)
+	}
+	return condition
+}
+
+// setConditions sets the conditions of the IP for the pool. It returns whether they changed.
+func setConditions(ip *blendedv1.IP, pool *blendedv1.Pool, allocated ipamv1.Condition) bool {
+	// The conditions are rebuilt if they can't be read
+	conditions, _ := util.Conditions(ip.ObjectMeta)
+	name := util.IPPool(ip)
+	if pool != nil {
+		name = pool.Name
+	}
+	available := poolAvailableCondition(name, pool)
+	if !util.ObserveConditions(&conditions, ip.Generation, allocated, available) {
+		return false
+	}
+	util.SetConditions(&ip.ObjectMeta, conditions)
+	return true
+}
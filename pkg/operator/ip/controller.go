@@ -17,8 +17,13 @@ limitations under the License.
 package ip
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/thoas/go-funk"
@@ -30,43 +35,90 @@ import (
 	informerv1 "github.com/inwinstack/blended/generated/informers/externalversions/inwinstack/v1"
 	listerv1 "github.com/inwinstack/blended/generated/listers/inwinstack/v1"
 	"github.com/inwinstack/blended/k8sutil"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
 	"github.com/inwinstack/ipam/pkg/ipaddr"
+	"github.com/inwinstack/ipam/pkg/metrics"
+	"github.com/inwinstack/ipam/pkg/util"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformerv1 "k8s.io/client-go/informers/core/v1"
+	corelisterv1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/client-go/util/workqueue"
 )
 
+// maxClaimAttempts bounds how many addresses claimed by others are skipped in a row
+const maxClaimAttempts = 16
+
 // Controller represents the controller of ip
 type Controller struct {
-	blendedset blended.Interface
-	lister     listerv1.IPLister
-	synced     cache.InformerSynced
-	queue      workqueue.RateLimitingInterface
+	blendedset       blended.Interface
+	allocations      client.AllocationInterface
+	conditions       client.ConditionsInterface
+	lister           listerv1.IPLister
+	allocationLister client.AllocationLister
+	quotaLister      client.PoolQuotaLister
+	namespaceLister  corelisterv1.NamespaceLister
+	synced           []cache.InformerSynced
+	queue            workqueue.RateLimitingInterface
+	recorder         record.EventRecorder
+	pools            *util.KeyMutex
+}
+
+// eventReasons maps the reasons of the failed allocations to the reasons of their events
+var eventReasons = map[string]string{
+	metrics.ReasonExhausted:       ipamconstants.PoolExhaustedReason,
+	metrics.ReasonPoolTerminating: ipamconstants.PoolTerminatingReason,
+	metrics.ReasonParseError:      ipamconstants.InvalidAddressesReason,
+	metrics.ReasonRequestedIP:     ipamconstants.RequestedIPUnavailableReason,
+	metrics.ReasonQuotaExceeded:   ipamconstants.QuotaExceededReason,
 }
 
 // NewController creates an instance of the ip controller
-func NewController(blendedset blended.Interface, informer informerv1.IPInformer) *Controller {
+func NewController(
+	blendedset blended.Interface,
+	allocations client.AllocationInterface,
+	conditions client.ConditionsInterface,
+	informer informerv1.IPInformer,
+	allocationInformer client.AllocationInformer,
+	quotaInformer client.PoolQuotaInformer,
+	namespaceInformer coreinformerv1.NamespaceInformer,
+	recorder record.EventRecorder,
+	pools *util.KeyMutex) *Controller {
 	controller := &Controller{
-		blendedset: blendedset,
-		lister:     informer.Lister(),
-		synced:     informer.Informer().HasSynced,
-		queue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "IPs"),
+		blendedset:       blendedset,
+		allocations:      allocations,
+		conditions:       conditions,
+		lister:           informer.Lister(),
+		allocationLister: allocationInformer.Lister(),
+		quotaLister:      quotaInformer.Lister(),
+		namespaceLister:  namespaceInformer.Lister(),
+		synced: []cache.InformerSynced{
+			informer.Informer().HasSynced,
+			allocationInformer.Informer().HasSynced,
+			quotaInformer.Informer().HasSynced,
+			namespaceInformer.Informer().HasSynced,
+		},
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "IPs"),
+		recorder: recorder,
+		pools:    pools,
 	}
 	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: controller.enqueue,
-		UpdateFunc: func(old, new interface{}) {
-			oo := old.(*blendedv1.IP)
-			no := new.(*blendedv1.IP)
-			k8sutil.MakeNeedToUpdate(&no.ObjectMeta, oo.Spec, no.Spec)
-			if k8sutil.IsNeedToUpdate(no.ObjectMeta) {
-				// Don't change the IP pool name
-				no.Spec.PoolName = oo.Spec.PoolName
-			}
-			controller.enqueue(no)
-		},
+		AddFunc:    controller.enqueue,
+		UpdateFunc: func(old, new interface{}) { controller.enqueue(new) },
+	})
+	allocationInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueueAllocationIP,
+		UpdateFunc: func(old, new interface{}) { controller.enqueueAllocationIP(new) },
 	})
 	return controller
 }
@@ -75,7 +127,7 @@ func NewController(blendedset blended.Interface, informer informerv1.IPInformer)
 func (c *Controller) Run(ctx context.Context, threadiness int) error {
 	glog.Info("Starting the ip controller")
 	glog.Info("Waiting for the ip informer caches to sync")
-	if ok := cache.WaitForCacheSync(ctx.Done(), c.synced); !ok {
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.synced...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
@@ -138,6 +190,19 @@ func (c *Controller) enqueue(obj interface{}) {
 	c.queue.Add(key)
 }
 
+// enqueueAllocationIP enqueues the IP that owns the allocation, so that a stale allocation gets released
+func (c *Controller) enqueueAllocationIP(obj interface{}) {
+	allocation, ok := obj.(*ipamv1.Allocation)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("IP expected an allocation but got %#v", obj))
+		return
+	}
+
+	if allocation.Spec.IP.Name != "" && allocation.Status.Phase == ipamv1.AllocationActive {
+		c.queue.Add(client.IPKey(allocation.Spec.IP.Namespace, allocation.Spec.IP.Name))
+	}
+}
+
 func (c *Controller) reconcile(key string) error {
 	namespace, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
@@ -148,8 +213,9 @@ func (c *Controller) reconcile(key string) error {
 	ip, err := c.lister.IPs(namespace).Get(name)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			utilruntime.HandleError(fmt.Errorf("ip '%s' in work queue no longer exists", key))
-			return err
+			// The deleted IP is still enqueued by its allocations, which is fine
+			glog.V(2).Infof("IP '%s' in work queue no longer exists.", key)
+			return nil
 		}
 		return err
 	}
@@ -162,13 +228,48 @@ func (c *Controller) reconcile(key string) error {
 		return err
 	}
 
+	if isPoolChanged(ip) {
+		return c.poolChanged(ip)
+	}
+
 	need := k8sutil.IsNeedToUpdate(ip.ObjectMeta)
 	if ip.Status.Phase != blendedv1.IPActive || need {
 		if err := c.allocate(ip); err != nil {
 			return err
 		}
+		return nil
 	}
-	return nil
+
+	if err := c.syncConditions(ip); err != nil {
+		return err
+	}
+	return c.releaseStale(ip)
+}
+
+// isPoolChanged checks if the pool of the IP no longer is the pool it got its addresses from.
+// The IPs that select their pools by labels can't tell.
+func isPoolChanged(ip *blendedv1.IP) bool {
+	if ip.Status.Address == "" {
+		return false
+	}
+
+	if _, ok := ip.Annotations[ipamconstants.PoolSelectorKey]; ok {
+		return false
+	}
+
+	pool := util.IPPool(ip)
+	return pool != ip.Spec.PoolName && !funk.ContainsString(util.FallbackPools(ip), pool)
+}
+
+// poolChanged fails the IP whose pool changed, which the webhook denies when it's enabled, and
+// releases its addresses. The IP then gets the addresses of its new pool.
+func (c *Controller) poolChanged(ip *blendedv1.IP) error {
+	ipCopy := ip.DeepCopy()
+	e := fmt.Errorf("The pool of the IP changed from \"%s\" to \"%s\"", util.IPPool(ip), ip.Spec.PoolName)
+	if err := c.makeFailedStatus(ipCopy, nil, ipamconstants.PoolChangedReason, e); err != nil {
+		return err
+	}
+	return c.releaseStale(ipCopy)
 }
 
 func (c *Controller) checkAndUdateFinalizer(ip *blendedv1.IP) error {
@@ -176,36 +277,628 @@ func (c *Controller) checkAndUdateFinalizer(ip *blendedv1.IP) error {
 	ok := funk.ContainsString(ipCopy.Finalizers, constants.CustomFinalizer)
 	if ipCopy.Status.Phase == blendedv1.IPActive && !ok {
 		k8sutil.AddFinalizer(&ipCopy.ObjectMeta, constants.CustomFinalizer)
-		if _, err := c.blendedset.InwinstackV1().IPs(ipCopy.Namespace).Update(ipCopy); err != nil {
+		return c.updateIP(ipCopy)
+	}
+	return nil
+}
+
+// syncConditions refreshes the conditions of an allocated IP as its pool changes.
+func (c *Controller) syncConditions(ip *blendedv1.IP) error {
+	pool, err := c.blendedset.InwinstackV1().Pools().Get(util.IPPool(ip), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		pool = nil
+	} else if err != nil {
+		return err
+	}
+
+	ipCopy := ip.DeepCopy()
+	if !setConditions(ipCopy, pool, allocatedCondition(ipCopy)) {
+		return nil
+	}
+	return c.updateIP(ipCopy)
+}
+
+// updatePool applies the change to the latest version of the pool. The update is conditional
+// on the resourceVersion, so the change is retried on conflicts.
+func (c *Controller) updatePool(name string, change func(pool *blendedv1.Pool)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pool, err := c.blendedset.InwinstackV1().Pools().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		change(pool)
+		pool.Status.LastUpdateTime = metav1.Now()
+		updated, err := c.blendedset.InwinstackV1().Pools().Update(pool)
+		if err != nil {
+			return err
+		}
+		c.mirror(client.PoolResource, updated.ObjectMeta)
+		return nil
+	})
+}
+
+// mirror mirrors the conditions of the object into its status. The conditions are kept in
+// the annotation, so a failed mirror is fixed by the next update.
+func (c *Controller) mirror(resource schema.GroupVersionResource, meta metav1.ObjectMeta) {
+	if err := c.conditions.Mirror(resource, meta); err != nil {
+		glog.Warningf("Failed to mirror the conditions of %s \"%s\": %+v.", resource.Resource, meta.Name, err)
+	}
+}
+
+// poolConflict reports the pool updates of the IP that kept conflicting.
+func (c *Controller) poolConflict(ip *blendedv1.IP, pool string, err error) {
+	if errors.IsConflict(err) {
+		c.recorder.Eventf(ip, corev1.EventTypeWarning, ipamconstants.UpdateConflictReason,
+			"Failed to update the \"%s\" pool: %s", pool, err.Error())
+	}
+}
+
+// updateIP writes the IP and mirrors its conditions, and reports the conflicts that requeue it.
+func (c *Controller) updateIP(ip *blendedv1.IP) error {
+	updated, err := c.blendedset.InwinstackV1().IPs(ip.Namespace).Update(ip)
+	if err != nil {
+		if errors.IsConflict(err) {
+			c.recorder.Eventf(ip, corev1.EventTypeWarning, ipamconstants.UpdateConflictReason, "Failed to update the IP: %s", err.Error())
+		}
+		return err
+	}
+	c.mirror(client.IPResource, updated.ObjectMeta)
+	return nil
+}
+
+// allocationError is an error that fails the IP instead of requeuing it
+type allocationError struct {
+	error
+	reason string
+}
+
+func (c *Controller) newAllocator(pool *blendedv1.Pool) (*ipaddr.Allocator, error) {
+	prefixes, err := util.DelegatedPrefixes(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	allocations, err := c.allocationLister.ByPool(pool.Name)
+	if err != nil {
+		return nil, err
+	}
+	return util.NewPoolAllocator(pool, prefixes, allocations)
+}
+
+// ownedAddresses returns the addresses of the pool that are already allocated to the IP, in
+// the order of the addresses. The addresses that the pool no longer covers are left for the
+// pool controller to release.
+func (c *Controller) ownedAddresses(ip *blendedv1.IP, pool *blendedv1.Pool) ([]string, error) {
+	allocations, err := c.allocationLister.ByIP(ip.Namespace, ip.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	stranded, err := util.StrandedAllocations(pool, allocations)
+	if err != nil {
+		return nil, err
+	}
+
+	isStranded := make(map[string]bool, len(stranded))
+	for _, allocation := range stranded {
+		isStranded[allocation.Name] = true
+	}
+
+	addresses := []string{}
+	for _, allocation := range allocations {
+		if isStranded[allocation.Name] {
+			continue
+		}
+
+		if allocation.Spec.PoolName == pool.Name && util.IsOwnedBy(allocation, ip) && allocation.Status.Phase == ipamv1.AllocationActive {
+			addresses = append(addresses, allocation.Spec.Address)
+		}
+	}
+	sortAddresses(addresses)
+	return addresses, nil
+}
+
+// sortAddresses sorts the addresses in numerical order.
+func sortAddresses(addresses []string) {
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(addresses[i]).To16(), net.ParseIP(addresses[j]).To16()) < 0
+	})
+}
+
+// isContiguous reports whether the sorted addresses are consecutive.
+func isContiguous(addresses []string) bool {
+	for i := 1; i < len(addresses); i++ {
+		next := net.ParseIP(addresses[i-1]).To16()
+		for j := len(next) - 1; j >= 0; j-- {
+			next[j]++
+			if next[j] != 0 {
+				break
+			}
+		}
+
+		if !next.Equal(net.ParseIP(addresses[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// adopt returns the addresses already allocated to the IP if they satisfy it, otherwise it
+// releases them so that the IP gets all of its addresses at once.
+func (c *Controller) adopt(ip *blendedv1.IP, pool *blendedv1.Pool, count int, contiguous bool) ([]string, error) {
+	owned, err := c.ownedAddresses(ip, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(owned) >= count && (!contiguous || isContiguous(owned[:count])) {
+		return owned[:count], nil
+	}
+	return nil, c.unclaim(ip, pool, owned)
+}
+
+// claim creates the allocation of the address for the IP. It returns false if another IP
+// has already claimed the address.
+func (c *Controller) claim(ip *blendedv1.IP, pool *blendedv1.Pool, address string) (bool, error) {
+	allocation, err := util.NewAllocation(pool.Name, address, ip)
+	if err != nil {
+		return false, err
+	}
+
+	for i := 0; i < maxClaimAttempts; i++ {
+		_, err := c.allocations.Create(allocation)
+		if !errors.IsAlreadyExists(err) {
+			return err == nil, err
+		}
+
+		existing, err := c.allocations.Get(allocation.Name, metav1.GetOptions{})
+		switch {
+		case errors.IsNotFound(err):
+			continue
+		case err != nil:
+			return false, err
+		case existing.Spec.PoolName == pool.Name && util.IsOwnedBy(existing, ip) && existing.Status.Phase == ipamv1.AllocationActive:
+			return true, nil
+		case existing.Spec.PoolName == pool.Name && existing.Status.Phase == ipamv1.AllocationActive && existing.Spec.IP.Name == "":
+			// The address was leaked by an IP that no longer exists
+			existing.Spec.IP = allocation.Spec.IP
+			existing.Status.LastUpdateTime = metav1.Now()
+			if _, err := c.allocations.Update(existing); err != nil && !errors.IsConflict(err) {
+				return false, err
+			}
+			continue
+		case existing.Status.Phase != ipamv1.AllocationReleasing || util.IsHeld(existing, time.Now()):
+			return false, nil
+		}
+
+		// The hold time of the released address is over
+		uid := existing.UID
+		err = c.allocations.Delete(existing.Name, &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+		if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// unclaim deletes the allocations of the addresses that the IP claimed.
+func (c *Controller) unclaim(ip *blendedv1.IP, pool *blendedv1.Pool, addresses []string) error {
+	for _, address := range addresses {
+		name, err := ipamv1.AllocationName(address)
+		if err != nil {
+			return err
+		}
+
+		allocation, err := c.allocations.Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if !util.IsOwnedBy(allocation, ip) || allocation.Spec.PoolName != pool.Name {
+			continue
+		}
+
+		uid := allocation.UID
+		opts := &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}}
+		if err := c.allocations.Delete(name, opts); err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Controller) updatePool(pool *blendedv1.Pool) error {
-	pool.Status.LastUpdateTime = metav1.Now()
-	if _, err := c.blendedset.InwinstackV1().Pools().Update(pool); err != nil {
+// exhausted returns the error of a pool that can't give the addresses to an IP.
+func exhausted(pool *blendedv1.Pool, count int, contiguous bool) error {
+	switch {
+	case contiguous && count > 1:
+		return &allocationError{fmt.Errorf("The \"%s\" pool doesn't have %d contiguous addresses left", pool.Name, count), metrics.ReasonExhausted}
+	case count > 1:
+		return &allocationError{fmt.Errorf("The \"%s\" pool doesn't have %d addresses left", pool.Name, count), metrics.ReasonExhausted}
+	}
+	return &allocationError{fmt.Errorf("The \"%s\" pool has been exhausted", pool.Name), metrics.ReasonExhausted}
+}
+
+// reserve claims the addresses of the pool for the IP, either the requested one or the ones
+// picked by the allocation strategy of the pool. The IP gets all of its addresses or none.
+func (c *Controller) reserve(ip *blendedv1.IP, pool *blendedv1.Pool, count int, contiguous bool) ([]string, error) {
+	if err := c.checkQuotas(ip, pool, count); err != nil {
+		return nil, err
+	}
+
+	allocator, err := c.newAllocator(pool)
+	if err != nil {
+		return nil, &allocationError{err, metrics.ReasonParseError}
+	}
+
+	if _, ok := ip.Annotations[ipamconstants.RequestedIPKey]; ok {
+		if count > 1 {
+			err := fmt.Errorf("The requested IP can't be combined with an address count of %d", count)
+			return nil, &allocationError{err, metrics.ReasonRequestedIP}
+		}
+
+		address, err := c.checkRequestedIP(ip, pool, allocator)
+		if err != nil {
+			return nil, &allocationError{err, metrics.ReasonRequestedIP}
+		}
+
+		claimed, err := c.claim(ip, pool, address)
+		if err != nil {
+			return nil, err
+		}
+
+		if !claimed {
+			err := fmt.Errorf("The requested IP %q has already been allocated", address)
+			return nil, &allocationError{err, metrics.ReasonRequestedIP}
+		}
+		return []string{address}, nil
+	}
+
+	if allocator.Free().Cmp(big.NewInt(int64(count))) < 0 {
+		return nil, exhausted(pool, count, contiguous)
+	}
+
+	if contiguous {
+		return c.reserveBlock(ip, pool, allocator, count)
+	}
+
+	strategy, err := ipaddr.NewStrategy(pool.Annotations[ipamconstants.AllocationStrategyKey], util.PoolHistory(pool))
+	if err != nil {
+		return nil, &allocationError{err, metrics.ReasonParseError}
+	}
+
+	// The informer cache can lag behind, so the addresses claimed meanwhile are skipped
+	addresses := []string{}
+	for skipped := 0; len(addresses) < count; {
+		if skipped == maxClaimAttempts {
+			err := fmt.Errorf("failed to claim an address of the \"%s\" pool after %d attempts", pool.Name, maxClaimAttempts)
+			return nil, c.rollback(ip, pool, addresses, err)
+		}
+
+		address, err := allocator.AllocateWith(strategy)
+		if err != nil {
+			return nil, c.rollback(ip, pool, addresses, exhausted(pool, count, contiguous))
+		}
+
+		claimed, err := c.claim(ip, pool, address)
+		if err != nil {
+			return nil, c.rollback(ip, pool, addresses, err)
+		}
+
+		if !claimed {
+			skipped++
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	sortAddresses(addresses)
+	return addresses, nil
+}
+
+// checkQuotas returns an error if the namespace of the IP can't get the count of addresses
+// more of the pool within the quotas of the pool. The quotas with an invalid namespace
+// selector only apply to their listed namespaces, their status tells why.
+func (c *Controller) checkQuotas(ip *blendedv1.IP, pool *blendedv1.Pool, count int) error {
+	quotas, err := c.quotaLister.ByPool(pool.Name)
+	if err != nil || len(quotas) == 0 {
 		return err
 	}
+
+	namespaceLabels := func(name string) labels.Set {
+		namespace, err := c.namespaceLister.Get(name)
+		if err != nil {
+			return nil
+		}
+		return labels.Set(namespace.Labels)
+	}
+
+	var usage map[string]int
+	for _, quota := range quotas {
+		selector, err := util.QuotaSelector(quota)
+		if err != nil {
+			glog.Warningf("The \"%s\" quota ignores its namespace selector: %+v.", quota.Name, err)
+			selector = labels.Nothing()
+		}
+
+		if !util.QuotaApplies(quota, selector, ip.Namespace, namespaceLabels(ip.Namespace)) {
+			continue
+		}
+
+		// The addresses allocated meanwhile may not be in the cache yet
+		if usage == nil {
+			list, err := c.allocations.List(metav1.ListOptions{LabelSelector: labels.Set{ipamconstants.PoolLabelKey: pool.Name}.String()})
+			if err != nil {
+				return err
+			}
+
+			allocations := []*ipamv1.Allocation{}
+			for i := range list.Items {
+				allocations = append(allocations, &list.Items[i])
+			}
+			usage = util.NamespaceUsage(allocations)
+		}
+
+		used, namespaces := util.QuotaUsage(quota, selector, usage, namespaceLabels)
+		if err := util.CheckQuota(quota, ip.Namespace, count, used, namespaces); err != nil {
+			return &allocationError{err, metrics.ReasonQuotaExceeded}
+		}
+	}
 	return nil
 }
 
-func (c *Controller) makeFailedStatus(ip *blendedv1.IP, e error) error {
-	ip.Status.Address = ""
+// reserveBlock claims a block of consecutive addresses of the pool for the IP.
+func (c *Controller) reserveBlock(ip *blendedv1.IP, pool *blendedv1.Pool, allocator *ipaddr.Allocator, count int) ([]string, error) {
+	for i := 0; i < maxClaimAttempts; i++ {
+		block, err := allocator.AllocateBlock(count)
+		if err != nil {
+			return nil, exhausted(pool, count, true)
+		}
+
+		addresses := []string{}
+		for _, address := range block {
+			claimed, err := c.claim(ip, pool, address)
+			if err != nil {
+				return nil, c.rollback(ip, pool, addresses, err)
+			}
+
+			if !claimed {
+				break
+			}
+			addresses = append(addresses, address)
+		}
+
+		if len(addresses) == count {
+			return addresses, nil
+		}
+
+		// Another IP claimed an address of the block, so the next block is tried. Only that
+		// address stays in use, the others may still be part of the next block.
+		if err := c.unclaim(ip, pool, addresses); err != nil {
+			return nil, err
+		}
+
+		for j, address := range block {
+			if j == len(addresses) {
+				continue
+			}
+
+			if err := allocator.Release(address); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("failed to claim %d contiguous addresses of the \"%s\" pool after %d attempts", count, pool.Name, maxClaimAttempts)
+}
+
+// rollback releases the addresses claimed so far when the IP can't get all of them, and
+// returns the error.
+func (c *Controller) rollback(ip *blendedv1.IP, pool *blendedv1.Pool, addresses []string, e error) error {
+	if err := c.unclaim(ip, pool, addresses); err != nil {
+		return err
+	}
+	return e
+}
+
+// checkRequestedIP validates the address pinned by the IP, the address must be a usable address
+// of the pool that is neither filtered nor allocated to another IP.
+func (c *Controller) checkRequestedIP(ip *blendedv1.IP, pool *blendedv1.Pool, allocator *ipaddr.Allocator) (string, error) {
+	requested := ip.Annotations[ipamconstants.RequestedIPKey]
+	parsed := net.ParseIP(requested)
+	if parsed == nil {
+		return "", fmt.Errorf("The requested IP %q is invalid", requested)
+	}
+
+	address := parsed.String()
+	if !allocator.Contains(address) {
+		return "", fmt.Errorf("The requested IP %q isn't a usable address of the \"%s\" pool", address, pool.Name)
+	}
+
+	for _, filter := range pool.Spec.FilterIPs {
+		if parsed.Equal(net.ParseIP(filter)) {
+			return "", fmt.Errorf("The requested IP %q is filtered by the \"%s\" pool", address, pool.Name)
+		}
+	}
+
+	if allocator.IsDelegated(address) {
+		return "", fmt.Errorf("The requested IP %q is in a prefix that the \"%s\" pool delegated", address, pool.Name)
+	}
+
+	name, err := ipamv1.AllocationName(address)
+	if err != nil {
+		return "", err
+	}
+
+	allocation, err := c.allocations.Get(name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		return address, nil
+	case err != nil:
+		return "", err
+	case util.IsHeld(allocation, time.Now()):
+		return "", fmt.Errorf("The requested IP %q is held after being released by the \"%s\" pool", address, pool.Name)
+	case allocation.Status.Phase == ipamv1.AllocationActive && allocation.Spec.IP.Name == "":
+		// The address isn't handed over to the IP, even if the IP that had it no longer exists
+		return "", fmt.Errorf("The requested IP %q has already been allocated", address)
+	case allocation.Status.Phase == ipamv1.AllocationActive && !util.IsOwnedBy(allocation, ip):
+		ref := allocation.Spec.IP
+		return "", fmt.Errorf("The requested IP %q has already been allocated to \"%s/%s\"", address, ref.Namespace, ref.Name)
+	}
+	return address, nil
+}
+
+// makeFailedStatus fails the IP for the reason, unless it already failed the same way.
+func (c *Controller) makeFailedStatus(ip *blendedv1.IP, pool *blendedv1.Pool, reason string, e error) error {
+	message := fmt.Sprintf("%+v.", e)
+	status := fmt.Sprintf("%s: %s", reason, message)
+	changed := setConditions(ip, pool, ipamv1.Condition{
+		Type:    ipamv1.IPAllocated,
+		Status:  corev1.ConditionFalse,
+		Reason:  reason,
+		Message: e.Error(),
+	})
+	if ip.Status.Phase == blendedv1.IPFailed && ip.Status.Reason == status && !k8sutil.IsNeedToUpdate(ip.ObjectMeta) && !changed {
+		return nil
+	}
+
+	util.SetIPAddresses(ip, nil)
+	util.SetIPPool(ip, "")
 	ip.Status.Phase = blendedv1.IPFailed
-	ip.Status.Reason = fmt.Sprintf("%+v.", e)
+	ip.Status.Reason = status
 	ip.Status.LastUpdateTime = metav1.Now()
 	delete(ip.Annotations, constants.NeedUpdateKey)
-	if _, err := c.blendedset.InwinstackV1().IPs(ip.Namespace).Update(ip); err != nil {
+	if err := c.updateIP(ip); err != nil {
 		return err
 	}
+	c.recorder.Event(ip, corev1.EventTypeWarning, reason, message)
 	return nil
 }
 
+// skipError is an error of a candidate pool that can't give the addresses to the IP, so
+// the next candidate is tried.
+type skipError struct {
+	error
+}
+
+// skippedError prepends the reasons why the previous candidate pools were skipped to the error.
+func skippedError(skipped []string, e error) error {
+	if len(skipped) == 0 {
+		return e
+	}
+	return fmt.Errorf("%s; %s", strings.Join(skipped, "; "), e.Error())
+}
+
+// candidatePools returns the names of the pools that the IP can get its addresses from: its
+// pool, its fallback pools, then the pools of its selector by name. The IP that already has
+// addresses only has the pool of its addresses.
+func (c *Controller) candidatePools(ip *blendedv1.IP, selector labels.Selector, selection string) ([]string, error) {
+	if ip.Status.Address != "" {
+		return []string{util.IPPool(ip)}, nil
+	}
+
+	names := []string{}
+	if ip.Spec.PoolName != "" {
+		names = append(names, ip.Spec.PoolName)
+	}
+	names = append(names, util.FallbackPools(ip)...)
+
+	if selector != nil {
+		list, err := c.blendedset.InwinstackV1().Pools().List(metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return nil, err
+		}
+
+		selected := []string{}
+		for _, pool := range list.Items {
+			selected = append(selected, pool.Name)
+		}
+		sort.Strings(selected)
+		names = append(names, selected...)
+	}
+	names = funk.UniqString(names)
+
+	if selection == ipamconstants.PoolSelectionMostFree && len(names) > 1 {
+		// The missing pools go last
+		allocatable := map[string]int{}
+		for _, name := range names {
+			allocatable[name] = -1
+			pool, err := c.blendedset.InwinstackV1().Pools().Get(name, metav1.GetOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return nil, err
+			}
+
+			if err == nil {
+				allocatable[name] = pool.Status.Allocatable
+			}
+		}
+		sort.SliceStable(names, func(i, j int) bool { return allocatable[names[i]] > allocatable[names[j]] })
+	}
+	return names, nil
+}
+
+// allocate gives the addresses of the first candidate pool that has them to the IP, the IP
+// fails with the reasons of all the candidates if none of them has.
 func (c *Controller) allocate(ip *blendedv1.IP) error {
+	selection, err := util.PoolSelection(ip)
+	var selector labels.Selector
+	if err == nil {
+		selector, err = util.PoolSelector(ip)
+	}
+
+	if err != nil {
+		pool, getErr := c.blendedset.InwinstackV1().Pools().Get(ip.Spec.PoolName, metav1.GetOptions{})
+		if getErr != nil {
+			pool = nil
+		}
+		metrics.AllocationFailed(ip.Spec.PoolName, metrics.ReasonParseError)
+		return c.makeFailedStatus(ip.DeepCopy(), pool, ipamconstants.InvalidSpecReason, err)
+	}
+
+	names, err := c.candidatePools(ip, selector, selection)
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		e := fmt.Errorf("No pool matches the pool selector %q", ip.Annotations[ipamconstants.PoolSelectorKey])
+		return c.makeFailedStatus(ip.DeepCopy(), nil, ipamconstants.PoolNotFoundReason, e)
+	}
+
+	skipped := []string{}
+	for i, name := range names {
+		err := c.allocateFrom(ip, name, i < len(names)-1, skipped)
+		if e, ok := err.(*skipError); ok {
+			skipped = append(skipped, e.Error())
+			continue
+		}
+		return err
+	}
+	return nil
+}
+
+// allocateFrom gives the addresses of the pool to the IP. Unless it's the last candidate, the
+// pool that can't give them is skipped instead of failing the IP.
+func (c *Controller) allocateFrom(ip *blendedv1.IP, name string, skip bool, skipped []string) error {
+	// The addresses of a pool are picked one at a time within the process
+	defer c.pools.Lock(name)()
+
+	start := time.Now()
 	ipCopy := ip.DeepCopy()
-	pool, err := c.blendedset.InwinstackV1().Pools().Get(ipCopy.Spec.PoolName, metav1.GetOptions{})
+	pool, err := c.blendedset.InwinstackV1().Pools().Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) && skip {
+		return &skipError{fmt.Errorf("The \"%s\" pool doesn't exist", name)}
+	}
+	if errors.IsNotFound(err) {
+		// Requeue until the pool shows up, but tell why meanwhile
+		if setConditions(ipCopy, nil, allocatedCondition(ipCopy)) {
+			if err := c.updateIP(ipCopy); err != nil {
+				return err
+			}
+		}
+		return err
+	}
 	if err != nil {
 		return err
 	}
@@ -213,62 +906,213 @@ func (c *Controller) allocate(ip *blendedv1.IP) error {
 	switch pool.Status.Phase {
 	case blendedv1.PoolActive:
 		if ipCopy.Status.Address == "" {
-			if pool.Status.Allocatable == 0 {
-				return c.makeFailedStatus(ipCopy, fmt.Errorf("The \"%s\" pool has been exhausted", pool.Name))
+			count, err := util.AddressCount(ipCopy)
+			if err != nil {
+				metrics.AllocationFailed(pool.Name, metrics.ReasonParseError)
+				return c.makeFailedStatus(ipCopy, pool, ipamconstants.InvalidSpecReason, err)
 			}
 
-			parser := ipaddr.NewParser(pool.Spec.Addresses, pool.Spec.AvoidBuggyIPs, pool.Spec.AvoidGatewayIPs)
-			ips, err := parser.FilterIPs(pool.Status.AllocatedIPs, pool.Spec.FilterIPs)
+			contiguous, err := util.IsContiguous(ipCopy)
 			if err != nil {
-				return c.makeFailedStatus(ipCopy, err)
+				metrics.AllocationFailed(pool.Name, metrics.ReasonParseError)
+				return c.makeFailedStatus(ipCopy, pool, ipamconstants.InvalidSpecReason, err)
 			}
 
-			pool.Status.AllocatedIPs = append(pool.Status.AllocatedIPs, ips[0])
-			pool.Status.Allocatable = pool.Status.Capacity - len(pool.Status.AllocatedIPs)
-			if err := c.updatePool(pool); err != nil {
-				// If the pool failed to update, this res will requeue
+			// The addresses are already claimed when the IP failed to update after the allocation
+			addresses, err := c.adopt(ipCopy, pool, count, contiguous)
+			if err != nil {
 				return err
 			}
 
+			if len(addresses) == 0 {
+				addresses, err = c.reserve(ipCopy, pool, count, contiguous)
+				if e, ok := err.(*allocationError); ok {
+					metrics.AllocationFailed(pool.Name, e.reason)
+					if skip {
+						return &skipError{e.error}
+					}
+					return c.makeFailedStatus(ipCopy, pool, eventReasons[e.reason], skippedError(skipped, e.error))
+				}
+				if err != nil {
+					return err
+				}
+
+				// If the pool failed to update, this res will requeue and adopt the addresses
+				err = c.updatePool(pool.Name, func(pool *blendedv1.Pool) {
+					for _, address := range addresses {
+						util.RecordAllocated(pool, address)
+					}
+				})
+				if err != nil {
+					c.poolConflict(ipCopy, pool.Name, err)
+					return err
+				}
+				metrics.ObserveAllocation(pool.Name, len(addresses), start)
+			}
+
 			ipCopy.Status.Reason = ""
-			ipCopy.Status.Address = ips[0]
+			util.SetIPAddresses(ipCopy, addresses)
+			util.SetIPPool(ipCopy, pool.Name)
 			ipCopy.Status.Phase = blendedv1.IPActive
 			k8sutil.AddFinalizer(&ipCopy.ObjectMeta, constants.CustomFinalizer)
 		}
 	case blendedv1.PoolTerminating:
-		ipCopy.Status.Reason = fmt.Sprintf("The \"%s\" pool has been terminated.", pool.Name)
-		ipCopy.Status.Phase = blendedv1.IPFailed
+		metrics.AllocationFailed(pool.Name, metrics.ReasonPoolTerminating)
+		e := fmt.Errorf("The \"%s\" pool has been terminated", pool.Name)
+		if skip {
+			return &skipError{e}
+		}
+		return c.makeFailedStatus(ipCopy, pool, ipamconstants.PoolTerminatingReason, skippedError(skipped, e))
+	default:
+		if skip {
+			return &skipError{fmt.Errorf("The \"%s\" pool isn't ready", pool.Name)}
+		}
 	}
 
+	setConditions(ipCopy, pool, allocatedCondition(ipCopy))
 	delete(ipCopy.Annotations, constants.NeedUpdateKey)
 	ipCopy.Status.LastUpdateTime = metav1.Now()
-	if _, err := c.blendedset.InwinstackV1().IPs(ipCopy.Namespace).Update(ipCopy); err != nil {
+	if err := c.updateIP(ipCopy); err != nil {
 		return err
 	}
+
+	if ip.Status.Address == "" && ipCopy.Status.Address != "" {
+		c.recorder.Eventf(ipCopy, corev1.EventTypeNormal, ipamconstants.AllocatedReason,
+			"Allocated %s of the \"%s\" pool", describeAddresses(util.IPAddresses(ipCopy)), pool.Name)
+	}
+	return nil
+}
+
+// ownedAllocations returns the active allocations of the IP. The allocation of the IP address
+// is read from the API server, since the cache may not have seen it yet.
+func (c *Controller) ownedAllocations(ip *blendedv1.IP) ([]*ipamv1.Allocation, error) {
+	cached, err := c.allocationLister.ByIP(ip.Namespace, ip.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, allocation := range cached {
+		names[allocation.Name] = true
+	}
+
+	for _, address := range util.IPAddresses(ip) {
+		if name, err := ipamv1.AllocationName(address); err == nil {
+			names[name] = true
+		}
+	}
+
+	allocations := []*ipamv1.Allocation{}
+	for name := range names {
+		allocation, err := c.allocations.Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if util.IsOwnedBy(allocation, ip) && allocation.Status.Phase == ipamv1.AllocationActive {
+			allocations = append(allocations, allocation)
+		}
+	}
+	return allocations, nil
+}
+
+// releaseStale deletes the allocations that the IP claimed but didn't get to use, which happens
+// when the IP failed to update after an allocation whose claim the next pass didn't see yet.
+func (c *Controller) releaseStale(ip *blendedv1.IP) error {
+	allocations, err := c.allocationLister.ByIP(ip.Namespace, ip.Name)
+	if err != nil {
+		return err
+	}
+
+	addresses := util.IPAddresses(ip)
+	for _, allocation := range allocations {
+		// The allocations of a previous IP of the same name are left to the garbage collector
+		if allocation.Status.Phase != ipamv1.AllocationActive || !util.IsOwnedBy(allocation, ip) {
+			continue
+		}
+
+		if allocation.Spec.PoolName == util.IPPool(ip) && funk.ContainsString(addresses, allocation.Spec.Address) {
+			continue
+		}
+
+		glog.Infof("IP \"%s/%s\" releases the stale address %s.", ip.Namespace, ip.Name, allocation.Spec.Address)
+		uid := allocation.UID
+		opts := &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}}
+		if err := c.allocations.Delete(allocation.Name, opts); err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			return err
+		}
+	}
 	return nil
 }
 
 func (c *Controller) deallocate(ip *blendedv1.IP) error {
+	// The addresses go back to the pool they came from, which may be a fallback pool
+	name := util.IPPool(ip)
+	defer c.pools.Lock(name)()
+
+	start := time.Now()
 	ipCopy := ip.DeepCopy()
-	pool, err := c.blendedset.InwinstackV1().Pools().Get(ipCopy.Spec.PoolName, metav1.GetOptions{})
-	if err != nil {
+	// The IPs orphaned by a deleted pool have nothing left to release in it
+	pool, err := c.blendedset.InwinstackV1().Pools().Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		pool = nil
+	} else if err != nil {
 		return err
 	}
 
-	pool.Status.AllocatedIPs = funk.FilterString(pool.Status.AllocatedIPs, func(v string) bool {
-		return v != ip.Status.Address
-	})
-	pool.Status.Allocatable = pool.Status.Capacity - len(pool.Status.AllocatedIPs)
-	if err := c.updatePool(pool); err != nil {
+	allocations, err := c.ownedAllocations(ip)
+	if err != nil {
 		return err
 	}
 
+	// An invalid hold time is reported by the pool, and nothing is held meanwhile
+	hold := time.Duration(0)
+	if pool != nil {
+		hold, _ = util.ReleaseHoldTime(pool)
+	}
+
+	released := []string{}
+	for _, allocation := range allocations {
+		if pool != nil && allocation.Spec.PoolName == pool.Name {
+			released = append(released, allocation.Spec.Address)
+		}
+	}
+
+	// The history is recorded while the allocations are still active, so that a retry
+	// records it again if the pool failed to update
+	if len(released) > 0 {
+		err := c.updatePool(pool.Name, func(pool *blendedv1.Pool) {
+			for _, address := range released {
+				util.RecordReleased(pool, address)
+			}
+		})
+		if err != nil {
+			c.poolConflict(ipCopy, pool.Name, err)
+			return err
+		}
+	}
+
+	for _, allocation := range allocations {
+		if err := util.ReleaseAllocation(c.allocations, allocation, hold); err != nil {
+			return err
+		}
+	}
+
+	if len(released) > 0 {
+		metrics.ObserveDeallocation(pool.Name, len(released), start)
+
+		for _, address := range released {
+			c.recorder.Eventf(ipCopy, corev1.EventTypeNormal, ipamconstants.ReleasedReason,
+				"Released address %s of the \"%s\" pool", address, pool.Name)
+		}
+	}
+
 	ipCopy.Status.LastUpdateTime = metav1.Now()
 	ipCopy.Status.Phase = blendedv1.IPTerminating
 	delete(ip.Annotations, constants.NeedUpdateKey)
 	k8sutil.RemoveFinalizer(&ipCopy.ObjectMeta, constants.CustomFinalizer)
-	if _, err := c.blendedset.InwinstackV1().IPs(ipCopy.Namespace).Update(ipCopy); err != nil {
-		return err
-	}
-	return nil
+	return c.updateIP(ipCopy)
 }
@@ -18,53 +18,204 @@ package ip
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
 	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
 	blendedinformers "github.com/inwinstack/blended/generated/informers/externalversions"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
 	"github.com/inwinstack/ipam/pkg/config"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/ipaddr"
+	"github.com/inwinstack/ipam/pkg/operator/testutil"
+	"github.com/inwinstack/ipam/pkg/util"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 )
 
-const timeout = 3 * time.Second
+func newController(ctx context.Context, t *testing.T) (*Controller, *blendedfake.Clientset, client.AllocationInterface) {
+	return newControllerWithRecorder(ctx, t, &record.FakeRecorder{})
+}
 
-func TestPoolController(t *testing.T) {
-	ctx, cancel := context.WithCancel(context.Background())
+func newControllerWithRecorder(ctx context.Context, t *testing.T, recorder record.EventRecorder) (*Controller, *blendedfake.Clientset, client.AllocationInterface) {
+	return newControllerWithClients(ctx, t, recorder, fake.NewSimpleClientset(), nil)
+}
+
+func newControllerWithClients(ctx context.Context, t *testing.T, recorder record.EventRecorder, k8sclient kubernetes.Interface, dynamicClient dynamic.Interface) (*Controller, *blendedfake.Clientset, client.AllocationInterface) {
 	cfg := &config.Config{Threads: 2}
-	blendedset := blendedfake.NewSimpleClientset()
-	informer := blendedinformers.NewSharedInformerFactory(blendedset, 0)
+	clients := testutil.NewClients(dynamicClient)
+	k8sinformer := informers.NewSharedInformerFactory(k8sclient, 0)
+	quotaInformer := client.NewPoolQuotaInformer(client.NewPoolQuotas(clients.Dynamic), 0)
 
-	controller := NewController(blendedset, informer.Inwinstack().V1().IPs())
-	go informer.Start(ctx.Done())
+	controller := NewController(
+		clients.Blendedset,
+		clients.Allocations,
+		clients.Conditions,
+		clients.Informer.Inwinstack().V1().IPs(),
+		clients.AllocationInformer,
+		quotaInformer,
+		k8sinformer.Core().V1().Namespaces(),
+		recorder,
+		util.NewKeyMutex())
+	clients.Start(ctx)
+	go k8sinformer.Start(ctx.Done())
+	go quotaInformer.Informer().Run(ctx.Done())
 	assert.Nil(t, controller.Run(ctx, cfg.Threads))
+	return controller, clients.Blendedset, clients.Allocations
+}
+
+// allocatedAddresses returns the addresses of the pool that are in use, sorted.
+func allocatedAddresses(t *testing.T, allocations client.AllocationInterface, pool string) []string {
+	list, err := allocations.List(metav1.ListOptions{LabelSelector: ipamconstants.PoolLabelKey + "=" + pool})
+	assert.Nil(t, err)
+
+	items := []*ipamv1.Allocation{}
+	for i := range list.Items {
+		items = append(items, &list.Items[i])
+	}
+	used, _ := util.AllocatedAddresses(items, time.Now())
+	return used
+}
+
+func createAllocation(t *testing.T, allocations client.AllocationInterface, pool, address string, ip *blendedv1.IP) {
+	allocation, err := util.NewAllocation(pool, address, ip)
+	assert.Nil(t, err)
+	_, err = allocations.Create(allocation)
+	assert.Nil(t, err)
+}
+
+func TestPoolController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	// The deleted IP isn't requeued
+	assert.Nil(t, controller.reconcile("default/test-missing"))
+
+	pool := testutil.NewPool("test", "172.22.132.0-172.22.132.5")
+	pool.Spec.AvoidBuggyIPs = true
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
 
-	pool := &blendedv1.Pool{
+	ip := &blendedv1.IP{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "test",
-		},
-		Spec: blendedv1.PoolSpec{
-			Addresses:         []string{"172.22.132.0-172.22.132.5"},
-			AssignToNamespace: false,
-			AvoidBuggyIPs:     true,
-			AvoidGatewayIPs:   false,
+			Name:      "test-ip-1",
+			Namespace: "default",
 		},
-		Status: blendedv1.PoolStatus{
-			Phase:          blendedv1.PoolActive,
-			AllocatedIPs:   []string{},
-			Capacity:       5,
-			Allocatable:    5,
-			LastUpdateTime: metav1.NewTime(time.Now()),
+		Spec: blendedv1.IPSpec{
+			PoolName: pool.Name,
 		},
 	}
+	_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+	assert.Nil(t, err)
+
+	gip := testutil.WaitForIP(t, blendedset, ip.Namespace, ip.Name, func(ip *blendedv1.IP) bool {
+		return ip.Status.Phase == blendedv1.IPActive
+	})
+	assert.Equal(t, "172.22.132.1", gip.Status.Address)
+	assert.Equal(t, []string{"172.22.132.1"}, allocatedAddresses(t, allocations, pool.Name))
+
+	// Test to deallocate IP
+	assert.Nil(t, controller.deallocate(gip))
+	assert.Equal(t, []string{}, allocatedAddresses(t, allocations, pool.Name))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestMultipleAddresses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	pool := testutil.NewPool("test-multi", "172.22.132.0-172.22.132.9")
+	pool.Spec.AvoidBuggyIPs = true
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	other := &blendedv1.IP{ObjectMeta: metav1.ObjectMeta{Name: "test-other", Namespace: "default", UID: "other-uid"}}
+	createAllocation(t, allocations, pool.Name, "172.22.132.3", other)
+	createAllocation(t, allocations, pool.Name, "172.22.132.8", other)
+
+	waitForIP := func(name string, count int, contiguous bool) *blendedv1.IP {
+		ip := &blendedv1.IP{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					ipamconstants.AddressCountKey: fmt.Sprint(count),
+					ipamconstants.ContiguousKey:   fmt.Sprint(contiguous),
+				},
+			},
+			Spec: blendedv1.IPSpec{PoolName: pool.Name},
+		}
+		_, err := blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+		assert.Nil(t, err)
+
+		return testutil.WaitForIP(t, blendedset, ip.Namespace, ip.Name, func(ip *blendedv1.IP) bool {
+			return ip.Status.Phase != blendedv1.IPNone
+		})
+	}
+
+	// The addresses that are already allocated are skipped
+	ip := waitForIP("test-multi", 3, false)
+	assert.Equal(t, blendedv1.IPActive, ip.Status.Phase)
+	assert.Equal(t, "172.22.132.1", ip.Status.Address)
+	assert.Equal(t, []string{"172.22.132.1", "172.22.132.2", "172.22.132.4"}, util.IPAddresses(ip))
+
+	// A contiguous block starts after them
+	block := waitForIP("test-block", 2, true)
+	assert.Equal(t, blendedv1.IPActive, block.Status.Phase)
+	assert.Equal(t, []string{"172.22.132.5", "172.22.132.6"}, util.IPAddresses(block))
+
+	// The IP gets all of its addresses or none of them, the two addresses left aren't contiguous
+	failed := waitForIP("test-too-many", 3, false)
+	assert.Equal(t, blendedv1.IPFailed, failed.Status.Phase)
+	assert.Contains(t, failed.Status.Reason, "doesn't have 3 addresses left")
+	assert.Nil(t, util.IPAddresses(failed))
+
+	failed = waitForIP("test-too-many-block", 2, true)
+	assert.Equal(t, blendedv1.IPFailed, failed.Status.Phase)
+	assert.Contains(t, failed.Status.Reason, "doesn't have 2 contiguous addresses left")
+
+	expected := []string{"172.22.132.1", "172.22.132.2", "172.22.132.3", "172.22.132.4", "172.22.132.5", "172.22.132.6", "172.22.132.8"}
+	assert.Equal(t, expected, allocatedAddresses(t, allocations, pool.Name))
+
+	// All the addresses are released along with the IP
+	assert.Nil(t, controller.deallocate(ip))
+	expected = []string{"172.22.132.3", "172.22.132.5", "172.22.132.6", "172.22.132.8"}
+	assert.Equal(t, expected, allocatedAddresses(t, allocations, pool.Name))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestIPv6Allocation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	pool := testutil.NewPool("test-v6", "2001:db8::/64")
+	pool.Spec.AvoidBuggyIPs = true
+	pool.Spec.AvoidGatewayIPs = true
+	pool.Spec.FilterIPs = []string{"2001:db8::2"}
 	_, err := blendedset.InwinstackV1().Pools().Create(pool)
 	assert.Nil(t, err)
 
 	ip := &blendedv1.IP{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "test-ip-1",
+			Name:      "test-ip-v6",
 			Namespace: "default",
 		},
 		Spec: blendedv1.IPSpec{
@@ -74,34 +225,808 @@ func TestPoolController(t *testing.T) {
 	_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
 	assert.Nil(t, err)
 
-	failed := true
-	for start := time.Now(); time.Since(start) < timeout; {
+	gip := testutil.WaitForIP(t, blendedset, ip.Namespace, ip.Name, func(ip *blendedv1.IP) bool {
+		return ip.Status.Phase == blendedv1.IPActive
+	})
+	assert.Equal(t, "2001:db8::3", gip.Status.Address)
+	assert.Equal(t, []string{"2001:db8::3"}, allocatedAddresses(t, allocations, pool.Name))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestRequestedIP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	pool := testutil.NewPool("test-requested", "172.22.132.0-172.22.132.10")
+	pool.Annotations = map[string]string{ipamconstants.DelegatedPrefixesKey: `{"default/test-claim":"172.22.132.8/30"}`}
+	pool.Spec.AvoidBuggyIPs = true
+	pool.Spec.FilterIPs = []string{"172.22.132.4"}
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	// The owner of 172.22.132.2, while 172.22.132.6 was leaked by a crash.
+	owner := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-owner",
+			Namespace:   "default",
+			Annotations: map[string]string{ipamconstants.RequestedIPKey: "172.22.132.2"},
+		},
+		Spec: blendedv1.IPSpec{PoolName: pool.Name},
+		Status: blendedv1.IPStatus{
+			Phase:   blendedv1.IPActive,
+			Address: "172.22.132.2",
+		},
+	}
+	_, err = blendedset.InwinstackV1().IPs(owner.Namespace).Create(owner)
+	assert.Nil(t, err)
+	createAllocation(t, allocations, pool.Name, "172.22.132.2", owner)
+	createAllocation(t, allocations, pool.Name, "172.22.132.6", nil)
+
+	tests := []struct {
+		Name      string
+		Requested string
+		Phase     blendedv1.IPPhase
+		Address   string
+		Reason    string
+	}{
+		{Name: "test-pinned", Requested: "172.22.132.3", Phase: blendedv1.IPActive, Address: "172.22.132.3"},
+		{Name: "test-leaked", Requested: "172.22.132.6", Phase: blendedv1.IPFailed, Reason: "The requested IP \"172.22.132.6\" has already been allocated."},
+		{Name: "test-allocated", Requested: "172.22.132.2", Phase: blendedv1.IPFailed, Reason: "has already been allocated to \"default/test-owner\""},
+		{Name: "test-filtered", Requested: "172.22.132.4", Phase: blendedv1.IPFailed, Reason: "is filtered by"},
+		{Name: "test-outside", Requested: "172.22.133.4", Phase: blendedv1.IPFailed, Reason: "isn't a usable address"},
+		{Name: "test-delegated", Requested: "172.22.132.9", Phase: blendedv1.IPFailed, Reason: "is in a prefix that the \"test-requested\" pool delegated"},
+		{Name: "test-invalid", Requested: "172.22.133", Phase: blendedv1.IPFailed, Reason: "is invalid"},
+	}
+
+	for _, test := range tests {
+		ip := &blendedv1.IP{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        test.Name,
+				Namespace:   "default",
+				Annotations: map[string]string{ipamconstants.RequestedIPKey: test.Requested},
+			},
+			Spec: blendedv1.IPSpec{PoolName: pool.Name},
+		}
+		_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+		assert.Nil(t, err)
+
+		gip := testutil.WaitForIP(t, blendedset, ip.Namespace, ip.Name, func(ip *blendedv1.IP) bool {
+			return ip.Status.Phase == test.Phase
+		})
+		assert.Equal(t, test.Address, gip.Status.Address, test.Name)
+		assert.Contains(t, gip.Status.Reason, test.Reason, test.Name)
+	}
+
+	addresses := []string{"172.22.132.2", "172.22.132.3", "172.22.132.6"}
+	assert.Equal(t, addresses, allocatedAddresses(t, allocations, pool.Name))
+
+	// The leaked address isn't handed over to the IP that requested it
+	leaked, err := allocations.Get("172.22.132.6", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", leaked.Spec.IP.Name)
+
+	// Re-reconcile the pinned IP
+	gip, err := blendedset.InwinstackV1().IPs("default").Get("test-pinned", metav1.GetOptions{})
+	assert.Nil(t, err)
+	gip.Status.Address = ""
+	assert.Nil(t, controller.allocate(gip))
+
+	gip, err = blendedset.InwinstackV1().IPs("default").Get("test-pinned", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.3", gip.Status.Address)
+
+	assert.Equal(t, addresses, allocatedAddresses(t, allocations, pool.Name))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestClaim(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, _, allocations := newController(ctx, t)
+
+	pool := &blendedv1.Pool{ObjectMeta: metav1.ObjectMeta{Name: "test-child"}}
+	ip := &blendedv1.IP{ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: "default", UID: "test-uid"}}
+	previous := &blendedv1.IP{ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: "default", UID: "previous-uid"}}
+
+	// The same address is in the parent pool, or was allocated to a previous IP of the same name
+	createAllocation(t, allocations, "test-parent", "172.22.132.1", nil)
+	createAllocation(t, allocations, "test-parent", "172.22.132.2", ip)
+	createAllocation(t, allocations, pool.Name, "172.22.132.3", previous)
+	createAllocation(t, allocations, pool.Name, "172.22.132.4", ip)
+	createAllocation(t, allocations, pool.Name, "172.22.132.5", nil)
+
+	tests := []struct {
+		Address string
+		Claimed bool
+	}{
+		{Address: "172.22.132.1", Claimed: false},
+		{Address: "172.22.132.2", Claimed: false},
+		{Address: "172.22.132.3", Claimed: false},
+		{Address: "172.22.132.4", Claimed: true},
+		{Address: "172.22.132.5", Claimed: true},
+		{Address: "172.22.132.6", Claimed: true},
+	}
+	for _, test := range tests {
+		claimed, err := controller.claim(ip, pool, test.Address)
+		assert.Nil(t, err)
+		assert.Equal(t, test.Claimed, claimed, test.Address)
+	}
+
+	parent, err := allocations.Get("172.22.132.1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", parent.Spec.IP.Name)
+
+	cancel()
+	controller.Stop()
+}
+
+func TestAllocationStrategy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	pool := testutil.NewPool("test-strategy", "172.22.132.0-172.22.132.5")
+	pool.Annotations = map[string]string{ipamconstants.AllocationStrategyKey: ipaddr.RoundRobinStrategy}
+	pool.Spec.AvoidBuggyIPs = true
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	waitForAddress := func(name string) string {
+		gip := testutil.WaitForIP(t, blendedset, "default", name, func(ip *blendedv1.IP) bool {
+			return ip.Status.Phase == blendedv1.IPActive
+		})
+		return gip.Status.Address
+	}
+
+	for i, expected := range []string{"172.22.132.1", "172.22.132.2"} {
+		ip := &blendedv1.IP{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("test-strategy-%d", i),
+				Namespace: "default",
+			},
+			Spec: blendedv1.IPSpec{PoolName: pool.Name},
+		}
+		_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, waitForAddress(ip.Name))
+
+		// Release the address right away, the next IP must not reuse it
 		gip, err := blendedset.InwinstackV1().IPs(ip.Namespace).Get(ip.Name, metav1.GetOptions{})
 		assert.Nil(t, err)
+		assert.Nil(t, controller.deallocate(gip))
+	}
 
-		if gip.Status.Phase == blendedv1.IPActive {
-			assert.Equal(t, "172.22.132.1", gip.Status.Address)
-			gpool, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	gpool, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.2", gpool.Annotations[ipamconstants.LastAllocatedIPKey])
+	assert.Equal(t, "172.22.132.1,172.22.132.2", gpool.Annotations[ipamconstants.ReleasedIPsKey])
+	assert.Equal(t, []string{}, allocatedAddresses(t, allocations, pool.Name))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestReleaseHoldTime(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	pool := testutil.NewPool("test-hold", "172.22.132.0-172.22.132.5")
+	pool.Annotations = map[string]string{ipamconstants.ReleaseHoldTimeKey: "1h"}
+	pool.Spec.AvoidBuggyIPs = true
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	// Release the allocated address
+	ip := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-hold-1", Namespace: "default"},
+		Spec:       blendedv1.IPSpec{PoolName: pool.Name},
+		Status:     blendedv1.IPStatus{Phase: blendedv1.IPActive, Address: "172.22.132.1"},
+	}
+	_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+	assert.Nil(t, err)
+	createAllocation(t, allocations, pool.Name, "172.22.132.1", ip)
+	assert.Nil(t, controller.deallocate(ip))
+
+	released, err := allocations.Get("172.22.132.1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, ipamv1.AllocationReleasing, released.Status.Phase)
+	assert.True(t, util.IsHeld(released, time.Now()))
+
+	// The held address can be neither allocated nor requested
+	requested := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-hold-requested",
+			Namespace:   "default",
+			Annotations: map[string]string{ipamconstants.RequestedIPKey: "172.22.132.1"},
+		},
+		Spec: blendedv1.IPSpec{PoolName: pool.Name},
+	}
+	_, err = blendedset.InwinstackV1().IPs(requested.Namespace).Create(requested)
+	assert.Nil(t, err)
+
+	ip = &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-hold-2", Namespace: "default"},
+		Spec:       blendedv1.IPSpec{PoolName: pool.Name},
+	}
+	_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+	assert.Nil(t, err)
+
+	gip := testutil.WaitForIP(t, blendedset, ip.Namespace, ip.Name, func(ip *blendedv1.IP) bool {
+		return ip.Status.Phase == blendedv1.IPActive
+	})
+	assert.Equal(t, "172.22.132.2", gip.Status.Address)
+	grequested := testutil.WaitForIP(t, blendedset, requested.Namespace, requested.Name, func(ip *blendedv1.IP) bool {
+		return ip.Status.Phase == blendedv1.IPFailed
+	})
+	assert.Contains(t, grequested.Status.Reason, "is held")
+
+	cancel()
+	controller.Stop()
+}
+
+func TestConcurrentAllocation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	blendedset := blendedfake.NewSimpleClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	allocations := client.NewAllocations(dynamicClient)
+
+	// Two operators with their own caches race for the same pool
+	controllers := []*Controller{}
+	for i := 0; i < 2; i++ {
+		informer := blendedinformers.NewSharedInformerFactory(blendedset, 0)
+		k8sinformer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+		allocationInformer := client.NewAllocationInformer(allocations, 0)
+		quotaInformer := client.NewPoolQuotaInformer(client.NewPoolQuotas(dynamicClient), 0)
+		controller := NewController(
+			blendedset,
+			allocations,
+			client.NewConditions(dynamicClient),
+			informer.Inwinstack().V1().IPs(),
+			allocationInformer,
+			quotaInformer,
+			k8sinformer.Core().V1().Namespaces(),
+			&record.FakeRecorder{},
+			util.NewKeyMutex())
+		go informer.Start(ctx.Done())
+		go k8sinformer.Start(ctx.Done())
+		go allocationInformer.Informer().Run(ctx.Done())
+		go quotaInformer.Informer().Run(ctx.Done())
+		assert.Nil(t, controller.Run(ctx, 4))
+		controllers = append(controllers, controller)
+	}
+
+	pool := testutil.NewPool("test-concurrent", "172.22.132.0/26")
+	pool.Spec.AvoidBuggyIPs = true
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	const count = 50
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			ip := &blendedv1.IP{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("test-concurrent-%d", i), Namespace: "default"},
+				Spec:       blendedv1.IPSpec{PoolName: pool.Name},
+			}
+			_, err := blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
 			assert.Nil(t, err)
-			assert.Equal(t, []string{"172.22.132.1"}, gpool.Status.AllocatedIPs)
-			assert.Equal(t, 4, gpool.Status.Allocatable)
-			assert.Equal(t, 5, gpool.Status.Capacity)
-			failed = false
+		}(i)
+	}
+
+	owners := map[string]string{}
+	for start := time.Now(); time.Since(start) < 3*testutil.Timeout; {
+		ips, err := blendedset.InwinstackV1().IPs("default").List(metav1.ListOptions{})
+		assert.Nil(t, err)
+
+		owners = map[string]string{}
+		for _, ip := range ips.Items {
+			if ip.Status.Phase == blendedv1.IPActive {
+				assert.NotContains(t, owners, ip.Status.Address, "%s is allocated twice", ip.Status.Address)
+				owners[ip.Status.Address] = ip.Name
+			}
+		}
+
+		if len(owners) == count && len(allocatedAddresses(t, allocations, pool.Name)) == count {
 			break
 		}
 	}
-	assert.Equal(t, false, failed, "The service object failed to allocate IP.")
+	assert.Equal(t, count, len(owners))
 
-	// Test to deallocate IP
-	gip, err := blendedset.InwinstackV1().IPs(ip.Namespace).Get(ip.Name, metav1.GetOptions{})
+	// Every address is claimed by the IP that got it
+	list, err := allocations.List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, count, len(list.Items))
+	for _, allocation := range list.Items {
+		assert.Equal(t, owners[allocation.Spec.Address], allocation.Spec.IP.Name)
+	}
+
+	cancel()
+	for _, controller := range controllers {
+		controller.Stop()
+	}
+}
+
+func TestReleaseRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	// The first update that records the released address fails
+	failures := 1
+	blendedset.PrependReactor("update", "pools", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pool := action.(k8stesting.UpdateAction).GetObject().(*blendedv1.Pool)
+		if failures > 0 && pool.Annotations[ipamconstants.ReleasedIPsKey] != "" {
+			failures--
+			return true, nil, fmt.Errorf("unavailable")
+		}
+		return false, nil, nil
+	})
+
+	pool := testutil.NewPool("test-retry", "172.22.132.0-172.22.132.5")
+	pool.Annotations = map[string]string{ipamconstants.ReleaseHoldTimeKey: "1h"}
+	pool.Spec.AvoidBuggyIPs = true
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	ip := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-retry-1", Namespace: "default"},
+		Spec:       blendedv1.IPSpec{PoolName: pool.Name},
+		Status:     blendedv1.IPStatus{Phase: blendedv1.IPActive, Address: "172.22.132.1"},
+	}
+	_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+	assert.Nil(t, err)
+	createAllocation(t, allocations, pool.Name, "172.22.132.1", ip)
+
+	// The allocation stays active until the history is recorded
+	assert.NotNil(t, controller.deallocate(ip))
+	assert.Equal(t, 0, failures)
+	allocation, err := allocations.Get("172.22.132.1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, ipamv1.AllocationActive, allocation.Status.Phase)
+
+	assert.Nil(t, controller.deallocate(ip))
+	allocation, err = allocations.Get("172.22.132.1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, ipamv1.AllocationReleasing, allocation.Status.Phase)
+
+	gpool, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"172.22.132.1"}, util.PoolHistory(gpool).Released)
+
+	cancel()
+	controller.Stop()
+}
+
+func TestPoolUpdateConflict(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	// Someone else updates the pool twice in between
+	conflicts := 2
+	blendedset.PrependReactor("update", "pools", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			conflicts--
+			return true, nil, apierrors.NewConflict(blendedv1.Resource("pools"), "test-conflict", fmt.Errorf("conflict"))
+		}
+		return false, nil, nil
+	})
+
+	pool := testutil.NewPool("test-conflict", "172.22.132.0-172.22.132.5")
+	pool.Spec.AvoidBuggyIPs = true
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	ip := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-conflict-1", Namespace: "default"},
+		Spec:       blendedv1.IPSpec{PoolName: pool.Name},
+	}
+	_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+	assert.Nil(t, err)
+
+	gip := testutil.WaitForIP(t, blendedset, ip.Namespace, ip.Name, func(ip *blendedv1.IP) bool {
+		return ip.Status.Phase == blendedv1.IPActive
+	})
+	assert.Equal(t, "172.22.132.1", gip.Status.Address)
+	assert.Equal(t, 0, conflicts)
+	assert.Equal(t, []string{"172.22.132.1"}, allocatedAddresses(t, allocations, pool.Name))
+
+	gpool, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.1", gpool.Annotations[ipamconstants.LastAllocatedIPKey])
+
+	cancel()
+	controller.Stop()
+}
+
+func TestCrashReconciliation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	pool := testutil.NewPool("test-crash", "172.22.132.0-172.22.132.5")
+	pool.Spec.AvoidBuggyIPs = true
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	// The address was claimed, but the operator crashed before updating the IP
+	reserved := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-reserved", Namespace: "default"},
+		Spec:       blendedv1.IPSpec{PoolName: pool.Name},
+	}
+	createAllocation(t, allocations, pool.Name, "172.22.132.3", reserved)
+
+	// The IP got an address, but a claim made before the crash was left behind
+	stale := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-stale", Namespace: "default"},
+		Spec:       blendedv1.IPSpec{PoolName: pool.Name},
+		Status:     blendedv1.IPStatus{Phase: blendedv1.IPActive, Address: "172.22.132.1"},
+	}
+	createAllocation(t, allocations, pool.Name, "172.22.132.1", stale)
+	createAllocation(t, allocations, pool.Name, "172.22.132.2", stale)
+
+	_, err = blendedset.InwinstackV1().IPs(stale.Namespace).Create(stale)
+	assert.Nil(t, err)
+	_, err = blendedset.InwinstackV1().IPs(reserved.Namespace).Create(reserved)
+	assert.Nil(t, err)
+
+	gip := testutil.WaitForIP(t, blendedset, reserved.Namespace, reserved.Name, func(ip *blendedv1.IP) bool {
+		return ip.Status.Phase == blendedv1.IPActive && len(allocatedAddresses(t, allocations, pool.Name)) == 2
+	})
+	assert.Equal(t, "172.22.132.3", gip.Status.Address)
+	assert.Equal(t, []string{"172.22.132.1", "172.22.132.3"}, allocatedAddresses(t, allocations, pool.Name))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := record.NewFakeRecorder(100)
+	controller, blendedset, _ := newControllerWithRecorder(ctx, t, recorder)
+
+	pool := testutil.NewPool("test-events", "172.22.132.1-172.22.132.1")
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	for _, name := range []string{"test-ip-1", "test-ip-2"} {
+		ip := &blendedv1.IP{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       blendedv1.IPSpec{PoolName: pool.Name},
+		}
+		_, err := blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+		assert.Nil(t, err)
+
+		// The second IP is only created after the first one got the address
+		if name == "test-ip-1" {
+			assert.True(t, testutil.WaitForEvent(recorder, "Normal Allocated Allocated address 172.22.132.1"))
+		}
+	}
+	assert.True(t, testutil.WaitForEvent(recorder, "Warning PoolExhausted The \"test-events\" pool has been exhausted"))
+
+	gip, err := blendedset.InwinstackV1().IPs("default").Get("test-ip-2", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, blendedv1.IPFailed, gip.Status.Phase)
+	assert.True(t, strings.HasPrefix(gip.Status.Reason, "PoolExhausted: "))
+
+	gip, err = blendedset.InwinstackV1().IPs("default").Get("test-ip-1", metav1.GetOptions{})
 	assert.Nil(t, err)
 	assert.Nil(t, controller.deallocate(gip))
+	assert.True(t, testutil.WaitForEvent(recorder, "Normal Released Released address 172.22.132.1"))
 
+	// The IPs of a terminating pool fail
 	gpool, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
 	assert.Nil(t, err)
-	assert.Equal(t, []string{}, gpool.Status.AllocatedIPs)
-	assert.Equal(t, 5, gpool.Status.Allocatable)
-	assert.Equal(t, 5, gpool.Status.Capacity)
+	gpool.Status.Phase = blendedv1.PoolTerminating
+	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
+	assert.Nil(t, err)
+
+	gip, err = blendedset.InwinstackV1().IPs("default").Get("test-ip-2", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, controller.allocate(gip))
+	assert.True(t, testutil.WaitForEvent(recorder, "Warning PoolTerminating"))
+
+	gip, err = blendedset.InwinstackV1().IPs("default").Get("test-ip-2", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(gip.Status.Reason, "PoolTerminating: "))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestPoolChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := record.NewFakeRecorder(100)
+	controller, blendedset, allocations := newControllerWithRecorder(ctx, t, recorder)
+
+	for name, addresses := range map[string]string{"test-old": "172.22.132.1-172.22.132.1", "test-new": "172.22.133.1-172.22.133.1"} {
+		pool := testutil.NewPool(name, addresses)
+		_, err := blendedset.InwinstackV1().Pools().Create(pool)
+		assert.Nil(t, err)
+	}
+
+	// The IP got its address from its old pool, and its pool changed without the webhook
+	ip := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: "default"},
+		Spec:       blendedv1.IPSpec{PoolName: "test-new"},
+		Status:     blendedv1.IPStatus{Phase: blendedv1.IPActive},
+	}
+	util.SetIPAddresses(ip, []string{"172.22.132.1"})
+	util.SetIPPool(ip, "test-old")
+	createAllocation(t, allocations, "test-old", "172.22.132.1", ip)
+	_, err := blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+	assert.Nil(t, err)
+
+	// The IP fails, gives its address back and gets an address of its new pool
+	assert.True(t, testutil.WaitForEvent(recorder, "Warning PoolChanged The pool of the IP changed from \"test-old\" to \"test-new\""))
+	assert.True(t, testutil.WaitForEvent(recorder, "Normal Allocated Allocated address 172.22.133.1"))
+
+	gip, err := blendedset.InwinstackV1().IPs(ip.Namespace).Get(ip.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, blendedv1.IPActive, gip.Status.Phase)
+	assert.Equal(t, "test-new", util.IPPool(gip))
+
+	assert.True(t, testutil.WaitFor(func() bool {
+		return len(allocatedAddresses(t, allocations, "test-old")) == 0
+	}))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestConditions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, _ := newController(ctx, t)
+
+	pool := testutil.NewPool("test-conditions", "172.22.132.1-172.22.132.1")
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	hasConditions := func(name string, expected map[ipamv1.ConditionType]corev1.ConditionStatus, reason string) bool {
+		return testutil.WaitFor(func() bool {
+			ip, err := blendedset.InwinstackV1().IPs("default").Get(name, metav1.GetOptions{})
+			assert.Nil(t, err)
+
+			conditions, err := util.Conditions(ip.ObjectMeta)
+			assert.Nil(t, err)
+			matched := 0
+			for conditionType, status := range expected {
+				condition := util.FindCondition(conditions, conditionType)
+				if condition != nil && condition.Status == status && condition.ObservedGeneration == ip.Generation {
+					matched++
+				}
+			}
+
+			allocated := util.FindCondition(conditions, ipamv1.IPAllocated)
+			return matched == len(expected) && allocated.Reason == reason
+		})
+	}
+
+	tests := []struct {
+		name     string
+		pool     string
+		expected map[ipamv1.ConditionType]corev1.ConditionStatus
+		reason   string
+	}{
+		{
+			name: "test-ip-1",
+			pool: pool.Name,
+			expected: map[ipamv1.ConditionType]corev1.ConditionStatus{
+				ipamv1.IPAllocated:     corev1.ConditionTrue,
+				ipamv1.IPPoolAvailable: corev1.ConditionTrue,
+			},
+			reason: ipamconstants.AllocatedReason,
+		},
+		{
+			name: "test-ip-2",
+			pool: pool.Name,
+			expected: map[ipamv1.ConditionType]corev1.ConditionStatus{
+				ipamv1.IPAllocated:     corev1.ConditionFalse,
+				ipamv1.IPPoolAvailable: corev1.ConditionTrue,
+			},
+			reason: ipamconstants.PoolExhaustedReason,
+		},
+		{
+			name: "test-ip-3",
+			pool: "test-missing",
+			expected: map[ipamv1.ConditionType]corev1.ConditionStatus{
+				ipamv1.IPAllocated:     corev1.ConditionFalse,
+				ipamv1.IPPoolAvailable: corev1.ConditionFalse,
+			},
+			reason: ipamconstants.PendingReason,
+		},
+	}
+
+	for _, test := range tests {
+		ip := &blendedv1.IP{
+			ObjectMeta: metav1.ObjectMeta{Name: test.name, Namespace: "default", Generation: 1},
+			Spec:       blendedv1.IPSpec{PoolName: test.pool},
+		}
+		_, err := blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+		assert.Nil(t, err)
+		assert.True(t, hasConditions(test.name, test.expected, test.reason), test.name)
+	}
+
+	// The allocated IP follows the state of its pool
+	gpool, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	gpool.Status.Phase = blendedv1.PoolTerminating
+	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
+	assert.Nil(t, err)
+
+	gip, err := blendedset.InwinstackV1().IPs("default").Get("test-ip-1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, controller.syncConditions(gip))
+
+	gip, err = blendedset.InwinstackV1().IPs("default").Get("test-ip-1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, blendedv1.IPActive, gip.Status.Phase)
+	conditions, err := util.Conditions(gip.ObjectMeta)
+	assert.Nil(t, err)
+	assert.Equal(t, corev1.ConditionTrue, util.FindCondition(conditions, ipamv1.IPAllocated).Status)
+	available := util.FindCondition(conditions, ipamv1.IPPoolAvailable)
+	assert.Equal(t, corev1.ConditionFalse, available.Status)
+	assert.Equal(t, ipamconstants.PoolTerminatingReason, available.Reason)
+
+	cancel()
+	controller.Stop()
+}
+
+func TestPoolSelection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	newPool := func(name, address string, allocatable int, tier string) {
+		pool := testutil.NewPool(name, address)
+		pool.Status.Allocatable = allocatable
+		if tier != "" {
+			pool.Labels = map[string]string{"tier": tier}
+		}
+		_, err := blendedset.InwinstackV1().Pools().Create(pool)
+		assert.Nil(t, err)
+	}
+	newPool("test-full", "172.22.132.1/32", 0, "")
+	newPool("test-small", "172.22.133.0/30", 4, "public")
+	newPool("test-large", "172.22.134.0/28", 16, "public")
+
+	other := &blendedv1.IP{ObjectMeta: metav1.ObjectMeta{Name: "test-other", Namespace: "default", UID: "other-uid"}}
+	createAllocation(t, allocations, "test-full", "172.22.132.1", other)
+
+	waitForIP := func(name, pool string, annotations map[string]string) *blendedv1.IP {
+		ip := &blendedv1.IP{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+			Spec:       blendedv1.IPSpec{PoolName: pool},
+		}
+		_, err := blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+		assert.Nil(t, err)
+
+		return testutil.WaitForIP(t, blendedset, ip.Namespace, ip.Name, func(ip *blendedv1.IP) bool {
+			return ip.Status.Phase != blendedv1.IPNone
+		})
+	}
+
+	// The exhausted and missing pools are skipped in order
+	ip := waitForIP("test-fallback", "test-full", map[string]string{ipamconstants.FallbackPoolsKey: "test-missing,test-small"})
+	assert.Equal(t, blendedv1.IPActive, ip.Status.Phase)
+	assert.Equal(t, "172.22.133.0", ip.Status.Address)
+	assert.Equal(t, "test-small", ip.Annotations[ipamconstants.AllocatedPoolKey])
+	assert.Equal(t, []string{"172.22.133.0"}, allocatedAddresses(t, allocations, "test-small"))
+
+	conditions, err := util.Conditions(ip.ObjectMeta)
+	assert.Nil(t, err)
+	assert.Equal(t, "Allocated address 172.22.133.0 of the \"test-small\" pool", util.FindCondition(conditions, ipamv1.IPAllocated).Message)
+
+	// The selected pool with the most allocatable addresses goes first
+	selected := waitForIP("test-selected", "", map[string]string{
+		ipamconstants.PoolSelectorKey:  "tier=public",
+		ipamconstants.PoolSelectionKey: ipamconstants.PoolSelectionMostFree,
+	})
+	assert.Equal(t, blendedv1.IPActive, selected.Status.Phase)
+	assert.Equal(t, "test-large", util.IPPool(selected))
+	assert.Equal(t, "172.22.134.0", selected.Status.Address)
+
+	// The IP fails with the reasons of all its pools
+	failed := waitForIP("test-failed", "test-missing", map[string]string{ipamconstants.FallbackPoolsKey: "test-full"})
+	assert.Equal(t, blendedv1.IPFailed, failed.Status.Phase)
+	assert.Contains(t, failed.Status.Reason, "The \"test-missing\" pool doesn't exist; The \"test-full\" pool has been exhausted")
+
+	failed = waitForIP("test-unselected", "", map[string]string{ipamconstants.PoolSelectorKey: "tier=private"})
+	assert.Equal(t, blendedv1.IPFailed, failed.Status.Phase)
+	assert.Contains(t, failed.Status.Reason, ipamconstants.PoolNotFoundReason)
+
+	// The addresses go back to the pool they came from
+	assert.Nil(t, controller.deallocate(ip))
+	assert.Equal(t, []string{}, allocatedAddresses(t, allocations, "test-small"))
+	assert.Equal(t, []string{"172.22.132.1"}, allocatedAddresses(t, allocations, "test-full"))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestQuotas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	k8sclient := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant-a", Labels: map[string]string{"tenant": "a"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant-b", Labels: map[string]string{"tenant": "b"}}},
+	)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	recorder := record.NewFakeRecorder(100)
+	controller, blendedset, allocations := newControllerWithClients(ctx, t, recorder, k8sclient, dynamicClient)
+	quotas := client.NewPoolQuotas(dynamicClient)
+
+	for _, name := range []string{"test-shared", "test-other"} {
+		pool := testutil.NewPool(name, "172.22.132.0/24")
+		pool.Status.Allocatable = 256
+		if name == "test-other" {
+			pool.Spec.Addresses = []string{"172.22.133.0/24"}
+		}
+		_, err := blendedset.InwinstackV1().Pools().Create(pool)
+		assert.Nil(t, err)
+	}
+
+	_, err := quotas.Create(&ipamv1.PoolQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-tenants"},
+		Spec: ipamv1.PoolQuotaSpec{
+			PoolName:          "test-shared",
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "a"}},
+			Namespaces:        []string{"tenant-b"},
+			Limit:             3,
+		},
+	})
+	assert.Nil(t, err)
+	assert.True(t, testutil.WaitFor(func() bool {
+		quotas, _ := controller.quotaLister.ByPool("test-shared")
+		return len(quotas) == 1
+	}))
+
+	waitForIP := func(namespace, name string, annotations map[string]string) *blendedv1.IP {
+		ip := &blendedv1.IP{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: annotations},
+			Spec:       blendedv1.IPSpec{PoolName: "test-shared"},
+		}
+		_, err := blendedset.InwinstackV1().IPs(namespace).Create(ip)
+		assert.Nil(t, err)
+
+		return testutil.WaitForIP(t, blendedset, namespace, name, func(ip *blendedv1.IP) bool {
+			return ip.Status.Phase != blendedv1.IPNone
+		})
+	}
+
+	// The namespaces of the quota share its limit
+	ip := waitForIP("tenant-a", "test-first", map[string]string{ipamconstants.AddressCountKey: "2"})
+	assert.Equal(t, blendedv1.IPActive, ip.Status.Phase)
+	ip = waitForIP("tenant-b", "test-second", nil)
+	assert.Equal(t, blendedv1.IPActive, ip.Status.Phase)
+
+	failed := waitForIP("tenant-b", "test-third", nil)
+	assert.Equal(t, blendedv1.IPFailed, failed.Status.Phase)
+	assert.Equal(t, "QuotaExceeded: The \"test-tenants\" quota allows its namespaces 3 addresses of the \"test-shared\" pool, they hold 3 and the \"tenant-b\" namespace requests 1 more.", failed.Status.Reason)
+	assert.True(t, testutil.WaitForEvent(recorder, "Warning QuotaExceeded"))
+	assert.Equal(t, 3, len(allocatedAddresses(t, allocations, "test-shared")))
+
+	// The other namespaces aren't limited
+	ip = waitForIP("default", "test-unlimited", nil)
+	assert.Equal(t, blendedv1.IPActive, ip.Status.Phase)
+
+	// The pool over quota is skipped for the fallback pools
+	ip = waitForIP("tenant-a", "test-fallback", map[string]string{ipamconstants.FallbackPoolsKey: "test-other"})
+	assert.Equal(t, blendedv1.IPActive, ip.Status.Phase)
+	assert.Equal(t, "test-other", util.IPPool(ip))
+
+	// Each namespace can have its own limit
+	quota, err := quotas.Get("test-tenants", metav1.GetOptions{})
+	assert.Nil(t, err)
+	quota.Spec.PerNamespace = true
+	_, err = quotas.Update(quota)
+	assert.Nil(t, err)
+	assert.True(t, testutil.WaitFor(func() bool {
+		quota, err := controller.quotaLister.Get("test-tenants")
+		return err == nil && quota.Spec.PerNamespace
+	}))
+
+	ip = waitForIP("tenant-b", "test-fourth", nil)
+	assert.Equal(t, blendedv1.IPActive, ip.Status.Phase)
+	failed = waitForIP("tenant-a", "test-fifth", map[string]string{ipamconstants.AddressCountKey: "2"})
+	assert.Equal(t, blendedv1.IPFailed, failed.Status.Phase)
+	assert.Contains(t, failed.Status.Reason, "the \"tenant-a\" namespace holds 2 and requests 2 more")
 
 	cancel()
 	controller.Stop()
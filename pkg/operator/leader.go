@@ -0,0 +1,88 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package operator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const lockName = "ipam"
+
+// elect campaigns for the leadership in the background, and runs the controllers
+// while it's held. The done channel is closed once the election is over.
+func (o *Operator) elect(ctx context.Context) error {
+	id := o.cfg.LeaderElectIdentity
+	if id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get the leader election identity: %s", err.Error())
+		}
+		id = hostname
+	}
+
+	lock, err := resourcelock.New(
+		o.cfg.LockType,
+		o.cfg.LockNamespace,
+		lockName,
+		o.k8sclient.CoreV1(),
+		o.k8sclient.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: id})
+	if err != nil {
+		return fmt.Errorf("failed to create the leader lock: %s", err.Error())
+	}
+
+	var once sync.Once
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: o.cfg.LeaseDuration,
+		RenewDeadline: o.cfg.RenewDeadline,
+		RetryPeriod:   o.cfg.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				glog.Infof("Became the leader as %q", id)
+				if err := o.run(ctx); err != nil {
+					glog.Errorf("Failed to run the operator: %+v.", err)
+					once.Do(func() { close(o.done) })
+				}
+			},
+			OnStoppedLeading: func() {
+				glog.Infof("Stopped leading as %q", id)
+				o.Stop()
+				once.Do(func() { close(o.done) })
+			},
+			OnNewLeader: func(identity string) {
+				if identity != id {
+					glog.Infof("The leader is %q", identity)
+				}
+			},
+		},
+		ReleaseOnCancel: true,
+		Name:            lockName,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create the leader elector: %s", err.Error())
+	}
+
+	go elector.Run(ctx)
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operator
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/util"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// migrate moves the addresses that older versions kept in the pool status into allocation
+// objects, so that the controllers only have to deal with allocations.
+func (o *Operator) migrate() error {
+	pools, err := o.clientset.InwinstackV1().Pools().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	var owners map[string]*blendedv1.IP
+	for i := range pools.Items {
+		pool := &pools.Items[i]
+		if len(pool.Status.AllocatedIPs) == 0 {
+			continue
+		}
+
+		if owners == nil {
+			if owners, err = o.ownersByAddress(); err != nil {
+				return err
+			}
+		}
+
+		glog.Infof("Migrating %d allocated addresses of the \"%s\" pool.", len(pool.Status.AllocatedIPs), pool.Name)
+		for _, address := range pool.Status.AllocatedIPs {
+			owner := owners[fmt.Sprintf("%s/%s", pool.Name, address)]
+			allocation, err := util.NewAllocation(pool.Name, address, owner)
+			if err != nil {
+				glog.Warningf("Pool \"%s\" has an invalid address %s, dropping it.", pool.Name, address)
+				continue
+			}
+
+			// The address may still be in use, so it's kept until its allocation is deleted
+			if owner == nil {
+				glog.Warningf("Address %s of the \"%s\" pool has no IP, keeping it.", address, pool.Name)
+				allocation.Labels[ipamconstants.MigratedLabelKey] = "true"
+			}
+
+			if err := o.createAllocation(allocation); err != nil {
+				return err
+			}
+		}
+
+		poolCopy := pool.DeepCopy()
+		poolCopy.Status.AllocatedIPs = []string{}
+		updated, err := o.clientset.InwinstackV1().Pools().Update(poolCopy)
+		if err != nil {
+			return err
+		}
+
+		if err := o.conditions.Mirror(client.PoolResource, updated.ObjectMeta); err != nil {
+			glog.Warningf("Failed to mirror the conditions of the \"%s\" pool: %+v.", pool.Name, err)
+		}
+	}
+	return nil
+}
+
+// ownersByAddress maps the "pool/address" of every allocated IP to the IP.
+func (o *Operator) ownersByAddress() (map[string]*blendedv1.IP, error) {
+	ips, err := o.clientset.InwinstackV1().IPs(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	owners := map[string]*blendedv1.IP{}
+	for i := range ips.Items {
+		ip := &ips.Items[i]
+		if ip.Status.Address != "" {
+			owners[fmt.Sprintf("%s/%s", ip.Spec.PoolName, ip.Status.Address)] = ip
+		}
+	}
+	return owners, nil
+}
+
+func (o *Operator) createAllocation(allocation *ipamv1.Allocation) error {
+	if _, err := o.allocations.Create(allocation); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/config"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMigrate(t *testing.T) {
+	blendedset := blendedfake.NewSimpleClientset()
+	op := New(&config.Config{Threads: 2}, k8sfake.NewSimpleClientset(), blendedset, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-migrate"},
+		Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.132.0/24"}},
+		Status: blendedv1.PoolStatus{
+			Phase:        blendedv1.PoolActive,
+			AllocatedIPs: []string{"172.22.132.1", "172.22.132.2"},
+		},
+	}
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	ip := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: "default"},
+		Spec:       blendedv1.IPSpec{PoolName: pool.Name},
+		Status:     blendedv1.IPStatus{Phase: blendedv1.IPActive, Address: "172.22.132.1"},
+	}
+	_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+	assert.Nil(t, err)
+
+	assert.Nil(t, op.migrate())
+
+	owned, err := op.allocations.Get("172.22.132.1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, ipamv1.IPReference{Namespace: "default", Name: "test-ip"}, owned.Spec.IP)
+	assert.Equal(t, ipamv1.AllocationActive, owned.Status.Phase)
+
+	// The address without an IP is kept, but marked as migrated
+	leaked, err := op.allocations.Get("172.22.132.2", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", leaked.Spec.IP.Name)
+	assert.Equal(t, "true", leaked.Labels[ipamconstants.MigratedLabelKey])
+	assert.Equal(t, "", owned.Labels[ipamconstants.MigratedLabelKey])
+
+	gpool, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, gpool.Status.AllocatedIPs)
+
+	// Migrating twice is a no-op
+	assert.Nil(t, op.migrate())
+	list, err := op.allocations.List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(list.Items))
+}
+
+func TestMigrateOwnerless(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	blendedset := blendedfake.NewSimpleClientset()
+	cfg := &config.Config{Threads: 2, GCPeriod: 10 * time.Millisecond}
+	op := New(cfg, k8sfake.NewSimpleClientset(), blendedset, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-ownerless"},
+		Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.132.0/24"}},
+		Status: blendedv1.PoolStatus{
+			Phase:        blendedv1.PoolActive,
+			AllocatedIPs: []string{"172.22.132.1"},
+		},
+	}
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+	assert.Nil(t, op.migrate())
+
+	// The address that lost its IP after the migration is reclaimed as usual
+	leaked, err := util.NewAllocation(pool.Name, "172.22.132.2", nil)
+	assert.Nil(t, err)
+	_, err = op.allocations.Create(leaked)
+	assert.Nil(t, err)
+
+	go op.informer.Start(ctx.Done())
+	go op.allocationInformer.Informer().Run(ctx.Done())
+	assert.Nil(t, op.gc.Run(ctx))
+
+	reclaimed := false
+	for start := time.Now(); time.Since(start) < timeout; {
+		if _, err := op.allocations.Get(leaked.Name, metav1.GetOptions{}); errors.IsNotFound(err) {
+			reclaimed = true
+			break
+		}
+	}
+	assert.True(t, reclaimed)
+
+	// The migrated address is kept, since it may still be in use
+	migrated, err := op.allocations.Get("172.22.132.1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", migrated.Spec.IP.Name)
+	assert.Equal(t, "true", migrated.Labels[ipamconstants.MigratedLabelKey])
+	assert.Equal(t, ipamv1.AllocationActive, migrated.Status.Phase)
+
+	cancel()
+	op.gc.Stop()
+}
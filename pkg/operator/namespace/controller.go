@@ -0,0 +1,325 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package namespace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blended "github.com/inwinstack/blended/generated/clientset/versioned"
+	informerv1 "github.com/inwinstack/blended/generated/informers/externalversions/inwinstack/v1"
+	listerv1 "github.com/inwinstack/blended/generated/listers/inwinstack/v1"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/thoas/go-funk"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformerv1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisterv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Controller represents the controller that assigns the IPs of the pools to the namespaces
+type Controller struct {
+	k8sclient  kubernetes.Interface
+	blendedset blended.Interface
+	lister     corelisterv1.NamespaceLister
+	poolLister listerv1.PoolLister
+	ipLister   listerv1.IPLister
+	synced     []cache.InformerSynced
+	queue      workqueue.RateLimitingInterface
+	recorder   record.EventRecorder
+}
+
+// assignedSelector selects the IPs that the pools assigned to the namespaces
+var assignedSelector = func() labels.Selector {
+	requirement, err := labels.NewRequirement(ipamconstants.NamespacePoolLabelKey, selection.Exists, nil)
+	utilruntime.Must(err)
+	return labels.NewSelector().Add(*requirement)
+}()
+
+// NewController creates an instance of the namespace controller
+func NewController(
+	k8sclient kubernetes.Interface,
+	blendedset blended.Interface,
+	informer coreinformerv1.NamespaceInformer,
+	poolInformer informerv1.PoolInformer,
+	ipInformer informerv1.IPInformer,
+	recorder record.EventRecorder) *Controller {
+	controller := &Controller{
+		k8sclient:  k8sclient,
+		blendedset: blendedset,
+		lister:     informer.Lister(),
+		poolLister: poolInformer.Lister(),
+		ipLister:   ipInformer.Lister(),
+		synced: []cache.InformerSynced{
+			informer.Informer().HasSynced,
+			poolInformer.Informer().HasSynced,
+			ipInformer.Informer().HasSynced,
+		},
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Namespaces"),
+		recorder: recorder,
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueue,
+		UpdateFunc: func(old, new interface{}) { controller.enqueue(new) },
+	})
+	poolInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueueAll,
+		UpdateFunc: func(old, new interface{}) { controller.enqueueAll(new) },
+		DeleteFunc: controller.enqueueAll,
+	})
+	ipInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueueIPNamespace,
+		UpdateFunc: func(old, new interface{}) { controller.enqueueIPNamespace(new) },
+		DeleteFunc: controller.enqueueIPNamespace,
+	})
+	return controller
+}
+
+// Run serves the namespace controller
+func (c *Controller) Run(ctx context.Context, threadiness int) error {
+	glog.Info("Starting the namespace controller")
+	glog.Info("Waiting for the namespace informer caches to sync")
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.synced...); !ok {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+
+	for i := 0; i < threadiness; i++ {
+		go wait.Until(c.runWorker, time.Second, ctx.Done())
+	}
+	return nil
+}
+
+// Stop stops the namespace controller
+func (c *Controller) Stop() {
+	glog.Info("Stopping the namespace controller")
+	c.queue.ShutDown()
+}
+
+func (c *Controller) runWorker() {
+	defer utilruntime.HandleCrash()
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	obj, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+
+	err := func(obj interface{}) error {
+		defer c.queue.Done(obj)
+		key, ok := obj.(string)
+		if !ok {
+			c.queue.Forget(obj)
+			utilruntime.HandleError(fmt.Errorf("Namespace expected string in workqueue but got %#v", obj))
+			return nil
+		}
+
+		if err := c.reconcile(key); err != nil {
+			c.queue.AddRateLimited(key)
+			return fmt.Errorf("Namespace error syncing '%s': %s, requeuing", key, err.Error())
+		}
+
+		c.queue.Forget(obj)
+		glog.V(2).Infof("Namespace successfully synced '%s'", key)
+		return nil
+	}(obj)
+
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+	return true
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// enqueueAll enqueues every namespace when a pool changes
+func (c *Controller) enqueueAll(obj interface{}) {
+	namespaces, err := c.lister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, ns := range namespaces {
+		c.queue.Add(ns.Name)
+	}
+}
+
+// enqueueIPNamespace enqueues the namespace of an assigned IP to refresh its addresses
+func (c *Controller) enqueueIPNamespace(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	ip, ok := obj.(*blendedv1.IP)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("Namespace expected an IP but got %#v", obj))
+		return
+	}
+
+	if _, ok := ip.Labels[ipamconstants.NamespacePoolLabelKey]; ok {
+		c.queue.Add(ip.Namespace)
+	}
+}
+
+// assigns checks if the pool assigns an IP to the namespace.
+func assigns(pool *blendedv1.Pool, ns *corev1.Namespace) bool {
+	return pool.Spec.AssignToNamespace && !funk.ContainsString(pool.Spec.IgnoreNamespaces, ns.Name)
+}
+
+func (c *Controller) reconcile(key string) error {
+	ns, err := c.lister.Get(key)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// The IPs are deleted along with the namespace
+			return nil
+		}
+		return err
+	}
+
+	pools, err := c.poolLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	ips, err := c.ipLister.IPs(ns.Name).List(assignedSelector)
+	if err != nil {
+		return err
+	}
+
+	assigned := map[string]*blendedv1.IP{}
+	for _, ip := range ips {
+		assigned[ip.Labels[ipamconstants.NamespacePoolLabelKey]] = ip
+	}
+
+	addresses := map[string]string{}
+	for _, pool := range pools {
+		ip, ok := assigned[pool.Name]
+		delete(assigned, pool.Name)
+
+		// A deleted pool drains its IPs according to its own policy
+		deleted := !pool.DeletionTimestamp.IsZero()
+		if !assigns(pool, ns) || (!ok && deleted) {
+			if ok {
+				assigned[pool.Name] = ip
+			}
+			continue
+		}
+
+		if !ok {
+			if ns.DeletionTimestamp.IsZero() {
+				if err := c.createIP(ns, pool); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if !pool.Spec.IgnoreNamespaceAnnotation && ip.Status.Phase == blendedv1.IPActive && ip.Status.Address != "" {
+			addresses[pool.Name] = ip.Status.Address
+		}
+	}
+
+	// The IPs of the pools that no longer assign them to the namespace
+	for _, ip := range assigned {
+		glog.Infof("Namespace \"%s\" deletes the IP of the \"%s\" pool.", ns.Name, ip.Labels[ipamconstants.NamespacePoolLabelKey])
+		if err := c.blendedset.InwinstackV1().IPs(ip.Namespace).Delete(ip.Name, nil); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return c.annotate(ns, addresses)
+}
+
+// createIP creates the IP that the pool assigns to the namespace, named after the pool.
+func (c *Controller) createIP(ns *corev1.Namespace, pool *blendedv1.Pool) error {
+	ip := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pool.Name,
+			Namespace: ns.Name,
+			Labels:    map[string]string{ipamconstants.NamespacePoolLabelKey: pool.Name},
+		},
+		Spec: blendedv1.IPSpec{PoolName: pool.Name},
+	}
+
+	if _, err := c.blendedset.InwinstackV1().IPs(ns.Name).Create(ip); err != nil {
+		if errors.IsAlreadyExists(err) {
+			glog.Warningf("Namespace \"%s\" already has an IP named \"%s\", skipping the pool.", ns.Name, pool.Name)
+			return nil
+		}
+		return err
+	}
+	c.recorder.Eventf(ns, corev1.EventTypeNormal, ipamconstants.NamespaceAssignedReason,
+		"Created the IP of the \"%s\" pool", pool.Name)
+	return nil
+}
+
+// annotate records the assigned addresses on the namespace, by the name of their pool.
+func (c *Controller) annotate(ns *corev1.Namespace, addresses map[string]string) error {
+	current := map[string]string{}
+	if value, ok := ns.Annotations[ipamconstants.NamespaceIPsKey]; ok {
+		// The annotation is rewritten if it can't be read
+		if err := json.Unmarshal([]byte(value), &current); err != nil {
+			current = nil
+		}
+	}
+
+	if reflect.DeepEqual(current, addresses) {
+		return nil
+	}
+
+	nsCopy := ns.DeepCopy()
+	if len(addresses) == 0 {
+		delete(nsCopy.Annotations, ipamconstants.NamespaceIPsKey)
+	} else {
+		data, err := json.Marshal(addresses)
+		if err != nil {
+			return err
+		}
+
+		if nsCopy.Annotations == nil {
+			nsCopy.Annotations = map[string]string{}
+		}
+		nsCopy.Annotations[ipamconstants.NamespaceIPsKey] = string(data)
+	}
+
+	_, err := c.k8sclient.CoreV1().Namespaces().Update(nsCopy)
+	return err
+}
@@ -0,0 +1,156 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package namespace
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
+	blendedinformers "github.com/inwinstack/blended/generated/informers/externalversions"
+	"github.com/inwinstack/ipam/pkg/config"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const timeout = 3 * time.Second
+
+func newController(ctx context.Context, t *testing.T) (*Controller, *k8sfake.Clientset, *blendedfake.Clientset) {
+	cfg := &config.Config{Threads: 2}
+	k8sclient := k8sfake.NewSimpleClientset()
+	blendedset := blendedfake.NewSimpleClientset()
+	k8sinformer := informers.NewSharedInformerFactory(k8sclient, 0)
+	informer := blendedinformers.NewSharedInformerFactory(blendedset, 0)
+
+	controller := NewController(
+		k8sclient,
+		blendedset,
+		k8sinformer.Core().V1().Namespaces(),
+		informer.Inwinstack().V1().Pools(),
+		informer.Inwinstack().V1().IPs(),
+		&record.FakeRecorder{})
+	go k8sinformer.Start(ctx.Done())
+	go informer.Start(ctx.Done())
+	assert.Nil(t, controller.Run(ctx, cfg.Threads))
+	return controller, k8sclient, blendedset
+}
+
+func TestNamespaceController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, k8sclient, blendedset := newController(ctx, t)
+
+	for _, name := range []string{"test-ns", "kube-system"} {
+		_, err := k8sclient.CoreV1().Namespaces().Create(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		assert.Nil(t, err)
+	}
+
+	pools := []*blendedv1.Pool{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-assigned"},
+			Spec: blendedv1.PoolSpec{
+				Addresses:         []string{"172.22.132.0/24"},
+				AssignToNamespace: true,
+				IgnoreNamespaces:  []string{"kube-system"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-unannotated"},
+			Spec: blendedv1.PoolSpec{
+				Addresses:                 []string{"172.22.133.0/24"},
+				AssignToNamespace:         true,
+				IgnoreNamespaceAnnotation: true,
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-unassigned"},
+			Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.134.0/24"}},
+		},
+	}
+	for _, pool := range pools {
+		_, err := blendedset.InwinstackV1().Pools().Create(pool)
+		assert.Nil(t, err)
+	}
+
+	hasIP := func(namespace, name string) bool {
+		for start := time.Now(); time.Since(start) < timeout; {
+			if _, err := blendedset.InwinstackV1().IPs(namespace).Get(name, metav1.GetOptions{}); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+	assert.True(t, hasIP("test-ns", "test-assigned"))
+	assert.True(t, hasIP("test-ns", "test-unannotated"))
+	assert.True(t, hasIP("kube-system", "test-unannotated"))
+
+	// The ignored namespaces and the unassigned pools get no IP
+	for _, ip := range []struct{ namespace, name string }{{"kube-system", "test-assigned"}, {"test-ns", "test-unassigned"}} {
+		_, err := blendedset.InwinstackV1().IPs(ip.namespace).Get(ip.name, metav1.GetOptions{})
+		assert.True(t, errors.IsNotFound(err), ip.name)
+	}
+
+	// Allocate the addresses
+	for name, address := range map[string]string{"test-assigned": "172.22.132.1", "test-unannotated": "172.22.133.1"} {
+		ip, err := blendedset.InwinstackV1().IPs("test-ns").Get(name, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, name, ip.Labels[ipamconstants.NamespacePoolLabelKey])
+		ip.Status.Phase = blendedv1.IPActive
+		ip.Status.Address = address
+		_, err = blendedset.InwinstackV1().IPs("test-ns").Update(ip)
+		assert.Nil(t, err)
+	}
+
+	annotated := func(expected map[string]string) bool {
+		for start := time.Now(); time.Since(start) < timeout; {
+			ns, err := k8sclient.CoreV1().Namespaces().Get("test-ns", metav1.GetOptions{})
+			assert.Nil(t, err)
+
+			addresses := map[string]string{}
+			if value, ok := ns.Annotations[ipamconstants.NamespaceIPsKey]; ok {
+				assert.Nil(t, json.Unmarshal([]byte(value), &addresses))
+			}
+			if assert.ObjectsAreEqual(expected, addresses) {
+				return true
+			}
+		}
+		return false
+	}
+	assert.True(t, annotated(map[string]string{"test-assigned": "172.22.132.1"}))
+
+	// The IP goes away when the pool no longer assigns it
+	pool, err := blendedset.InwinstackV1().Pools().Get("test-assigned", metav1.GetOptions{})
+	assert.Nil(t, err)
+	pool.Spec.IgnoreNamespaces = append(pool.Spec.IgnoreNamespaces, "test-ns")
+	_, err = blendedset.InwinstackV1().Pools().Update(pool)
+	assert.Nil(t, err)
+	assert.True(t, annotated(map[string]string{}))
+
+	_, err = blendedset.InwinstackV1().IPs("test-ns").Get("test-assigned", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	cancel()
+	controller.Stop()
+}
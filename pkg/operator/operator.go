@@ -21,46 +21,210 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/golang/glog"
 	blended "github.com/inwinstack/blended/generated/clientset/versioned"
+	blendedscheme "github.com/inwinstack/blended/generated/clientset/versioned/scheme"
 	blendedinformers "github.com/inwinstack/blended/generated/informers/externalversions"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
 	"github.com/inwinstack/ipam/pkg/config"
+	"github.com/inwinstack/ipam/pkg/operator/gc"
 	"github.com/inwinstack/ipam/pkg/operator/ip"
+	"github.com/inwinstack/ipam/pkg/operator/namespace"
+	"github.com/inwinstack/ipam/pkg/operator/pod"
 	"github.com/inwinstack/ipam/pkg/operator/pool"
+	"github.com/inwinstack/ipam/pkg/operator/prefix"
+	"github.com/inwinstack/ipam/pkg/operator/quota"
+	"github.com/inwinstack/ipam/pkg/operator/service"
+	"github.com/inwinstack/ipam/pkg/util"
+	"github.com/inwinstack/ipam/pkg/webhook"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 const defaultSyncTime = time.Second * 30
 
 // Operator represents an operator context
 type Operator struct {
-	clientset blended.Interface
-	informer  blendedinformers.SharedInformerFactory
-	cfg       *config.Config
-	pool      *pool.Controller
-	ip        *ip.Controller
+	k8sclient           kubernetes.Interface
+	clientset           blended.Interface
+	allocations         client.AllocationInterface
+	prefixClaims        client.PrefixClaimsGetter
+	quotas              client.PoolQuotaInterface
+	conditions          client.ConditionsInterface
+	informer            blendedinformers.SharedInformerFactory
+	k8sinformer         informers.SharedInformerFactory
+	allocationInformer  client.AllocationInformer
+	prefixClaimInformer client.PrefixClaimInformer
+	quotaInformer       client.PoolQuotaInformer
+	cfg                 *config.Config
+	pool                *pool.Controller
+	ip                  *ip.Controller
+	prefix              *prefix.Controller
+	quota               *quota.Controller
+	namespace           *namespace.Controller
+	service             *service.Controller
+	pod                 *pod.Controller
+	gc                  *gc.Collector
+	webhook             *webhook.Server
+	done                chan struct{}
+}
+
+// newRecorder creates an event recorder that knows the IPAM resources
+func newRecorder(clientset kubernetes.Interface) record.EventRecorder {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(blendedscheme.AddToScheme(scheme))
+	utilruntime.Must(ipamv1.AddToScheme(scheme))
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.V(2).Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme, corev1.EventSource{Component: "ipam"})
 }
 
 // New creates an instance of the operator
-func New(cfg *config.Config, clientset blended.Interface) *Operator {
+func New(cfg *config.Config, k8sclient kubernetes.Interface, clientset blended.Interface, dynamicClient dynamic.Interface) *Operator {
 	t := defaultSyncTime
 	if cfg.SyncSec > 30 {
 		t = time.Second * time.Duration(cfg.SyncSec)
 	}
-	o := &Operator{cfg: cfg, clientset: clientset}
+	o := &Operator{
+		cfg:          cfg,
+		k8sclient:    k8sclient,
+		clientset:    clientset,
+		allocations:  client.NewAllocations(dynamicClient),
+		prefixClaims: client.NewPrefixClaims(dynamicClient),
+		quotas:       client.NewPoolQuotas(dynamicClient),
+		conditions:   client.NewConditions(dynamicClient),
+		done:         make(chan struct{}),
+	}
 	o.informer = blendedinformers.NewSharedInformerFactory(clientset, t)
-	o.pool = pool.NewController(clientset, o.informer.Inwinstack().V1().Pools())
-	o.ip = ip.NewController(clientset, o.informer.Inwinstack().V1().IPs())
+	o.allocationInformer = client.NewAllocationInformer(o.allocations, t)
+	o.prefixClaimInformer = client.NewPrefixClaimInformer(o.prefixClaims, t)
+	o.quotaInformer = client.NewPoolQuotaInformer(o.quotas, t)
+	o.k8sinformer = informers.NewSharedInformerFactory(k8sclient, t)
+	recorder := newRecorder(k8sclient)
+	// The IPs, the prefix claims and the child pools take the addresses of a pool one at a time
+	pools := util.NewKeyMutex()
+	o.pool = pool.NewController(clientset, o.allocations, o.conditions, o.informer.Inwinstack().V1().Pools(), o.allocationInformer, recorder, pools)
+	o.ip = ip.NewController(
+		clientset,
+		o.allocations,
+		o.conditions,
+		o.informer.Inwinstack().V1().IPs(),
+		o.allocationInformer,
+		o.quotaInformer,
+		o.k8sinformer.Core().V1().Namespaces(),
+		recorder,
+		pools)
+	o.prefix = prefix.NewController(
+		clientset,
+		o.prefixClaims,
+		o.allocations,
+		o.prefixClaimInformer,
+		o.informer.Inwinstack().V1().Pools(),
+		recorder,
+		pools)
+	o.quota = quota.NewController(o.quotas, o.quotaInformer, o.allocationInformer, o.k8sinformer.Core().V1().Namespaces())
+	o.namespace = namespace.NewController(
+		k8sclient,
+		clientset,
+		o.k8sinformer.Core().V1().Namespaces(),
+		o.informer.Inwinstack().V1().Pools(),
+		o.informer.Inwinstack().V1().IPs(),
+		recorder)
+	o.service = service.NewController(
+		k8sclient,
+		clientset,
+		o.k8sinformer.Core().V1().Services(),
+		o.informer.Inwinstack().V1().IPs(),
+		recorder,
+		cfg)
+	o.pod = pod.NewController(
+		k8sclient,
+		clientset,
+		o.k8sinformer.Core().V1().Pods(),
+		o.k8sinformer.Apps().V1().StatefulSets(),
+		o.informer.Inwinstack().V1().IPs(),
+		recorder)
+	if cfg.GCPeriod > 0 {
+		o.gc = gc.NewCollector(
+			clientset,
+			o.allocations,
+			o.informer.Inwinstack().V1().IPs(),
+			o.informer.Inwinstack().V1().Pools(),
+			o.allocationInformer,
+			recorder,
+			cfg)
+	}
+	if cfg.WebhookAddr != "" {
+		o.webhook = webhook.NewServer(clientset, o.allocations)
+	}
 	return o
 }
 
-// Run serves an isntance of the operator
+// Run serves an isntance of the operator. With leader election, the controllers only
+// run once the leadership is acquired, and they are stopped when it's lost.
 func (o *Operator) Run(ctx context.Context) error {
+	if o.webhook != nil {
+		if err := o.webhook.Run(ctx, o.cfg.WebhookAddr, o.cfg.TLSCertFile, o.cfg.TLSKeyFile); err != nil {
+			return fmt.Errorf("failed to run the webhook server: %s", err.Error())
+		}
+	}
+
+	if !o.cfg.LeaderElect {
+		return o.run(ctx)
+	}
+	return o.elect(ctx)
+}
+
+// Done returns a channel that is closed when the operator stops leading.
+func (o *Operator) Done() <-chan struct{} {
+	return o.done
+}
+
+func (o *Operator) run(ctx context.Context) error {
+	if err := o.migrate(); err != nil {
+		return fmt.Errorf("failed to migrate the allocated addresses: %s", err.Error())
+	}
+
 	go o.informer.Start(ctx.Done())
+	go o.k8sinformer.Start(ctx.Done())
+	go o.allocationInformer.Informer().Run(ctx.Done())
+	go o.prefixClaimInformer.Informer().Run(ctx.Done())
+	go o.quotaInformer.Informer().Run(ctx.Done())
 	if err := o.pool.Run(ctx, o.cfg.Threads); err != nil {
 		return fmt.Errorf("failed to run the pool controller: %s", err.Error())
 	}
 	if err := o.ip.Run(ctx, o.cfg.Threads); err != nil {
 		return fmt.Errorf("failed to run the ip controller: %s", err.Error())
 	}
+	if err := o.prefix.Run(ctx, o.cfg.Threads); err != nil {
+		return fmt.Errorf("failed to run the prefix claim controller: %s", err.Error())
+	}
+	if err := o.quota.Run(ctx, o.cfg.Threads); err != nil {
+		return fmt.Errorf("failed to run the pool quota controller: %s", err.Error())
+	}
+	if err := o.namespace.Run(ctx, o.cfg.Threads); err != nil {
+		return fmt.Errorf("failed to run the namespace controller: %s", err.Error())
+	}
+	if err := o.service.Run(ctx, o.cfg.Threads); err != nil {
+		return fmt.Errorf("failed to run the service controller: %s", err.Error())
+	}
+	if err := o.pod.Run(ctx, o.cfg.Threads); err != nil {
+		return fmt.Errorf("failed to run the pod controller: %s", err.Error())
+	}
+	if o.gc != nil {
+		if err := o.gc.Run(ctx); err != nil {
+			return fmt.Errorf("failed to run the garbage collector: %s", err.Error())
+		}
+	}
 	return nil
 }
 
@@ -68,4 +232,12 @@ func (o *Operator) Run(ctx context.Context) error {
 func (o *Operator) Stop() {
 	o.pool.Stop()
 	o.ip.Stop()
+	o.prefix.Stop()
+	o.quota.Stop()
+	o.namespace.Stop()
+	o.service.Stop()
+	o.pod.Stop()
+	if o.gc != nil {
+		o.gc.Stop()
+	}
 }
@@ -18,9 +18,11 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
 	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
 	"github.com/inwinstack/ipam/pkg/config"
 	"github.com/stretchr/testify/assert"
 	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
@@ -28,8 +30,13 @@ import (
 	extensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
 )
 
+const timeout = 3 * time.Second
+
 type customResource struct {
 	Name       string
 	Kind       string
@@ -69,7 +76,7 @@ func createCRD(clientset apiextensionsclientset.Interface, resource customResour
 
 func TestOperator(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	cfg := &config.Config{Threads: 2}
+	cfg := &config.Config{Threads: 2, GCPeriod: time.Minute}
 	blendedset := blendedfake.NewSimpleClientset()
 	extensionsClient := extensionsfake.NewSimpleClientset()
 
@@ -82,6 +89,14 @@ func TestOperator(t *testing.T) {
 			Version: blendedv1.Version,
 			Scope:   apiextensionsv1beta1.ClusterScoped,
 		},
+		{
+			Name:    "allocation",
+			Plural:  "allocations",
+			Kind:    reflect.TypeOf(ipamv1.Allocation{}).Name(),
+			Group:   ipamv1.GroupName,
+			Version: ipamv1.Version,
+			Scope:   apiextensionsv1beta1.ClusterScoped,
+		},
 		{
 			Name:    "ip",
 			Plural:  "ips",
@@ -99,10 +114,88 @@ func TestOperator(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, len(resources), len(crds.Items))
 
-	op := New(cfg, blendedset)
+	op := New(cfg, k8sfake.NewSimpleClientset(), blendedset, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
 	assert.NotNil(t, op)
 	assert.Nil(t, op.Run(ctx))
 
 	cancel()
 	op.Stop()
 }
+
+func poll(condition func() bool) bool {
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLeaderElection(t *testing.T) {
+	k8sclient := k8sfake.NewSimpleClientset()
+	blendedset := blendedfake.NewSimpleClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	newOperator := func(id string) *Operator {
+		cfg := &config.Config{
+			Threads:             2,
+			LeaderElect:         true,
+			LeaderElectIdentity: id,
+			LockType:            "leases",
+			LockNamespace:       "kube-system",
+			LeaseDuration:       time.Second,
+			RenewDeadline:       500 * time.Millisecond,
+			RetryPeriod:         100 * time.Millisecond,
+		}
+		return New(cfg, k8sclient, blendedset, dynamicClient)
+	}
+
+	holder := func() string {
+		lease, err := k8sclient.CoordinationV1().Leases("kube-system").Get(lockName, metav1.GetOptions{})
+		if err != nil || lease.Spec.HolderIdentity == nil {
+			return ""
+		}
+		return *lease.Spec.HolderIdentity
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	op1 := newOperator("test-1")
+	assert.Nil(t, op1.Run(ctx1))
+	assert.True(t, poll(func() bool { return holder() == "test-1" }), "The first replica didn't lead.")
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	op2 := newOperator("test-2")
+	assert.Nil(t, op2.Run(ctx2))
+
+	// The second replica waits while the first one leads
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, "test-1", holder())
+
+	// Losing the leadership stops the first replica, and the second one takes over
+	cancel1()
+	select {
+	case <-op1.Done():
+	case <-time.After(timeout):
+		assert.Fail(t, "The first replica didn't stop leading.")
+	}
+	assert.True(t, poll(func() bool { return holder() == "test-2" }), "The second replica didn't take over.")
+
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.132.0/24"}},
+	}
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+	assert.True(t, poll(func() bool {
+		pool, err := blendedset.InwinstackV1().Pools().Get("test", metav1.GetOptions{})
+		return err == nil && pool.Status.Phase == blendedv1.PoolActive
+	}), "The leader didn't reconcile the pool.")
+
+	select {
+	case <-op2.Done():
+		assert.Fail(t, "The second replica stopped leading.")
+	default:
+	}
+	op2.Stop()
+}
@@ -0,0 +1,371 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pod
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blended "github.com/inwinstack/blended/generated/clientset/versioned"
+	informerv1 "github.com/inwinstack/blended/generated/informers/externalversions/inwinstack/v1"
+	listerv1 "github.com/inwinstack/blended/generated/listers/inwinstack/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/util"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	appsinformerv1 "k8s.io/client-go/informers/apps/v1"
+	coreinformerv1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	appslisterv1 "k8s.io/client-go/listers/apps/v1"
+	corelisterv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Controller represents the controller that gives static addresses to the pods with a pool
+// annotation. It creates an IP named after each pod, and writes the address of the IP into
+// the annotations of the pod for the CNI plugin. The IPs of the pods of a StatefulSet belong
+// to the StatefulSet, so they're kept when the pods are recreated, and released when the
+// StatefulSet scales down.
+type Controller struct {
+	k8sclient  kubernetes.Interface
+	blendedset blended.Interface
+	lister     corelisterv1.PodLister
+	setLister  appslisterv1.StatefulSetLister
+	ipLister   listerv1.IPLister
+	synced     []cache.InformerSynced
+	queue      workqueue.RateLimitingInterface
+	recorder   record.EventRecorder
+}
+
+// NewController creates an instance of the pod controller
+func NewController(
+	k8sclient kubernetes.Interface,
+	blendedset blended.Interface,
+	informer coreinformerv1.PodInformer,
+	setInformer appsinformerv1.StatefulSetInformer,
+	ipInformer informerv1.IPInformer,
+	recorder record.EventRecorder) *Controller {
+	controller := &Controller{
+		k8sclient:  k8sclient,
+		blendedset: blendedset,
+		lister:     informer.Lister(),
+		setLister:  setInformer.Lister(),
+		ipLister:   ipInformer.Lister(),
+		synced: []cache.InformerSynced{
+			informer.Informer().HasSynced,
+			setInformer.Informer().HasSynced,
+			ipInformer.Informer().HasSynced,
+		},
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Pods"),
+		recorder: recorder,
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueue,
+		UpdateFunc: func(old, new interface{}) { controller.enqueue(new) },
+		DeleteFunc: controller.enqueue,
+	})
+	setInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) { controller.enqueueSetPods(new) },
+		DeleteFunc: controller.enqueueSetPods,
+	})
+	ipInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueueIPPod,
+		UpdateFunc: func(old, new interface{}) { controller.enqueueIPPod(new) },
+		DeleteFunc: controller.enqueueIPPod,
+	})
+	return controller
+}
+
+// Run serves the pod controller
+func (c *Controller) Run(ctx context.Context, threadiness int) error {
+	glog.Info("Starting the pod controller")
+	glog.Info("Waiting for the pod informer caches to sync")
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.synced...); !ok {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+
+	for i := 0; i < threadiness; i++ {
+		go wait.Until(c.runWorker, time.Second, ctx.Done())
+	}
+	return nil
+}
+
+// Stop stops the pod controller
+func (c *Controller) Stop() {
+	glog.Info("Stopping the pod controller")
+	c.queue.ShutDown()
+}
+
+func (c *Controller) runWorker() {
+	defer utilruntime.HandleCrash()
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	obj, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+
+	err := func(obj interface{}) error {
+		defer c.queue.Done(obj)
+		key, ok := obj.(string)
+		if !ok {
+			c.queue.Forget(obj)
+			utilruntime.HandleError(fmt.Errorf("Pod expected string in workqueue but got %#v", obj))
+			return nil
+		}
+
+		if err := c.reconcile(key); err != nil {
+			c.queue.AddRateLimited(key)
+			return fmt.Errorf("Pod error syncing '%s': %s, requeuing", key, err.Error())
+		}
+
+		c.queue.Forget(obj)
+		glog.V(2).Infof("Pod successfully synced '%s'", key)
+		return nil
+	}(obj)
+
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+	return true
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// enqueueSetPods enqueues the pods of the IPs that the StatefulSet keeps, to release the
+// ones of the ordinals it scaled down.
+func (c *Controller) enqueueSetPods(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	set, ok := obj.(*appsv1.StatefulSet)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("Pod expected a StatefulSet but got %#v", obj))
+		return
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{ipamconstants.StatefulSetLabelKey: set.Name})
+	ips, err := c.ipLister.IPs(set.Namespace).List(selector)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, ip := range ips {
+		c.queue.Add(client.IPKey(ip.Namespace, ip.Labels[ipamconstants.PodLabelKey]))
+	}
+}
+
+// enqueueIPPod enqueues the pod of the IP to refresh its address
+func (c *Controller) enqueueIPPod(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	ip, ok := obj.(*blendedv1.IP)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("Pod expected an IP but got %#v", obj))
+		return
+	}
+
+	if name, ok := ip.Labels[ipamconstants.PodLabelKey]; ok {
+		c.queue.Add(client.IPKey(ip.Namespace, name))
+	}
+}
+
+func (c *Controller) reconcile(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("invalid resource key: %s", key))
+		return err
+	}
+
+	pod, err := c.lister.Pods(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return c.release(namespace, name, false)
+		}
+		return err
+	}
+
+	pool := pod.Annotations[ipamconstants.PoolKey]
+	if pool == "" {
+		return c.release(namespace, name, true)
+	}
+
+	if !pod.DeletionTimestamp.IsZero() {
+		return c.release(namespace, name, false)
+	}
+
+	ip, err := c.ipLister.IPs(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return c.createIP(pod, pool)
+	}
+	if err != nil {
+		return err
+	}
+
+	if ip.Labels[ipamconstants.PodLabelKey] != pod.Name {
+		c.recorder.Eventf(pod, corev1.EventTypeWarning, ipamconstants.IPConflictReason,
+			"The IP \"%s/%s\" already exists and doesn't belong to the pod", ip.Namespace, ip.Name)
+		return nil
+	}
+
+	// The pool of an IP can't change, so it's created again
+	if ip.Spec.PoolName != pool {
+		return c.release(namespace, name, true)
+	}
+
+	if ip.Status.Phase != blendedv1.IPActive || ip.Status.Address == "" {
+		return nil
+	}
+	return c.setAddress(pod, ip)
+}
+
+// statefulSetOf returns the reference to the StatefulSet that controls the pod, or nil.
+func statefulSetOf(pod *corev1.Pod) *metav1.OwnerReference {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil || ref.Kind != "StatefulSet" || !strings.HasPrefix(ref.APIVersion, appsv1.GroupName+"/") {
+		return nil
+	}
+	return ref
+}
+
+// createIP creates the IP of the pod. The StatefulSet of the pod owns it if there's one,
+// otherwise the pod does.
+func (c *Controller) createIP(pod *corev1.Pod, pool string) error {
+	ip := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Labels:    map[string]string{ipamconstants.PodLabelKey: pod.Name},
+		},
+		Spec: blendedv1.IPSpec{PoolName: pool},
+	}
+
+	if ref := statefulSetOf(pod); ref != nil {
+		ip.Labels[ipamconstants.StatefulSetLabelKey] = ref.Name
+		ip.OwnerReferences = []metav1.OwnerReference{*ref}
+	} else {
+		ip.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(pod, corev1.SchemeGroupVersion.WithKind("Pod"))}
+	}
+
+	if _, err := c.blendedset.InwinstackV1().IPs(pod.Namespace).Create(ip); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// setAddress writes the address of the IP into the annotations of the pod.
+func (c *Controller) setAddress(pod *corev1.Pod, ip *blendedv1.IP) error {
+	if pod.Annotations[ipamconstants.AddressKey] == ip.Status.Address {
+		return nil
+	}
+
+	podCopy := pod.DeepCopy()
+	podCopy.Annotations[ipamconstants.AddressKey] = ip.Status.Address
+	if _, err := c.k8sclient.CoreV1().Pods(pod.Namespace).Update(podCopy); err != nil {
+		return err
+	}
+	c.recorder.Eventf(podCopy, corev1.EventTypeNormal, ipamconstants.PodAddressAssignedReason,
+		"Assigned address %s of the \"%s\" pool", ip.Status.Address, util.IPPool(ip))
+	return nil
+}
+
+// kept returns whether the StatefulSet of the IP still has the ordinal of its pod.
+func (c *Controller) kept(ip *blendedv1.IP) (bool, error) {
+	name, ok := ip.Labels[ipamconstants.StatefulSetLabelKey]
+	if !ok {
+		return false, nil
+	}
+
+	set, err := c.setLister.StatefulSets(ip.Namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ordinal, err := strconv.Atoi(strings.TrimPrefix(ip.Labels[ipamconstants.PodLabelKey], name+"-"))
+	if err != nil {
+		return false, nil
+	}
+
+	replicas := int32(1)
+	if set.Spec.Replicas != nil {
+		replicas = *set.Spec.Replicas
+	}
+	return int32(ordinal) < replicas, nil
+}
+
+// release deletes the IP of the pod. Unless forced, the IPs that a StatefulSet keeps
+// for the ordinal of the pod are left alone.
+func (c *Controller) release(namespace, name string, force bool) error {
+	ip, err := c.ipLister.IPs(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if ip.Labels[ipamconstants.PodLabelKey] != name || !ip.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	if !force {
+		kept, err := c.kept(ip)
+		if err != nil {
+			return err
+		}
+		if kept {
+			return nil
+		}
+	}
+
+	glog.Infof("Pod \"%s/%s\" releases the address of its IP.", namespace, name)
+	if err := c.blendedset.InwinstackV1().IPs(namespace).Delete(name, nil); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pod
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
+	blendedinformers "github.com/inwinstack/blended/generated/informers/externalversions"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const timeout = 3 * time.Second
+
+func newController(ctx context.Context, t *testing.T) (*Controller, *k8sfake.Clientset, *blendedfake.Clientset) {
+	k8sclient := k8sfake.NewSimpleClientset()
+	blendedset := blendedfake.NewSimpleClientset()
+	k8sinformer := informers.NewSharedInformerFactory(k8sclient, 0)
+	informer := blendedinformers.NewSharedInformerFactory(blendedset, 0)
+
+	controller := NewController(
+		k8sclient,
+		blendedset,
+		k8sinformer.Core().V1().Pods(),
+		k8sinformer.Apps().V1().StatefulSets(),
+		informer.Inwinstack().V1().IPs(),
+		&record.FakeRecorder{})
+	go k8sinformer.Start(ctx.Done())
+	go informer.Start(ctx.Done())
+	assert.Nil(t, controller.Run(ctx, 1))
+	return controller, k8sclient, blendedset
+}
+
+func newPod(name string, set *appsv1.StatefulSet, annotations map[string]string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations}}
+	if set != nil {
+		pod.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(set, appsv1.SchemeGroupVersion.WithKind("StatefulSet"))}
+	}
+	return pod
+}
+
+func TestPodController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, k8sclient, blendedset := newController(ctx, t)
+
+	getIP := func(name string) *blendedv1.IP {
+		for start := time.Now(); time.Since(start) < timeout; {
+			if ip, err := blendedset.InwinstackV1().IPs("default").Get(name, metav1.GetOptions{}); err == nil {
+				return ip
+			}
+		}
+		return nil
+	}
+	isDeleted := func(name string) bool {
+		for start := time.Now(); time.Since(start) < timeout; {
+			if _, err := blendedset.InwinstackV1().IPs("default").Get(name, metav1.GetOptions{}); errors.IsNotFound(err) {
+				return true
+			}
+		}
+		return false
+	}
+	hasAddress := func(name, address string) bool {
+		for start := time.Now(); time.Since(start) < timeout; {
+			pod, err := k8sclient.CoreV1().Pods("default").Get(name, metav1.GetOptions{})
+			assert.Nil(t, err)
+			if pod.Annotations[ipamconstants.AddressKey] == address {
+				return true
+			}
+		}
+		return false
+	}
+
+	replicas := int32(2)
+	set := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: types.UID("web-uid")},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+	}
+	_, err := k8sclient.AppsV1().StatefulSets("default").Create(set)
+	assert.Nil(t, err)
+
+	annotations := map[string]string{ipamconstants.PoolKey: "test-pool"}
+	pods := []*corev1.Pod{
+		newPod("web-0", set, annotations),
+		newPod("web-1", set, annotations),
+		newPod("test-standalone", nil, annotations),
+		newPod("test-none", nil, nil),
+	}
+	for _, pod := range pods {
+		_, err := k8sclient.CoreV1().Pods("default").Create(pod)
+		assert.Nil(t, err)
+	}
+
+	ip := getIP("web-0")
+	assert.NotNil(t, ip)
+	assert.Equal(t, "test-pool", ip.Spec.PoolName)
+	assert.Equal(t, "web-0", ip.Labels[ipamconstants.PodLabelKey])
+	assert.Equal(t, "web", ip.Labels[ipamconstants.StatefulSetLabelKey])
+	assert.Equal(t, "StatefulSet", ip.OwnerReferences[0].Kind)
+
+	standalone := getIP("test-standalone")
+	assert.NotNil(t, standalone)
+	assert.Equal(t, "Pod", standalone.OwnerReferences[0].Kind)
+	assert.NotNil(t, getIP("web-1"))
+
+	_, err = blendedset.InwinstackV1().IPs("default").Get("test-none", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	// The address is written into the annotations once allocated
+	ip.Status.Phase = blendedv1.IPActive
+	ip.Status.Address = "172.22.132.10"
+	_, err = blendedset.InwinstackV1().IPs("default").Update(ip)
+	assert.Nil(t, err)
+	assert.True(t, hasAddress("web-0", "172.22.132.10"))
+
+	// The pod of a StatefulSet keeps its address when it's recreated, unlike the others
+	assert.Nil(t, k8sclient.CoreV1().Pods("default").Delete("web-0", nil))
+	assert.Nil(t, k8sclient.CoreV1().Pods("default").Delete("test-standalone", nil))
+	assert.True(t, isDeleted("test-standalone"))
+	assert.NotNil(t, getIP("web-0"))
+
+	_, err = k8sclient.CoreV1().Pods("default").Create(newPod("web-0", set, annotations))
+	assert.Nil(t, err)
+	assert.True(t, hasAddress("web-0", "172.22.132.10"))
+
+	// The address of an ordinal is released when the StatefulSet scales down
+	assert.Nil(t, k8sclient.CoreV1().Pods("default").Delete("web-1", nil))
+	replicas = 1
+	_, err = k8sclient.AppsV1().StatefulSets("default").Update(set)
+	assert.Nil(t, err)
+	assert.True(t, isDeleted("web-1"))
+	assert.NotNil(t, getIP("web-0"))
+
+	cancel()
+	controller.Stop()
+}
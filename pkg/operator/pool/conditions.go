@@ -0,0 +1,101 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pool
+
+import (
+	"fmt"
+	"strings"
+
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// activeConditions returns the conditions of a pool that allocates addresses, the pool is
+// degraded while it has allocated addresses that it no longer covers.
+func activeConditions(capacity, allocatable int, stranded []string) []ipamv1.Condition {
+	exhausted := ipamv1.Condition{
+		Type:    ipamv1.PoolExhausted,
+		Status:  corev1.ConditionFalse,
+		Reason:  ipamconstants.AddressesAvailableReason,
+		Message: fmt.Sprintf("The pool has %d allocatable addresses", allocatable),
+	}
+	if allocatable == 0 {
+		exhausted.Status = corev1.ConditionTrue
+		exhausted.Reason = ipamconstants.PoolExhaustedReason
+		exhausted.Message = "The pool has no allocatable addresses"
+	}
+
+	degraded := ipamv1.Condition{
+		Type:   ipamv1.PoolDegraded,
+		Status: corev1.ConditionFalse,
+		Reason: ipamconstants.AsExpectedReason,
+	}
+	if len(stranded) > 0 {
+		degraded.Status = corev1.ConditionTrue
+		degraded.Reason = ipamconstants.AddressesStrandedReason
+		degraded.Message = strandedMessage(stranded)
+	}
+
+	return []ipamv1.Condition{
+		{
+			Type:    ipamv1.PoolReady,
+			Status:  corev1.ConditionTrue,
+			Reason:  ipamconstants.PoolReadyReason,
+			Message: fmt.Sprintf("The pool has %d addresses", capacity),
+		},
+		{
+			Type:    ipamv1.PoolAddressesValid,
+			Status:  corev1.ConditionTrue,
+			Reason:  ipamconstants.AddressesParsedReason,
+			Message: "The addresses of the pool are valid",
+		},
+		exhausted,
+		degraded,
+	}
+}
+
+// strandedMessage describes the allocated addresses that the pool no longer covers.
+func strandedMessage(stranded []string) string {
+	return fmt.Sprintf("%d allocated addresses are no longer in the pool: %s", len(stranded), strings.Join(stranded, ", "))
+}
+
+// failedConditions returns the conditions of a pool that failed for the reason. The
+// addresses are checked first, so any other reason means they are valid.
+func failedConditions(reason, message string) []ipamv1.Condition {
+	valid := ipamv1.Condition{
+		Type:    ipamv1.PoolAddressesValid,
+		Status:  corev1.ConditionTrue,
+		Reason:  ipamconstants.AddressesParsedReason,
+		Message: "The addresses of the pool are valid",
+	}
+	if reason == ipamconstants.InvalidAddressesReason {
+		valid.Status = corev1.ConditionFalse
+		valid.Reason = reason
+		valid.Message = message
+	}
+
+	return []ipamv1.Condition{
+		{
+			Type:    ipamv1.PoolReady,
+			Status:  corev1.ConditionFalse,
+			Reason:  reason,
+			Message: message,
+		},
+		valid,
+	}
+}
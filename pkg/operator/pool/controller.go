@@ -18,7 +18,13 @@ package pool
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/thoas/go-funk"
@@ -32,39 +38,115 @@ import (
 	informerv1 "github.com/inwinstack/blended/generated/informers/externalversions/inwinstack/v1"
 	listerv1 "github.com/inwinstack/blended/generated/listers/inwinstack/v1"
 	"github.com/inwinstack/blended/k8sutil"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
 	"github.com/inwinstack/ipam/pkg/ipaddr"
+	"github.com/inwinstack/ipam/pkg/metrics"
+	"github.com/inwinstack/ipam/pkg/util"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/client-go/util/workqueue"
 )
 
 // Controller represents the controller of pool
 type Controller struct {
-	blendedset blended.Interface
-	lister     listerv1.PoolLister
-	synced     cache.InformerSynced
-	queue      workqueue.RateLimitingInterface
+	blendedset       blended.Interface
+	allocations      client.AllocationInterface
+	conditions       client.ConditionsInterface
+	lister           listerv1.PoolLister
+	allocationLister client.AllocationLister
+	synced           []cache.InformerSynced
+	queue            workqueue.RateLimitingInterface
+	recorder         record.EventRecorder
+	pools            *util.KeyMutex
+}
+
+// addressError is an error about the addresses of the pool
+type addressError struct {
+	error
+}
+
+// shrinkError is an edit of the pool that the block policy rejects
+type shrinkError struct {
+	error
+}
+
+// parentError is an error about the parent pool of the pool
+type parentError struct {
+	error
+}
+
+// specHash returns the hash of the spec of the pool along with the annotations that extend it
+func specHash(pool *blendedv1.Pool) string {
+	data, _ := json.Marshal(struct {
+		Spec        blendedv1.PoolSpec
+		Annotations map[string]string
+	}{pool.Spec, util.SpecAnnotations(pool)})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// isSpecChanged checks if the spec of the pool changed since its status was last made.
+// The hash is recorded instead of marking the changes on the objects of the informer cache.
+func isSpecChanged(pool *blendedv1.Pool) bool {
+	return pool.Annotations[ipamconstants.SpecHashKey] != specHash(pool)
+}
+
+// recordSpec records the hash of the spec that the status of the pool was made from
+func recordSpec(pool *blendedv1.Pool) {
+	if pool.Annotations == nil {
+		pool.Annotations = map[string]string{}
+	}
+	pool.Annotations[ipamconstants.SpecHashKey] = specHash(pool)
+	delete(pool.Annotations, constants.NeedUpdateKey)
 }
 
 // NewController creates an instance of the pool controller
-func NewController(blendedset blended.Interface, informer informerv1.PoolInformer) *Controller {
+func NewController(
+	blendedset blended.Interface,
+	allocations client.AllocationInterface,
+	conditions client.ConditionsInterface,
+	informer informerv1.PoolInformer,
+	allocationInformer client.AllocationInformer,
+	recorder record.EventRecorder,
+	pools *util.KeyMutex) *Controller {
 	controller := &Controller{
-		blendedset: blendedset,
-		lister:     informer.Lister(),
-		synced:     informer.Informer().HasSynced,
-		queue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Pools"),
+		blendedset:       blendedset,
+		allocations:      allocations,
+		conditions:       conditions,
+		lister:           informer.Lister(),
+		allocationLister: allocationInformer.Lister(),
+		synced:           []cache.InformerSynced{informer.Informer().HasSynced, allocationInformer.Informer().HasSynced},
+		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Pools"),
+		recorder:         recorder,
+		pools:            pools,
 	}
 	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: controller.enqueue,
+		AddFunc: func(obj interface{}) {
+			controller.enqueue(obj)
+			controller.enqueueChildren(obj)
+		},
 		UpdateFunc: func(old, new interface{}) {
-			oo := old.(*blendedv1.Pool)
-			no := new.(*blendedv1.Pool)
-			k8sutil.MakeNeedToUpdate(&no.ObjectMeta, oo.Spec, no.Spec)
-			controller.enqueue(no)
+			controller.enqueue(new)
+			controller.enqueueChildren(new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			controller.enqueueChildren(obj)
+			controller.enqueueParent(obj)
 		},
 	})
+	allocationInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueueAllocationPool,
+		UpdateFunc: func(old, new interface{}) { controller.enqueueAllocationPool(new) },
+		DeleteFunc: controller.enqueueAllocationPool,
+	})
 	return controller
 }
 
@@ -72,7 +154,7 @@ func NewController(blendedset blended.Interface, informer informerv1.PoolInforme
 func (c *Controller) Run(ctx context.Context, threadiness int) error {
 	glog.Info("Starting the pool controller")
 	glog.Info("Waiting for the pool informer caches to sync")
-	if ok := cache.WaitForCacheSync(ctx.Done(), c.synced); !ok {
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.synced...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
@@ -135,6 +217,62 @@ func (c *Controller) enqueue(obj interface{}) {
 	c.queue.Add(key)
 }
 
+// enqueueChildren enqueues the child pools of the pool, which depend on its phase and addresses
+func (c *Controller) enqueueChildren(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	pool, ok := obj.(*blendedv1.Pool)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("Pool expected a pool but got %#v", obj))
+		return
+	}
+
+	pools, err := c.lister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, child := range pools {
+		if child.Annotations[ipamconstants.ParentPoolKey] == pool.Name {
+			c.queue.Add(child.Name)
+		}
+	}
+}
+
+// enqueueParent enqueues the parent pool of the deleted pool, which may be waiting for it
+func (c *Controller) enqueueParent(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	pool, ok := obj.(*blendedv1.Pool)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("Pool expected a pool but got %#v", obj))
+		return
+	}
+
+	if name, ok := pool.Annotations[ipamconstants.ParentPoolKey]; ok {
+		c.queue.Add(name)
+	}
+}
+
+// enqueueAllocationPool enqueues the pool of the allocation to refresh its counters
+func (c *Controller) enqueueAllocationPool(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	allocation, ok := obj.(*ipamv1.Allocation)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("Pool expected an allocation but got %#v", obj))
+		return
+	}
+	c.queue.Add(allocation.Spec.PoolName)
+}
+
 func (c *Controller) reconcile(key string) error {
 	_, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
@@ -145,8 +283,10 @@ func (c *Controller) reconcile(key string) error {
 	pool, err := c.lister.Get(name)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			utilruntime.HandleError(fmt.Errorf("pool '%s' in work queue no longer exists", key))
-			return err
+			// The deleted pool is still enqueued by its allocations and children, which is fine
+			metrics.DeletePool(name)
+			glog.V(2).Infof("Pool '%s' in work queue no longer exists.", key)
+			return nil
 		}
 		return err
 	}
@@ -159,11 +299,180 @@ func (c *Controller) reconcile(key string) error {
 		return err
 	}
 
-	need := k8sutil.IsNeedToUpdate(pool.ObjectMeta)
-	if pool.Status.Phase != blendedv1.PoolActive || need {
-		if err := c.makeStatus(pool); err != nil {
-			return c.makeFailedStatus(pool, err)
+	// Free the held addresses once their hold time expires
+	next, err := c.expireAllocations(pool)
+	if err != nil {
+		return err
+	}
+
+	if next > 0 {
+		c.queue.AddAfter(key, next)
+	}
+
+	err = c.reserve(pool)
+	if err == nil {
+		err = c.makeStatus(pool)
+	}
+
+	if err != nil {
+		if errors.IsConflict(err) {
+			return err
+		}
+
+		reason := ipamconstants.InvalidSpecReason
+		switch err.(type) {
+		case *addressError:
+			reason = ipamconstants.InvalidAddressesReason
+		case *parentError:
+			reason = ipamconstants.PoolNotReadyReason
+		case *shrinkError:
+			reason = ipamconstants.ShrinkBlockedReason
 		}
+		return c.makeFailedStatus(pool, reason, err)
+	}
+	return nil
+}
+
+// reserve records the addresses of the child pool on its parent pool, which allocates them
+// as a whole.
+func (c *Controller) reserve(pool *blendedv1.Pool) error {
+	name, ok := pool.Annotations[ipamconstants.ParentPoolKey]
+	if !ok {
+		return nil
+	}
+
+	if name == pool.Name {
+		return &parentError{fmt.Errorf("The pool can't be its own parent")}
+	}
+
+	defer c.pools.Lock(name)()
+
+	parent, err := c.blendedset.InwinstackV1().Pools().Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// The child is enqueued again when the parent shows up
+		return &parentError{fmt.Errorf("The parent pool \"%s\" doesn't exist", name)}
+	}
+	if err != nil {
+		return err
+	}
+
+	prefixes, err := util.DelegatedPrefixes(parent)
+	if err != nil {
+		return err
+	}
+
+	// The child pools of the prefix claims are recorded by the prefix controller
+	addresses := strings.Join(pool.Spec.Addresses, ",")
+	if prefixes[pool.Name] == addresses || util.PublishesPrefixOf(pool, parent) {
+		return nil
+	}
+
+	if parent.Status.Phase != blendedv1.PoolActive || !parent.DeletionTimestamp.IsZero() {
+		return &parentError{fmt.Errorf("The parent pool \"%s\" isn't active", name)}
+	}
+
+	parser := ipaddr.NewParser(pool.Spec.Addresses, pool.Spec.AvoidBuggyIPs, pool.Spec.AvoidGatewayIPs)
+	parentParser := ipaddr.NewParser(parent.Spec.Addresses, parent.Spec.AvoidBuggyIPs, parent.Spec.AvoidGatewayIPs)
+	address, outside, err := parser.Outside(parentParser)
+	if err != nil {
+		return &addressError{err}
+	}
+	if outside {
+		return &addressError{fmt.Errorf("The address %s isn't in the parent pool \"%s\"", address, name)}
+	}
+
+	// The previous addresses of the child are free for its new ones
+	delete(prefixes, pool.Name)
+	list, err := c.allocations.List(metav1.ListOptions{LabelSelector: ipamconstants.PoolLabelKey + "=" + name})
+	if err != nil {
+		return err
+	}
+
+	allocations := []*ipamv1.Allocation{}
+	for i := range list.Items {
+		allocations = append(allocations, &list.Items[i])
+	}
+
+	allocator, err := util.NewPoolAllocator(parent, prefixes, allocations)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range pool.Spec.Addresses {
+		if !allocator.IsFreePrefix(address) {
+			return &addressError{fmt.Errorf("The address %s is already in use in the parent pool \"%s\"", address, name)}
+		}
+	}
+
+	parentCopy := parent.DeepCopy()
+	prefixes[pool.Name] = addresses
+	util.SetDelegatedPrefixes(parentCopy, prefixes)
+	if _, err := c.blendedset.InwinstackV1().Pools().Update(parentCopy); err != nil {
+		return err
+	}
+	glog.Infof("Pool \"%s\" reserved %s for its child pool \"%s\".", name, addresses, pool.Name)
+	return nil
+}
+
+// unreserve gives the addresses of the deleted child pool back to its parent pool.
+func (c *Controller) unreserve(pool *blendedv1.Pool) error {
+	name, ok := pool.Annotations[ipamconstants.ParentPoolKey]
+	if !ok {
+		return nil
+	}
+
+	defer c.pools.Lock(name)()
+
+	parent, err := c.blendedset.InwinstackV1().Pools().Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	prefixes, err := util.DelegatedPrefixes(parent)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := prefixes[pool.Name]; !ok {
+		return nil
+	}
+
+	parentCopy := parent.DeepCopy()
+	delete(prefixes, pool.Name)
+	util.SetDelegatedPrefixes(parentCopy, prefixes)
+	if _, err := c.blendedset.InwinstackV1().Pools().Update(parentCopy); err != nil {
+		return err
+	}
+	glog.Infof("Pool \"%s\" got the addresses of its child pool \"%s\" back.", name, pool.Name)
+	return nil
+}
+
+// expireAllocations deletes the allocations of the pool whose hold time expired, and returns
+// how long until the next one expires.
+func (c *Controller) expireAllocations(pool *blendedv1.Pool) (time.Duration, error) {
+	allocations, err := c.allocationLister.ByPool(pool.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	expired, next := util.ExpiredAllocations(allocations, time.Now())
+	for _, allocation := range expired {
+		if err := c.deleteAllocation(allocation); err != nil {
+			return 0, err
+		}
+	}
+	return next, nil
+}
+
+// deleteAllocation deletes the allocation unless it has been replaced meanwhile.
+func (c *Controller) deleteAllocation(allocation *ipamv1.Allocation) error {
+	uid := allocation.UID
+	opts := &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}}
+	if err := c.allocations.Delete(allocation.Name, opts); err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+		return err
 	}
 	return nil
 }
@@ -171,62 +480,473 @@ func (c *Controller) reconcile(key string) error {
 func (c *Controller) checkAndUdateFinalizer(pool *blendedv1.Pool) error {
 	poolCopy := pool.DeepCopy()
 	ok := funk.ContainsString(poolCopy.Finalizers, constants.CustomFinalizer)
-	if poolCopy.Status.Phase == blendedv1.PoolActive && !ok {
+
+	// A child pool keeps its finalizer, so its addresses are given back to its parent once it's deleted
+	_, child := poolCopy.Annotations[ipamconstants.ParentPoolKey]
+	if (poolCopy.Status.Phase == blendedv1.PoolActive || child) && !ok {
 		k8sutil.AddFinalizer(&poolCopy.ObjectMeta, constants.CustomFinalizer)
-		if _, err := c.blendedset.InwinstackV1().Pools().Update(poolCopy); err != nil {
-			return err
-		}
+		return c.updatePool(poolCopy)
 	}
 	return nil
 }
 
 func (c *Controller) makeStatus(pool *blendedv1.Pool) error {
 	poolCopy := pool.DeepCopy()
-	if poolCopy.Status.AllocatedIPs == nil {
-		poolCopy.Status.AllocatedIPs = []string{}
+	parser := ipaddr.NewParser(poolCopy.Spec.Addresses, poolCopy.Spec.AvoidBuggyIPs, poolCopy.Spec.AvoidGatewayIPs)
+	allocator, err := ipaddr.NewAllocator(parser)
+	if err != nil {
+		return &addressError{err}
 	}
 
-	parser := ipaddr.NewParser(poolCopy.Spec.Addresses, poolCopy.Spec.AvoidBuggyIPs, poolCopy.Spec.AvoidGatewayIPs)
-	ips, err := parser.FilterIPs(pool.Spec.FilterIPs)
+	if err := allocator.Exclude(poolCopy.Spec.FilterIPs...); err != nil {
+		return &addressError{err}
+	}
+
+	// The delegated prefixes are allocated as a whole
+	prefixes, err := util.DelegatedPrefixes(poolCopy)
+	if err != nil {
+		return err
+	}
+
+	delegated := util.DelegatedAddresses(prefixes)
+	if err := allocator.Delegate(delegated...); err != nil {
+		return err
+	}
+
+	// The addresses that the pool delegated must stay in the pool
+	address, outside, err := ipaddr.NewParser(delegated, false, false).Outside(parser)
+	if err != nil {
+		return err
+	}
+	if outside {
+		return &addressError{fmt.Errorf("The delegated address %s is no longer in the pool", address)}
+	}
+
+	strategy := poolCopy.Annotations[ipamconstants.AllocationStrategyKey]
+	if _, err := ipaddr.NewStrategy(strategy, ipaddr.History{}); err != nil {
+		return err
+	}
+
+	if _, err := util.ReleaseHoldTime(poolCopy); err != nil {
+		return err
+	}
+
+	warning, critical, err := util.UtilizationThresholds(poolCopy)
+	if err != nil {
+		return err
+	}
+
+	policy, err := util.ShrinkPolicy(poolCopy)
+	if err != nil {
+		return err
+	}
+
+	allocations, err := c.allocationLister.ByPool(poolCopy.Name)
 	if err != nil {
 		return err
 	}
 
-	poolCopy.Status.Reason = ""
-	poolCopy.Status.Capacity = len(ips)
-	poolCopy.Status.Allocatable = len(ips) - len(poolCopy.Status.AllocatedIPs)
+	// The allocations that the pool no longer covers are ignored by the allocator
+	stranded, err := c.checkStranded(poolCopy, allocations, policy)
+	if err != nil {
+		return err
+	}
+
+	// Without the webhook, the pool stops allocating until the edit is reverted
+	if policy == ipamconstants.ShrinkPolicyBlock && len(stranded) > 0 {
+		return &shrinkError{fmt.Errorf("The edit was blocked, %s", strandedMessage(stranded))}
+	}
+
+	used, held := util.AllocatedAddresses(allocations, time.Now())
+	if err := allocator.Use(used...); err != nil {
+		return err
+	}
+
+	if err := allocator.Hold(held...); err != nil {
+		return err
+	}
+
+	// The allocations are kept in their own objects, so the status only holds the counters
+	capacity := ipaddr.ClampInt(allocator.Capacity())
+	allocatable := ipaddr.ClampInt(allocator.Free())
+	metrics.SetPoolUsage(poolCopy.Name, capacity, len(used), allocatable, len(held))
+
+	reason := ""
+	if allocatable == 0 {
+		reason = fmt.Sprintf("%s: The pool has no allocatable addresses.", ipamconstants.PoolExhaustedReason)
+	}
+
+	// The conditions are rebuilt if they can't be read
+	conditions, _ := util.Conditions(poolCopy.ObjectMeta)
+	previous := utilizationLevel(conditions)
+	updates := activeConditions(capacity, allocatable, stranded)
+	changed := false
+	if low := lowCapacityCondition(capacity, allocatable, warning, critical); low != nil {
+		updates = append(updates, *low)
+	} else {
+		changed = util.RemoveCondition(&conditions, ipamv1.PoolLowCapacity)
+	}
+	changed = util.ObserveConditions(&conditions, poolCopy.Generation, updates...) || changed
+	util.SetConditions(&poolCopy.ObjectMeta, conditions)
+	level := utilizationLevel(conditions)
+	metrics.SetPoolUtilization(poolCopy.Name, utilization(capacity, allocatable), level)
+
+	strandedChanged := !reflect.DeepEqual(util.StrandedIPs(poolCopy), stranded)
+	util.SetStrandedIPs(poolCopy, stranded)
+
+	need := isSpecChanged(poolCopy)
+	if poolCopy.Status.Phase == blendedv1.PoolActive && !need && !changed && !strandedChanged &&
+		poolCopy.Status.Capacity == capacity && poolCopy.Status.Allocatable == allocatable &&
+		poolCopy.Status.Reason == reason && len(poolCopy.Status.AllocatedIPs) == 0 {
+		return nil
+	}
+
+	ready := poolCopy.Status.Phase != blendedv1.PoolActive
+	exhausted := reason != "" && poolCopy.Status.Reason != reason
+	poolCopy.Status.Reason = reason
+	poolCopy.Status.AllocatedIPs = []string{}
+	poolCopy.Status.Capacity = capacity
+	poolCopy.Status.Allocatable = allocatable
 	poolCopy.Status.LastUpdateTime = metav1.NewTime(time.Now())
 	poolCopy.Status.Phase = blendedv1.PoolActive
-	delete(poolCopy.Annotations, constants.NeedUpdateKey)
+	recordSpec(poolCopy)
 	k8sutil.AddFinalizer(&poolCopy.ObjectMeta, constants.CustomFinalizer)
-	if _, err := c.blendedset.InwinstackV1().Pools().Update(poolCopy); err != nil {
+	if err := c.updatePool(poolCopy); err != nil {
 		return err
 	}
+
+	if ready {
+		c.recorder.Eventf(poolCopy, corev1.EventTypeNormal, ipamconstants.PoolReadyReason,
+			"The pool has %d allocatable addresses out of %d", allocatable, capacity)
+	}
+
+	if exhausted {
+		c.recorder.Event(poolCopy, corev1.EventTypeWarning, ipamconstants.PoolExhaustedReason, "The pool has no allocatable addresses")
+	}
+
+	if level != previous {
+		c.utilizationEvent(poolCopy, conditions, level)
+	}
+
+	if strandedChanged && len(stranded) > 0 {
+		c.recorder.Event(poolCopy, corev1.EventTypeWarning, ipamconstants.AddressesStrandedReason, strandedMessage(stranded))
+	}
+	return nil
+}
+
+// checkStranded returns the allocated addresses that the pool no longer covers. With the
+// release policy, they are released and their IPs fail, so the IP controller gives them an
+// address of the pool again.
+func (c *Controller) checkStranded(pool *blendedv1.Pool, allocations []*ipamv1.Allocation, policy string) ([]string, error) {
+	stranded, err := util.StrandedAllocations(pool, allocations)
+	if err != nil {
+		return nil, &addressError{err}
+	}
+
+	var addresses []string
+	for _, allocation := range stranded {
+		if policy != ipamconstants.ShrinkPolicyRelease {
+			addresses = append(addresses, allocation.Spec.Address)
+			continue
+		}
+
+		// The IP fails first, otherwise it would keep the address if the pool failed to update it
+		if ref := allocation.Spec.IP; ref.Name != "" {
+			if err := c.failStrandedIP(pool, ref, allocation.Spec.Address); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := c.deleteAllocation(allocation); err != nil {
+			return nil, err
+		}
+		c.recorder.Eventf(pool, corev1.EventTypeWarning, ipamconstants.StrandedReleasedReason,
+			"Released address %s that is no longer in the pool", allocation.Spec.Address)
+	}
+	return addresses, nil
+}
+
+// failStrandedIP fails the IP that owns an address the pool no longer covers.
+func (c *Controller) failStrandedIP(pool *blendedv1.Pool, ref ipamv1.IPReference, address string) error {
+	message := fmt.Sprintf("The address %s is no longer in the \"%s\" pool", address, pool.Name)
+	var failed *blendedv1.IP
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ip, err := c.blendedset.InwinstackV1().IPs(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if ip.UID != ref.UID || !funk.ContainsString(util.IPAddresses(ip), address) {
+			return nil
+		}
+
+		conditions, _ := util.Conditions(ip.ObjectMeta)
+		util.ObserveConditions(&conditions, ip.Generation, ipamv1.Condition{
+			Type:    ipamv1.IPAllocated,
+			Status:  corev1.ConditionFalse,
+			Reason:  ipamconstants.StrandedReleasedReason,
+			Message: message,
+		})
+		util.SetConditions(&ip.ObjectMeta, conditions)
+		util.SetIPAddresses(ip, nil)
+		util.SetIPPool(ip, "")
+		ip.Status.Phase = blendedv1.IPFailed
+		ip.Status.Reason = fmt.Sprintf("%s: %s.", ipamconstants.StrandedReleasedReason, message)
+		ip.Status.LastUpdateTime = metav1.Now()
+		failed, err = c.blendedset.InwinstackV1().IPs(ip.Namespace).Update(ip)
+		return err
+	})
+	if errors.IsNotFound(err) || (err == nil && failed == nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := c.conditions.Mirror(client.IPResource, failed.ObjectMeta); err != nil {
+		glog.Warningf("Failed to mirror the conditions of the \"%s/%s\" IP: %+v.", failed.Namespace, failed.Name, err)
+	}
+	c.recorder.Event(failed, corev1.EventTypeWarning, ipamconstants.StrandedReleasedReason, message)
 	return nil
 }
 
-func (c *Controller) makeFailedStatus(pool *blendedv1.Pool, e error) error {
+// utilizationEvent reports the utilisation thresholds crossed by the pool.
+func (c *Controller) utilizationEvent(pool *blendedv1.Pool, conditions []ipamv1.Condition, level int) {
+	condition := util.FindCondition(conditions, ipamv1.PoolLowCapacity)
+	switch {
+	case level == levelCritical:
+		c.recorder.Event(pool, corev1.EventTypeWarning, ipamconstants.UtilizationCriticalReason, condition.Message)
+	case level == levelWarning:
+		c.recorder.Event(pool, corev1.EventTypeWarning, ipamconstants.UtilizationWarningReason, condition.Message)
+	case condition != nil:
+		c.recorder.Event(pool, corev1.EventTypeNormal, ipamconstants.UtilizationNormalReason, condition.Message)
+	}
+}
+
+// makeFailedStatus fails the pool for the reason, unless it already failed the same way.
+func (c *Controller) makeFailedStatus(pool *blendedv1.Pool, reason string, e error) error {
+	metrics.DeletePool(pool.Name)
+	status := fmt.Sprintf("%s: %s", reason, e.Error())
 	poolCopy := pool.DeepCopy()
-	poolCopy.Status.Reason = e.Error()
+	conditions, _ := util.Conditions(poolCopy.ObjectMeta)
+	changed := util.ObserveConditions(&conditions, poolCopy.Generation, failedConditions(reason, e.Error())...)
+	if poolCopy.Status.Phase == blendedv1.PoolFailed && poolCopy.Status.Reason == status &&
+		!isSpecChanged(poolCopy) && !changed {
+		return nil
+	}
+
+	util.SetConditions(&poolCopy.ObjectMeta, conditions)
+	poolCopy.Status.Reason = status
 	poolCopy.Status.Phase = blendedv1.PoolFailed
 	poolCopy.Status.LastUpdateTime = metav1.NewTime(time.Now())
-	delete(poolCopy.Annotations, constants.NeedUpdateKey)
-	if _, err := c.blendedset.InwinstackV1().Pools().Update(poolCopy); err != nil {
+	recordSpec(poolCopy)
+	if err := c.updatePool(poolCopy); err != nil {
 		return err
 	}
 	glog.Errorf("Pool got an error: %+v.", e)
+	c.recorder.Event(poolCopy, corev1.EventTypeWarning, reason, e.Error())
 	return nil
 }
 
+// updatePool writes the pool and mirrors its conditions, and reports the conflicts that requeue it.
+func (c *Controller) updatePool(pool *blendedv1.Pool) error {
+	updated, err := c.blendedset.InwinstackV1().Pools().Update(pool)
+	if err != nil {
+		if errors.IsConflict(err) {
+			c.recorder.Eventf(pool, corev1.EventTypeWarning, ipamconstants.UpdateConflictReason, "Failed to update the pool: %s", err.Error())
+		}
+		return err
+	}
+
+	// The conditions are kept in the annotation, so a failed mirror is fixed by the next update
+	if err := c.conditions.Mirror(client.PoolResource, updated.ObjectMeta); err != nil {
+		glog.Warningf("Failed to mirror the conditions of the \"%s\" pool: %+v.", pool.Name, err)
+	}
+	return nil
+}
+
+// cleanup drains the deleted pool according to its drain policy, and removes its finalizer
+// once no address is allocated anymore.
 func (c *Controller) cleanup(pool *blendedv1.Pool) error {
+	allocations, err := c.allocationLister.ByPool(pool.Name)
+	if err != nil {
+		return err
+	}
+
+	policy, err := util.DrainPolicy(pool)
+	if err != nil {
+		glog.Warningf("Pool \"%s\" has %s, waiting for its IPs.", pool.Name, err.Error())
+		policy = ipamconstants.DrainPolicyWait
+	}
+
+	// The held addresses go away along with the pool
+	active := []*ipamv1.Allocation{}
+	for _, allocation := range allocations {
+		if allocation.Status.Phase != ipamv1.AllocationReleasing {
+			active = append(active, allocation)
+			continue
+		}
+
+		if err := c.deleteAllocation(allocation); err != nil {
+			return err
+		}
+	}
+
+	switch policy {
+	case ipamconstants.DrainPolicyCascade:
+		deleted, err := c.cascade(pool, active)
+		if err != nil {
+			return err
+		}
+
+		// The IPs without a finalizer go away without releasing their addresses
+		if deleted {
+			c.queue.AddAfter(pool.Name, time.Second)
+		}
+	case ipamconstants.DrainPolicyOrphan:
+		if err := c.orphan(pool, active); err != nil {
+			return err
+		}
+		active = nil
+	}
+
+	// The child pools draw from the addresses of the pool, so they block it like the IPs
+	children, err := c.childPools(pool)
+	if err != nil {
+		return err
+	}
+
 	poolCopy := pool.DeepCopy()
+	terminating := poolCopy.Status.Phase != blendedv1.PoolTerminating
+	message := fmt.Sprintf("The pool is being deleted with %d allocated addresses", len(active))
+	if len(children) > 0 {
+		message = fmt.Sprintf("%s and %d child pools", message, len(children))
+	}
+	reason := fmt.Sprintf("%s: %s.", ipamconstants.PoolTerminatingReason, message)
+	blocking := append(blockingIPs(active), children...)
+	blockingChanged := !reflect.DeepEqual(util.BlockingIPs(poolCopy), blocking)
+	util.SetBlockingIPs(poolCopy, blocking)
+
+	ready := ipamv1.Condition{
+		Type:    ipamv1.PoolReady,
+		Status:  corev1.ConditionFalse,
+		Reason:  ipamconstants.PoolTerminatingReason,
+		Message: message,
+	}
+	if len(blocking) > 0 {
+		ready.Message = fmt.Sprintf("%s, waiting for %s", message, strings.Join(blocking, ", "))
+	}
+
+	conditions, _ := util.Conditions(poolCopy.ObjectMeta)
+	changed := util.ObserveConditions(&conditions, poolCopy.Generation, ready)
+	if !terminating && len(blocking) > 0 && poolCopy.Status.Reason == reason && !changed && !blockingChanged {
+		return nil
+	}
+
+	util.SetConditions(&poolCopy.ObjectMeta, conditions)
 	poolCopy.Status.Phase = blendedv1.PoolTerminating
-	if len(poolCopy.Status.AllocatedIPs) == 0 {
+	poolCopy.Status.Reason = reason
+	if len(active) == 0 && len(children) == 0 {
+		if err := c.unreserve(pool); err != nil {
+			return err
+		}
 		k8sutil.RemoveFinalizer(&poolCopy.ObjectMeta, constants.CustomFinalizer)
 	}
 
-	if _, err := c.blendedset.InwinstackV1().Pools().Update(poolCopy); err != nil {
+	if err := c.updatePool(poolCopy); err != nil {
 		return err
 	}
+
+	if terminating {
+		c.recorder.Event(poolCopy, corev1.EventTypeWarning, ipamconstants.PoolTerminatingReason, message)
+	}
+	return nil
+}
+
+// blockingIPs returns the "namespace/name" of the IPs that own the allocations, sorted.
+func blockingIPs(allocations []*ipamv1.Allocation) []string {
+	var blocking []string
+	for _, allocation := range allocations {
+		if ref := allocation.Spec.IP; ref.Name != "" {
+			blocking = append(blocking, ref.Namespace+"/"+ref.Name)
+		}
+	}
+	sort.Strings(blocking)
+	return funk.UniqString(blocking)
+}
+
+// childPools returns the "pool/name" of the pools that draw from the addresses of the pool, sorted.
+func (c *Controller) childPools(pool *blendedv1.Pool) ([]string, error) {
+	pools, err := c.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var children []string
+	for _, child := range pools {
+		if child.Annotations[ipamconstants.ParentPoolKey] == pool.Name {
+			children = append(children, "pool/"+child.Name)
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+// cascade deletes the IPs that own the allocations of the deleted pool, and the allocations
+// that no IP owns. The IPs release their addresses as they are deleted. It returns whether
+// any IP was deleted.
+func (c *Controller) cascade(pool *blendedv1.Pool, allocations []*ipamv1.Allocation) (bool, error) {
+	deleted := false
+	for _, allocation := range allocations {
+		ref := allocation.Spec.IP
+		if ref.Name == "" {
+			if err := c.deleteAllocation(allocation); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		ip, err := c.blendedset.InwinstackV1().IPs(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) || (err == nil && ip.UID != ref.UID) {
+			// The IP is gone, so nothing releases its address
+			if err := c.deleteAllocation(allocation); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if !ip.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		uid := ip.UID
+		opts := &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}}
+		err = c.blendedset.InwinstackV1().IPs(ip.Namespace).Delete(ip.Name, opts)
+		if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			return false, err
+		}
+
+		deleted = true
+		c.recorder.Eventf(pool, corev1.EventTypeNormal, ipamconstants.DrainDeletedReason,
+			"Deleted IP \"%s/%s\" that has address %s", ip.Namespace, ip.Name, allocation.Spec.Address)
+	}
+	return deleted, nil
+}
+
+// orphan deletes the allocations of the deleted pool, and leaves their IPs with the addresses.
+func (c *Controller) orphan(pool *blendedv1.Pool, allocations []*ipamv1.Allocation) error {
+	for _, allocation := range allocations {
+		if err := c.deleteAllocation(allocation); err != nil {
+			return err
+		}
+	}
+
+	if blocking := blockingIPs(allocations); len(blocking) > 0 {
+		c.recorder.Eventf(pool, corev1.EventTypeWarning, ipamconstants.DrainOrphanedReason,
+			"Left %d IPs with the addresses of the pool: %s", len(blocking), strings.Join(blocking, ", "))
+	}
 	return nil
 }
@@ -18,28 +18,46 @@ package pool
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
 	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
 	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
-	blendedinformers "github.com/inwinstack/blended/generated/informers/externalversions"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
 	"github.com/inwinstack/ipam/pkg/config"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/ipaddr"
+	"github.com/inwinstack/ipam/pkg/operator/testutil"
+	"github.com/inwinstack/ipam/pkg/util"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 )
 
-const timeout = 3 * time.Second
+func newController(ctx context.Context, t *testing.T) (*Controller, *blendedfake.Clientset, client.AllocationInterface) {
+	return newControllerWithRecorder(ctx, t, &record.FakeRecorder{})
+}
 
-func TestPoolController(t *testing.T) {
-	ctx, cancel := context.WithCancel(context.Background())
+func newControllerWithRecorder(ctx context.Context, t *testing.T, recorder record.EventRecorder) (*Controller, *blendedfake.Clientset, client.AllocationInterface) {
 	cfg := &config.Config{Threads: 2}
-	blendedset := blendedfake.NewSimpleClientset()
-	informer := blendedinformers.NewSharedInformerFactory(blendedset, 0)
+	clients := testutil.NewClients(nil)
 
-	controller := NewController(blendedset, informer.Inwinstack().V1().Pools())
-	go informer.Start(ctx.Done())
+	controller := NewController(clients.Blendedset, clients.Allocations, clients.Conditions, clients.Informer.Inwinstack().V1().Pools(), clients.AllocationInformer, recorder, util.NewKeyMutex())
+	clients.Start(ctx)
 	assert.Nil(t, controller.Run(ctx, cfg.Threads))
+	return controller, clients.Blendedset, clients.Allocations
+}
+
+func TestPoolController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	// The deleted pool isn't requeued
+	assert.Nil(t, controller.reconcile("test-missing"))
 
 	pool := &blendedv1.Pool{
 		ObjectMeta: metav1.ObjectMeta{
@@ -58,20 +76,12 @@ func TestPoolController(t *testing.T) {
 	_, err := blendedset.InwinstackV1().Pools().Create(pool)
 	assert.Nil(t, err)
 
-	failed := true
-	for start := time.Now(); time.Since(start) < timeout; {
-		p, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
-		assert.Nil(t, err)
-
-		if p.Status.Phase == blendedv1.PoolActive {
-			assert.Equal(t, []string{}, p.Status.AllocatedIPs)
-			assert.Equal(t, 5, p.Status.Capacity)
-			assert.Equal(t, 5, p.Status.Allocatable)
-			failed = false
-			break
-		}
-	}
-	assert.Equal(t, false, failed, "The pool object failed to make status.")
+	p := testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolActive
+	})
+	assert.Equal(t, []string{}, p.Status.AllocatedIPs)
+	assert.Equal(t, 5, p.Status.Capacity)
+	assert.Equal(t, 5, p.Status.Allocatable)
 
 	// Success to update the pool
 	gpool, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
@@ -81,18 +91,39 @@ func TestPoolController(t *testing.T) {
 	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
 	assert.Nil(t, err)
 
-	failed = true
-	for start := time.Now(); time.Since(start) < timeout; {
-		p, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
-		assert.Nil(t, err)
+	p = testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		return p.Status.Capacity == 10
+	})
+	assert.Equal(t, 10, p.Status.Allocatable)
 
-		if p.Status.Capacity == 10 {
-			assert.Equal(t, 10, p.Status.Allocatable)
-			failed = false
-			break
-		}
-	}
-	assert.Equal(t, false, failed, "The service object failed to sync status.")
+	// Count the allocations of the pool
+	allocation, err := util.NewAllocation(pool.Name, "172.22.132.1", nil)
+	assert.Nil(t, err)
+	_, err = allocations.Create(allocation)
+	assert.Nil(t, err)
+
+	p = testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		return p.Status.Allocatable == 9
+	})
+	assert.Equal(t, []string{}, p.Status.AllocatedIPs)
+	assert.Nil(t, allocations.Delete(allocation.Name, nil))
+
+	// Wait for the pool to count the deletion, so that it doesn't overwrite the next update
+	testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		return p.Status.Allocatable == 10
+	})
+
+	// The delegated prefixes are allocated as a whole
+	gpool, err = blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	util.SetDelegatedPrefixes(gpool, map[string]string{"default/test-claim": "172.22.132.252/30"})
+	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
+	assert.Nil(t, err)
+
+	p = testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		return p.Status.Allocatable == 7
+	})
+	assert.Equal(t, 10, p.Status.Capacity)
 
 	// Failed to update the pool
 	gpool, err = blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
@@ -102,18 +133,37 @@ func TestPoolController(t *testing.T) {
 	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
 	assert.Nil(t, err)
 
-	failed = true
-	for start := time.Now(); time.Since(start) < timeout; {
-		p, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
-		assert.Nil(t, err)
+	p = testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolFailed
+	})
+	assert.NotNil(t, p.Status.Reason)
 
-		if p.Status.Phase == blendedv1.PoolFailed {
-			assert.NotNil(t, p.Status.Reason)
-			failed = false
-			break
-		}
-	}
-	assert.Equal(t, false, failed, "The service object failed to get error status.")
+	// Failed to use an unknown allocation strategy
+	gpool, err = blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	gpool.Spec.Addresses = []string{"172.22.132.250-172.22.132.255"}
+	gpool.Annotations = map[string]string{ipamconstants.AllocationStrategyKey: "unknown"}
+
+	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
+	assert.Nil(t, err)
+
+	testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolFailed && strings.Contains(p.Status.Reason, "strategy")
+	})
+
+	// Update the pool to IPv6
+	gpool, err = blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	gpool.Annotations[ipamconstants.AllocationStrategyKey] = ipaddr.RandomStrategy
+	gpool.Spec.Addresses = []string{"2001:db8::/120", "2001:db8:1::/64"}
+
+	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
+	assert.Nil(t, err)
+
+	p = testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolActive
+	})
+	assert.Equal(t, int(^uint(0)>>1), p.Status.Capacity)
 
 	// Delete the pool
 	assert.Nil(t, blendedset.InwinstackV1().Pools().Delete(pool.Name, nil))
@@ -124,3 +174,527 @@ func TestPoolController(t *testing.T) {
 	cancel()
 	controller.Stop()
 }
+
+func TestReleasingExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	pool := testutil.NewPool("test-releasing", "172.22.132.0-172.22.132.5")
+	pool.Annotations = map[string]string{ipamconstants.ReleaseHoldTimeKey: "1s"}
+	pool.Spec.AvoidBuggyIPs = true
+
+	allocation, err := util.NewAllocation(pool.Name, "172.22.132.1", nil)
+	assert.Nil(t, err)
+	allocation.Status.Phase = ipamv1.AllocationReleasing
+	allocation.Status.ReleaseTime = metav1.NewTime(time.Now().Add(time.Second))
+	_, err = allocations.Create(allocation)
+	assert.Nil(t, err)
+
+	_, err = blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		_, err := allocations.Get(allocation.Name, metav1.GetOptions{})
+		return errors.IsNotFound(err) && p.Status.Allocatable == 5
+	})
+
+	cancel()
+	controller.Stop()
+}
+
+func TestEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := record.NewFakeRecorder(100)
+	controller, blendedset, allocations := newControllerWithRecorder(ctx, t, recorder)
+
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-events"},
+		Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.132.1-172.22.132.1"}},
+	}
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+	assert.True(t, testutil.WaitForEvent(recorder, "Normal PoolReady The pool has 1 allocatable addresses out of 1"))
+
+	allocation, err := util.NewAllocation(pool.Name, "172.22.132.1", nil)
+	assert.Nil(t, err)
+	_, err = allocations.Create(allocation)
+	assert.Nil(t, err)
+	assert.True(t, testutil.WaitForEvent(recorder, "Warning PoolExhausted"))
+
+	gpool, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, blendedv1.PoolActive, gpool.Status.Phase)
+	assert.True(t, strings.HasPrefix(gpool.Status.Reason, "PoolExhausted: "))
+
+	// The pool fails once for the same reason
+	gpool.Spec.Addresses = []string{"172.22.132.1-172.22.132.267"}
+	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
+	assert.Nil(t, err)
+	assert.True(t, testutil.WaitForEvent(recorder, "Warning InvalidAddresses"))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(recorder.Events))
+	gpool, err = blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, blendedv1.PoolFailed, gpool.Status.Phase)
+	assert.True(t, strings.HasPrefix(gpool.Status.Reason, "InvalidAddresses: "))
+
+	// The pool keeps its finalizer while an address is allocated
+	now := metav1.Now()
+	gpool.DeletionTimestamp = &now
+	assert.Nil(t, controller.cleanup(gpool))
+	assert.True(t, testutil.WaitForEvent(recorder, "Warning PoolTerminating The pool is being deleted with 1 allocated addresses"))
+
+	gpool, err = blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(gpool.Status.Reason, "PoolTerminating: "))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestUtilizationThresholds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := record.NewFakeRecorder(100)
+	controller, blendedset, allocations := newControllerWithRecorder(ctx, t, recorder)
+
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-thresholds",
+			Annotations: map[string]string{
+				ipamconstants.UtilizationWarningKey:  "50",
+				ipamconstants.UtilizationCriticalKey: "75%",
+			},
+		},
+		Spec: blendedv1.PoolSpec{Addresses: []string{"172.22.132.1-172.22.132.4"}},
+	}
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	lowCapacity := func(status corev1.ConditionStatus, reason string) bool {
+		return testutil.WaitFor(func() bool {
+			p, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+			assert.Nil(t, err)
+
+			conditions, err := util.Conditions(p.ObjectMeta)
+			assert.Nil(t, err)
+			condition := util.FindCondition(conditions, ipamv1.PoolLowCapacity)
+			return condition != nil && condition.Status == status && condition.Reason == reason
+		})
+	}
+	assert.True(t, lowCapacity(corev1.ConditionFalse, ipamv1.BelowThresholdReason))
+
+	for i, address := range []string{"172.22.132.1", "172.22.132.2", "172.22.132.3"} {
+		allocation, err := util.NewAllocation(pool.Name, address, nil)
+		assert.Nil(t, err)
+		_, err = allocations.Create(allocation)
+		assert.Nil(t, err)
+
+		switch i {
+		case 1:
+			assert.True(t, lowCapacity(corev1.ConditionTrue, ipamv1.WarningThresholdReason))
+			assert.True(t, testutil.WaitForEvent(recorder, "Warning UtilizationWarning 50.0% of the addresses are used"))
+		case 2:
+			assert.True(t, lowCapacity(corev1.ConditionTrue, ipamv1.CriticalThresholdReason))
+			assert.True(t, testutil.WaitForEvent(recorder, "Warning UtilizationCritical 75.0% of the addresses are used"))
+		}
+	}
+
+	for _, address := range []string{"172.22.132.2", "172.22.132.3"} {
+		name, err := ipamv1.AllocationName(address)
+		assert.Nil(t, err)
+		assert.Nil(t, allocations.Delete(name, nil))
+	}
+	assert.True(t, lowCapacity(corev1.ConditionFalse, ipamv1.BelowThresholdReason))
+	assert.True(t, testutil.WaitForEvent(recorder, "Normal UtilizationNormal 25.0% of the addresses are used"))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestConditions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, allocations := newController(ctx, t)
+
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-conditions", Generation: 1},
+		Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.132.1-172.22.132.2"}},
+	}
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	hasConditions := func(generation int64, expected map[ipamv1.ConditionType]string) bool {
+		return testutil.WaitFor(func() bool {
+			p, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+			assert.Nil(t, err)
+
+			conditions, err := util.Conditions(p.ObjectMeta)
+			assert.Nil(t, err)
+			matched := 0
+			for conditionType, reason := range expected {
+				condition := util.FindCondition(conditions, conditionType)
+				if condition != nil && condition.Reason == reason && condition.ObservedGeneration == generation {
+					assert.False(t, condition.LastTransitionTime.IsZero())
+					matched++
+				}
+			}
+			return matched == len(expected)
+		})
+	}
+
+	assert.True(t, hasConditions(1, map[ipamv1.ConditionType]string{
+		ipamv1.PoolReady:          ipamconstants.PoolReadyReason,
+		ipamv1.PoolAddressesValid: ipamconstants.AddressesParsedReason,
+		ipamv1.PoolExhausted:      ipamconstants.AddressesAvailableReason,
+		ipamv1.PoolDegraded:       ipamconstants.AsExpectedReason,
+	}))
+
+	for _, address := range []string{"172.22.132.1", "172.22.132.2"} {
+		allocation, err := util.NewAllocation(pool.Name, address, nil)
+		assert.Nil(t, err)
+		_, err = allocations.Create(allocation)
+		assert.Nil(t, err)
+	}
+	assert.True(t, hasConditions(1, map[ipamv1.ConditionType]string{
+		ipamv1.PoolReady:     ipamconstants.PoolReadyReason,
+		ipamv1.PoolExhausted: ipamconstants.PoolExhaustedReason,
+	}))
+
+	// Break the addresses of the pool
+	p, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	p.Generation = 2
+	p.Spec.Addresses = []string{"172.22.132.x"}
+	_, err = blendedset.InwinstackV1().Pools().Update(p)
+	assert.Nil(t, err)
+	assert.True(t, hasConditions(2, map[ipamv1.ConditionType]string{
+		ipamv1.PoolReady:          ipamconstants.InvalidAddressesReason,
+		ipamv1.PoolAddressesValid: ipamconstants.InvalidAddressesReason,
+	}))
+
+	p, err = blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	conditions, err := util.Conditions(p.ObjectMeta)
+	assert.Nil(t, err)
+	assert.Equal(t, corev1.ConditionFalse, util.FindCondition(conditions, ipamv1.PoolReady).Status)
+	assert.Equal(t, corev1.ConditionFalse, util.FindCondition(conditions, ipamv1.PoolAddressesValid).Status)
+
+	cancel()
+	controller.Stop()
+}
+
+func TestStrandedAllocations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := record.NewFakeRecorder(100)
+	controller, blendedset, allocations := newControllerWithRecorder(ctx, t, recorder)
+
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-stranded"},
+		Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.132.1-172.22.132.5"}},
+	}
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	ip := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: "default", UID: "test-uid"},
+		Spec:       blendedv1.IPSpec{PoolName: pool.Name},
+		Status:     blendedv1.IPStatus{Phase: blendedv1.IPActive, Address: "172.22.132.5"},
+	}
+	_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+	assert.Nil(t, err)
+
+	for address, owner := range map[string]*blendedv1.IP{"172.22.132.1": nil, "172.22.132.5": ip} {
+		allocation, err := util.NewAllocation(pool.Name, address, owner)
+		assert.Nil(t, err)
+		_, err = allocations.Create(allocation)
+		assert.Nil(t, err)
+	}
+
+	degraded := func(p *blendedv1.Pool) corev1.ConditionStatus {
+		conditions, err := util.Conditions(p.ObjectMeta)
+		assert.Nil(t, err)
+		if condition := util.FindCondition(conditions, ipamv1.PoolDegraded); condition != nil {
+			return condition.Status
+		}
+		return corev1.ConditionUnknown
+	}
+	testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool { return p.Status.Allocatable == 3 })
+
+	// Shrink the pool, the stranded address is kept by default
+	gpool, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	gpool.Spec.Addresses = []string{"172.22.132.1-172.22.132.3"}
+	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
+	assert.Nil(t, err)
+	assert.True(t, testutil.WaitForEvent(recorder, "Warning AddressesStranded 1 allocated addresses are no longer in the pool: 172.22.132.5"))
+	testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		return degraded(p) == corev1.ConditionTrue && p.Status.Allocatable == 2 &&
+			p.Annotations[ipamconstants.StrandedIPsKey] == "172.22.132.5"
+	})
+
+	name, err := ipamv1.AllocationName("172.22.132.5")
+	assert.Nil(t, err)
+	_, err = allocations.Get(name, metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	// Force the release of the stranded address
+	gpool, err = blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	gpool.Annotations[ipamconstants.ShrinkPolicyKey] = ipamconstants.ShrinkPolicyRelease
+	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
+	assert.Nil(t, err)
+	assert.True(t, testutil.WaitForEvent(recorder, "Warning StrandedReleased The address 172.22.132.5 is no longer in the \"test-stranded\" pool"))
+	testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		_, ok := p.Annotations[ipamconstants.StrandedIPsKey]
+		return degraded(p) == corev1.ConditionFalse && !ok
+	})
+
+	_, err = allocations.Get(name, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	gip, err := blendedset.InwinstackV1().IPs(ip.Namespace).Get(ip.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, blendedv1.IPFailed, gip.Status.Phase)
+	assert.Equal(t, "", gip.Status.Address)
+	assert.True(t, strings.HasPrefix(gip.Status.Reason, "StrandedReleased: "))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestShrinkPolicyBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := record.NewFakeRecorder(100)
+	controller, blendedset, allocations := newControllerWithRecorder(ctx, t, recorder)
+
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-block",
+			Annotations: map[string]string{ipamconstants.ShrinkPolicyKey: ipamconstants.ShrinkPolicyBlock},
+		},
+		Spec: blendedv1.PoolSpec{Addresses: []string{"172.22.132.1-172.22.132.5"}},
+	}
+	_, err := blendedset.InwinstackV1().Pools().Create(pool)
+	assert.Nil(t, err)
+
+	allocation, err := util.NewAllocation(pool.Name, "172.22.132.5", nil)
+	assert.Nil(t, err)
+	_, err = allocations.Create(allocation)
+	assert.Nil(t, err)
+
+	testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool { return p.Status.Allocatable == 4 })
+
+	// Shrink the pool, the edit is blocked since the webhook isn't there to deny it
+	gpool, err := blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	gpool.Spec.Addresses = []string{"172.22.132.1-172.22.132.3"}
+	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
+	assert.Nil(t, err)
+	assert.True(t, testutil.WaitForEvent(recorder, "Warning ShrinkBlocked The edit was blocked, 1 allocated addresses are no longer in the pool: 172.22.132.5"))
+	testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolFailed && strings.HasPrefix(p.Status.Reason, "ShrinkBlocked: ")
+	})
+
+	// Revert the edit, the pool allocates again
+	gpool, err = blendedset.InwinstackV1().Pools().Get(pool.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	gpool.Spec.Addresses = []string{"172.22.132.1-172.22.132.5"}
+	_, err = blendedset.InwinstackV1().Pools().Update(gpool)
+	assert.Nil(t, err)
+	testutil.WaitForPool(t, blendedset, pool.Name, func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolActive && p.Status.Allocatable == 4
+	})
+
+	cancel()
+	controller.Stop()
+}
+
+func TestDrainPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := record.NewFakeRecorder(100)
+	controller, blendedset, allocations := newControllerWithRecorder(ctx, t, recorder)
+
+	// newPool creates an active pool whose address is allocated to an IP
+	newPool := func(name, address string) *blendedv1.IP {
+		pool := &blendedv1.Pool{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       blendedv1.PoolSpec{Addresses: []string{address + "/32"}},
+		}
+		_, err := blendedset.InwinstackV1().Pools().Create(pool)
+		assert.Nil(t, err)
+
+		ip := &blendedv1.IP{
+			ObjectMeta: metav1.ObjectMeta{Name: name + "-ip", Namespace: "default"},
+			Spec:       blendedv1.IPSpec{PoolName: name},
+			Status:     blendedv1.IPStatus{Phase: blendedv1.IPActive, Address: address},
+		}
+		_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Create(ip)
+		assert.Nil(t, err)
+
+		allocation, err := util.NewAllocation(name, address, ip)
+		assert.Nil(t, err)
+		_, err = allocations.Create(allocation)
+		assert.Nil(t, err)
+		testutil.WaitForPool(t, blendedset, name, func(p *blendedv1.Pool) bool { return p.Status.Allocatable == 0 && len(p.Finalizers) == 1 })
+		return ip
+	}
+
+	deletePool := func(name, policy string) {
+		p, err := blendedset.InwinstackV1().Pools().Get(name, metav1.GetOptions{})
+		assert.Nil(t, err)
+		now := metav1.Now()
+		p.DeletionTimestamp = &now
+		if policy != "" {
+			p.Annotations[ipamconstants.DrainPolicyKey] = policy
+		}
+		_, err = blendedset.InwinstackV1().Pools().Update(p)
+		assert.Nil(t, err)
+	}
+
+	// The pool waits for its IPs by default
+	ip := newPool("test-drain", "172.22.132.1")
+	deletePool("test-drain", "")
+	testutil.WaitForPool(t, blendedset, "test-drain", func(p *blendedv1.Pool) bool {
+		conditions, err := util.Conditions(p.ObjectMeta)
+		assert.Nil(t, err)
+		ready := util.FindCondition(conditions, ipamv1.PoolReady)
+		return p.Status.Phase == blendedv1.PoolTerminating && p.Annotations[ipamconstants.BlockingIPsKey] == "default/test-drain-ip" &&
+			ready != nil && strings.HasSuffix(ready.Message, "waiting for default/test-drain-ip")
+	})
+
+	p, err := blendedset.InwinstackV1().Pools().Get("test-drain", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(p.Finalizers))
+
+	// Cascade deletes the IP, and the pool goes away once the address is released
+	p.Annotations[ipamconstants.DrainPolicyKey] = ipamconstants.DrainPolicyCascade
+	_, err = blendedset.InwinstackV1().Pools().Update(p)
+	assert.Nil(t, err)
+	assert.True(t, testutil.WaitForEvent(recorder, "Normal DrainDeleted Deleted IP \"default/test-drain-ip\" that has address 172.22.132.1"))
+	testutil.WaitForPool(t, blendedset, "test-drain", func(p *blendedv1.Pool) bool {
+		_, ok := p.Annotations[ipamconstants.BlockingIPsKey]
+		return len(p.Finalizers) == 0 && !ok
+	})
+
+	_, err = blendedset.InwinstackV1().IPs(ip.Namespace).Get(ip.Name, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	// Orphan leaves the IP with its address
+	ip = newPool("test-orphan", "172.22.132.2")
+	deletePool("test-orphan", ipamconstants.DrainPolicyOrphan)
+	assert.True(t, testutil.WaitForEvent(recorder, "Warning DrainOrphaned Left 1 IPs with the addresses of the pool: default/test-orphan-ip"))
+	testutil.WaitForPool(t, blendedset, "test-orphan", func(p *blendedv1.Pool) bool { return len(p.Finalizers) == 0 })
+
+	gip, err := blendedset.InwinstackV1().IPs(ip.Namespace).Get(ip.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.2", gip.Status.Address)
+
+	name, err := ipamv1.AllocationName("172.22.132.2")
+	assert.Nil(t, err)
+	_, err = allocations.Get(name, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	cancel()
+	controller.Stop()
+}
+
+func TestChildPools(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, blendedset, _ := newController(ctx, t)
+
+	newChild := func(name string, addresses ...string) {
+		child := &blendedv1.Pool{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Annotations: map[string]string{ipamconstants.ParentPoolKey: "test-parent"},
+			},
+			Spec: blendedv1.PoolSpec{Addresses: addresses},
+		}
+		_, err := blendedset.InwinstackV1().Pools().Create(child)
+		assert.Nil(t, err)
+	}
+
+	// The child waits for its parent
+	newChild("test-child", "172.22.132.16/28")
+	testutil.WaitForPool(t, blendedset, "test-child", func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolFailed && strings.HasPrefix(p.Status.Reason, ipamconstants.PoolNotReadyReason)
+	})
+
+	parent := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-parent"},
+		Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.132.0/24"}, AvoidBuggyIPs: true},
+	}
+	_, err := blendedset.InwinstackV1().Pools().Create(parent)
+	assert.Nil(t, err)
+
+	// The addresses of the child are allocated in the parent
+	testutil.WaitForPool(t, blendedset, "test-child", func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolActive && p.Status.Capacity == 16 && len(p.Finalizers) == 1
+	})
+	testutil.WaitForPool(t, blendedset, "test-parent", func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolActive && p.Status.Capacity == 254 && p.Status.Allocatable == 238
+	})
+
+	// The children can't overlap, nor go beyond their parent
+	newChild("test-child-overlap", "172.22.132.20-172.22.132.40")
+	newChild("test-child-outside", "172.22.133.0/28")
+	testutil.WaitForPool(t, blendedset, "test-child-overlap", func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolFailed && strings.HasPrefix(p.Status.Reason, ipamconstants.InvalidAddressesReason)
+	})
+	testutil.WaitForPool(t, blendedset, "test-child-outside", func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolFailed && strings.HasPrefix(p.Status.Reason, ipamconstants.InvalidAddressesReason)
+	})
+
+	// The parent can't drop the addresses of its children
+	p, err := blendedset.InwinstackV1().Pools().Get("test-parent", metav1.GetOptions{})
+	assert.Nil(t, err)
+	p.Spec.Addresses = []string{"172.22.132.128/25"}
+	_, err = blendedset.InwinstackV1().Pools().Update(p)
+	assert.Nil(t, err)
+	testutil.WaitForPool(t, blendedset, "test-parent", func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolFailed && strings.HasPrefix(p.Status.Reason, ipamconstants.InvalidAddressesReason)
+	})
+
+	p, err = blendedset.InwinstackV1().Pools().Get("test-parent", metav1.GetOptions{})
+	assert.Nil(t, err)
+	p.Spec.Addresses = []string{"172.22.132.0/24"}
+	_, err = blendedset.InwinstackV1().Pools().Update(p)
+	assert.Nil(t, err)
+	testutil.WaitForPool(t, blendedset, "test-parent", func(p *blendedv1.Pool) bool { return p.Status.Phase == blendedv1.PoolActive })
+
+	// The deleted child gives its addresses back, then the overlapping child gets them
+	c, err := blendedset.InwinstackV1().Pools().Get("test-child", metav1.GetOptions{})
+	assert.Nil(t, err)
+	now := metav1.Now()
+	c.DeletionTimestamp = &now
+	_, err = blendedset.InwinstackV1().Pools().Update(c)
+	assert.Nil(t, err)
+	testutil.WaitForPool(t, blendedset, "test-child", func(p *blendedv1.Pool) bool { return len(p.Finalizers) == 0 })
+	testutil.WaitForPool(t, blendedset, "test-child-overlap", func(p *blendedv1.Pool) bool { return p.Status.Phase == blendedv1.PoolActive })
+	testutil.WaitForPool(t, blendedset, "test-parent", func(p *blendedv1.Pool) bool {
+		prefixes, err := util.DelegatedPrefixes(p)
+		assert.Nil(t, err)
+		return len(prefixes) == 1 && prefixes["test-child-overlap"] == "172.22.132.20-172.22.132.40" && p.Status.Allocatable == 233
+	})
+	assert.Nil(t, blendedset.InwinstackV1().Pools().Delete("test-child", &metav1.DeleteOptions{}))
+
+	// The deleted parent waits for its children, whatever its drain policy
+	p, err = blendedset.InwinstackV1().Pools().Get("test-parent", metav1.GetOptions{})
+	assert.Nil(t, err)
+	p.Annotations[ipamconstants.DrainPolicyKey] = ipamconstants.DrainPolicyOrphan
+	p.DeletionTimestamp = &now
+	_, err = blendedset.InwinstackV1().Pools().Update(p)
+	assert.Nil(t, err)
+	testutil.WaitForPool(t, blendedset, "test-parent", func(p *blendedv1.Pool) bool {
+		return p.Status.Phase == blendedv1.PoolTerminating && len(p.Finalizers) == 1 &&
+			p.Annotations[ipamconstants.BlockingIPsKey] == "pool/test-child-outside,pool/test-child-overlap"
+	})
+
+	for _, name := range []string{"test-child-outside", "test-child-overlap"} {
+		assert.Nil(t, blendedset.InwinstackV1().Pools().Delete(name, &metav1.DeleteOptions{}))
+	}
+	testutil.WaitForPool(t, blendedset, "test-parent", func(p *blendedv1.Pool) bool { return len(p.Finalizers) == 0 })
+
+	cancel()
+	controller.Stop()
+}
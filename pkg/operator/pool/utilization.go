@@ -0,0 +1,81 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pool
+
+import (
+	"fmt"
+
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The utilisation thresholds crossed by a pool
+const (
+	levelNormal = iota
+	levelWarning
+	levelCritical
+)
+
+// utilization returns the ratio of the usable addresses that can't be allocated.
+func utilization(capacity, allocatable int) float64 {
+	if capacity == 0 {
+		return 1
+	}
+	return float64(capacity-allocatable) / float64(capacity)
+}
+
+// utilizationLevel returns the thresholds crossed according to the LowCapacity condition.
+func utilizationLevel(conditions []ipamv1.Condition) int {
+	condition := util.FindCondition(conditions, ipamv1.PoolLowCapacity)
+	switch {
+	case condition == nil || condition.Status != corev1.ConditionTrue:
+		return levelNormal
+	case condition.Reason == ipamv1.CriticalThresholdReason:
+		return levelCritical
+	default:
+		return levelWarning
+	}
+}
+
+// lowCapacityCondition returns the LowCapacity condition according to the thresholds,
+// or nil for the pools without thresholds.
+func lowCapacityCondition(capacity, allocatable int, warning, critical float64) *ipamv1.Condition {
+	if warning == 0 && critical == 0 {
+		return nil
+	}
+
+	used := utilization(capacity, allocatable) * 100
+	condition := &ipamv1.Condition{
+		Type:    ipamv1.PoolLowCapacity,
+		Status:  corev1.ConditionFalse,
+		Reason:  ipamv1.BelowThresholdReason,
+		Message: fmt.Sprintf("%.1f%% of the addresses are used", used),
+	}
+
+	switch {
+	case critical > 0 && used >= critical:
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = ipamv1.CriticalThresholdReason
+		condition.Message = fmt.Sprintf("%.1f%% of the addresses are used, over the critical threshold of %v%%", used, critical)
+	case warning > 0 && used >= warning:
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = ipamv1.WarningThresholdReason
+		condition.Message = fmt.Sprintf("%.1f%% of the addresses are used, over the warning threshold of %v%%", used, warning)
+	}
+	return condition
+}
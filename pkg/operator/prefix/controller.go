@@ -0,0 +1,511 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prefix
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	"github.com/inwinstack/blended/constants"
+	blended "github.com/inwinstack/blended/generated/clientset/versioned"
+	informerv1 "github.com/inwinstack/blended/generated/informers/externalversions/inwinstack/v1"
+	listerv1 "github.com/inwinstack/blended/generated/listers/inwinstack/v1"
+	"github.com/inwinstack/blended/k8sutil"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/ipaddr"
+	"github.com/inwinstack/ipam/pkg/util"
+	"github.com/thoas/go-funk"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Controller represents the controller of the prefix claims. It carves an aligned prefix
+// out of the pool of each claim, and publishes it as a child pool if the claim names one.
+// The prefixes are recorded on their pool, so that its allocators take them as a whole.
+// The addresses of a pool are picked under the same lock as the IP controller.
+type Controller struct {
+	blendedset  blended.Interface
+	claims      client.PrefixClaimsGetter
+	allocations client.AllocationInterface
+	lister      client.PrefixClaimLister
+	poolLister  listerv1.PoolLister
+	synced      []cache.InformerSynced
+	queue       workqueue.RateLimitingInterface
+	recorder    record.EventRecorder
+	pools       *util.KeyMutex
+}
+
+// NewController creates an instance of the prefix claim controller
+func NewController(
+	blendedset blended.Interface,
+	claims client.PrefixClaimsGetter,
+	allocations client.AllocationInterface,
+	informer client.PrefixClaimInformer,
+	poolInformer informerv1.PoolInformer,
+	recorder record.EventRecorder,
+	pools *util.KeyMutex) *Controller {
+	controller := &Controller{
+		blendedset:  blendedset,
+		claims:      claims,
+		allocations: allocations,
+		lister:      informer.Lister(),
+		poolLister:  poolInformer.Lister(),
+		synced:      []cache.InformerSynced{informer.Informer().HasSynced, poolInformer.Informer().HasSynced},
+		queue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "PrefixClaims"),
+		recorder:    recorder,
+		pools:       pools,
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueue,
+		UpdateFunc: func(old, new interface{}) { controller.enqueue(new) },
+	})
+	poolInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueuePoolClaims,
+		UpdateFunc: func(old, new interface{}) { controller.enqueuePoolClaims(new) },
+		DeleteFunc: controller.enqueuePoolClaims,
+	})
+	return controller
+}
+
+// Run serves the prefix claim controller
+func (c *Controller) Run(ctx context.Context, threadiness int) error {
+	glog.Info("Starting the prefix claim controller")
+	glog.Info("Waiting for the prefix claim informer caches to sync")
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.synced...); !ok {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+
+	for i := 0; i < threadiness; i++ {
+		go wait.Until(c.runWorker, time.Second, ctx.Done())
+	}
+	return nil
+}
+
+// Stop stops the prefix claim controller
+func (c *Controller) Stop() {
+	glog.Info("Stopping the prefix claim controller")
+	c.queue.ShutDown()
+}
+
+func (c *Controller) runWorker() {
+	defer utilruntime.HandleCrash()
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	obj, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+
+	err := func(obj interface{}) error {
+		defer c.queue.Done(obj)
+		key, ok := obj.(string)
+		if !ok {
+			c.queue.Forget(obj)
+			utilruntime.HandleError(fmt.Errorf("PrefixClaim expected string in workqueue but got %#v", obj))
+			return nil
+		}
+
+		if err := c.reconcile(key); err != nil {
+			c.queue.AddRateLimited(key)
+			return fmt.Errorf("PrefixClaim error syncing '%s': %s, requeuing", key, err.Error())
+		}
+
+		c.queue.Forget(obj)
+		glog.V(2).Infof("PrefixClaim successfully synced '%s'", key)
+		return nil
+	}(obj)
+
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+	return true
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// enqueuePoolClaims enqueues the claims of the pool, and the claim that the pool publishes
+// the prefix of, so that they follow the pool.
+func (c *Controller) enqueuePoolClaims(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	pool, ok := obj.(*blendedv1.Pool)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("PrefixClaim expected a pool but got %#v", obj))
+		return
+	}
+
+	if key, ok := pool.Annotations[ipamconstants.PrefixClaimKey]; ok {
+		c.queue.Add(key)
+	}
+
+	claims, err := c.lister.ByPool(pool.Name)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, claim := range claims {
+		c.enqueue(claim)
+	}
+}
+
+// claimKey returns the key of the claim in the delegated prefixes of its pool.
+func claimKey(claim *ipamv1.PrefixClaim) string {
+	return fmt.Sprintf("%s/%s", claim.Namespace, claim.Name)
+}
+
+func validate(claim *ipamv1.PrefixClaim) error {
+	if claim.Spec.PoolName == "" {
+		return fmt.Errorf("The claim has no pool")
+	}
+
+	if claim.Spec.PrefixLength < 1 || claim.Spec.PrefixLength > 128 {
+		return fmt.Errorf("invalid prefix length %d", claim.Spec.PrefixLength)
+	}
+
+	if claim.Spec.ChildPoolName == claim.Spec.PoolName {
+		return fmt.Errorf("The child pool can't be the pool of the claim")
+	}
+	return nil
+}
+
+func (c *Controller) reconcile(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("invalid resource key: %s", key))
+		return err
+	}
+
+	claim, err := c.lister.Get(namespace, name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// The prefix is released before the finalizer goes away
+			return nil
+		}
+		return err
+	}
+
+	if !claim.DeletionTimestamp.IsZero() {
+		return c.cleanup(claim)
+	}
+
+	if claim.Status.Phase == ipamv1.PrefixClaimFailed || c.isSynced(claim) {
+		return nil
+	}
+
+	if !funk.ContainsString(claim.Finalizers, constants.CustomFinalizer) {
+		claimCopy := claim.DeepCopy()
+		k8sutil.AddFinalizer(&claimCopy.ObjectMeta, constants.CustomFinalizer)
+		_, err := c.claims.PrefixClaims(claim.Namespace).Update(claimCopy)
+		return err
+	}
+
+	if err := validate(claim); err != nil {
+		return c.fail(claim, ipamconstants.InvalidSpecReason, err.Error())
+	}
+	return c.delegate(claim)
+}
+
+// isSynced reports whether the cached pools already reflect the active claim.
+func (c *Controller) isSynced(claim *ipamv1.PrefixClaim) bool {
+	if claim.Status.Phase != ipamv1.PrefixClaimActive {
+		return false
+	}
+
+	pool, err := c.poolLister.Get(claim.Spec.PoolName)
+	if err != nil {
+		return false
+	}
+
+	prefixes, err := util.DelegatedPrefixes(pool)
+	if err != nil || prefixes[claimKey(claim)] != claim.Status.Prefix {
+		return false
+	}
+
+	if name := claim.Spec.ChildPoolName; name != "" {
+		child, err := c.poolLister.Get(name)
+		return err == nil && child.Annotations[ipamconstants.PrefixClaimKey] == claimKey(claim)
+	}
+	return true
+}
+
+// newAllocator creates the allocator of the pool from the allocations in the API server,
+// the cached ones may miss the latest claims of the IP controller.
+func (c *Controller) newAllocator(pool *blendedv1.Pool, prefixes map[string]string) (*ipaddr.Allocator, error) {
+	list, err := c.allocations.List(metav1.ListOptions{LabelSelector: ipamconstants.PoolLabelKey + "=" + pool.Name})
+	if err != nil {
+		return nil, err
+	}
+
+	allocations := []*ipamv1.Allocation{}
+	for i := range list.Items {
+		allocations = append(allocations, &list.Items[i])
+	}
+	return util.NewPoolAllocator(pool, prefixes, allocations)
+}
+
+// delegate records the prefix of the claim on its pool, then publishes it. A claim keeps
+// its prefix, so it's delegated again if the pool lost it.
+func (c *Controller) delegate(claim *ipamv1.PrefixClaim) error {
+	defer c.pools.Lock(claim.Spec.PoolName)()
+
+	pool, err := c.blendedset.InwinstackV1().Pools().Get(claim.Spec.PoolName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// The claim is enqueued again when the pool shows up
+		return c.pending(claim, fmt.Sprintf("The \"%s\" pool doesn't exist", claim.Spec.PoolName))
+	}
+	if err != nil {
+		return err
+	}
+
+	if pool.Status.Phase != blendedv1.PoolActive || !pool.DeletionTimestamp.IsZero() {
+		return c.pending(claim, fmt.Sprintf("The \"%s\" pool isn't active", pool.Name))
+	}
+
+	prefixes, err := util.DelegatedPrefixes(pool)
+	if err != nil {
+		return err
+	}
+
+	key := claimKey(claim)
+	prefix, ok := prefixes[key]
+	if !ok {
+		if ok, err := c.checkChildPool(claim); !ok || err != nil {
+			return err
+		}
+
+		allocator, err := c.newAllocator(pool, prefixes)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case claim.Status.Prefix == "":
+			next, err := allocator.NextPrefix(claim.Spec.PrefixLength)
+			if err != nil {
+				return c.fail(claim, ipamconstants.PoolExhaustedReason, err.Error())
+			}
+			prefix = next.String()
+		case allocator.IsFreePrefix(claim.Status.Prefix):
+			prefix = claim.Status.Prefix
+		default:
+			return c.fail(claim, ipamconstants.PoolExhaustedReason,
+				fmt.Sprintf("The prefix %s is no longer available in the \"%s\" pool", claim.Status.Prefix, pool.Name))
+		}
+
+		poolCopy := pool.DeepCopy()
+		prefixes[key] = prefix
+		util.SetDelegatedPrefixes(poolCopy, prefixes)
+		if _, err := c.blendedset.InwinstackV1().Pools().Update(poolCopy); err != nil {
+			return err
+		}
+		glog.Infof("Pool \"%s\" delegated prefix %s to \"%s\".", pool.Name, prefix, key)
+	}
+
+	if err := c.publish(claim, pool, prefix); err != nil {
+		return err
+	}
+	return c.bind(claim, prefix)
+}
+
+// checkChildPool fails the claim if its child pool already exists and publishes something else.
+func (c *Controller) checkChildPool(claim *ipamv1.PrefixClaim) (bool, error) {
+	name := claim.Spec.ChildPoolName
+	if name == "" {
+		return true, nil
+	}
+
+	child, err := c.blendedset.InwinstackV1().Pools().Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if child.Annotations[ipamconstants.PrefixClaimKey] != claimKey(claim) {
+		return false, c.fail(claim, ipamconstants.PoolConflictReason,
+			fmt.Sprintf("The \"%s\" pool already exists and doesn't publish the prefix of the claim", name))
+	}
+	return true, nil
+}
+
+// publish creates the child pool of the prefix, it avoids the same addresses as its parent.
+func (c *Controller) publish(claim *ipamv1.PrefixClaim, parent *blendedv1.Pool, prefix string) error {
+	if claim.Spec.ChildPoolName == "" {
+		return nil
+	}
+
+	child := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: claim.Spec.ChildPoolName,
+			Annotations: map[string]string{
+				ipamconstants.PrefixClaimKey: claimKey(claim),
+				ipamconstants.ParentPoolKey:  parent.Name,
+			},
+		},
+		Spec: blendedv1.PoolSpec{
+			Addresses:       []string{prefix},
+			AvoidBuggyIPs:   parent.Spec.AvoidBuggyIPs,
+			AvoidGatewayIPs: parent.Spec.AvoidGatewayIPs,
+		},
+	}
+	if _, err := c.blendedset.InwinstackV1().Pools().Create(child); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// bind makes the claim active with its prefix.
+func (c *Controller) bind(claim *ipamv1.PrefixClaim, prefix string) error {
+	if claim.Status.Phase == ipamv1.PrefixClaimActive && claim.Status.Prefix == prefix {
+		return nil
+	}
+
+	claimCopy := claim.DeepCopy()
+	claimCopy.Status.Phase = ipamv1.PrefixClaimActive
+	claimCopy.Status.Reason = ""
+	claimCopy.Status.Prefix = prefix
+	claimCopy.Status.LastUpdateTime = metav1.Now()
+	if _, err := c.claims.PrefixClaims(claim.Namespace).Update(claimCopy); err != nil {
+		return err
+	}
+	c.recorder.Eventf(claimCopy, corev1.EventTypeNormal, ipamconstants.PrefixDelegatedReason,
+		"Delegated prefix %s of the \"%s\" pool", prefix, claim.Spec.PoolName)
+	return nil
+}
+
+// pending tells why the claim waits for its pool.
+func (c *Controller) pending(claim *ipamv1.PrefixClaim, message string) error {
+	if claim.Status.Phase == ipamv1.PrefixClaimPending && claim.Status.Reason == message {
+		return nil
+	}
+
+	claimCopy := claim.DeepCopy()
+	claimCopy.Status.Phase = ipamv1.PrefixClaimPending
+	claimCopy.Status.Reason = message
+	claimCopy.Status.LastUpdateTime = metav1.Now()
+	_, err := c.claims.PrefixClaims(claim.Namespace).Update(claimCopy)
+	return err
+}
+
+// fail fails the claim, it keeps the prefix it may already have until it's deleted.
+func (c *Controller) fail(claim *ipamv1.PrefixClaim, reason, message string) error {
+	claimCopy := claim.DeepCopy()
+	claimCopy.Status.Phase = ipamv1.PrefixClaimFailed
+	claimCopy.Status.Reason = message
+	claimCopy.Status.LastUpdateTime = metav1.Now()
+	if _, err := c.claims.PrefixClaims(claim.Namespace).Update(claimCopy); err != nil {
+		return err
+	}
+	c.recorder.Event(claimCopy, corev1.EventTypeWarning, reason, message)
+	return nil
+}
+
+// cleanup deletes the child pool of the deleted claim, and gives the prefix back to the pool
+// once the child pool is gone, so that the addresses of its IPs aren't allocated twice.
+func (c *Controller) cleanup(claim *ipamv1.PrefixClaim) error {
+	if !funk.ContainsString(claim.Finalizers, constants.CustomFinalizer) {
+		return nil
+	}
+
+	if name := claim.Spec.ChildPoolName; name != "" {
+		child, err := c.blendedset.InwinstackV1().Pools().Get(name, metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		if err == nil && child.Annotations[ipamconstants.PrefixClaimKey] == claimKey(claim) {
+			// The claim is enqueued again when the child pool is gone
+			if child.DeletionTimestamp.IsZero() {
+				glog.Infof("PrefixClaim \"%s\" deletes the \"%s\" pool.", claimKey(claim), name)
+				if err := c.blendedset.InwinstackV1().Pools().Delete(name, nil); err != nil && !errors.IsNotFound(err) {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	if err := c.release(claim); err != nil {
+		return err
+	}
+
+	claimCopy := claim.DeepCopy()
+	k8sutil.RemoveFinalizer(&claimCopy.ObjectMeta, constants.CustomFinalizer)
+	if _, err := c.claims.PrefixClaims(claim.Namespace).Update(claimCopy); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// release removes the prefix of the claim from its pool.
+func (c *Controller) release(claim *ipamv1.PrefixClaim) error {
+	defer c.pools.Lock(claim.Spec.PoolName)()
+
+	pool, err := c.blendedset.InwinstackV1().Pools().Get(claim.Spec.PoolName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	prefixes, err := util.DelegatedPrefixes(pool)
+	if err != nil {
+		return err
+	}
+
+	prefix, ok := prefixes[claimKey(claim)]
+	if !ok {
+		return nil
+	}
+
+	poolCopy := pool.DeepCopy()
+	delete(prefixes, claimKey(claim))
+	util.SetDelegatedPrefixes(poolCopy, prefixes)
+	if _, err := c.blendedset.InwinstackV1().Pools().Update(poolCopy); err != nil {
+		return err
+	}
+	c.recorder.Eventf(claim, corev1.EventTypeNormal, ipamconstants.PrefixReleasedReason,
+		"Released prefix %s of the \"%s\" pool", prefix, pool.Name)
+	return nil
+}
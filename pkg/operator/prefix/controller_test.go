@@ -0,0 +1,162 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prefix
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/inwinstack/blended/constants"
+	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
+	blendedinformers "github.com/inwinstack/blended/generated/informers/externalversions"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/operator/testutil"
+	"github.com/inwinstack/ipam/pkg/util"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const timeout = 3 * time.Second
+
+func newClaim(name, pool string, length int, child string) *ipamv1.PrefixClaim {
+	return &ipamv1.PrefixClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       ipamv1.PrefixClaimSpec{PoolName: pool, PrefixLength: length, ChildPoolName: child},
+	}
+}
+
+// waitForPhase waits until the claim gets into the phase, and returns it.
+func waitForPhase(t *testing.T, claims client.PrefixClaimInterface, name string, phase ipamv1.PrefixClaimPhase) *ipamv1.PrefixClaim {
+	for start := time.Now(); time.Since(start) < timeout; {
+		if claim, err := claims.Get(name, metav1.GetOptions{}); err == nil && claim.Status.Phase == phase {
+			return claim
+		}
+	}
+
+	claim, err := claims.Get(name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, phase, claim.Status.Phase, name)
+	return claim
+}
+
+func TestPrefixController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blendedset := blendedfake.NewSimpleClientset(testutil.NewPool("test", "172.22.132.0/24"), testutil.NewPool("other", "172.22.133.0/24"))
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	allocations := client.NewAllocations(dynamicClient)
+	prefixClaims := client.NewPrefixClaims(dynamicClient)
+	informer := blendedinformers.NewSharedInformerFactory(blendedset, 0)
+	claimInformer := client.NewPrefixClaimInformer(prefixClaims, 0)
+
+	controller := NewController(blendedset, prefixClaims, allocations, claimInformer, informer.Inwinstack().V1().Pools(), &record.FakeRecorder{}, util.NewKeyMutex())
+	go informer.Start(ctx.Done())
+	go claimInformer.Informer().Run(ctx.Done())
+	assert.Nil(t, controller.Run(ctx, 2))
+	defer controller.Stop()
+
+	allocation, err := util.NewAllocation("test", "172.22.132.3", nil)
+	assert.Nil(t, err)
+	_, err = allocations.Create(allocation)
+	assert.Nil(t, err)
+
+	claims := prefixClaims.PrefixClaims("default")
+	_, err = claims.Create(newClaim("test-child", "test", 28, "test-child"))
+	assert.Nil(t, err)
+
+	// The prefix skips the allocated addresses, and it's published as a child pool
+	claim := waitForPhase(t, claims, "test-child", ipamv1.PrefixClaimActive)
+	assert.Equal(t, "172.22.132.16/28", claim.Status.Prefix)
+	assert.Contains(t, claim.Finalizers, constants.CustomFinalizer)
+
+	pool, err := blendedset.InwinstackV1().Pools().Get("test", metav1.GetOptions{})
+	assert.Nil(t, err)
+	prefixes, err := util.DelegatedPrefixes(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"default/test-child": "172.22.132.16/28"}, prefixes)
+
+	child, err := blendedset.InwinstackV1().Pools().Get("test-child", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"172.22.132.16/28"}, child.Spec.Addresses)
+	assert.True(t, util.PublishesPrefixOf(child, pool))
+	assert.Equal(t, "test", child.Annotations[ipamconstants.ParentPoolKey])
+
+	_, err = claims.Create(newClaim("test-large", "test", 25, ""))
+	assert.Nil(t, err)
+	claim = waitForPhase(t, claims, "test-large", ipamv1.PrefixClaimActive)
+	assert.Equal(t, "172.22.132.128/25", claim.Status.Prefix)
+
+	_, err = claims.Create(newClaim("test-exhausted", "test", 25, ""))
+	assert.Nil(t, err)
+	claim = waitForPhase(t, claims, "test-exhausted", ipamv1.PrefixClaimFailed)
+	assert.Contains(t, claim.Status.Reason, "No available /25 prefix")
+
+	_, err = claims.Create(newClaim("test-invalid", "test", 0, ""))
+	assert.Nil(t, err)
+	claim = waitForPhase(t, claims, "test-invalid", ipamv1.PrefixClaimFailed)
+	assert.Contains(t, claim.Status.Reason, "invalid prefix length")
+
+	_, err = claims.Create(newClaim("test-conflict", "test", 28, "other"))
+	assert.Nil(t, err)
+	claim = waitForPhase(t, claims, "test-conflict", ipamv1.PrefixClaimFailed)
+	assert.Contains(t, claim.Status.Reason, "already exists")
+
+	// The claim waits for its pool
+	_, err = claims.Create(newClaim("test-missing", "missing", 30, ""))
+	assert.Nil(t, err)
+	waitForPhase(t, claims, "test-missing", ipamv1.PrefixClaimPending)
+	_, err = blendedset.InwinstackV1().Pools().Create(testutil.NewPool("missing", "172.22.134.0/24"))
+	assert.Nil(t, err)
+	claim = waitForPhase(t, claims, "test-missing", ipamv1.PrefixClaimActive)
+	assert.Equal(t, "172.22.134.0/30", claim.Status.Prefix)
+
+	// The deleted claim removes its child pool before it gives the prefix back
+	claim, err = claims.Get("test-child", metav1.GetOptions{})
+	assert.Nil(t, err)
+	now := metav1.Now()
+	claim.DeletionTimestamp = &now
+	_, err = claims.Update(claim)
+	assert.Nil(t, err)
+
+	for start := time.Now(); time.Since(start) < timeout; {
+		if claim, err := claims.Get("test-child", metav1.GetOptions{}); err == nil && len(claim.Finalizers) == 0 {
+			break
+		}
+	}
+
+	claim, err = claims.Get("test-child", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, claim.Finalizers)
+
+	_, err = blendedset.InwinstackV1().Pools().Get("test-child", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	pool, err = blendedset.InwinstackV1().Pools().Get("test", metav1.GetOptions{})
+	assert.Nil(t, err)
+	prefixes, err = util.DelegatedPrefixes(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"default/test-large": "172.22.132.128/25"}, prefixes)
+	assert.NotContains(t, pool.Annotations[ipamconstants.DelegatedPrefixesKey], "test-child")
+}
@@ -0,0 +1,254 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/util"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformerv1 "k8s.io/client-go/informers/core/v1"
+	corelisterv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Controller represents the controller of the pool quotas. It reports how many addresses
+// of its pool the namespaces of each quota hold, the IP controller enforces the limits.
+type Controller struct {
+	quotas           client.PoolQuotaInterface
+	lister           client.PoolQuotaLister
+	allocationLister client.AllocationLister
+	namespaceLister  corelisterv1.NamespaceLister
+	synced           []cache.InformerSynced
+	queue            workqueue.RateLimitingInterface
+}
+
+// NewController creates an instance of the pool quota controller
+func NewController(
+	quotas client.PoolQuotaInterface,
+	informer client.PoolQuotaInformer,
+	allocationInformer client.AllocationInformer,
+	namespaceInformer coreinformerv1.NamespaceInformer) *Controller {
+	controller := &Controller{
+		quotas:           quotas,
+		lister:           informer.Lister(),
+		allocationLister: allocationInformer.Lister(),
+		namespaceLister:  namespaceInformer.Lister(),
+		synced: []cache.InformerSynced{
+			informer.Informer().HasSynced,
+			allocationInformer.Informer().HasSynced,
+			namespaceInformer.Informer().HasSynced,
+		},
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "PoolQuotas"),
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueue,
+		UpdateFunc: func(old, new interface{}) { controller.enqueue(new) },
+	})
+	allocationInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueuePoolQuotas,
+		UpdateFunc: func(old, new interface{}) { controller.enqueuePoolQuotas(new) },
+		DeleteFunc: controller.enqueuePoolQuotas,
+	})
+	// The labels of the namespaces decide which quotas select them
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueueAll,
+		UpdateFunc: func(old, new interface{}) { controller.enqueueAll(new) },
+		DeleteFunc: controller.enqueueAll,
+	})
+	return controller
+}
+
+// Run serves the pool quota controller
+func (c *Controller) Run(ctx context.Context, threadiness int) error {
+	glog.Info("Starting the pool quota controller")
+	glog.Info("Waiting for the pool quota informer caches to sync")
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.synced...); !ok {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+
+	for i := 0; i < threadiness; i++ {
+		go wait.Until(c.runWorker, time.Second, ctx.Done())
+	}
+	return nil
+}
+
+// Stop stops the pool quota controller
+func (c *Controller) Stop() {
+	glog.Info("Stopping the pool quota controller")
+	c.queue.ShutDown()
+}
+
+func (c *Controller) runWorker() {
+	defer utilruntime.HandleCrash()
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	obj, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+
+	err := func(obj interface{}) error {
+		defer c.queue.Done(obj)
+		key, ok := obj.(string)
+		if !ok {
+			c.queue.Forget(obj)
+			utilruntime.HandleError(fmt.Errorf("PoolQuota expected string in workqueue but got %#v", obj))
+			return nil
+		}
+
+		if err := c.reconcile(key); err != nil {
+			c.queue.AddRateLimited(key)
+			return fmt.Errorf("PoolQuota error syncing '%s': %s, requeuing", key, err.Error())
+		}
+
+		c.queue.Forget(obj)
+		glog.V(2).Infof("PoolQuota successfully synced '%s'", key)
+		return nil
+	}(obj)
+
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+	return true
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// enqueuePoolQuotas enqueues the quotas of the pool of the allocation.
+func (c *Controller) enqueuePoolQuotas(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	allocation, ok := obj.(*ipamv1.Allocation)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("PoolQuota expected an allocation but got %#v", obj))
+		return
+	}
+
+	quotas, err := c.lister.ByPool(allocation.Spec.PoolName)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, quota := range quotas {
+		c.enqueue(quota)
+	}
+}
+
+func (c *Controller) enqueueAll(obj interface{}) {
+	quotas, err := c.lister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, quota := range quotas {
+		c.enqueue(quota)
+	}
+}
+
+func validate(quota *ipamv1.PoolQuota) error {
+	if quota.Spec.PoolName == "" {
+		return fmt.Errorf("The quota has no pool")
+	}
+
+	if quota.Spec.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", quota.Spec.Limit)
+	}
+	return nil
+}
+
+func (c *Controller) namespaceLabels(name string) labels.Set {
+	namespace, err := c.namespaceLister.Get(name)
+	if err != nil {
+		return nil
+	}
+	return labels.Set(namespace.Labels)
+}
+
+func (c *Controller) reconcile(key string) error {
+	quota, err := c.lister.Get(key)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	reason := ""
+	if err := validate(quota); err != nil {
+		reason = fmt.Sprintf("%s: %+v.", ipamconstants.InvalidSpecReason, err)
+	}
+
+	// Like the IP controller, the quota with an invalid selector keeps its listed namespaces
+	selector, err := util.QuotaSelector(quota)
+	if err != nil {
+		reason = fmt.Sprintf("%s: %+v.", ipamconstants.InvalidSpecReason, err)
+		selector = labels.Nothing()
+	}
+
+	allocations, err := c.allocationLister.ByPool(quota.Spec.PoolName)
+	if err != nil {
+		return err
+	}
+
+	used, namespaces := util.QuotaUsage(quota, selector, util.NamespaceUsage(allocations), c.namespaceLabels)
+	if len(namespaces) == 0 {
+		namespaces = nil
+	}
+
+	status := quota.Status
+	if status.Used == used && status.Reason == reason && reflect.DeepEqual(status.Namespaces, namespaces) {
+		return nil
+	}
+
+	quotaCopy := quota.DeepCopy()
+	quotaCopy.Status.Used = used
+	quotaCopy.Status.Namespaces = namespaces
+	quotaCopy.Status.Reason = reason
+	quotaCopy.Status.LastUpdateTime = metav1.Now()
+	if _, err := c.quotas.Update(quotaCopy); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/util"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const timeout = 3 * time.Second
+
+func newNamespace(name string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+// waitForUsed waits until the quota reports the number of used addresses, and returns it.
+func waitForUsed(t *testing.T, quotas client.PoolQuotaInterface, name string, used int) *ipamv1.PoolQuota {
+	for start := time.Now(); time.Since(start) < timeout; {
+		if quota, err := quotas.Get(name, metav1.GetOptions{}); err == nil && quota.Status.Used == used && !quota.Status.LastUpdateTime.IsZero() {
+			return quota
+		}
+	}
+
+	quota, err := quotas.Get(name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, used, quota.Status.Used, name)
+	return quota
+}
+
+func TestQuotaController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	k8sclient := fake.NewSimpleClientset(
+		newNamespace("default", nil),
+		newNamespace("tenant-a", map[string]string{"tenant": "a"}),
+	)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	allocations := client.NewAllocations(dynamicClient)
+	quotas := client.NewPoolQuotas(dynamicClient)
+	k8sinformer := informers.NewSharedInformerFactory(k8sclient, 0)
+	allocationInformer := client.NewAllocationInformer(allocations, 0)
+	quotaInformer := client.NewPoolQuotaInformer(quotas, 0)
+
+	controller := NewController(quotas, quotaInformer, allocationInformer, k8sinformer.Core().V1().Namespaces())
+	go k8sinformer.Start(ctx.Done())
+	go allocationInformer.Informer().Run(ctx.Done())
+	go quotaInformer.Informer().Run(ctx.Done())
+	assert.Nil(t, controller.Run(ctx, 2))
+
+	createAllocation := func(address, namespace string) *ipamv1.Allocation {
+		ip := &blendedv1.IP{ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: namespace}}
+		allocation, err := util.NewAllocation("test-pool", address, ip)
+		assert.Nil(t, err)
+		created, err := allocations.Create(allocation)
+		assert.Nil(t, err)
+		return created
+	}
+	createAllocation("172.22.132.1", "default")
+	createAllocation("172.22.132.2", "tenant-a")
+	createAllocation("172.22.132.3", "other")
+
+	_, err := quotas.Create(&ipamv1.PoolQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-quota"},
+		Spec: ipamv1.PoolQuotaSpec{
+			PoolName:          "test-pool",
+			Namespaces:        []string{"default"},
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "a"}},
+			Limit:             4,
+		},
+	})
+	assert.Nil(t, err)
+
+	// The namespaces that the quota doesn't select aren't counted
+	quota := waitForUsed(t, quotas, "test-quota", 2)
+	assert.Equal(t, map[string]int{"default": 1, "tenant-a": 1}, quota.Status.Namespaces)
+	assert.Equal(t, "", quota.Status.Reason)
+
+	// The released addresses no longer count
+	allocation := createAllocation("172.22.132.4", "tenant-a")
+	waitForUsed(t, quotas, "test-quota", 3)
+	assert.Nil(t, util.ReleaseAllocation(allocations, allocation, time.Minute))
+	waitForUsed(t, quotas, "test-quota", 2)
+
+	// The namespaces with the selected labels join the quota
+	_, err = k8sclient.CoreV1().Namespaces().Create(newNamespace("other", map[string]string{"tenant": "a"}))
+	assert.Nil(t, err)
+	quota = waitForUsed(t, quotas, "test-quota", 3)
+	assert.Equal(t, map[string]int{"default": 1, "tenant-a": 1, "other": 1}, quota.Status.Namespaces)
+
+	// The invalid selector is reported, while the listed namespaces still count
+	quota.Spec.NamespaceSelector = &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "tenant", Operator: "Bogus"}},
+	}
+	_, err = quotas.Update(quota)
+	assert.Nil(t, err)
+	quota = waitForUsed(t, quotas, "test-quota", 1)
+	assert.Contains(t, quota.Status.Reason, ipamconstants.InvalidSpecReason)
+}
@@ -0,0 +1,307 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blended "github.com/inwinstack/blended/generated/clientset/versioned"
+	informerv1 "github.com/inwinstack/blended/generated/informers/externalversions/inwinstack/v1"
+	listerv1 "github.com/inwinstack/blended/generated/listers/inwinstack/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	"github.com/inwinstack/ipam/pkg/config"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformerv1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisterv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Controller represents the controller that gives addresses to the LoadBalancer Services.
+// It creates an IP for each of them, which the ip controller allocates.
+type Controller struct {
+	k8sclient  kubernetes.Interface
+	blendedset blended.Interface
+	lister     corelisterv1.ServiceLister
+	ipLister   listerv1.IPLister
+	synced     []cache.InformerSynced
+	queue      workqueue.RateLimitingInterface
+	recorder   record.EventRecorder
+	cfg        *config.Config
+}
+
+// NewController creates an instance of the service controller
+func NewController(
+	k8sclient kubernetes.Interface,
+	blendedset blended.Interface,
+	informer coreinformerv1.ServiceInformer,
+	ipInformer informerv1.IPInformer,
+	recorder record.EventRecorder,
+	cfg *config.Config) *Controller {
+	controller := &Controller{
+		k8sclient:  k8sclient,
+		blendedset: blendedset,
+		lister:     informer.Lister(),
+		ipLister:   ipInformer.Lister(),
+		synced:     []cache.InformerSynced{informer.Informer().HasSynced, ipInformer.Informer().HasSynced},
+		queue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Services"),
+		recorder:   recorder,
+		cfg:        cfg,
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueue,
+		UpdateFunc: func(old, new interface{}) { controller.enqueue(new) },
+		DeleteFunc: controller.enqueue,
+	})
+	ipInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueueIPService,
+		UpdateFunc: func(old, new interface{}) { controller.enqueueIPService(new) },
+		DeleteFunc: controller.enqueueIPService,
+	})
+	return controller
+}
+
+// Run serves the service controller
+func (c *Controller) Run(ctx context.Context, threadiness int) error {
+	glog.Info("Starting the service controller")
+	glog.Info("Waiting for the service informer caches to sync")
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.synced...); !ok {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+
+	for i := 0; i < threadiness; i++ {
+		go wait.Until(c.runWorker, time.Second, ctx.Done())
+	}
+	return nil
+}
+
+// Stop stops the service controller
+func (c *Controller) Stop() {
+	glog.Info("Stopping the service controller")
+	c.queue.ShutDown()
+}
+
+func (c *Controller) runWorker() {
+	defer utilruntime.HandleCrash()
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	obj, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+
+	err := func(obj interface{}) error {
+		defer c.queue.Done(obj)
+		key, ok := obj.(string)
+		if !ok {
+			c.queue.Forget(obj)
+			utilruntime.HandleError(fmt.Errorf("Service expected string in workqueue but got %#v", obj))
+			return nil
+		}
+
+		if err := c.reconcile(key); err != nil {
+			c.queue.AddRateLimited(key)
+			return fmt.Errorf("Service error syncing '%s': %s, requeuing", key, err.Error())
+		}
+
+		c.queue.Forget(obj)
+		glog.V(2).Infof("Service successfully synced '%s'", key)
+		return nil
+	}(obj)
+
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+	return true
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// enqueueIPService enqueues the Service that owns the IP to refresh its address
+func (c *Controller) enqueueIPService(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	ip, ok := obj.(*blendedv1.IP)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("Service expected an IP but got %#v", obj))
+		return
+	}
+
+	if name, ok := ip.Labels[ipamconstants.ServiceLabelKey]; ok {
+		c.queue.Add(client.IPKey(ip.Namespace, name))
+	}
+}
+
+// poolName returns the pool of the Service, either from its annotation or the default one.
+func (c *Controller) poolName(svc *corev1.Service) string {
+	if pool, ok := svc.Annotations[ipamconstants.PoolKey]; ok {
+		return pool
+	}
+	return c.cfg.DefaultServicePool
+}
+
+func (c *Controller) reconcile(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("invalid resource key: %s", key))
+		return err
+	}
+
+	svc, err := c.lister.Services(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return c.release(namespace, name, nil)
+		}
+		return err
+	}
+
+	pool := c.poolName(svc)
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || pool == "" || !svc.DeletionTimestamp.IsZero() {
+		return c.release(namespace, name, svc)
+	}
+
+	ip, err := c.ipLister.IPs(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return c.createIP(svc, pool)
+	}
+	if err != nil {
+		return err
+	}
+
+	if ip.Labels[ipamconstants.ServiceLabelKey] != svc.Name {
+		c.recorder.Eventf(svc, corev1.EventTypeWarning, ipamconstants.IPConflictReason,
+			"The IP \"%s/%s\" already exists and doesn't belong to the Service", ip.Namespace, ip.Name)
+		return nil
+	}
+
+	// The pool and the requested address of an IP can't change, so it's created again
+	if ip.Spec.PoolName != pool || ip.Annotations[ipamconstants.RequestedIPKey] != svc.Spec.LoadBalancerIP {
+		return c.release(namespace, name, svc)
+	}
+
+	if ip.Status.Phase != blendedv1.IPActive || ip.Status.Address == "" {
+		return nil
+	}
+	return c.setIngress(svc, ip)
+}
+
+// createIP creates the IP of the Service, which the Service owns.
+func (c *Controller) createIP(svc *corev1.Service, pool string) error {
+	ip := &blendedv1.IP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            svc.Name,
+			Namespace:       svc.Namespace,
+			Labels:          map[string]string{ipamconstants.ServiceLabelKey: svc.Name},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(svc, corev1.SchemeGroupVersion.WithKind("Service"))},
+		},
+		Spec: blendedv1.IPSpec{PoolName: pool},
+	}
+
+	if svc.Spec.LoadBalancerIP != "" {
+		ip.Annotations = map[string]string{ipamconstants.RequestedIPKey: svc.Spec.LoadBalancerIP}
+	}
+
+	if _, err := c.blendedset.InwinstackV1().IPs(svc.Namespace).Create(ip); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// setIngress writes the address of the IP into the status of the Service.
+func (c *Controller) setIngress(svc *corev1.Service, ip *blendedv1.IP) error {
+	ingress := []corev1.LoadBalancerIngress{{IP: ip.Status.Address}}
+	if len(svc.Status.LoadBalancer.Ingress) == 1 && svc.Status.LoadBalancer.Ingress[0] == ingress[0] {
+		return nil
+	}
+
+	svcCopy := svc.DeepCopy()
+	svcCopy.Status.LoadBalancer.Ingress = ingress
+	if _, err := c.k8sclient.CoreV1().Services(svc.Namespace).UpdateStatus(svcCopy); err != nil {
+		return err
+	}
+	c.recorder.Eventf(svcCopy, corev1.EventTypeNormal, ipamconstants.LoadBalancerAssignedReason,
+		"Assigned address %s of the \"%s\" pool", ip.Status.Address, util.IPPool(ip))
+	return nil
+}
+
+// release deletes the IP of the Service, and removes its address from the status of the
+// Service if it still exists.
+func (c *Controller) release(namespace, name string, svc *corev1.Service) error {
+	ip, err := c.ipLister.IPs(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if ip.Labels[ipamconstants.ServiceLabelKey] != name {
+		return nil
+	}
+
+	if svc != nil && ip.Status.Address != "" {
+		ingress := []corev1.LoadBalancerIngress{}
+		for _, entry := range svc.Status.LoadBalancer.Ingress {
+			if entry.IP != ip.Status.Address {
+				ingress = append(ingress, entry)
+			}
+		}
+
+		if len(ingress) != len(svc.Status.LoadBalancer.Ingress) {
+			svcCopy := svc.DeepCopy()
+			svcCopy.Status.LoadBalancer.Ingress = ingress
+			if _, err := c.k8sclient.CoreV1().Services(namespace).UpdateStatus(svcCopy); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !ip.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	glog.Infof("Service \"%s/%s\" releases the address of its IP.", namespace, name)
+	if err := c.blendedset.InwinstackV1().IPs(namespace).Delete(name, nil); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
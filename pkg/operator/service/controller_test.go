@@ -0,0 +1,145 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
+	blendedinformers "github.com/inwinstack/blended/generated/informers/externalversions"
+	"github.com/inwinstack/ipam/pkg/config"
+	ipamconstants "github.com/inwinstack/ipam/pkg/constants"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const timeout = 3 * time.Second
+
+func newController(ctx context.Context, t *testing.T, cfg *config.Config) (*Controller, *k8sfake.Clientset, *blendedfake.Clientset) {
+	k8sclient := k8sfake.NewSimpleClientset()
+	blendedset := blendedfake.NewSimpleClientset()
+	k8sinformer := informers.NewSharedInformerFactory(k8sclient, 0)
+	informer := blendedinformers.NewSharedInformerFactory(blendedset, 0)
+
+	controller := NewController(
+		k8sclient,
+		blendedset,
+		k8sinformer.Core().V1().Services(),
+		informer.Inwinstack().V1().IPs(),
+		&record.FakeRecorder{},
+		cfg)
+	go k8sinformer.Start(ctx.Done())
+	go informer.Start(ctx.Done())
+	assert.Nil(t, controller.Run(ctx, cfg.Threads))
+	return controller, k8sclient, blendedset
+}
+
+func newService(name string, serviceType corev1.ServiceType, annotations map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+		Spec:       corev1.ServiceSpec{Type: serviceType},
+	}
+}
+
+func TestServiceController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller, k8sclient, blendedset := newController(ctx, t, &config.Config{Threads: 2, DefaultServicePool: "test-default"})
+
+	getIP := func(name string) *blendedv1.IP {
+		for start := time.Now(); time.Since(start) < timeout; {
+			if ip, err := blendedset.InwinstackV1().IPs("default").Get(name, metav1.GetOptions{}); err == nil {
+				return ip
+			}
+		}
+		return nil
+	}
+	isDeleted := func(name string) bool {
+		for start := time.Now(); time.Since(start) < timeout; {
+			if _, err := blendedset.InwinstackV1().IPs("default").Get(name, metav1.GetOptions{}); errors.IsNotFound(err) {
+				return true
+			}
+		}
+		return false
+	}
+	hasIngress := func(name string, expected []corev1.LoadBalancerIngress) bool {
+		for start := time.Now(); time.Since(start) < timeout; {
+			svc, err := k8sclient.CoreV1().Services("default").Get(name, metav1.GetOptions{})
+			assert.Nil(t, err)
+			if assert.ObjectsAreEqual(expected, svc.Status.LoadBalancer.Ingress) {
+				return true
+			}
+		}
+		return false
+	}
+
+	annotated := newService("test-annotated", corev1.ServiceTypeLoadBalancer, map[string]string{ipamconstants.PoolKey: "test-pool"})
+	annotated.Spec.LoadBalancerIP = "172.22.132.10"
+	services := []*corev1.Service{
+		annotated,
+		newService("test-default", corev1.ServiceTypeLoadBalancer, nil),
+		newService("test-cluster-ip", corev1.ServiceTypeClusterIP, nil),
+	}
+	for _, svc := range services {
+		_, err := k8sclient.CoreV1().Services(svc.Namespace).Create(svc)
+		assert.Nil(t, err)
+	}
+
+	ip := getIP("test-annotated")
+	assert.NotNil(t, ip)
+	assert.Equal(t, "test-pool", ip.Spec.PoolName)
+	assert.Equal(t, "172.22.132.10", ip.Annotations[ipamconstants.RequestedIPKey])
+	assert.Equal(t, "test-annotated", ip.Labels[ipamconstants.ServiceLabelKey])
+	assert.Equal(t, "Service", ip.OwnerReferences[0].Kind)
+
+	ip = getIP("test-default")
+	assert.NotNil(t, ip)
+	assert.Equal(t, "test-default", ip.Spec.PoolName)
+
+	_, err := blendedset.InwinstackV1().IPs("default").Get("test-cluster-ip", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	// The address is written into the status once allocated
+	ip.Status.Phase = blendedv1.IPActive
+	ip.Status.Address = "172.22.133.1"
+	_, err = blendedset.InwinstackV1().IPs("default").Update(ip)
+	assert.Nil(t, err)
+	assert.True(t, hasIngress("test-default", []corev1.LoadBalancerIngress{{IP: "172.22.133.1"}}))
+
+	// The address is released when the type changes
+	svc, err := k8sclient.CoreV1().Services("default").Get("test-default", metav1.GetOptions{})
+	assert.Nil(t, err)
+	svc.Spec.Type = corev1.ServiceTypeNodePort
+	_, err = k8sclient.CoreV1().Services("default").Update(svc)
+	assert.Nil(t, err)
+	assert.True(t, isDeleted("test-default"))
+	assert.True(t, hasIngress("test-default", []corev1.LoadBalancerIngress{}))
+
+	// The address is released when the Service is deleted
+	assert.Nil(t, k8sclient.CoreV1().Services("default").Delete("test-annotated", nil))
+	assert.True(t, isDeleted("test-annotated"))
+
+	cancel()
+	controller.Stop()
+}
@@ -0,0 +1,137 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testutil provides the fixtures shared by the tests of the controllers.
+package testutil
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blended "github.com/inwinstack/blended/generated/clientset/versioned"
+	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
+	blendedinformers "github.com/inwinstack/blended/generated/informers/externalversions"
+	"github.com/inwinstack/ipam/pkg/client"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// Timeout is how long the tests wait for the controllers.
+const Timeout = 3 * time.Second
+
+// Clients are the fake clients and the informers of the controllers under test.
+type Clients struct {
+	Blendedset         *blendedfake.Clientset
+	Dynamic            dynamic.Interface
+	Allocations        client.AllocationInterface
+	Conditions         client.ConditionsInterface
+	Informer           blendedinformers.SharedInformerFactory
+	AllocationInformer client.AllocationInformer
+}
+
+// NewClients creates the fake clients, backed by an empty dynamic client if none is given.
+func NewClients(dynamicClient dynamic.Interface) *Clients {
+	if dynamicClient == nil {
+		dynamicClient = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	}
+
+	blendedset := blendedfake.NewSimpleClientset()
+	allocations := client.NewAllocations(dynamicClient)
+	return &Clients{
+		Blendedset:         blendedset,
+		Dynamic:            dynamicClient,
+		Allocations:        allocations,
+		Conditions:         client.NewConditions(dynamicClient),
+		Informer:           blendedinformers.NewSharedInformerFactory(blendedset, 0),
+		AllocationInformer: client.NewAllocationInformer(allocations, 0),
+	}
+}
+
+// Start runs the informers until the context is done.
+func (c *Clients) Start(ctx context.Context) {
+	go c.Informer.Start(ctx.Done())
+	go c.AllocationInformer.Informer().Run(ctx.Done())
+}
+
+// NewPool returns an active pool of the addresses.
+func NewPool(name string, addresses ...string) *blendedv1.Pool {
+	return &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       blendedv1.PoolSpec{Addresses: addresses},
+		Status: blendedv1.PoolStatus{
+			Phase:          blendedv1.PoolActive,
+			AllocatedIPs:   []string{},
+			LastUpdateTime: metav1.NewTime(time.Now()),
+		},
+	}
+}
+
+// WaitFor polls the condition until it holds, and returns false if it never did.
+func WaitFor(condition func() bool) bool {
+	for start := time.Now(); time.Since(start) < Timeout; {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitForIP polls the IP until the condition holds, and returns the IP it got last.
+func WaitForIP(t *testing.T, blendedset blended.Interface, namespace, name string, condition func(ip *blendedv1.IP) bool) *blendedv1.IP {
+	var ip *blendedv1.IP
+	ok := WaitFor(func() bool {
+		var err error
+		ip, err = blendedset.InwinstackV1().IPs(namespace).Get(name, metav1.GetOptions{})
+		assert.Nil(t, err)
+		return err == nil && condition(ip)
+	})
+	assert.True(t, ok, "The IP \"%s/%s\" never reached the expected state.", namespace, name)
+	return ip
+}
+
+// WaitForPool polls the pool until the condition holds, and returns the pool it got last.
+func WaitForPool(t *testing.T, blendedset blended.Interface, name string, condition func(pool *blendedv1.Pool) bool) *blendedv1.Pool {
+	var pool *blendedv1.Pool
+	ok := WaitFor(func() bool {
+		var err error
+		pool, err = blendedset.InwinstackV1().Pools().Get(name, metav1.GetOptions{})
+		assert.Nil(t, err)
+		return err == nil && condition(pool)
+	})
+	assert.True(t, ok, "The pool \"%s\" never reached the expected state.", name)
+	return pool
+}
+
+// WaitForEvent drains the recorded events until one starts with the prefix.
+func WaitForEvent(recorder *record.FakeRecorder, prefix string) bool {
+	for {
+		select {
+		case event := <-recorder.Events:
+			if strings.HasPrefix(event, prefix) {
+				return true
+			}
+		case <-time.After(Timeout):
+			return false
+		}
+	}
+}
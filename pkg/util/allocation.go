@@ -0,0 +1,132 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"sort"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/client"
+	"github.com/inwinstack/ipam/pkg/constants"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NewAllocation returns the allocation that claims the address of the pool for the IP.
+func NewAllocation(pool, address string, ip *blendedv1.IP) (*ipamv1.Allocation, error) {
+	name, err := ipamv1.AllocationName(address)
+	if err != nil {
+		return nil, err
+	}
+
+	allocation := &ipamv1.Allocation{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{constants.PoolLabelKey: pool},
+		},
+		Spec: ipamv1.AllocationSpec{
+			PoolName: pool,
+			Address:  address,
+		},
+		Status: ipamv1.AllocationStatus{
+			Phase:          ipamv1.AllocationActive,
+			LastUpdateTime: metav1.Now(),
+		},
+	}
+
+	if ip != nil {
+		allocation.Spec.IP = ipamv1.IPReference{Namespace: ip.Namespace, Name: ip.Name, UID: ip.UID}
+	}
+	return allocation, nil
+}
+
+// IsOwnedBy checks if the allocation belongs to the IP. The allocation that records the UID
+// of its IP doesn't belong to an IP recreated with the same name.
+func IsOwnedBy(allocation *ipamv1.Allocation, ip *blendedv1.IP) bool {
+	ref := allocation.Spec.IP
+	if ref.Namespace != ip.Namespace || ref.Name != ip.Name {
+		return false
+	}
+	return ref.UID == "" || ip.UID == "" || ref.UID == ip.UID
+}
+
+// IsHeld checks if the released address of the allocation is still held at the given time.
+func IsHeld(allocation *ipamv1.Allocation, now time.Time) bool {
+	return allocation.Status.Phase == ipamv1.AllocationReleasing && allocation.Status.ReleaseTime.Time.After(now)
+}
+
+// AllocatedAddresses returns the addresses in use and the addresses held by the allocations, sorted.
+// The addresses whose hold time expired are free.
+func AllocatedAddresses(allocations []*ipamv1.Allocation, now time.Time) ([]string, []string) {
+	used, held := []string{}, []string{}
+	for _, allocation := range allocations {
+		switch {
+		case allocation.Status.Phase != ipamv1.AllocationReleasing:
+			used = append(used, allocation.Spec.Address)
+		case IsHeld(allocation, now):
+			held = append(held, allocation.Spec.Address)
+		}
+	}
+	sort.Strings(used)
+	sort.Strings(held)
+	return used, held
+}
+
+// ExpiredAllocations returns the released allocations whose hold time expired, and how long
+// until the next one expires.
+func ExpiredAllocations(allocations []*ipamv1.Allocation, now time.Time) ([]*ipamv1.Allocation, time.Duration) {
+	expired := []*ipamv1.Allocation{}
+	var next time.Duration
+	for _, allocation := range allocations {
+		if allocation.Status.Phase != ipamv1.AllocationReleasing {
+			continue
+		}
+
+		if !IsHeld(allocation, now) {
+			expired = append(expired, allocation)
+			continue
+		}
+
+		if d := allocation.Status.ReleaseTime.Time.Sub(now); next == 0 || d < next {
+			next = d
+		}
+	}
+	return expired, next
+}
+
+// ReleaseAllocation frees the allocation, or holds its address for the release hold time of the pool.
+func ReleaseAllocation(allocations client.AllocationInterface, allocation *ipamv1.Allocation, hold time.Duration) error {
+	if hold == 0 {
+		uid := allocation.UID
+		opts := &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}}
+		if err := allocations.Delete(allocation.Name, opts); err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			return err
+		}
+		return nil
+	}
+
+	allocationCopy := allocation.DeepCopy()
+	allocationCopy.Status.Phase = ipamv1.AllocationReleasing
+	allocationCopy.Status.ReleaseTime = metav1.NewTime(time.Now().Add(hold))
+	allocationCopy.Status.LastUpdateTime = metav1.Now()
+	if _, err := allocations.Update(allocationCopy); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/constants"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewAllocation(t *testing.T) {
+	ip := &blendedv1.IP{ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: "default"}}
+	allocation, err := NewAllocation("test-pool", "2001:db8::1", ip)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001-0db8-0000-0000-0000-0000-0000-0001", allocation.Name)
+	assert.Equal(t, "test-pool", allocation.Labels[constants.PoolLabelKey])
+	assert.Equal(t, ipamv1.AllocationActive, allocation.Status.Phase)
+	assert.True(t, IsOwnedBy(allocation, ip))
+
+	other := &blendedv1.IP{ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: "other"}}
+	assert.False(t, IsOwnedBy(allocation, other))
+
+	// The IP recreated with the same name doesn't own the allocation of the previous one
+	ip.UID = "test-uid"
+	allocation, err = NewAllocation("test-pool", "2001:db8::1", ip)
+	assert.Nil(t, err)
+	assert.True(t, IsOwnedBy(allocation, ip))
+	recreated := &blendedv1.IP{ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: "default", UID: "other-uid"}}
+	assert.False(t, IsOwnedBy(allocation, recreated))
+
+	_, err = NewAllocation("test-pool", "172.22.132", ip)
+	assert.NotNil(t, err)
+}
+
+func TestAllocatedAddresses(t *testing.T) {
+	now := time.Now()
+	newReleasing := func(address string, releaseTime time.Time) *ipamv1.Allocation {
+		allocation, _ := NewAllocation("test-pool", address, nil)
+		allocation.Status.Phase = ipamv1.AllocationReleasing
+		allocation.Status.ReleaseTime = metav1.NewTime(releaseTime)
+		return allocation
+	}
+
+	active, _ := NewAllocation("test-pool", "172.22.132.3", nil)
+	allocations := []*ipamv1.Allocation{
+		active,
+		newReleasing("172.22.132.2", now.Add(time.Minute)),
+		newReleasing("172.22.132.1", now.Add(30*time.Second)),
+		newReleasing("172.22.132.4", now),
+	}
+
+	used, held := AllocatedAddresses(allocations, now)
+	assert.Equal(t, []string{"172.22.132.3"}, used)
+	assert.Equal(t, []string{"172.22.132.1", "172.22.132.2"}, held)
+
+	expired, next := ExpiredAllocations(allocations, now)
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, "172.22.132.4", expired[0].Spec.Address)
+	assert.Equal(t, 30*time.Second, next)
+
+	expired, next = ExpiredAllocations(allocations, now.Add(time.Minute))
+	assert.Equal(t, 3, len(expired))
+	assert.Equal(t, time.Duration(0), next)
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/constants"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Conditions returns the conditions recorded in the annotations of the object.
+func Conditions(meta metav1.ObjectMeta) ([]ipamv1.Condition, error) {
+	conditions := []ipamv1.Condition{}
+	value, ok := meta.Annotations[constants.ConditionsKey]
+	if !ok {
+		return conditions, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &conditions); err != nil {
+		return []ipamv1.Condition{}, fmt.Errorf("invalid conditions %q: %s", value, err.Error())
+	}
+	return conditions, nil
+}
+
+// SetConditions records the conditions in the annotations of the object.
+func SetConditions(meta *metav1.ObjectMeta, conditions []ipamv1.Condition) {
+	if len(conditions) == 0 {
+		delete(meta.Annotations, constants.ConditionsKey)
+		return
+	}
+
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	data, _ := json.Marshal(conditions)
+	meta.Annotations[constants.ConditionsKey] = string(data)
+}
+
+// FindCondition returns the condition of the type, or nil.
+func FindCondition(conditions []ipamv1.Condition, conditionType ipamv1.ConditionType) *ipamv1.Condition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds the condition or replaces the one of the same type, the transition
+// time only moves when the status changes. It returns whether the conditions changed.
+func SetCondition(conditions *[]ipamv1.Condition, condition ipamv1.Condition) bool {
+	existing := FindCondition(*conditions, condition.Type)
+	if existing == nil {
+		if condition.LastTransitionTime.IsZero() {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		*conditions = append(*conditions, condition)
+		return true
+	}
+
+	if existing.Status == condition.Status {
+		condition.LastTransitionTime = existing.LastTransitionTime
+	} else if condition.LastTransitionTime.IsZero() {
+		condition.LastTransitionTime = metav1.Now()
+	}
+
+	if *existing == condition {
+		return false
+	}
+	*existing = condition
+	return true
+}
+
+// RemoveCondition removes the condition of the type. It returns whether the conditions changed.
+func RemoveCondition(conditions *[]ipamv1.Condition, conditionType ipamv1.ConditionType) bool {
+	for i := range *conditions {
+		if (*conditions)[i].Type == conditionType {
+			*conditions = append((*conditions)[:i], (*conditions)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ObserveConditions sets the conditions as observed at the generation of the object.
+// It returns whether the conditions changed.
+func ObserveConditions(conditions *[]ipamv1.Condition, generation int64, updates ...ipamv1.Condition) bool {
+	changed := false
+	for _, condition := range updates {
+		condition.ObservedGeneration = generation
+		if SetCondition(conditions, condition) {
+			changed = true
+		}
+	}
+	return changed
+}
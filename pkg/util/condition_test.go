@@ -0,0 +1,65 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+	"time"
+
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/constants"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestConditions(t *testing.T) {
+	meta := metav1.ObjectMeta{}
+	conditions, err := Conditions(meta)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(conditions))
+
+	// The transition time only moves along with the status
+	past := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	condition := ipamv1.Condition{Type: "Test", Status: corev1.ConditionFalse, Reason: "A", LastTransitionTime: past}
+	assert.True(t, SetCondition(&conditions, condition))
+	assert.False(t, SetCondition(&conditions, ipamv1.Condition{Type: "Test", Status: corev1.ConditionFalse, Reason: "A"}))
+
+	assert.True(t, SetCondition(&conditions, ipamv1.Condition{Type: "Test", Status: corev1.ConditionFalse, Reason: "B"}))
+	assert.Equal(t, "B", FindCondition(conditions, "Test").Reason)
+	assert.True(t, FindCondition(conditions, "Test").LastTransitionTime.Equal(&past))
+
+	assert.True(t, SetCondition(&conditions, ipamv1.Condition{Type: "Test", Status: corev1.ConditionTrue, Reason: "B"}))
+	assert.True(t, FindCondition(conditions, "Test").LastTransitionTime.After(past.Time))
+	assert.Nil(t, FindCondition(conditions, "Other"))
+
+	SetConditions(&meta, conditions)
+	read, err := Conditions(meta)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(read))
+	assert.Equal(t, corev1.ConditionTrue, read[0].Status)
+
+	assert.True(t, RemoveCondition(&conditions, "Test"))
+	assert.False(t, RemoveCondition(&conditions, "Test"))
+	SetConditions(&meta, conditions)
+	_, ok := meta.Annotations[constants.ConditionsKey]
+	assert.False(t, ok)
+
+	meta.Annotations[constants.ConditionsKey] = "{"
+	_, err = Conditions(meta)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	"github.com/inwinstack/ipam/pkg/constants"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// MaxAddressCount bounds how many addresses a single IP can get.
+const MaxAddressCount = 256
+
+// AddressCount returns how many addresses the IP gets from its pool, one by default.
+func AddressCount(ip *blendedv1.IP) (int, error) {
+	value, ok := ip.Annotations[constants.AddressCountKey]
+	if !ok {
+		return 1, nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 || count > MaxAddressCount {
+		return 0, fmt.Errorf("invalid address count %q, it must be between 1 and %d", value, MaxAddressCount)
+	}
+	return count, nil
+}
+
+// IsContiguous returns whether the addresses of the IP must be consecutive.
+func IsContiguous(ip *blendedv1.IP) (bool, error) {
+	value, ok := ip.Annotations[constants.ContiguousKey]
+	if !ok {
+		return false, nil
+	}
+
+	contiguous, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid contiguous flag %q", value)
+	}
+	return contiguous, nil
+}
+
+// IPAddresses returns the addresses allocated to the IP, the IPs allocated before they could
+// get several addresses only have their status address.
+func IPAddresses(ip *blendedv1.IP) []string {
+	if addresses := ip.Annotations[constants.IPAddressesKey]; addresses != "" {
+		return strings.Split(addresses, ",")
+	}
+
+	if ip.Status.Address != "" {
+		return []string{ip.Status.Address}
+	}
+	return nil
+}
+
+// SetIPAddresses stores the addresses allocated to the IP, and the first one as its address.
+func SetIPAddresses(ip *blendedv1.IP, addresses []string) {
+	ip.Status.Address = ""
+	if len(addresses) == 0 {
+		delete(ip.Annotations, constants.IPAddressesKey)
+		return
+	}
+
+	if ip.Annotations == nil {
+		ip.Annotations = map[string]string{}
+	}
+	ip.Status.Address = addresses[0]
+	ip.Annotations[constants.IPAddressesKey] = strings.Join(addresses, ",")
+}
+
+// IPPool returns the name of the pool that the IP got its addresses from, or the name of its
+// pool until it gets them.
+func IPPool(ip *blendedv1.IP) string {
+	if pool := ip.Annotations[constants.AllocatedPoolKey]; pool != "" {
+		return pool
+	}
+	return ip.Spec.PoolName
+}
+
+// SetIPPool stores the pool that the IP got its addresses from.
+func SetIPPool(ip *blendedv1.IP, pool string) {
+	if pool == "" {
+		delete(ip.Annotations, constants.AllocatedPoolKey)
+		return
+	}
+
+	if ip.Annotations == nil {
+		ip.Annotations = map[string]string{}
+	}
+	ip.Annotations[constants.AllocatedPoolKey] = pool
+}
+
+// FallbackPools returns the pools that the IP tries in order after its pool.
+func FallbackPools(ip *blendedv1.IP) []string {
+	return splitList(ip.Annotations[constants.FallbackPoolsKey])
+}
+
+// PoolSelector returns the selector of the pools that the IP tries after its fallback pools,
+// nil if the IP doesn't select pools.
+func PoolSelector(ip *blendedv1.IP) (labels.Selector, error) {
+	value, ok := ip.Annotations[constants.PoolSelectorKey]
+	if !ok {
+		return nil, nil
+	}
+
+	selector, err := labels.Parse(value)
+	if err != nil || selector.Empty() {
+		return nil, fmt.Errorf("invalid pool selector %q", value)
+	}
+	return selector, nil
+}
+
+// PoolSelection returns how the IP orders the pools it can get its addresses from, in order by default.
+func PoolSelection(ip *blendedv1.IP) (string, error) {
+	selection, ok := ip.Annotations[constants.PoolSelectionKey]
+	if !ok {
+		return constants.PoolSelectionOrdered, nil
+	}
+
+	switch selection {
+	case constants.PoolSelectionOrdered, constants.PoolSelectionMostFree:
+		return selection, nil
+	}
+	return "", fmt.Errorf("invalid pool selection %q", selection)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	"github.com/inwinstack/ipam/pkg/constants"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressCount(t *testing.T) {
+	ip := &blendedv1.IP{}
+	count, err := AddressCount(ip)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	contiguous, err := IsContiguous(ip)
+	assert.Nil(t, err)
+	assert.False(t, contiguous)
+
+	ip.Annotations = map[string]string{constants.AddressCountKey: "4", constants.ContiguousKey: "true"}
+	count, err = AddressCount(ip)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, count)
+
+	contiguous, err = IsContiguous(ip)
+	assert.Nil(t, err)
+	assert.True(t, contiguous)
+
+	for _, value := range []string{"0", "-1", "257", "four"} {
+		ip.Annotations[constants.AddressCountKey] = value
+		_, err = AddressCount(ip)
+		assert.NotNil(t, err, value)
+	}
+
+	ip.Annotations[constants.ContiguousKey] = "maybe"
+	_, err = IsContiguous(ip)
+	assert.NotNil(t, err)
+}
+
+func TestIPAddresses(t *testing.T) {
+	ip := &blendedv1.IP{}
+	assert.Nil(t, IPAddresses(ip))
+
+	ip.Status.Address = "172.22.132.1"
+	assert.Equal(t, []string{"172.22.132.1"}, IPAddresses(ip))
+
+	SetIPAddresses(ip, []string{"172.22.132.2", "172.22.132.3"})
+	assert.Equal(t, "172.22.132.2", ip.Status.Address)
+	assert.Equal(t, []string{"172.22.132.2", "172.22.132.3"}, IPAddresses(ip))
+
+	SetIPAddresses(ip, nil)
+	assert.Equal(t, "", ip.Status.Address)
+	assert.Nil(t, IPAddresses(ip))
+}
+
+func TestPoolSelection(t *testing.T) {
+	ip := &blendedv1.IP{Spec: blendedv1.IPSpec{PoolName: "test"}}
+	assert.Equal(t, "test", IPPool(ip))
+	assert.Equal(t, []string{}, FallbackPools(ip))
+
+	selector, err := PoolSelector(ip)
+	assert.Nil(t, err)
+	assert.Nil(t, selector)
+
+	selection, err := PoolSelection(ip)
+	assert.Nil(t, err)
+	assert.Equal(t, constants.PoolSelectionOrdered, selection)
+
+	SetIPPool(ip, "test-fallback")
+	assert.Equal(t, "test-fallback", IPPool(ip))
+	SetIPPool(ip, "")
+	assert.Equal(t, "test", IPPool(ip))
+
+	ip.Annotations = map[string]string{
+		constants.FallbackPoolsKey: "test-a, test-b",
+		constants.PoolSelectorKey:  "tier in (public,private)",
+		constants.PoolSelectionKey: constants.PoolSelectionMostFree,
+	}
+	assert.Equal(t, []string{"test-a", "test-b"}, FallbackPools(ip))
+
+	selector, err = PoolSelector(ip)
+	assert.Nil(t, err)
+	assert.Equal(t, "tier in (private,public)", selector.String())
+
+	selection, err = PoolSelection(ip)
+	assert.Nil(t, err)
+	assert.Equal(t, constants.PoolSelectionMostFree, selection)
+
+	for _, value := range []string{"tier in (", ""} {
+		ip.Annotations[constants.PoolSelectorKey] = value
+		_, err = PoolSelector(ip)
+		assert.NotNil(t, err, value)
+	}
+
+	ip.Annotations[constants.PoolSelectionKey] = "random"
+	_, err = PoolSelection(ip)
+	assert.NotNil(t, err)
+}
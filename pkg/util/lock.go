@@ -0,0 +1,61 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import "sync"
+
+// KeyMutex serialises the work on each key, e.g. the allocations of a pool. The lock of
+// a key only lives while it's held or waited for, so the keys of deleted pools go away.
+type KeyMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// keyLock is the lock of a key, along with how many callers hold or wait for it
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewKeyMutex creates an instance of the key mutex
+func NewKeyMutex() *KeyMutex {
+	return &KeyMutex{locks: map[string]*keyLock{}}
+}
+
+// Lock locks the key, and returns the function that unlocks it.
+func (m *KeyMutex) Lock(key string) func() {
+	m.mu.Lock()
+	lock, ok := m.locks[key]
+	if !ok {
+		lock = &keyLock{}
+		m.locks[key] = lock
+	}
+	lock.refs++
+	m.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		m.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyMutex(t *testing.T) {
+	m := NewKeyMutex()
+
+	// Each key guards its own counter
+	counts := map[string]*int{"test-a": new(int), "test-b": new(int)}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, key := range []string{"test-a", "test-b"} {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				defer m.Lock(key)()
+				*counts[key]++
+			}(key)
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, 50, *counts["test-a"])
+	assert.Equal(t, 50, *counts["test-b"])
+
+	// The keys go away once nobody holds or waits for them
+	unlock := m.Lock("test-a")
+	assert.Equal(t, 1, len(m.locks))
+	unlock()
+	assert.Equal(t, 0, len(m.locks))
+}
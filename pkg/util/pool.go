@@ -0,0 +1,381 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/ipaddr"
+	"github.com/thoas/go-funk"
+)
+
+// maxReleasedIPs bounds the release history that is kept on a pool
+const maxReleasedIPs = 1024
+
+// specAnnotationKeys are the annotations that extend the spec of a pool, unlike the ones
+// that record its state
+var specAnnotationKeys = []string{
+	constants.AllocationStrategyKey,
+	constants.ReleaseHoldTimeKey,
+	constants.UtilizationWarningKey,
+	constants.UtilizationCriticalKey,
+	constants.ShrinkPolicyKey,
+	constants.DrainPolicyKey,
+	constants.GatewayKey,
+	constants.RoutesKey,
+	constants.ParentPoolKey,
+}
+
+// SpecAnnotations returns the annotations that extend the spec of the pool.
+func SpecAnnotations(pool *blendedv1.Pool) map[string]string {
+	annotations := map[string]string{}
+	for _, key := range specAnnotationKeys {
+		if v, ok := pool.Annotations[key]; ok {
+			annotations[key] = v
+		}
+	}
+	return annotations
+}
+
+func setAnnotation(pool *blendedv1.Pool, key, value string) {
+	if pool.Annotations == nil {
+		pool.Annotations = map[string]string{}
+	}
+
+	if value == "" {
+		delete(pool.Annotations, key)
+		return
+	}
+	pool.Annotations[key] = value
+}
+
+// PoolHistory returns the allocation history of the pool.
+func PoolHistory(pool *blendedv1.Pool) ipaddr.History {
+	history := ipaddr.History{LastAllocated: pool.Annotations[constants.LastAllocatedIPKey]}
+	if released := pool.Annotations[constants.ReleasedIPsKey]; released != "" {
+		history.Released = strings.Split(released, ",")
+	}
+	return history
+}
+
+func setReleasedIPs(pool *blendedv1.Pool, released []string) {
+	if len(released) > maxReleasedIPs {
+		released = released[len(released)-maxReleasedIPs:]
+	}
+	setAnnotation(pool, constants.ReleasedIPsKey, strings.Join(released, ","))
+}
+
+// RecordAllocated adds the allocated address to the history of the pool.
+func RecordAllocated(pool *blendedv1.Pool, address string) {
+	released := funk.FilterString(PoolHistory(pool).Released, func(v string) bool { return v != address })
+	setReleasedIPs(pool, released)
+	setAnnotation(pool, constants.LastAllocatedIPKey, address)
+}
+
+// RecordReleased adds the released address to the history of the pool.
+func RecordReleased(pool *blendedv1.Pool, address string) {
+	released := funk.FilterString(PoolHistory(pool).Released, func(v string) bool { return v != address })
+	setReleasedIPs(pool, append(released, address))
+}
+
+// ReleaseHoldTime returns how long the pool holds its released addresses.
+func ReleaseHoldTime(pool *blendedv1.Pool) (time.Duration, error) {
+	value, ok := pool.Annotations[constants.ReleaseHoldTimeKey]
+	if !ok {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid release hold time %q", value)
+	}
+	return d, nil
+}
+
+func parseThreshold(pool *blendedv1.Pool, key string) (float64, error) {
+	value, ok := pool.Annotations[key]
+	if !ok {
+		return 0, nil
+	}
+
+	threshold, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || threshold <= 0 || threshold > 100 {
+		return 0, fmt.Errorf("invalid utilization threshold %q", value)
+	}
+	return threshold, nil
+}
+
+// UtilizationThresholds returns the percentages of used addresses over which the pool
+// warns about its capacity, zero if the pool doesn't set them.
+func UtilizationThresholds(pool *blendedv1.Pool) (warning, critical float64, err error) {
+	if warning, err = parseThreshold(pool, constants.UtilizationWarningKey); err != nil {
+		return 0, 0, err
+	}
+
+	if critical, err = parseThreshold(pool, constants.UtilizationCriticalKey); err != nil {
+		return 0, 0, err
+	}
+
+	if warning > 0 && critical > 0 && warning > critical {
+		return 0, 0, fmt.Errorf("the warning threshold %v%% is over the critical threshold %v%%", warning, critical)
+	}
+	return warning, critical, nil
+}
+
+// ShrinkPolicy returns what the pool does with the allocations its addresses no longer
+// cover, the stranded allocations are kept by default.
+func ShrinkPolicy(pool *blendedv1.Pool) (string, error) {
+	policy, ok := pool.Annotations[constants.ShrinkPolicyKey]
+	if !ok {
+		return constants.ShrinkPolicyKeep, nil
+	}
+
+	switch policy {
+	case constants.ShrinkPolicyBlock, constants.ShrinkPolicyKeep, constants.ShrinkPolicyRelease:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid shrink policy %q", policy)
+}
+
+// StrandedAllocations returns the active allocations whose address is no longer a usable
+// address of the pool, either because the addresses changed or because it's filtered.
+func StrandedAllocations(pool *blendedv1.Pool, allocations []*ipamv1.Allocation) ([]*ipamv1.Allocation, error) {
+	parser := ipaddr.NewParser(pool.Spec.Addresses, pool.Spec.AvoidBuggyIPs, pool.Spec.AvoidGatewayIPs)
+	allocator, err := ipaddr.NewAllocator(parser)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := map[string]bool{}
+	for _, filter := range pool.Spec.FilterIPs {
+		if ip := net.ParseIP(filter); ip != nil {
+			filtered[ip.String()] = true
+		}
+	}
+
+	stranded := []*ipamv1.Allocation{}
+	for _, allocation := range allocations {
+		if allocation.Status.Phase != ipamv1.AllocationActive {
+			continue
+		}
+
+		ip := net.ParseIP(allocation.Spec.Address)
+		if ip == nil || !allocator.Contains(ip.String()) || filtered[ip.String()] {
+			stranded = append(stranded, allocation)
+		}
+	}
+
+	sort.Slice(stranded, func(i, j int) bool { return stranded[i].Name < stranded[j].Name })
+	return stranded, nil
+}
+
+// StrandedIPs returns the allocated addresses that the pool no longer covers.
+func StrandedIPs(pool *blendedv1.Pool) []string {
+	if stranded := pool.Annotations[constants.StrandedIPsKey]; stranded != "" {
+		return strings.Split(stranded, ",")
+	}
+	return nil
+}
+
+// SetStrandedIPs stores the allocated addresses that the pool no longer covers.
+func SetStrandedIPs(pool *blendedv1.Pool, stranded []string) {
+	setAnnotation(pool, constants.StrandedIPsKey, strings.Join(stranded, ","))
+}
+
+// DrainPolicy returns what the deleted pool does with the IPs that still have its addresses,
+// the pool waits for them by default.
+func DrainPolicy(pool *blendedv1.Pool) (string, error) {
+	policy, ok := pool.Annotations[constants.DrainPolicyKey]
+	if !ok {
+		return constants.DrainPolicyWait, nil
+	}
+
+	switch policy {
+	case constants.DrainPolicyWait, constants.DrainPolicyCascade, constants.DrainPolicyOrphan:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid drain policy %q", policy)
+}
+
+// BlockingIPs returns the "namespace/name" of the IPs and the "pool/name" of the child pools that
+// keep the deleted pool from going away.
+func BlockingIPs(pool *blendedv1.Pool) []string {
+	if blocking := pool.Annotations[constants.BlockingIPsKey]; blocking != "" {
+		return strings.Split(blocking, ",")
+	}
+	return nil
+}
+
+// SetBlockingIPs stores the IPs and child pools that keep the deleted pool from going away.
+func SetBlockingIPs(pool *blendedv1.Pool, blocking []string) {
+	setAnnotation(pool, constants.BlockingIPsKey, strings.Join(blocking, ","))
+}
+
+// DelegatedPrefixes returns the prefixes that the pool delegated, by the "namespace/name" of their prefix claims,
+// along with the comma-separated addresses of its child pools, by their name.
+func DelegatedPrefixes(pool *blendedv1.Pool) (map[string]string, error) {
+	prefixes := map[string]string{}
+	value, ok := pool.Annotations[constants.DelegatedPrefixesKey]
+	if !ok {
+		return prefixes, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &prefixes); err != nil {
+		return prefixes, fmt.Errorf("invalid delegated prefixes %q: %s", value, err.Error())
+	}
+	return prefixes, nil
+}
+
+// SetDelegatedPrefixes stores the delegated prefixes on the pool.
+func SetDelegatedPrefixes(pool *blendedv1.Pool, prefixes map[string]string) {
+	if len(prefixes) == 0 {
+		setAnnotation(pool, constants.DelegatedPrefixesKey, "")
+		return
+	}
+
+	data, _ := json.Marshal(prefixes)
+	setAnnotation(pool, constants.DelegatedPrefixesKey, string(data))
+}
+
+// DelegatedAddresses returns the addresses of the delegated prefixes and child pools.
+func DelegatedAddresses(prefixes map[string]string) []string {
+	addresses := []string{}
+	for _, value := range prefixes {
+		addresses = append(addresses, splitList(value)...)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// NewPoolAllocator creates the allocator of the pool from its delegated addresses and allocations.
+func NewPoolAllocator(pool *blendedv1.Pool, prefixes map[string]string, allocations []*ipamv1.Allocation) (*ipaddr.Allocator, error) {
+	parser := ipaddr.NewParser(pool.Spec.Addresses, pool.Spec.AvoidBuggyIPs, pool.Spec.AvoidGatewayIPs)
+	allocator, err := ipaddr.NewAllocator(parser)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := allocator.Exclude(pool.Spec.FilterIPs...); err != nil {
+		return nil, err
+	}
+
+	// The delegated addresses are allocated as a whole
+	if err := allocator.Delegate(DelegatedAddresses(prefixes)...); err != nil {
+		return nil, err
+	}
+
+	used, held := AllocatedAddresses(allocations, time.Now())
+	if err := allocator.Use(used...); err != nil {
+		return nil, err
+	}
+
+	if err := allocator.Hold(held...); err != nil {
+		return nil, err
+	}
+	return allocator, nil
+}
+
+// PublishesPrefixOf reports whether the pool is the child pool of a prefix that the parent delegated.
+func PublishesPrefixOf(pool, parent *blendedv1.Pool) bool {
+	key, ok := pool.Annotations[constants.PrefixClaimKey]
+	if !ok || len(pool.Spec.Addresses) != 1 {
+		return false
+	}
+
+	prefixes, err := DelegatedPrefixes(parent)
+	return err == nil && prefixes[key] == pool.Spec.Addresses[0]
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Gateways returns the gateways of the pool, at most one of each address family.
+func Gateways(pool *blendedv1.Pool) ([]net.IP, error) {
+	gateways := []net.IP{}
+	families := map[bool]bool{}
+	for _, item := range splitList(pool.Annotations[constants.GatewayKey]) {
+		gateway := net.ParseIP(item)
+		if gateway == nil {
+			return nil, fmt.Errorf("invalid gateway %q", item)
+		}
+
+		v4 := gateway.To4() != nil
+		if families[v4] {
+			return nil, fmt.Errorf("more than one gateway for the address family of %q", item)
+		}
+		families[v4] = true
+		gateways = append(gateways, gateway)
+	}
+	return gateways, nil
+}
+
+// Routes returns the destinations routed through the gateways of the pool.
+func Routes(pool *blendedv1.Pool) ([]*net.IPNet, error) {
+	routes := []*net.IPNet{}
+	for _, item := range splitList(pool.Annotations[constants.RoutesKey]) {
+		_, dst, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q", item)
+		}
+		routes = append(routes, dst)
+	}
+	return routes, nil
+}
+
+// AddressNetwork returns the address with the mask of the CIDR of the pool that covers it.
+// The IP ranges don't tell their network, so their addresses get a host mask.
+func AddressNetwork(pool *blendedv1.Pool, address string) (*net.IPNet, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", address)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	for _, entry := range pool.Spec.Addresses {
+		if strings.Contains(entry, "-") {
+			ok, err := ipaddr.NewParser([]string{entry}, false, false).Contains(address)
+			if err == nil && ok {
+				bits := len(ip) * 8
+				return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+			}
+			continue
+		}
+
+		if _, n, err := net.ParseCIDR(entry); err == nil && n.Contains(ip) {
+			return &net.IPNet{IP: ip, Mask: n.Mask}, nil
+		}
+	}
+	return nil, fmt.Errorf("the address %s isn't in the \"%s\" pool", address, pool.Name)
+}
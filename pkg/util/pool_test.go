@@ -0,0 +1,275 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/constants"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPoolHistory(t *testing.T) {
+	pool := &blendedv1.Pool{}
+	RecordAllocated(pool, "172.22.132.1")
+	RecordAllocated(pool, "172.22.132.2")
+	RecordReleased(pool, "172.22.132.2")
+	RecordReleased(pool, "172.22.132.1")
+	RecordReleased(pool, "172.22.132.2")
+
+	history := PoolHistory(pool)
+	assert.Equal(t, "172.22.132.2", history.LastAllocated)
+	assert.Equal(t, []string{"172.22.132.1", "172.22.132.2"}, history.Released)
+
+	RecordAllocated(pool, "172.22.132.1")
+	assert.Equal(t, []string{"172.22.132.2"}, PoolHistory(pool).Released)
+
+	for i := 0; i < maxReleasedIPs+10; i++ {
+		RecordReleased(pool, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	history = PoolHistory(pool)
+	assert.Equal(t, maxReleasedIPs, len(history.Released))
+	assert.Equal(t, "10.0.0.10", history.Released[0])
+}
+
+func TestReleaseHoldTime(t *testing.T) {
+	pool := &blendedv1.Pool{}
+	d, err := ReleaseHoldTime(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), d)
+
+	pool.Annotations = map[string]string{constants.ReleaseHoldTimeKey: "5m"}
+	d, err = ReleaseHoldTime(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Minute, d)
+
+	for _, value := range []string{"5", "-5m"} {
+		pool.Annotations[constants.ReleaseHoldTimeKey] = value
+		_, err = ReleaseHoldTime(pool)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestUtilizationThresholds(t *testing.T) {
+	pool := &blendedv1.Pool{}
+	warning, critical, err := UtilizationThresholds(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, warning)
+	assert.Equal(t, 0.0, critical)
+
+	pool.Annotations = map[string]string{constants.UtilizationWarningKey: "80%", constants.UtilizationCriticalKey: "95"}
+	warning, critical, err = UtilizationThresholds(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, 80.0, warning)
+	assert.Equal(t, 95.0, critical)
+
+	for _, value := range []string{"0", "101", "high", "-5%"} {
+		pool.Annotations[constants.UtilizationCriticalKey] = value
+		_, _, err = UtilizationThresholds(pool)
+		assert.NotNil(t, err)
+	}
+
+	pool.Annotations[constants.UtilizationCriticalKey] = "70"
+	_, _, err = UtilizationThresholds(pool)
+	assert.NotNil(t, err)
+}
+
+func TestDelegatedPrefixes(t *testing.T) {
+	parent := &blendedv1.Pool{}
+	prefixes, err := DelegatedPrefixes(parent)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(prefixes))
+
+	SetDelegatedPrefixes(parent, map[string]string{"default/test-claim": "172.22.132.16/28"})
+	prefixes, err = DelegatedPrefixes(parent)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.22.132.16/28", prefixes["default/test-claim"])
+
+	child := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{constants.PrefixClaimKey: "default/test-claim"}},
+		Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.132.16/28"}},
+	}
+	assert.True(t, PublishesPrefixOf(child, parent))
+	assert.False(t, PublishesPrefixOf(parent, child))
+
+	child.Spec.Addresses = []string{"172.22.132.0/27"}
+	assert.False(t, PublishesPrefixOf(child, parent))
+
+	SetDelegatedPrefixes(parent, nil)
+	_, ok := parent.Annotations[constants.DelegatedPrefixesKey]
+	assert.False(t, ok)
+
+	parent.Annotations[constants.DelegatedPrefixesKey] = "["
+	_, err = DelegatedPrefixes(parent)
+	assert.NotNil(t, err)
+}
+
+func TestPoolAllocator(t *testing.T) {
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Spec: blendedv1.PoolSpec{
+			Addresses:       []string{"172.22.132.0/24"},
+			FilterIPs:       []string{"172.22.132.1"},
+			AvoidBuggyIPs:   true,
+			AvoidGatewayIPs: true,
+		},
+	}
+
+	prefixes := map[string]string{
+		"default/test-claim": "172.22.132.16/28",
+		"test-child":         "172.22.132.100-172.22.132.109,172.22.132.200/30",
+	}
+	assert.Equal(t, []string{"172.22.132.100-172.22.132.109", "172.22.132.16/28", "172.22.132.200/30"}, DelegatedAddresses(prefixes))
+
+	allocation, err := NewAllocation("test", "172.22.132.2", nil)
+	assert.Nil(t, err)
+
+	allocator, err := NewPoolAllocator(pool, prefixes, []*ipamv1.Allocation{allocation})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(252-16-10-4-1), allocator.Free().Int64())
+	assert.True(t, allocator.IsDelegated("172.22.132.105"))
+	assert.False(t, allocator.IsFreePrefix("172.22.132.0/30"))
+
+	_, err = NewPoolAllocator(pool, map[string]string{"test-child": "172.22.132.x"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestShrinkPolicy(t *testing.T) {
+	pool := &blendedv1.Pool{}
+	policy, err := ShrinkPolicy(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, constants.ShrinkPolicyKeep, policy)
+
+	pool.Annotations = map[string]string{constants.ShrinkPolicyKey: constants.ShrinkPolicyRelease}
+	policy, err = ShrinkPolicy(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, constants.ShrinkPolicyRelease, policy)
+
+	pool.Annotations[constants.ShrinkPolicyKey] = "drop"
+	_, err = ShrinkPolicy(pool)
+	assert.NotNil(t, err)
+}
+
+func TestStrandedAllocations(t *testing.T) {
+	pool := &blendedv1.Pool{
+		Spec: blendedv1.PoolSpec{
+			Addresses:       []string{"172.22.132.0/29"},
+			FilterIPs:       []string{"172.22.132.3"},
+			AvoidGatewayIPs: true,
+		},
+	}
+
+	allocations := []*ipamv1.Allocation{}
+	for _, address := range []string{"172.22.132.9", "172.22.132.2", "172.22.132.3", "172.22.132.1", "172.22.132.8"} {
+		allocation, err := NewAllocation("test", address, nil)
+		assert.Nil(t, err)
+		allocations = append(allocations, allocation)
+	}
+
+	// The released addresses are left to expire
+	allocations[4].Status.Phase = ipamv1.AllocationReleasing
+
+	stranded, err := StrandedAllocations(pool, allocations)
+	assert.Nil(t, err)
+	addresses := []string{}
+	for _, allocation := range stranded {
+		addresses = append(addresses, allocation.Spec.Address)
+	}
+	assert.Equal(t, []string{"172.22.132.1", "172.22.132.3", "172.22.132.9"}, addresses)
+
+	SetStrandedIPs(pool, addresses)
+	assert.Equal(t, addresses, StrandedIPs(pool))
+	SetStrandedIPs(pool, nil)
+	assert.Nil(t, StrandedIPs(pool))
+
+	pool.Spec.Addresses = []string{"172.22.132.x"}
+	_, err = StrandedAllocations(pool, allocations)
+	assert.NotNil(t, err)
+}
+
+func TestDrainPolicy(t *testing.T) {
+	pool := &blendedv1.Pool{}
+	policy, err := DrainPolicy(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, constants.DrainPolicyWait, policy)
+
+	pool.Annotations = map[string]string{constants.DrainPolicyKey: constants.DrainPolicyCascade}
+	policy, err = DrainPolicy(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, constants.DrainPolicyCascade, policy)
+
+	pool.Annotations[constants.DrainPolicyKey] = "force"
+	_, err = DrainPolicy(pool)
+	assert.NotNil(t, err)
+
+	SetBlockingIPs(pool, []string{"default/test-1", "default/test-2"})
+	assert.Equal(t, []string{"default/test-1", "default/test-2"}, BlockingIPs(pool))
+	SetBlockingIPs(pool, nil)
+	assert.Nil(t, BlockingIPs(pool))
+}
+
+func TestGatewaysAndRoutes(t *testing.T) {
+	pool := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+			Annotations: map[string]string{
+				constants.GatewayKey: "172.22.132.1, 2001:db8::1",
+				constants.RoutesKey:  "0.0.0.0/0,10.0.0.0/8",
+			},
+		},
+		Spec: blendedv1.PoolSpec{Addresses: []string{"172.22.132.0/24", "172.22.133.10-172.22.133.20", "2001:db8::/64"}},
+	}
+
+	gateways, err := Gateways(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, "[172.22.132.1 2001:db8::1]", fmt.Sprint(gateways))
+
+	routes, err := Routes(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, "[0.0.0.0/0 10.0.0.0/8]", fmt.Sprint(routes))
+
+	tests := map[string]string{
+		"172.22.132.10": "172.22.132.10/24",
+		"172.22.133.15": "172.22.133.15/32",
+		"2001:db8::10":  "2001:db8::10/64",
+	}
+	for address, expected := range tests {
+		network, err := AddressNetwork(pool, address)
+		assert.Nil(t, err, address)
+		assert.Equal(t, expected, network.String(), address)
+	}
+
+	_, err = AddressNetwork(pool, "172.22.134.1")
+	assert.NotNil(t, err)
+
+	pool.Annotations[constants.GatewayKey] = "172.22.132.1,172.22.132.2"
+	_, err = Gateways(pool)
+	assert.NotNil(t, err)
+
+	pool.Annotations[constants.GatewayKey] = "172.22.132"
+	_, err = Gateways(pool)
+	assert.NotNil(t, err)
+
+	pool.Annotations[constants.RoutesKey] = "10.0.0.0"
+	_, err = Routes(pool)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// QuotaSelector returns the selector of the namespaces that the quota applies to besides its
+// listed ones. The quota without a namespace selector selects none.
+func QuotaSelector(quota *ipamv1.PoolQuota) (labels.Selector, error) {
+	selector, err := metav1.LabelSelectorAsSelector(quota.Spec.NamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace selector: %s", err.Error())
+	}
+	return selector, nil
+}
+
+// QuotaApplies checks if the quota applies to the namespace with the labels.
+func QuotaApplies(quota *ipamv1.PoolQuota, selector labels.Selector, namespace string, set labels.Set) bool {
+	for _, name := range quota.Spec.Namespaces {
+		if name == namespace {
+			return true
+		}
+	}
+	return selector.Matches(set)
+}
+
+// NamespaceUsage returns how many addresses the IPs of each namespace hold, from the allocations
+// of a pool. The released addresses no longer count, even while they are held.
+func NamespaceUsage(allocations []*ipamv1.Allocation) map[string]int {
+	usage := map[string]int{}
+	for _, allocation := range allocations {
+		if allocation.Status.Phase == ipamv1.AllocationReleasing || allocation.Spec.IP.Namespace == "" {
+			continue
+		}
+		usage[allocation.Spec.IP.Namespace]++
+	}
+	return usage
+}
+
+// QuotaUsage returns how many addresses the namespaces that the quota applies to hold together,
+// and by namespace.
+func QuotaUsage(quota *ipamv1.PoolQuota, selector labels.Selector, usage map[string]int, namespaceLabels func(string) labels.Set) (int, map[string]int) {
+	used, namespaces := 0, map[string]int{}
+	for namespace, count := range usage {
+		if QuotaApplies(quota, selector, namespace, namespaceLabels(namespace)) {
+			used += count
+			namespaces[namespace] = count
+		}
+	}
+	return used, namespaces
+}
+
+// CheckQuota returns an error if the namespace can't get the count of addresses more within the
+// quota, given the addresses held under the quota.
+func CheckQuota(quota *ipamv1.PoolQuota, namespace string, count, used int, namespaces map[string]int) error {
+	if quota.Spec.PerNamespace {
+		if namespaces[namespace]+count > quota.Spec.Limit {
+			return fmt.Errorf("The \"%s\" quota allows each namespace %d addresses of the \"%s\" pool, the \"%s\" namespace holds %d and requests %d more",
+				quota.Name, quota.Spec.Limit, quota.Spec.PoolName, namespace, namespaces[namespace], count)
+		}
+		return nil
+	}
+
+	if used+count > quota.Spec.Limit {
+		return fmt.Errorf("The \"%s\" quota allows its namespaces %d addresses of the \"%s\" pool, they hold %d and the \"%s\" namespace requests %d more",
+			quota.Name, quota.Spec.Limit, quota.Spec.PoolName, used, namespace, count)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestQuota(t *testing.T) {
+	quota := &ipamv1.PoolQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-quota"},
+		Spec: ipamv1.PoolQuotaSpec{
+			PoolName:          "test-pool",
+			Namespaces:        []string{"default"},
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "a"}},
+			Limit:             4,
+		},
+	}
+	namespaceLabels := func(namespace string) labels.Set {
+		if namespace == "tenant-a" {
+			return labels.Set{"tenant": "a"}
+		}
+		return nil
+	}
+
+	newAllocation := func(address, namespace string) *ipamv1.Allocation {
+		ip := &blendedv1.IP{ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: namespace}}
+		allocation, _ := NewAllocation("test-pool", address, ip)
+		return allocation
+	}
+	released := newAllocation("172.22.132.4", "default")
+	released.Status.Phase = ipamv1.AllocationReleasing
+	allocations := []*ipamv1.Allocation{
+		newAllocation("172.22.132.1", "default"),
+		newAllocation("172.22.132.2", "tenant-a"),
+		newAllocation("172.22.132.3", "other"),
+		released,
+	}
+
+	usage := NamespaceUsage(allocations)
+	assert.Equal(t, map[string]int{"default": 1, "tenant-a": 1, "other": 1}, usage)
+
+	selector, err := QuotaSelector(quota)
+	assert.Nil(t, err)
+	used, namespaces := QuotaUsage(quota, selector, usage, namespaceLabels)
+	assert.Equal(t, 2, used)
+	assert.Equal(t, map[string]int{"default": 1, "tenant-a": 1}, namespaces)
+
+	// The namespaces share the limit
+	assert.Nil(t, CheckQuota(quota, "default", 2, used, namespaces))
+	err = CheckQuota(quota, "tenant-a", 3, used, namespaces)
+	assert.NotNil(t, err)
+	assert.Equal(t, "The \"test-quota\" quota allows its namespaces 4 addresses of the \"test-pool\" pool, they hold 2 and the \"tenant-a\" namespace requests 3 more", err.Error())
+
+	// Or each of them has its own
+	quota.Spec.PerNamespace = true
+	assert.Nil(t, CheckQuota(quota, "tenant-a", 3, used, namespaces))
+	err = CheckQuota(quota, "default", 4, used, namespaces)
+	assert.NotNil(t, err)
+	assert.Equal(t, "The \"test-quota\" quota allows each namespace 4 addresses of the \"test-pool\" pool, the \"default\" namespace holds 1 and requests 4 more", err.Error())
+
+	// Without a namespace selector, only the listed namespaces are selected
+	quota.Spec.NamespaceSelector = nil
+	selector, err = QuotaSelector(quota)
+	assert.Nil(t, err)
+	assert.True(t, QuotaApplies(quota, selector, "default", nil))
+	assert.False(t, QuotaApplies(quota, selector, "tenant-a", labels.Set{"tenant": "a"}))
+
+	quota.Spec.NamespaceSelector = &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "tenant", Operator: "Bogus"}},
+	}
+	_, err = QuotaSelector(quota)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	blended "github.com/inwinstack/blended/generated/clientset/versioned"
+	"github.com/inwinstack/ipam/pkg/client"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The paths of the validating webhooks
+const (
+	ValidatePoolsPath = "/validate/pools"
+	ValidateIPsPath   = "/validate/ips"
+)
+
+// validateFunc validates an admission request, the error is the reason to reject it
+type validateFunc func(req *admissionv1beta1.AdmissionRequest) error
+
+// Server represents the validating admission webhook server
+type Server struct {
+	blendedset  blended.Interface
+	allocations client.AllocationInterface
+}
+
+// NewServer creates an instance of the webhook server
+func NewServer(blendedset blended.Interface, allocations client.AllocationInterface) *Server {
+	return &Server{blendedset: blendedset, allocations: allocations}
+}
+
+// Handler returns the handler that serves the webhooks
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ValidatePoolsPath, s.serve(s.validatePool))
+	mux.HandleFunc(ValidateIPsPath, s.serve(s.validateIP))
+	return mux
+}
+
+// Run serves the webhooks over TLS until the context is done
+func (s *Server) Run(ctx context.Context, addr, certFile, keyFile string) error {
+	glog.Infof("Starting the webhook server on %s", addr)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the webhook certificate: %s", err.Error())
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:   s.Handler(),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	go func() {
+		if err := server.ServeTLS(listener, "", ""); err != http.ErrServerClosed {
+			glog.Errorf("Webhook server got an error: %+v.", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		glog.Info("Stopping the webhook server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
+
+func (s *Server) serve(validate validateFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		review := &admissionv1beta1.AdmissionReview{}
+		if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+			http.Error(w, "invalid admission review", http.StatusBadRequest)
+			return
+		}
+
+		response := &admissionv1beta1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+		if err := validate(review.Request); err != nil {
+			glog.V(2).Infof("Webhook rejected %s \"%s\": %s.", review.Request.Kind.Kind, review.Request.Name, err.Error())
+			response.Allowed = false
+			response.Result = &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Message: err.Error(),
+				Code:    http.StatusUnprocessableEntity,
+			}
+		}
+
+		review.Response = response
+		review.Request = nil
+		data, err := json.Marshal(review)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
@@ -0,0 +1,350 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	blendedfake "github.com/inwinstack/blended/generated/clientset/versioned/fake"
+	"github.com/inwinstack/ipam/pkg/client"
+	"github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/util"
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newAllocations() client.AllocationInterface {
+	return client.NewAllocations(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+}
+
+func review(t *testing.T, url string, operation admissionv1beta1.Operation, obj, old interface{}) *admissionv1beta1.AdmissionResponse {
+	req := &admissionv1beta1.AdmissionRequest{UID: types.UID("test-uid"), Operation: operation}
+	if obj != nil {
+		raw, err := json.Marshal(obj)
+		assert.Nil(t, err)
+		req.Object = runtime.RawExtension{Raw: raw}
+	}
+
+	if old != nil {
+		raw, err := json.Marshal(old)
+		assert.Nil(t, err)
+		req.OldObject = runtime.RawExtension{Raw: raw}
+	}
+
+	body, err := json.Marshal(&admissionv1beta1.AdmissionReview{Request: req})
+	assert.Nil(t, err)
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	result := &admissionv1beta1.AdmissionReview{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(result))
+	assert.Equal(t, req.UID, result.Response.UID)
+	return result.Response
+}
+
+func TestValidatePool(t *testing.T) {
+	blendedset := blendedfake.NewSimpleClientset(&blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-existing",
+			Annotations: map[string]string{constants.DelegatedPrefixesKey: `{"default/test-claim":"172.22.132.16/28"}`},
+		},
+		Spec: blendedv1.PoolSpec{Addresses: []string{"172.22.132.0/24", "2001:db8::/64"}},
+	}, &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-existing-child",
+			Annotations: map[string]string{constants.ParentPoolKey: "test-cycle"},
+		},
+		Spec: blendedv1.PoolSpec{Addresses: []string{"172.22.134.0/24"}},
+	})
+	server := httptest.NewServer(NewServer(blendedset, newAllocations()).Handler())
+	defer server.Close()
+
+	tests := []struct {
+		Name        string
+		Addresses   []string
+		FilterIPs   []string
+		Annotations map[string]string
+		Allowed     bool
+		Message     string
+	}{
+		{Name: "test-valid", Addresses: []string{"172.22.133.0/24", "2001:db8:1::/64"}, FilterIPs: []string{"172.22.133.1"}, Allowed: true},
+		{Name: "test-existing", Addresses: []string{"172.22.132.0/25"}, Allowed: true},
+		{Name: "test-empty", Message: "has no addresses"},
+		{Name: "test-cidr", Addresses: []string{"172.22.133.0/33"}, Message: "invalid CIDR"},
+		{Name: "test-range", Addresses: []string{"172.22.133.0-172.22.133.267"}, Message: "invalid end IP"},
+		{Name: "test-reversed", Addresses: []string{"172.22.133.10-172.22.133.1"}, Message: "the start IP is after the end IP"},
+		{Name: "test-overlap", Addresses: []string{"172.22.132.128-172.22.133.10"}, Message: "overlaps with the \"test-existing\" pool"},
+		{Name: "test-overlap-v6", Addresses: []string{"2001:db8::/48"}, Message: "overlaps with the \"test-existing\" pool"},
+		{Name: "test-filter", Addresses: []string{"172.22.133.0/24"}, FilterIPs: []string{"172.22.134.1"}, Message: "isn't in the \"test-filter\" pool"},
+		{Name: "test-filter-invalid", Addresses: []string{"172.22.133.0/24"}, FilterIPs: []string{"172.22.134"}, Message: "is invalid"},
+		{
+			Name:        "test-child",
+			Addresses:   []string{"172.22.132.16/28"},
+			Annotations: map[string]string{constants.PrefixClaimKey: "default/test-claim"},
+			Allowed:     true,
+		},
+		{
+			Name:        "test-child-other",
+			Addresses:   []string{"172.22.132.16/28"},
+			Annotations: map[string]string{constants.PrefixClaimKey: "default/other-claim"},
+			Message:     "overlaps with the \"test-existing\" pool",
+		},
+		{
+			Name:        "test-existing",
+			Addresses:   []string{"172.22.132.128/25"},
+			Annotations: map[string]string{constants.DelegatedPrefixesKey: `{"test-parented":"172.22.132.32/28"}`},
+			Message:     "would no longer cover the delegated address \"172.22.132.32/28\"",
+		},
+		{
+			Name:        "test-parented",
+			Addresses:   []string{"172.22.132.32/28", "2001:db8::100-2001:db8::1ff"},
+			Annotations: map[string]string{constants.ParentPoolKey: "test-existing"},
+			Allowed:     true,
+		},
+		{
+			Name:        "test-parent-missing",
+			Addresses:   []string{"172.22.133.0/24"},
+			Annotations: map[string]string{constants.ParentPoolKey: "test-missing"},
+			Message:     "The parent pool \"test-missing\" of the \"test-parent-missing\" pool doesn't exist",
+		},
+		{
+			Name:        "test-parent-self",
+			Addresses:   []string{"172.22.133.0/24"},
+			Annotations: map[string]string{constants.ParentPoolKey: "test-parent-self"},
+			Message:     "doesn't exist",
+		},
+		{
+			Name:        "test-parent-outside",
+			Addresses:   []string{"172.22.132.240-172.22.133.10"},
+			Annotations: map[string]string{constants.ParentPoolKey: "test-existing"},
+			Message:     "The address \"172.22.132.240-172.22.133.10\" isn't in the parent pool \"test-existing\"",
+		},
+		{
+			Name:        "test-cycle",
+			Addresses:   []string{"172.22.134.0/24"},
+			Annotations: map[string]string{constants.ParentPoolKey: "test-existing-child"},
+			Message:     "is a descendant of the \"test-cycle\" pool",
+		},
+		{
+			Name:        "test-shrink-policy",
+			Addresses:   []string{"172.22.133.0/24"},
+			Annotations: map[string]string{constants.ShrinkPolicyKey: "drop"},
+			Message:     "invalid shrink policy",
+		},
+		{
+			Name:        "test-drain-policy",
+			Addresses:   []string{"172.22.133.0/24"},
+			Annotations: map[string]string{constants.DrainPolicyKey: "force"},
+			Message:     "invalid drain policy",
+		},
+		{
+			Name:        "test-gateway",
+			Addresses:   []string{"172.22.133.0/24"},
+			Annotations: map[string]string{constants.GatewayKey: "172.22.133"},
+			Message:     "invalid gateway",
+		},
+		{
+			Name:        "test-routes",
+			Addresses:   []string{"172.22.133.0/24"},
+			Annotations: map[string]string{constants.RoutesKey: "0.0.0.0"},
+			Message:     "invalid route",
+		},
+		{
+			Name:        "test-thresholds",
+			Addresses:   []string{"172.22.133.0/24"},
+			Annotations: map[string]string{constants.UtilizationWarningKey: "90", constants.UtilizationCriticalKey: "80%"},
+			Message:     "is over the critical threshold",
+		},
+	}
+
+	for _, test := range tests {
+		pool := &blendedv1.Pool{
+			ObjectMeta: metav1.ObjectMeta{Name: test.Name, Annotations: test.Annotations},
+			Spec:       blendedv1.PoolSpec{Addresses: test.Addresses, FilterIPs: test.FilterIPs},
+		}
+		resp := review(t, server.URL+ValidatePoolsPath, admissionv1beta1.Create, pool, nil)
+		assert.Equal(t, test.Allowed, resp.Allowed, test.Name)
+		if !test.Allowed {
+			assert.Contains(t, resp.Result.Message, test.Message, test.Name)
+		}
+	}
+
+	// Deleting is always allowed
+	resp := review(t, server.URL+ValidatePoolsPath, admissionv1beta1.Delete, nil, nil)
+	assert.True(t, resp.Allowed)
+
+	// The pool that became invalid can still get its status, state annotations and finalizers
+	old := &blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-overlap", Finalizers: []string{"kubernetes"}},
+		Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.132.128-172.22.133.10"}},
+	}
+	pool := old.DeepCopy()
+	pool.Status.Phase = blendedv1.PoolFailed
+	pool.Annotations = map[string]string{constants.StrandedIPsKey: "172.22.132.200"}
+	resp = review(t, server.URL+ValidatePoolsPath, admissionv1beta1.Update, pool, old)
+	assert.True(t, resp.Allowed)
+
+	deleted := old.DeepCopy()
+	now := metav1.Now()
+	deleted.DeletionTimestamp = &now
+	deleted.Finalizers = nil
+	deleted.Spec.Addresses = []string{"172.22.132.0/16"}
+	resp = review(t, server.URL+ValidatePoolsPath, admissionv1beta1.Update, deleted, old)
+	assert.True(t, resp.Allowed)
+
+	// The edits of its spec are still checked
+	for _, edit := range []func(pool *blendedv1.Pool){
+		func(pool *blendedv1.Pool) { pool.Spec.FilterIPs = []string{"172.22.133.1"} },
+		func(pool *blendedv1.Pool) {
+			pool.Annotations = map[string]string{constants.AllocationStrategyKey: "random"}
+		},
+	} {
+		pool := old.DeepCopy()
+		edit(pool)
+		resp = review(t, server.URL+ValidatePoolsPath, admissionv1beta1.Update, pool, old)
+		assert.False(t, resp.Allowed)
+		assert.Contains(t, resp.Result.Message, "overlaps with the \"test-existing\" pool")
+	}
+}
+
+func TestValidatePoolShrink(t *testing.T) {
+	allocations := newAllocations()
+	server := httptest.NewServer(NewServer(blendedfake.NewSimpleClientset(), allocations).Handler())
+	defer server.Close()
+
+	allocation, err := util.NewAllocation("test-shrink", "172.22.133.200", nil)
+	assert.Nil(t, err)
+	_, err = allocations.Create(allocation)
+	assert.Nil(t, err)
+
+	newPool := func(policy string, addresses ...string) *blendedv1.Pool {
+		return &blendedv1.Pool{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "test-shrink",
+				Annotations: map[string]string{constants.ShrinkPolicyKey: policy},
+			},
+			Spec: blendedv1.PoolSpec{Addresses: addresses},
+		}
+	}
+
+	old := newPool(constants.ShrinkPolicyBlock, "172.22.133.0/24")
+	resp := review(t, server.URL+ValidatePoolsPath, admissionv1beta1.Update, newPool(constants.ShrinkPolicyBlock, "172.22.133.0/25"), old)
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, "would no longer cover the allocated addresses 172.22.133.200")
+
+	resp = review(t, server.URL+ValidatePoolsPath, admissionv1beta1.Update, newPool(constants.ShrinkPolicyBlock, "172.22.133.128/25"), old)
+	assert.True(t, resp.Allowed)
+
+	resp = review(t, server.URL+ValidatePoolsPath, admissionv1beta1.Update, newPool(constants.ShrinkPolicyKeep, "172.22.133.0/25"), old)
+	assert.True(t, resp.Allowed)
+}
+
+func TestValidateIP(t *testing.T) {
+	blendedset := blendedfake.NewSimpleClientset(&blendedv1.Pool{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pool"},
+		Spec:       blendedv1.PoolSpec{Addresses: []string{"172.22.132.0/24"}},
+	})
+	server := httptest.NewServer(NewServer(blendedset, newAllocations()).Handler())
+	defer server.Close()
+
+	newIP := func(pool string) *blendedv1.IP {
+		return &blendedv1.IP{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-ip", Namespace: "default"},
+			Spec:       blendedv1.IPSpec{PoolName: pool},
+		}
+	}
+
+	resp := review(t, server.URL+ValidateIPsPath, admissionv1beta1.Create, newIP("test-pool"), nil)
+	assert.True(t, resp.Allowed)
+
+	resp = review(t, server.URL+ValidateIPsPath, admissionv1beta1.Create, newIP("test-missing"), nil)
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, "The \"test-missing\" pool doesn't exist")
+
+	resp = review(t, server.URL+ValidateIPsPath, admissionv1beta1.Update, newIP("test-pool"), newIP("test-pool"))
+	assert.True(t, resp.Allowed)
+
+	resp = review(t, server.URL+ValidateIPsPath, admissionv1beta1.Update, newIP("test-other"), newIP("test-pool"))
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, "can't be changed")
+
+	multi := newIP("test-pool")
+	multi.Annotations = map[string]string{constants.AddressCountKey: "4", constants.ContiguousKey: "true"}
+	resp = review(t, server.URL+ValidateIPsPath, admissionv1beta1.Create, multi, nil)
+	assert.True(t, resp.Allowed)
+
+	resp = review(t, server.URL+ValidateIPsPath, admissionv1beta1.Update, newIP("test-pool"), multi)
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, "annotation of the IP can't be changed")
+
+	tests := []struct {
+		Annotations map[string]string
+		Message     string
+	}{
+		{map[string]string{constants.AddressCountKey: "0"}, "invalid address count"},
+		{map[string]string{constants.ContiguousKey: "yes please"}, "invalid contiguous flag"},
+		{map[string]string{constants.AddressCountKey: "2", constants.RequestedIPKey: "172.22.132.10"}, "can't be combined"},
+		{map[string]string{constants.PoolSelectorKey: "tier in ("}, "invalid pool selector"},
+		{map[string]string{constants.PoolSelectionKey: "random"}, "invalid pool selection"},
+	}
+	for _, test := range tests {
+		ip := newIP("test-pool")
+		ip.Annotations = test.Annotations
+		resp = review(t, server.URL+ValidateIPsPath, admissionv1beta1.Create, ip, nil)
+		assert.False(t, resp.Allowed)
+		assert.Contains(t, resp.Result.Message, test.Message)
+	}
+
+	// The IPs that select their pools may leave the pool name out
+	selecting := newIP("")
+	resp = review(t, server.URL+ValidateIPsPath, admissionv1beta1.Create, selecting, nil)
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, "neither a pool name")
+
+	selecting.Annotations = map[string]string{constants.PoolSelectorKey: "tier=public", constants.FallbackPoolsKey: "test-missing"}
+	resp = review(t, server.URL+ValidateIPsPath, admissionv1beta1.Create, selecting, nil)
+	assert.True(t, resp.Allowed)
+}
+
+func TestBadRequest(t *testing.T) {
+	server := httptest.NewServer(NewServer(blendedfake.NewSimpleClientset(), newAllocations()).Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + ValidateIPsPath)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+ValidateIPsPath, "application/json", bytes.NewReader([]byte("{")))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	err = NewServer(blendedfake.NewSimpleClientset(), newAllocations()).Run(context.Background(), ":0", "missing.crt", "missing.key")
+	assert.NotNil(t, err)
+}
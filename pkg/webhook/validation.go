@@ -0,0 +1,310 @@
+/*
+Copyright © 2018 inwinSTACK Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	blendedv1 "github.com/inwinstack/blended/apis/inwinstack/v1"
+	ipamv1 "github.com/inwinstack/ipam/pkg/apis/ipam/v1"
+	"github.com/inwinstack/ipam/pkg/constants"
+	"github.com/inwinstack/ipam/pkg/ipaddr"
+	"github.com/inwinstack/ipam/pkg/util"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newParser(pool *blendedv1.Pool) *ipaddr.Parser {
+	return ipaddr.NewParser(pool.Spec.Addresses, pool.Spec.AvoidBuggyIPs, pool.Spec.AvoidGatewayIPs)
+}
+
+// validatePool rejects invalid addresses, the addresses used by other pools, the filtered
+// addresses that aren't in the pool and, with the block policy, the edits that strand allocations.
+// The updates that leave the spec alone, like the writes of the status, the state annotations
+// and the finalizers, are always allowed, and so is everything once the pool is deleted.
+func (s *Server) validatePool(req *admissionv1beta1.AdmissionRequest) error {
+	if req.Operation != admissionv1beta1.Create && req.Operation != admissionv1beta1.Update {
+		return nil
+	}
+
+	pool := &blendedv1.Pool{}
+	if err := json.Unmarshal(req.Object.Raw, pool); err != nil {
+		return fmt.Errorf("failed to decode the pool: %s", err.Error())
+	}
+
+	if !pool.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	if req.Operation == admissionv1beta1.Update {
+		old := &blendedv1.Pool{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return fmt.Errorf("failed to decode the old pool: %s", err.Error())
+		}
+
+		if reflect.DeepEqual(old.Spec, pool.Spec) && reflect.DeepEqual(util.SpecAnnotations(old), util.SpecAnnotations(pool)) {
+			return nil
+		}
+	}
+
+	if len(pool.Spec.Addresses) == 0 {
+		return fmt.Errorf("The \"%s\" pool has no addresses", pool.Name)
+	}
+
+	parser := newParser(pool)
+	if err := parser.Validate(); err != nil {
+		return err
+	}
+
+	if _, _, err := util.UtilizationThresholds(pool); err != nil {
+		return err
+	}
+
+	policy, err := util.ShrinkPolicy(pool)
+	if err != nil {
+		return err
+	}
+
+	if _, err := util.DrainPolicy(pool); err != nil {
+		return err
+	}
+
+	if _, err := util.Gateways(pool); err != nil {
+		return err
+	}
+
+	if _, err := util.Routes(pool); err != nil {
+		return err
+	}
+
+	for _, filter := range pool.Spec.FilterIPs {
+		ok, err := parser.InRanges(filter)
+		if err != nil {
+			return fmt.Errorf("The filtered IP %q is invalid", filter)
+		}
+
+		if !ok {
+			return fmt.Errorf("The filtered IP %q isn't in the \"%s\" pool", filter, pool.Name)
+		}
+	}
+
+	if req.Operation == admissionv1beta1.Update && policy == constants.ShrinkPolicyBlock {
+		if err := s.checkStranded(pool); err != nil {
+			return err
+		}
+	}
+
+	// The delegated prefixes and the child pools are never stranded
+	prefixes, err := util.DelegatedPrefixes(pool)
+	if err != nil {
+		return err
+	}
+
+	address, outside, err := ipaddr.NewParser(util.DelegatedAddresses(prefixes), false, false).Outside(parser)
+	if err != nil {
+		return err
+	}
+	if outside {
+		return fmt.Errorf("The \"%s\" pool would no longer cover the delegated address %q", pool.Name, address)
+	}
+
+	list, err := s.blendedset.InwinstackV1().Pools().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	pools := map[string]*blendedv1.Pool{pool.Name: pool}
+	for i := range list.Items {
+		if list.Items[i].Name != pool.Name {
+			pools[list.Items[i].Name] = &list.Items[i]
+		}
+	}
+
+	if err := checkParent(pool, pools); err != nil {
+		return err
+	}
+
+	for i := range list.Items {
+		other := &list.Items[i]
+		if other.Name == pool.Name {
+			continue
+		}
+
+		// The child pools overlap with their ancestors
+		if isAncestor(pools, other.Name, pool) || isAncestor(pools, pool.Name, other) {
+			continue
+		}
+
+		// The child pools of the delegated prefixes overlap with their parent
+		if util.PublishesPrefixOf(pool, other) || util.PublishesPrefixOf(other, pool) {
+			continue
+		}
+
+		// The other pool can't be fixed by rejecting this one
+		address, overlap, err := parser.Overlaps(newParser(other))
+		if err == nil && overlap {
+			return fmt.Errorf("The address %q overlaps with the \"%s\" pool", address, other.Name)
+		}
+	}
+	return nil
+}
+
+// checkParent rejects the child pool if its parent pool doesn't exist, is one of its
+// descendants, or doesn't cover its addresses.
+func checkParent(pool *blendedv1.Pool, pools map[string]*blendedv1.Pool) error {
+	name, ok := pool.Annotations[constants.ParentPoolKey]
+	if !ok {
+		return nil
+	}
+
+	parent, ok := pools[name]
+	if !ok || name == pool.Name {
+		return fmt.Errorf("The parent pool \"%s\" of the \"%s\" pool doesn't exist", name, pool.Name)
+	}
+
+	if isAncestor(pools, pool.Name, parent) {
+		return fmt.Errorf("The parent pool \"%s\" is a descendant of the \"%s\" pool", name, pool.Name)
+	}
+
+	address, outside, err := newParser(pool).Outside(newParser(parent))
+	if err != nil {
+		return err
+	}
+	if outside {
+		return fmt.Errorf("The address %q isn't in the parent pool \"%s\"", address, name)
+	}
+	return nil
+}
+
+// isAncestor reports whether the named pool is a parent of the pool, or a parent of its parents.
+func isAncestor(pools map[string]*blendedv1.Pool, name string, pool *blendedv1.Pool) bool {
+	seen := map[string]bool{pool.Name: true}
+	for {
+		parent, ok := pool.Annotations[constants.ParentPoolKey]
+		if !ok || seen[parent] {
+			return false
+		}
+
+		if parent == name {
+			return true
+		}
+
+		seen[parent] = true
+		if pool, ok = pools[parent]; !ok {
+			return false
+		}
+	}
+}
+
+// checkStranded rejects the pool if its addresses no longer cover some of its allocations.
+func (s *Server) checkStranded(pool *blendedv1.Pool) error {
+	list, err := s.allocations.List(metav1.ListOptions{LabelSelector: constants.PoolLabelKey + "=" + pool.Name})
+	if err != nil {
+		return err
+	}
+
+	allocations := []*ipamv1.Allocation{}
+	for i := range list.Items {
+		allocations = append(allocations, &list.Items[i])
+	}
+
+	stranded, err := util.StrandedAllocations(pool, allocations)
+	if err != nil {
+		return err
+	}
+
+	if len(stranded) > 0 {
+		addresses := []string{}
+		for _, allocation := range stranded {
+			addresses = append(addresses, allocation.Spec.Address)
+		}
+		return fmt.Errorf("The \"%s\" pool would no longer cover the allocated addresses %s", pool.Name, strings.Join(addresses, ", "))
+	}
+	return nil
+}
+
+// validateIP rejects the IPs of missing pools, the invalid pool selections and the changes
+// of the pool name.
+func (s *Server) validateIP(req *admissionv1beta1.AdmissionRequest) error {
+	ip := &blendedv1.IP{}
+	switch req.Operation {
+	case admissionv1beta1.Create:
+		if err := json.Unmarshal(req.Object.Raw, ip); err != nil {
+			return fmt.Errorf("failed to decode the IP: %s", err.Error())
+		}
+
+		count, err := util.AddressCount(ip)
+		if err != nil {
+			return err
+		}
+
+		if _, err := util.IsContiguous(ip); err != nil {
+			return err
+		}
+
+		if _, ok := ip.Annotations[constants.RequestedIPKey]; ok && count > 1 {
+			return fmt.Errorf("The requested IP can't be combined with an address count of %d", count)
+		}
+
+		if _, err := util.PoolSelection(ip); err != nil {
+			return err
+		}
+
+		selector, err := util.PoolSelector(ip)
+		if err != nil {
+			return err
+		}
+
+		// The IPs that select their pools may leave the pool name out
+		if ip.Spec.PoolName == "" {
+			if selector == nil && len(util.FallbackPools(ip)) == 0 {
+				return fmt.Errorf("The IP has neither a pool name, fallback pools nor a pool selector")
+			}
+			return nil
+		}
+
+		_, err = s.blendedset.InwinstackV1().Pools().Get(ip.Spec.PoolName, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("The \"%s\" pool doesn't exist", ip.Spec.PoolName)
+		}
+		return err
+	case admissionv1beta1.Update:
+		old := &blendedv1.IP{}
+		if err := json.Unmarshal(req.Object.Raw, ip); err != nil {
+			return fmt.Errorf("failed to decode the IP: %s", err.Error())
+		}
+
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return fmt.Errorf("failed to decode the old IP: %s", err.Error())
+		}
+
+		if ip.Spec.PoolName != old.Spec.PoolName {
+			return fmt.Errorf("The pool name of the IP can't be changed from \"%s\"", old.Spec.PoolName)
+		}
+
+		for _, key := range []string{constants.AddressCountKey, constants.ContiguousKey} {
+			if ip.Annotations[key] != old.Annotations[key] {
+				return fmt.Errorf("The %s annotation of the IP can't be changed", key)
+			}
+		}
+	}
+	return nil
+}